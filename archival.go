@@ -0,0 +1,228 @@
+package dxfuse
+
+// Archived files are listed, but cannot be read. An unarchive request is sent
+// with the /file-xxxx/unarchive API call. It only starts the process; the file
+// is restored by the platform, which can take hours. In the meantime, the
+// file is in the unarchiving state.
+//
+// The tracker keeps a list of the files that are being unarchived, and polls
+// their state. When a file becomes live, the database is updated, and opens
+// that are waiting for the file are released.
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dnanexus/dxda"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	// How often the state of the files being unarchived is checked
+	archivalPollInterval = 5 * time.Minute
+)
+
+// The archival state is per project, so a file is identified by
+// the project too.
+type archivalKey struct {
+	fileId string
+	projId string
+}
+
+type archivalEntry struct {
+	// closed when the file is live again, or when the
+	// tracker stops following it.
+	done chan struct{}
+	live bool
+}
+
+type ArchivalTracker struct {
+	dxEnv    dxda.DXEnvironment
+	mdb     *MetadataDb
+
+	// shared by the poller and the waiters
+	client  *retryablehttp.Client
+
+	// the global filesystem lock, held when updating the database
+	fsysMutex *sync.Mutex
+
+	// protects the entries
+	mutex    sync.Mutex
+	entries  map[archivalKey]*archivalEntry
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewArchivalTracker(dxEnv dxda.DXEnvironment, mdb *MetadataDb, fsysMutex *sync.Mutex) *ArchivalTracker {
+	at := &ArchivalTracker{
+		dxEnv : dxEnv,
+		mdb : mdb,
+		client : dxda.NewHttpClient(true),
+		fsysMutex : fsysMutex,
+		entries : make(map[archivalKey]*archivalEntry),
+		shutdown : make(chan struct{}),
+	}
+	at.wg.Add(1)
+	go at.pollWorker()
+	return at
+}
+
+// Stop polling, and release all the waiters
+func (at *ArchivalTracker) Shutdown() {
+	close(at.shutdown)
+	at.wg.Wait()
+
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+	for key, entry := range at.entries {
+		close(entry.done)
+		delete(at.entries, key)
+	}
+}
+
+// write a log message, and add a header
+func (at *ArchivalTracker) log(a string, args ...interface{}) {
+	LogMsg("archival", a, args...)
+}
+
+func (at *ArchivalTracker) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "archival", a, args...)
+}
+
+func (at *ArchivalTracker) logEnabled(level int) bool {
+	return LogEnabled("archival", level)
+}
+
+// Follow a file that is being unarchived. It is fine to track a
+// file more than once.
+func (at *ArchivalTracker) Track(fileId string, projId string) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+	at.track(archivalKey{ fileId, projId })
+}
+
+// Called with the mutex held. Returns nil after shutdown, when nothing
+// would release the entry.
+func (at *ArchivalTracker) track(key archivalKey) *archivalEntry {
+	select {
+	case <- at.shutdown:
+		return nil
+	default:
+	}
+	entry, ok := at.entries[key]
+	if !ok {
+		if at.logEnabled(LOG_DEBUG) {
+			at.logAt(LOG_DEBUG, "tracking %s:%s", key.projId, key.fileId)
+		}
+		entry = &archivalEntry{
+			done : make(chan struct{}),
+			live : false,
+		}
+		at.entries[key] = entry
+	}
+	return entry
+}
+
+// Wait for a file being unarchived to become live. Return true if it
+// did, false on timeout, or if the operation was interrupted. The state
+// is checked right away, and then every poll interval, so timeouts
+// shorter than the interval only catch files that are already live.
+func (at *ArchivalTracker) WaitLive(ctx context.Context, fileId string, projId string, timeout time.Duration) bool {
+	key := archivalKey{ fileId, projId }
+	at.mutex.Lock()
+	entry := at.track(key)
+	at.mutex.Unlock()
+	if entry == nil {
+		return false
+	}
+
+	// the database may be out of date, the file could
+	// have become live since the last poll.
+	at.check(ctx, key)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <- entry.done:
+		return entry.live
+	case <- timer.C:
+		return false
+	case <- ctx.Done():
+		return false
+	}
+}
+
+func (at *ArchivalTracker) pollWorker() {
+	defer at.wg.Done()
+
+	ticker := time.NewTicker(archivalPollInterval)
+	defer ticker.Stop()
+	for true {
+		select {
+		case <- at.shutdown:
+			return
+		case <- ticker.C:
+			at.poll()
+		}
+	}
+}
+
+// Check the state of all the tracked files
+func (at *ArchivalTracker) poll() {
+	at.mutex.Lock()
+	var keys []archivalKey
+	for key, _ := range at.entries {
+		keys = append(keys, key)
+	}
+	at.mutex.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+	if at.logEnabled(LOG_DEBUG) {
+		at.logAt(LOG_DEBUG, "checking the state of %d files being unarchived", len(keys))
+	}
+
+	for _, key := range keys {
+		at.check(context.TODO(), key)
+	}
+}
+
+// Check the state of one file. If it is no longer being unarchived,
+// update the database and release the waiters.
+func (at *ArchivalTracker) check(ctx context.Context, key archivalKey) {
+	state, err := DxArchivalState(ctx, at.client, &at.dxEnv, key.projId, key.fileId)
+	if err != nil {
+		// try again on the next round
+		at.logAt(LOG_WARN, "could not describe %s:%s, %s", key.projId, key.fileId, err.Error())
+		return
+	}
+	if state == "unarchiving" {
+		return
+	}
+
+	// The file is live, or the request was canceled, and it
+	// is archived again. Either way, the new state goes
+	// into the database before the waiters are released.
+	at.log("%s:%s is now %s", key.projId, key.fileId, state)
+	at.fsysMutex.Lock()
+	oph := at.mdb.opOpen()
+	err = at.mdb.UpdateArchivalState(ctx, oph, key.fileId, key.projId, state)
+	if err != nil {
+		oph.RecordError(err)
+	}
+	at.mdb.opClose(oph)
+	at.fsysMutex.Unlock()
+	if err != nil {
+		at.logAt(LOG_ERROR, "database error updating the archival state of %s: %s", key.fileId, err.Error())
+		return
+	}
+
+	at.mutex.Lock()
+	if entry, ok := at.entries[key]; ok {
+		entry.live = (state == "live")
+		close(entry.done)
+		delete(at.entries, key)
+	}
+	at.mutex.Unlock()
+}
@@ -4,13 +4,18 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/fuse"
@@ -25,6 +30,8 @@ type Config struct {
 	mountpoint string
 	dxEnv dxda.DXEnvironment
 	options dxfuse.Options
+	logCfg dxfuse.LogConfig
+	traceCfg dxfuse.TraceConfig
 }
 
 var progName = filepath.Base(os.Args[0])
@@ -32,22 +39,46 @@ var progName = filepath.Base(os.Args[0])
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage:\n")
 	fmt.Fprintf(os.Stderr, "    %s [options] MOUNTPOINT PROJECT1 PROJECT2 ...\n", progName)
+	fmt.Fprintf(os.Stderr, "    %s [options] MOUNTPOINT PROJECT1:/FOLDER PROJECT2:/FOLDER/FILE ...\n", progName)
 	fmt.Fprintf(os.Stderr, "    %s [options] MOUNTPOINT manifest.json\n", progName)
+	fmt.Fprintf(os.Stderr, "    %s fetch PATH1 PATH2 ...\n", progName)
+	fmt.Fprintf(os.Stderr, "    %s unarchive PATH1 PATH2 ...\n", progName)
+	fmt.Fprintf(os.Stderr, "    %s unmount MOUNTPOINT\n", progName)
 	fmt.Fprintf(os.Stderr, "options:\n")
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\n")
-	fmt.Fprintf(os.Stderr, "A project can be specified by its ID or name. The manifest is a JSON\n")
-	fmt.Fprintf(os.Stderr, "file describing the initial filesystem structure.\n")
+	fmt.Fprintf(os.Stderr, "A project can be specified by its ID or name. A project path mounts only\n")
+	fmt.Fprintf(os.Stderr, "a folder, or a file, under the project name. The manifest is a JSON\n")
+	fmt.Fprintf(os.Stderr, "file describing the initial filesystem structure. The fetch command\n")
+	fmt.Fprintf(os.Stderr, "downloads files from a mounted filesystem to local disk. The unarchive\n")
+	fmt.Fprintf(os.Stderr, "command asks the platform to restore archived files. The unmount\n")
+	fmt.Fprintf(os.Stderr, "command uploads all pending changes, and then unmounts the filesystem.\n")
 }
 
 var (
+	configFile = flag.String("config", "", "Read options and tuning knobs from this JSON file. Options given on the command line take precedence")
 	debugFuseFlag = flag.Bool("debugFuse", false, "Tap into FUSE debugging information")
+	foreground = flag.Bool("foreground", false, "Run in the foreground, and log to stderr. Useful for systemd and containers")
 	fsSync = flag.Bool("sync", false, "Sychronize the filesystem and exit")
 	gid = flag.Int("gid", -1, "User group id (gid)")
 	help = flag.Bool("help", false, "display program options")
+	logBackups = flag.Int("logBackups", 3, "Number of rotated log files to keep")
+	logFormat = flag.String("logFormat", dxfuse.LOG_FORMAT_TEXT, "Log format, text or json")
+	logLevel = flag.String("logLevel", "", "Log level: error, warn, info, debug, or trace. Overrides -verbose")
+	logMaxSize = flag.Int("logMaxSize", 100, "Rotate the log file when it reaches this size, in MiB. Zero means no rotation")
+	logModules = flag.String("logModules", "", "Per module log levels, for example prefetch=debug,sync_db_dx=error")
+	streamingUpload = flag.Bool("streamingUpload", false, "Upload new files while they are being written, if they are written sequentially")
 	readOnly = flag.Bool("readOnly", false, "mount the filesystem in read-only mode")
+	shutdownTimeout = flag.Duration("shutdownTimeout", dxfuse.ShutdownTimeoutDefault, "How long to wait for pending uploads when unmounting")
+	traceEndpoint = flag.String("traceEndpoint", "", "Export trace spans to this OTLP/HTTP endpoint, for example http://localhost:4318/v1/traces")
+	traceFile = flag.String("traceFile", "", "Append trace spans to this file, in OTLP/JSON format")
 	uid = flag.Int("uid", -1, "User id (uid)")
+	unarchiveWait = flag.Duration("unarchiveWait", 0, "How long opening a file that is being unarchived waits for it to become live. Zero means the open fails right away")
+	uploadBandwidth = flag.Int("uploadBandwidth", 0, "Limit on the upload bandwidth, in MiB/sec. Zero means no limit")
+	uploadThreads = flag.Int("uploadThreads", 0, "Number of threads uploading file data. Zero means a default based on the number of CPUs")
+	urlDuration = flag.Duration("urlDuration", dxfuse.DownloadUrlDurationDefault, "How long a file download URL is valid for; URLs are renewed when they expire")
 	verbose = flag.Int("verbose", 0, "Enable verbose debugging")
+	waitForClose = flag.Duration("waitForClose", 0, "How long opening a file that is still being written on the platform waits for it to close. Zero means the open fails right away")
 	version = flag.Bool("version", false, "Print the version and exit")
 )
 
@@ -66,17 +97,50 @@ func lookupProject(dxEnv *dxda.DXEnvironment, projectIdOrName string) (string, e
 	return dxfuse.DxFindProject(context.TODO(), dxEnv, projectIdOrName)
 }
 
-func initLog() *os.File {
-	// Redirect the log output to a file
-	f, err := os.OpenFile(dxfuse.LogFile, os.O_RDWR | os.O_CREATE | os.O_APPEND | os.O_TRUNC, 0666)
+// The log is written to /var/log when running as root. A regular user
+// cannot write there, and gets a private file in the temporary directory.
+func logFilePath() string {
+	if os.Geteuid() == 0 {
+		return dxfuse.LogFile
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("dxfuse-%d.log", os.Getuid()))
+}
+
+// Does /etc/fuse.conf allow regular users to use the allow_other option?
+func fuseUserAllowOther() bool {
+	data, err := ioutil.ReadFile("/etc/fuse.conf")
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "user_allow_other" {
+			return true
+		}
 	}
-	log.SetOutput(f)
+	return false
+}
+
+func initLog(cfg Config) io.WriteCloser {
+	var w io.WriteCloser
+	if *foreground {
+		// the log is collected by the service manager
+		w = os.Stderr
+	} else {
+		// Redirect the log output to a file, rotated by size
+		rf, err := dxfuse.NewRotatingFile(logFilePath(), int64(*logMaxSize) * dxfuse.MiB, *logBackups)
+		if err != nil {
+			log.Fatalf("error opening file: %v", err)
+		}
+		w = rf
+	}
+	log.SetOutput(w)
 	log.SetFlags(0)
 	log.SetPrefix(progName + ": ")
 
-	return f
+	logCfg := cfg.logCfg
+	logCfg.Output = w
+	dxfuse.InitLogging(logCfg)
+	return w
 }
 
 func initUidGid(uid int, gid int) (uint32,uint32) {
@@ -116,7 +180,7 @@ func fsDaemon(
 	dxEnv dxda.DXEnvironment,
 	manifest dxfuse.Manifest,
 	options dxfuse.Options,
-	logf *os.File,
+	logf io.Writer,
 	logger *log.Logger) error {
 
 	fsys, err := dxfuse.NewDxfuse(dxEnv, manifest, options)
@@ -128,8 +192,13 @@ func fsDaemon(
 	logger.Printf("starting fsDaemon")
 	mountOptions := make(map[string]string)
 
-	// Allow users other than root access the filesystem
-	mountOptions["allow_other"] = ""
+	// Allow users other than root access the filesystem. A regular user
+	// can do this only if the system administrator permits it.
+	if os.Geteuid() == 0 || fuseUserAllowOther() {
+		mountOptions["allow_other"] = ""
+	} else {
+		logger.Printf("mounting as a regular user, the filesystem is accessible only to uid=%d", os.Getuid())
+	}
 
 	// capture debug output from the FUSE subsystem
 	var fuse_logger *log.Logger
@@ -153,16 +222,23 @@ func fsDaemon(
 		// Currently, instead of dxfuse receiving every 4KB synchronously,
 		// it can get 128KB.
 		DisableWritebackCaching : false,
+
+		// Return the attributes of the entries together with a directory
+		// listing, instead of a separate lookup for each entry.
+		EnableReaddirplus : true,
 		Options : mountOptions,
 	}
 
 	logger.Printf("mounting dxfuse")
-	os.Stdout.WriteString("Ready")
-	os.Stdout.Close()
 	mfs, err := fuse.Mount(mountpoint, server, cfg)
 	if err != nil {
-		logger.Printf(err.Error())
+		fsys.Shutdown()
+		return fmt.Errorf("mount failed: %s", err.Error())
 	}
+	signalReady(nil)
+
+	// On SIGTERM or SIGINT, upload the pending changes, and unmount.
+	go handleSignals(mountpoint, fsys, logger)
 
 	// Wait for it to be unmounted. This happens only after
 	// all requests have been served.
@@ -170,22 +246,147 @@ func fsDaemon(
 		logger.Fatalf("Join: %v", err)
 	}
 
-	// shutdown the filesystem
-	//fsys.Shutdown()
-
+	// shutdown the filesystem. The pending uploads are completed first,
+	// unless this has already been done.
+	leftovers := fsys.Shutdown()
+	if len(leftovers) > 0 {
+		return fmt.Errorf("%d files have changes that were not uploaded", len(leftovers))
+	}
 	return nil
 }
 
+// The first signal starts a clean unmount. If the filesystem is busy and cannot
+// be unmounted, a second signal terminates the process.
+func handleSignals(mountpoint string, fsys *dxfuse.Filesys, logger *log.Logger) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <- sigChan
+	logger.Printf("received signal %s, unmounting", sig.String())
+	sdNotify("STOPPING=1")
+	fsys.Drain()
+	if err := fuse.Unmount(mountpoint); err != nil {
+		logger.Printf("could not unmount %s: %s", mountpoint, err.Error())
+		logger.Printf("the filesystem is busy, send the signal again to terminate")
+
+		sig = <- sigChan
+		logger.Printf("received signal %s, exiting", sig.String())
+		os.Exit(1)
+	}
+}
+
+// In the background mode, the daemon reports its status to the parent
+// process through this pipe. It is passed as the first extra file
+// descriptor (3).
+var readyPipe *os.File
+
+const readyPipeFd = 3
+
+// Report that the filesystem is mounted, or that it failed to start. Only
+// the first report counts.
+func signalReady(err error) {
+	if readyPipe != nil {
+		if err == nil {
+			readyPipe.WriteString("Ready")
+		} else {
+			readyPipe.WriteString("Error: " + err.Error())
+		}
+		readyPipe.Close()
+		readyPipe = nil
+	}
+	if err == nil {
+		sdNotify("READY=1")
+	}
+}
+
+// Notify systemd about a state change, if we are running under it as
+// a service of type "notify".
+func sdNotify(state string) {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return
+	}
+	if strings.HasPrefix(socketAddr, "@") {
+		// abstract namespace socket
+		socketAddr = "\x00" + socketAddr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{ Name : socketAddr, Net : "unixgram" })
+	if err != nil {
+		log.Printf("sd_notify: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("sd_notify: %s", err.Error())
+	}
+}
+
+// Read the status reported by the daemon. The pipe is closed when
+// the daemon reports, or when it exits.
 func waitForReady(readyReader *os.File, c chan string) {
-	status := make([]byte, 100)
-	_, err := readyReader.Read(status)
+	status, err := ioutil.ReadAll(readyReader)
 	if err != nil {
 		log.Printf("Reading from ready pipe: %v", err)
-		return
 	}
 	c <- string(status)
 }
 
+func parseLogConfig() (dxfuse.LogConfig, error) {
+	level := dxfuse.VerboseToLogLevel(*verbose)
+	if *logLevel != "" {
+		var err error
+		level, err = dxfuse.ParseLogLevel(*logLevel)
+		if err != nil {
+			return dxfuse.LogConfig{}, err
+		}
+	}
+	moduleLevels, err := dxfuse.ParseLogModules(*logModules)
+	if err != nil {
+		return dxfuse.LogConfig{}, err
+	}
+	if *logFormat != dxfuse.LOG_FORMAT_TEXT && *logFormat != dxfuse.LOG_FORMAT_JSON {
+		return dxfuse.LogConfig{}, fmt.Errorf("unknown log format %s, should be text or json", *logFormat)
+	}
+	if *logMaxSize < 0 || *logBackups < 0 {
+		return dxfuse.LogConfig{}, fmt.Errorf("the log size and number of backups cannot be negative")
+	}
+	return dxfuse.LogConfig{
+		Level : level,
+		ModuleLevels : moduleLevels,
+		Format : *logFormat,
+	}, nil
+}
+
+// Read the configuration file, if one was given. Options set in the file are
+// applied to the flags that were not set on the command line.
+func applyConfigFile() (dxfuse.Tuning, error) {
+	if *configFile == "" {
+		return dxfuse.Tuning{}, nil
+	}
+	cf, err := dxfuse.ReadConfigFile(*configFile)
+	if err != nil {
+		return dxfuse.Tuning{}, err
+	}
+
+	setOnCmdLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCmdLine[f.Name] = true
+	})
+	for name, value := range cf.Flags {
+		if flag.Lookup(name) == nil || name == "config" {
+			return dxfuse.Tuning{}, fmt.Errorf("configuration file %s: unknown option %s", *configFile, name)
+		}
+		if setOnCmdLine[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return dxfuse.Tuning{}, fmt.Errorf("configuration file %s: bad value for %s: %s",
+				*configFile, name, err.Error())
+		}
+	}
+	return cf.Tuning, nil
+}
+
 func parseCmdLineArgs() Config {
 	if *version {
 		// print the version and exit
@@ -201,6 +402,33 @@ func parseCmdLineArgs() Config {
 		usage()
 		os.Exit(0)
 	}
+	if flag.Arg(0) == "fetch" {
+		if flag.NArg() < 2 {
+			usage()
+			os.Exit(2)
+		}
+		cmdClient := dxfuse.NewCmdClient()
+		cmdClient.Fetch(flag.Args()[1:])
+		os.Exit(0)
+	}
+	if flag.Arg(0) == "unarchive" {
+		if flag.NArg() < 2 {
+			usage()
+			os.Exit(2)
+		}
+		cmdClient := dxfuse.NewCmdClient()
+		cmdClient.Unarchive(flag.Args()[1:])
+		os.Exit(0)
+	}
+	if flag.Arg(0) == "unmount" {
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		cmdClient := dxfuse.NewCmdClient()
+		cmdClient.Unmount(flag.Arg(1))
+		os.Exit(0)
+	}
 
 	numArgs := flag.NArg()
 	if numArgs < 2 {
@@ -208,6 +436,14 @@ func parseCmdLineArgs() Config {
 		os.Exit(2)
 	}
 	mountpoint := flag.Arg(0)
+
+	tuning, err := applyConfigFile()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	tuning = tuning.WithDefaults()
+	dxfuse.NumRetries = tuning.NumRetries
 	uid,gid := initUidGid(*uid, *gid)
 
 	options := dxfuse.Options{
@@ -216,6 +452,20 @@ func parseCmdLineArgs() Config {
 		VerboseLevel : *verbose,
 		Uid : uid,
 		Gid : gid,
+		DownloadUrlDuration : *urlDuration,
+		UploadThreads : *uploadThreads,
+		UploadBandwidth : int64(*uploadBandwidth) * dxfuse.MiB,
+		StreamingUpload : *streamingUpload,
+		ShutdownTimeout : *shutdownTimeout,
+		UnarchiveWait : *unarchiveWait,
+		WaitForClose : *waitForClose,
+		Tuning : tuning,
+	}
+
+	logCfg, err := parseLogConfig()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
 	}
 
 	dxEnv, _, err := dxda.GetDxEnvironment()
@@ -228,6 +478,11 @@ func parseCmdLineArgs() Config {
 		mountpoint : mountpoint,
 		dxEnv : dxEnv,
 		options : options,
+		logCfg : logCfg,
+		traceCfg : dxfuse.TraceConfig{
+			FilePath : *traceFile,
+			Endpoint : *traceEndpoint,
+		},
 	}
 }
 
@@ -244,29 +499,75 @@ func validateConfig(cfg Config) {
 		fmt.Printf("error, mountpoint %s is not a directory\n", cfg.mountpoint)
 		os.Exit(1)
 	}
+	if cfg.options.UploadThreads < 0 || cfg.options.UploadBandwidth < 0 {
+		fmt.Printf("error, the number of upload threads, and the upload bandwidth, cannot be negative\n")
+		os.Exit(1)
+	}
+	if cfg.options.ShutdownTimeout < 0 {
+		fmt.Printf("error, the shutdown timeout cannot be negative\n")
+		os.Exit(1)
+	}
+	if cfg.options.UnarchiveWait < 0 {
+		fmt.Printf("error, the unarchive wait cannot be negative\n")
+		os.Exit(1)
+	}
+	if cfg.options.WaitForClose < 0 {
+		fmt.Printf("error, the wait for close cannot be negative\n")
+		os.Exit(1)
+	}
+	if cfg.options.DownloadUrlDuration < time.Minute {
+		fmt.Printf("error, the download URL duration must be at least one minute, it is %s\n",
+			cfg.options.DownloadUrlDuration.String())
+		os.Exit(1)
+	}
+}
+
+// A local file is a manifest. Otherwise, an argument with a colon is a project path.
+func isManifestFile(p string) bool {
+	if fInfo, err := os.Stat(p); err == nil {
+		return !fInfo.IsDir()
+	}
+	return !strings.Contains(p, ":")
 }
 
 func parseManifest(cfg Config, logger *log.Logger) (*dxfuse.Manifest, error) {
 	numArgs := flag.NArg()
 
 	// distinguish between the case of a manifest, and a list of projects.
-	if numArgs == 2 && strings.HasSuffix(flag.Arg(1), ".json") {
+	// A project path, such as project:/A/B.json, is not a manifest, unless
+	// there is a local file by that name.
+	if numArgs == 2 &&
+		strings.HasSuffix(flag.Arg(1), ".json") &&
+		isManifestFile(flag.Arg(1)) {
 		p := flag.Arg(1)
 		logger.Printf("Provided with a manifest, reading from %s", p)
 		manifest, err := dxfuse.ReadManifest(p)
 		if err != nil {
 			return nil, err
 		}
-		if err := manifest.FillInMissingFields(context.TODO(), cfg.dxEnv); err != nil {
+		if err := manifest.ResolveSelectors(context.TODO(), cfg.dxEnv); err != nil {
+			return nil, err
+		}
+		if err := manifest.FillInMissingFields(context.TODO(), cfg.dxEnv, cfg.options.WaitForClose > 0); err != nil {
 			return nil, err
 		}
 		return manifest, nil
 	} else {
 		// process the project inputs, and convert to an array of verified
-		// project IDs
+		// project IDs. An argument of the form project:/path mounts only
+		// a folder, or a file, from the project.
 		var projectIds []string
+		var projectPaths []dxfuse.ProjectPath
 		for i := 1; i < numArgs; i++ {
 			projectIdOrName := flag.Arg(i)
+			path := ""
+			if colon := strings.Index(projectIdOrName, ":"); colon >= 0 {
+				path = projectIdOrName[colon+1:]
+				projectIdOrName = projectIdOrName[:colon]
+				if !strings.HasPrefix(path, "/") {
+					return nil, fmt.Errorf("the path in %s must start with a slash", flag.Arg(i))
+				}
+			}
 			projId, err := lookupProject(&cfg.dxEnv, projectIdOrName)
 			if err != nil {
 				return nil, err
@@ -274,13 +575,26 @@ func parseManifest(cfg Config, logger *log.Logger) (*dxfuse.Manifest, error) {
 			if projId == "" {
 				return nil, fmt.Errorf("no project with name %s", projectIdOrName)
 			}
-			projectIds = append(projectIds, projId)
+			if path == "" || path == "/" {
+				projectIds = append(projectIds, projId)
+			} else {
+				projectPaths = append(projectPaths, dxfuse.ProjectPath{
+					ProjId : projId,
+					Path : path,
+				})
+			}
 		}
 
 		manifest, err := dxfuse.MakeManifestFromProjectIds(context.TODO(), cfg.dxEnv, projectIds)
 		if err != nil {
 			return nil, err
 		}
+		if err := manifest.AddProjectPaths(context.TODO(), cfg.dxEnv, projectPaths); err != nil {
+			return nil, err
+		}
+		if err := manifest.FillInMissingFields(context.TODO(), cfg.dxEnv, cfg.options.WaitForClose > 0); err != nil {
+			return nil, err
+		}
 		return manifest, nil
 	}
 }
@@ -288,19 +602,28 @@ func parseManifest(cfg Config, logger *log.Logger) (*dxfuse.Manifest, error) {
 
 func startDaemon(cfg Config) {
 	// initialize the log file
-	logf := initLog()
+	logf := initLog(cfg)
 	defer logf.Close()
 	logger := log.New(logf, "dxfuse: ", log.Flags())
 
+	if err := dxfuse.InitTracing(cfg.traceCfg); err != nil {
+		logger.Printf("could not start tracing: %s", err.Error())
+		signalReady(err)
+		os.Exit(1)
+	}
+
 	manifest, err := parseManifest(cfg, logger)
 	if err != nil {
 		logger.Printf(err.Error())
+		signalReady(err)
 		os.Exit(1)
 	}
 	logger.Printf("manifest = %v", manifest)
 	err = fsDaemon(cfg.mountpoint, cfg.dxEnv, *manifest, cfg.options, logf, logger)
+	dxfuse.ShutdownTracing()
 	if err != nil {
 		logger.Printf(err.Error())
+		signalReady(err)
 		os.Exit(1)
 	}
 }
@@ -319,20 +642,26 @@ func isActual() bool {
 
 
 func startDaemonAndWaitForInitializationToComplete(cfg Config) {
+	if *foreground {
+		// Run the filesystem in this process. Readiness is reported
+		// to systemd, if it is the one that started us.
+		startDaemon(cfg)
+		return
+	}
 	if isActual() {
 		// This will be true -only- in the child sub-process
+		readyPipe = os.NewFile(readyPipeFd, "ready-pipe")
 		startDaemon(cfg)
 		return
 	}
 
 	// Set up a pipe for the "ready" status.
-	errorReader, errorWriter, err := os.Pipe()
+	readyReader, readyWriter, err := os.Pipe()
 	if err != nil {
 		fmt.Printf("Pipe: %v", err)
 		os.Exit(1)
 	}
-	defer errorWriter.Close()
-	defer errorReader.Close()
+	defer readyReader.Close()
 
 	// Mount in a subprocess, and wait for the filesystem to start.
 	// If there is an error, report it. Otherwise, return after the filesystem
@@ -344,7 +673,7 @@ func startDaemonAndWaitForInitializationToComplete(cfg Config) {
 		os.Exit(1)
 	}
 	mountCmd := exec.Command(progPath, os.Args[1:]...)
-	mountCmd.Stdout = errorWriter
+	mountCmd.ExtraFiles = []*os.File{ readyWriter }
 	mountCmd.Env = append(os.Environ(), "ACTUAL=1")
 
 	// Start the command.
@@ -354,23 +683,36 @@ func startDaemonAndWaitForInitializationToComplete(cfg Config) {
 		os.Exit(1)
 	}
 
+	// Only the daemon should hold the write side, so that we see
+	// an end-of-file if it exits.
+	readyWriter.Close()
+
 	// Wait for the tool to say the file system is ready.
 	fmt.Println("wait for ready")
 
-	// This is needed for older versions of mac?
-	time.Sleep(1 * time.Second)
-
 	readyChan := make(chan string, 1)
-	go waitForReady(errorReader, readyChan)
+	go waitForReady(readyReader, readyChan)
 
 	status := <-readyChan
-	status = strings.ToLower(status)
-	if !strings.HasPrefix(status, "ready") {
-		fmt.Println("There was an error starting the daemon")
+	if strings.HasPrefix(strings.ToLower(status), "ready") {
+		fmt.Println("Daemon started successfully")
+		return
+	}
+
+	// The daemon failed. Report the error, and exit with the same code.
+	fmt.Println("There was an error starting the daemon")
+	if status != "" {
 		fmt.Println(status)
-		os.Exit(1)
+	} else {
+		fmt.Printf("See the log file %s for details\n", logFilePath())
+	}
+	exitCode := 1
+	if err := mountCmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+			exitCode = exitErr.ExitCode()
+		}
 	}
-	fmt.Println("Daemon started successfully")
+	os.Exit(exitCode)
 }
 
 func main() {
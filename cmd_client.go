@@ -4,6 +4,11 @@ import (
 	"fmt"
 	"net/rpc"
 	"os"
+	"runtime"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"golang.org/x/sys/unix"
 )
 
 type CmdClient struct {
@@ -31,3 +36,103 @@ func (client *CmdClient) Sync() {
 		os.Exit(1)
 	}
 }
+
+// Linux requires extended attributes to be in a namespace
+func xattrSysName(name string) string {
+	if runtime.GOOS == "linux" {
+		return "user." + name
+	}
+	return name
+}
+
+// Download files to the local disk, so that they could be read at local disk speed.
+// This is done through an extended attribute, so it works without the command port.
+// Setting the attribute starts the download, reading it reports the progress. All
+// the downloads are started, and then we wait for them to complete.
+func (client *CmdClient) Fetch(paths []string) {
+	numErrors := 0
+	var started []string
+	for _, p := range paths {
+		err := unix.Setxattr(p, xattrSysName(XATTR_MATERIALIZE), []byte("1"), 0)
+		if err != nil {
+			fmt.Printf("fetch %s: %s\n", p, err.Error())
+			numErrors++
+			continue
+		}
+		started = append(started, p)
+	}
+
+	buf := make([]byte, 64)
+	for _, p := range started {
+		for true {
+			n, err := unix.Getxattr(p, xattrSysName(XATTR_MATERIALIZE), buf)
+			if err != nil {
+				fmt.Printf("fetch %s: %s\n", p, err.Error())
+				numErrors++
+				break
+			}
+			state := string(buf[:n])
+			if state == "downloading" {
+				time.Sleep(time.Second)
+				continue
+			}
+			if state != "local" {
+				fmt.Printf("fetch %s: the download did not complete (%s)\n", p, state)
+				numErrors++
+			}
+			break
+		}
+	}
+	if numErrors > 0 {
+		os.Exit(1)
+	}
+}
+
+// Ask the platform to unarchive files. This is done by setting the archival
+// state to live, through an extended attribute. The files are restored in the
+// background, and can be read once they are live.
+func (client *CmdClient) Unarchive(paths []string) {
+	numErrors := 0
+	for _, p := range paths {
+		err := unix.Setxattr(p, xattrSysName(XATTR_BASE + ".archivalState"), []byte("live"), 0)
+		if err != nil {
+			fmt.Printf("unarchive %s: %s\n", p, err.Error())
+			numErrors++
+		}
+	}
+	if numErrors > 0 {
+		os.Exit(1)
+	}
+}
+
+// Upload all pending changes, and then unmount the filesystem. If some files
+// could not be uploaded, they are reported, and the filesystem stays mounted.
+// A filesystem without a command port (read-only) is unmounted directly.
+func (client *CmdClient) Unmount(mountpoint string) {
+	rpcClient, err := rpc.Dial("tcp", fmt.Sprintf(":%d", CmdPort))
+	if err == nil {
+		var leftovers []string
+		err = rpcClient.Call("CmdServerBox.Unmount", "", &leftovers)
+		rpcClient.Close()
+		if err != nil {
+			fmt.Printf("unmount error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if len(leftovers) > 0 {
+			fmt.Printf("%d files have changes that were not uploaded:\n", len(leftovers))
+			for _, p := range leftovers {
+				fmt.Printf("    %s\n", p)
+			}
+			fmt.Printf("The filesystem is still mounted, and does not accept modifications.\n")
+			fmt.Printf("Uploads that are in progress continue in the background, running the command\n")
+			fmt.Printf("again waits for them. Failed uploads are not retried. Use fusermount -u to\n")
+			fmt.Printf("unmount anyway, the changes listed above are then lost.\n")
+			os.Exit(1)
+		}
+	}
+
+	if err := fuse.Unmount(mountpoint); err != nil {
+		fmt.Printf("could not unmount %s: %s\n", mountpoint, err.Error())
+		os.Exit(1)
+	}
+}
@@ -1,6 +1,6 @@
-/* Accept commands from the dxfuse_tools program. The only command
-* right now is sync, but this is the place to implement additional
-* ones to come in the future.
+/* Accept commands from the dxfuse_tools program. The commands are sync,
+* and unmount. This is the place to implement additional ones to come
+* in the future.
 */
 package dxfuse
 
@@ -19,6 +19,7 @@ const (
 type CmdServer struct {
 	options  Options
 	sybx    *SyncDbDx
+	fsys    *Filesys
 	inbound *net.TCPListener
 }
 
@@ -27,10 +28,11 @@ type CmdServerBox struct {
 	cmdSrv *CmdServer
 }
 
-func NewCmdServer(options Options, sybx *SyncDbDx) *CmdServer {
+func NewCmdServer(options Options, sybx *SyncDbDx, fsys *Filesys) *CmdServer {
 	cmdServer := &CmdServer{
 		options: options,
 		sybx : sybx,
+		fsys : fsys,
 		inbound : nil,
 	}
 	return cmdServer
@@ -41,6 +43,10 @@ func (cmdSrv *CmdServer) log(a string, args ...interface{}) {
 	LogMsg("CmdServer", a, args...)
 }
 
+func (cmdSrv *CmdServer) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "CmdServer", a, args...)
+}
+
 func (cmdSrv *CmdServer) Init() {
 	addy, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", CmdPort))
 	if err != nil {
@@ -63,7 +69,9 @@ func (cmdSrv *CmdServer) Init() {
 }
 
 func (cmdSrv *CmdServer) Close() {
-	cmdSrv.inbound.Close()
+	if cmdSrv.inbound != nil {
+		cmdSrv.inbound.Close()
+	}
 }
 
 // Note: all export functions from this module have to have this format.
@@ -75,9 +83,18 @@ func (box *CmdServerBox) GetLine(arg string, reply *bool) error {
 	case "sync":
 		cmdSrv.sybx.CmdSync()
 	default:
-		cmdSrv.log("Unknown command")
+		cmdSrv.logAt(LOG_WARN, "Unknown command")
 	}
 
 	*reply = true
 	return nil
 }
+
+// Prepare for unmount. Stop accepting modifications, and upload all the pending
+// changes. The reply holds the paths of files that could not be uploaded.
+func (box *CmdServerBox) Unmount(arg string, reply *[]string) error {
+	cmdSrv := box.cmdSrv
+	cmdSrv.log("Received unmount command")
+	*reply = cmdSrv.fsys.Drain()
+	return nil
+}
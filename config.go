@@ -0,0 +1,255 @@
+package dxfuse
+
+// Configuration file.
+//
+// A JSON file, with two optional sections. The "flags" section sets command
+// line options; an option given on the command line overrides the file. The
+// "tuning" section sets knobs that do not have a flag. For example:
+//
+// {
+//   "flags" : {
+//     "uploadThreads" : 16,
+//     "urlDuration" : "24h"
+//   },
+//   "tuning" : {
+//     "httpClientPoolSize" : 8,
+//     "numRetries" : 5,
+//     "fileWriteInactivityThresh" : "1m",
+//     "prefetchMaxIoSizeMiB" : 32
+//   }
+// }
+//
+// Unset knobs, and knobs set to zero, keep their default values.
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// The platform does not accept upload parts smaller than this, except
+// for the last part of a file.
+const uploadMinPartSize = 5 * MiB
+
+type Tuning struct {
+	HttpClientPoolSize        int            // number of http clients for synchronous API calls
+	NumRetries                int            // number of attempts for an API call
+	MaxDirSize                int            // maximal number of data objects in a directory, zero means no limit
+	WritableFileSizeLimit     int64          // maximal size of an existing file that can be modified
+	FileWriteInactivityThresh time.Duration  // upload a file after it has not been written for this long
+	MaterializeCacheSize      int64          // total size of the local copies of remote files
+
+	PrefetchMaxThreads        int            // maximal number of prefetch IO threads
+	PrefetchMaxFiles          int            // maximal number of files tracked for sequential access
+	PrefetchMinIoSize         int64          // the first prefetch IO size
+	PrefetchMaxIoSize         int64          // zero means a default based on where we are running
+	PrefetchIoFactor          int            // growth factor for prefetch IOs
+
+	UploadMinChunkSize        int64          // zero means a default based on where we are running
+	UploadMaxThreads          int            // limit on the default number of upload threads
+}
+
+// The values used when a knob is not set
+func DefaultTuning() Tuning {
+	return Tuning{
+		HttpClientPoolSize : HttpClientPoolSize,
+		NumRetries : NumRetriesDefault,
+		MaxDirSize : MaxDirSize,
+		WritableFileSizeLimit : WritableFileSizeLimit,
+		FileWriteInactivityThresh : FileWriteInactivityThresh,
+		MaterializeCacheSize : MaterializeCacheSize,
+		PrefetchMaxThreads : maxNumPrefetchThreads,
+		PrefetchMaxFiles : maxNumEntriesInTable,
+		PrefetchMinIoSize : prefetchMinIoSize,
+		PrefetchMaxIoSize : 0,
+		PrefetchIoFactor : prefetchIoFactor,
+		UploadMinChunkSize : 0,
+		UploadMaxThreads : maxNumBulkDataThreads,
+	}
+}
+
+// Fill in the knobs that were not set with their defaults
+func (t Tuning) WithDefaults() Tuning {
+	d := DefaultTuning()
+	if t.HttpClientPoolSize == 0 {
+		t.HttpClientPoolSize = d.HttpClientPoolSize
+	}
+	if t.NumRetries == 0 {
+		t.NumRetries = d.NumRetries
+	}
+	if t.MaxDirSize == 0 {
+		t.MaxDirSize = d.MaxDirSize
+	}
+	if t.WritableFileSizeLimit == 0 {
+		t.WritableFileSizeLimit = d.WritableFileSizeLimit
+	}
+	if t.FileWriteInactivityThresh == 0 {
+		t.FileWriteInactivityThresh = d.FileWriteInactivityThresh
+	}
+	if t.MaterializeCacheSize == 0 {
+		t.MaterializeCacheSize = d.MaterializeCacheSize
+	}
+	if t.PrefetchMaxThreads == 0 {
+		t.PrefetchMaxThreads = d.PrefetchMaxThreads
+	}
+	if t.PrefetchMaxFiles == 0 {
+		t.PrefetchMaxFiles = d.PrefetchMaxFiles
+	}
+	if t.PrefetchMinIoSize == 0 {
+		t.PrefetchMinIoSize = d.PrefetchMinIoSize
+	}
+	if t.PrefetchIoFactor == 0 {
+		t.PrefetchIoFactor = d.PrefetchIoFactor
+	}
+	if t.UploadMaxThreads == 0 {
+		t.UploadMaxThreads = d.UploadMaxThreads
+	}
+	return t
+}
+
+func (t Tuning) Validate() error {
+	if t.HttpClientPoolSize < 0 || t.HttpClientPoolSize > 1024 {
+		return fmt.Errorf("httpClientPoolSize must be between 1 and 1024, or zero for the default, it is %d", t.HttpClientPoolSize)
+	}
+	if t.NumRetries < 0 || t.NumRetries > 100 {
+		return fmt.Errorf("numRetries must be between 1 and 100, or zero for the default, it is %d", t.NumRetries)
+	}
+	if t.MaxDirSize < 0 {
+		return fmt.Errorf("maxDirSize cannot be negative")
+	}
+	if t.WritableFileSizeLimit < 0 {
+		return fmt.Errorf("writableFileSizeLimitMiB cannot be negative")
+	}
+	if t.FileWriteInactivityThresh < 0 {
+		return fmt.Errorf("fileWriteInactivityThresh cannot be negative")
+	}
+	if t.MaterializeCacheSize < 0 {
+		return fmt.Errorf("materializeCacheSizeGiB cannot be negative")
+	}
+	if t.PrefetchMaxThreads < 0 || t.PrefetchMaxThreads > 1024 {
+		return fmt.Errorf("prefetchMaxThreads must be between 1 and 1024, or zero for the default, it is %d", t.PrefetchMaxThreads)
+	}
+	if t.PrefetchMaxFiles < 0 {
+		return fmt.Errorf("prefetchMaxFiles cannot be negative")
+	}
+	if t.PrefetchIoFactor < 0 || t.PrefetchIoFactor == 1 {
+		return fmt.Errorf("prefetchIoFactor must be at least 2, or zero for the default, it is %d", t.PrefetchIoFactor)
+	}
+
+	// The prefetch IOs are divided into slots
+	if t.PrefetchMinIoSize < 0 || t.PrefetchMinIoSize % numSlotsInChunk != 0 {
+		return fmt.Errorf("prefetchMinIoSizeKiB must be a multiple of %d bytes", numSlotsInChunk)
+	}
+	if t.PrefetchMaxIoSize < 0 {
+		return fmt.Errorf("prefetchMaxIoSizeMiB cannot be negative")
+	}
+	if t.PrefetchMinIoSize > 0 && t.PrefetchMaxIoSize > 0 &&
+		t.PrefetchMaxIoSize < t.PrefetchMinIoSize {
+		return fmt.Errorf("prefetchMaxIoSizeMiB is smaller than prefetchMinIoSizeKiB")
+	}
+	if t.UploadMinChunkSize < 0 {
+		return fmt.Errorf("uploadMinChunkSizeMiB cannot be negative")
+	}
+	if t.UploadMinChunkSize > 0 && t.UploadMinChunkSize < uploadMinPartSize {
+		return fmt.Errorf("uploadMinChunkSizeMiB must be at least %d, the minimal part size of the platform",
+			uploadMinPartSize / MiB)
+	}
+	if t.UploadMaxThreads < 0 {
+		return fmt.Errorf("uploadMaxThreads cannot be negative")
+	}
+	return nil
+}
+
+// The tuning section, as it appears in the file. Sizes are in KiB or MiB,
+// durations are strings such as "90s" or "5m".
+type tuningJson struct {
+	HttpClientPoolSize        int    `json:"httpClientPoolSize"`
+	NumRetries                int    `json:"numRetries"`
+	MaxDirSize                int    `json:"maxDirSize"`
+	WritableFileSizeLimitMiB  int64  `json:"writableFileSizeLimitMiB"`
+	FileWriteInactivityThresh string `json:"fileWriteInactivityThresh"`
+	MaterializeCacheSizeGiB   int64  `json:"materializeCacheSizeGiB"`
+	PrefetchMaxThreads        int    `json:"prefetchMaxThreads"`
+	PrefetchMaxFiles          int    `json:"prefetchMaxFiles"`
+	PrefetchMinIoSizeKiB      int64  `json:"prefetchMinIoSizeKiB"`
+	PrefetchMaxIoSizeMiB      int64  `json:"prefetchMaxIoSizeMiB"`
+	PrefetchIoFactor          int    `json:"prefetchIoFactor"`
+	UploadMinChunkSizeMiB     int64  `json:"uploadMinChunkSizeMiB"`
+	UploadMaxThreads          int    `json:"uploadMaxThreads"`
+}
+
+type configFileJson struct {
+	Flags   map[string]interface{}  `json:"flags"`
+	Tuning  tuningJson              `json:"tuning"`
+}
+
+type ConfigFile struct {
+	// command line options, converted to strings, so they can be parsed
+	// like the command line.
+	Flags   map[string]string
+	Tuning  Tuning
+}
+
+// Read and validate a configuration file. Unknown tuning knobs are an error;
+// the flags are checked by the caller.
+func ReadConfigFile(path string) (*ConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw configFileJson
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("could not parse configuration file %s: %s", path, err.Error())
+	}
+
+	flags := make(map[string]string)
+	for name, value := range raw.Flags {
+		switch v := value.(type) {
+		case string:
+			flags[name] = v
+		case bool:
+			flags[name] = fmt.Sprintf("%t", v)
+		case json.Number:
+			flags[name] = v.String()
+		default:
+			return nil, fmt.Errorf("configuration file %s: bad value for flag %s", path, name)
+		}
+	}
+
+	tj := raw.Tuning
+	tuning := Tuning{
+		HttpClientPoolSize : tj.HttpClientPoolSize,
+		NumRetries : tj.NumRetries,
+		MaxDirSize : tj.MaxDirSize,
+		WritableFileSizeLimit : tj.WritableFileSizeLimitMiB * MiB,
+		MaterializeCacheSize : tj.MaterializeCacheSizeGiB * GiB,
+		PrefetchMaxThreads : tj.PrefetchMaxThreads,
+		PrefetchMaxFiles : tj.PrefetchMaxFiles,
+		PrefetchMinIoSize : tj.PrefetchMinIoSizeKiB * KiB,
+		PrefetchMaxIoSize : tj.PrefetchMaxIoSizeMiB * MiB,
+		PrefetchIoFactor : tj.PrefetchIoFactor,
+		UploadMinChunkSize : tj.UploadMinChunkSizeMiB * MiB,
+		UploadMaxThreads : tj.UploadMaxThreads,
+	}
+	if tj.FileWriteInactivityThresh != "" {
+		d, err := time.ParseDuration(tj.FileWriteInactivityThresh)
+		if err != nil {
+			return nil, fmt.Errorf("configuration file %s: bad fileWriteInactivityThresh %s",
+				path, tj.FileWriteInactivityThresh)
+		}
+		tuning.FileWriteInactivityThresh = d
+	}
+	if err := tuning.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration file %s: %s", path, err.Error())
+	}
+
+	return &ConfigFile{
+		Flags : flags,
+		Tuning : tuning,
+	}, nil
+}
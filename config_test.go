@@ -0,0 +1,183 @@
+package dxfuse
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "dxfuse.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTuningValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		tuning Tuning
+		errMsg string   // empty if the tuning is valid
+	}{
+		{ "nothing set", Tuning{}, "" },
+		{ "the defaults", DefaultTuning(), "" },
+		{ "pool size", Tuning{ HttpClientPoolSize : 1024 }, "" },
+		{ "pool size too large", Tuning{ HttpClientPoolSize : 1025 }, "httpClientPoolSize" },
+		{ "negative pool size", Tuning{ HttpClientPoolSize : -1 }, "httpClientPoolSize" },
+		{ "retries", Tuning{ NumRetries : 101 }, "numRetries" },
+		{ "dir size", Tuning{ MaxDirSize : -1 }, "maxDirSize" },
+		{ "writable size", Tuning{ WritableFileSizeLimit : -1 }, "writableFileSizeLimitMiB" },
+		{ "inactivity", Tuning{ FileWriteInactivityThresh : -time.Second }, "fileWriteInactivityThresh" },
+		{ "materialize cache", Tuning{ MaterializeCacheSize : -GiB }, "materializeCacheSizeGiB" },
+		{ "prefetch threads", Tuning{ PrefetchMaxThreads : 2000 }, "prefetchMaxThreads" },
+		{ "prefetch files", Tuning{ PrefetchMaxFiles : -1 }, "prefetchMaxFiles" },
+		{ "io factor of one", Tuning{ PrefetchIoFactor : 1 }, "prefetchIoFactor" },
+		{ "io factor", Tuning{ PrefetchIoFactor : 2 }, "" },
+		{ "min io size in slots", Tuning{ PrefetchMinIoSize : numSlotsInChunk * KiB }, "" },
+		{ "min io size not in slots", Tuning{ PrefetchMinIoSize : numSlotsInChunk + 1 }, "prefetchMinIoSizeKiB" },
+		{ "max io size", Tuning{ PrefetchMaxIoSize : -1 }, "prefetchMaxIoSizeMiB" },
+		{
+			"max io below min io",
+			Tuning{ PrefetchMinIoSize : 2 * MiB, PrefetchMaxIoSize : MiB },
+			"smaller than prefetchMinIoSizeKiB",
+		},
+		{ "max io without min io", Tuning{ PrefetchMaxIoSize : MiB }, "" },
+		{ "chunk size", Tuning{ UploadMinChunkSize : uploadMinPartSize }, "" },
+		{ "chunk size below a part", Tuning{ UploadMinChunkSize : MiB }, "uploadMinChunkSizeMiB" },
+		{ "negative chunk size", Tuning{ UploadMinChunkSize : -1 }, "uploadMinChunkSizeMiB" },
+		{ "upload threads", Tuning{ UploadMaxThreads : -1 }, "uploadMaxThreads" },
+	}
+	for _, tc := range testCases {
+		err := tc.tuning.Validate()
+		switch {
+		case tc.errMsg == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		case tc.errMsg != "" && err == nil:
+			t.Errorf("%s: expected an error about %s", tc.name, tc.errMsg)
+		case tc.errMsg != "" && !strings.Contains(err.Error(), tc.errMsg):
+			t.Errorf("%s: expected an error about %s, got %v", tc.name, tc.errMsg, err)
+		}
+	}
+}
+
+// Knobs that are set keep their values, the others get the defaults
+func TestTuningWithDefaults(t *testing.T) {
+	d := DefaultTuning()
+	testCases := []struct {
+		name     string
+		tuning   Tuning
+		expected Tuning
+	}{
+		{ "nothing set", Tuning{}, d },
+		{ "the defaults", d, d },
+		{
+			"some knobs set",
+			Tuning{ NumRetries : 3, MaterializeCacheSize : GiB, PrefetchIoFactor : 2 },
+			func() Tuning {
+				t := d
+				t.NumRetries = 3
+				t.MaterializeCacheSize = GiB
+				t.PrefetchIoFactor = 2
+				return t
+			}(),
+		},
+
+		// these have no static default, the zero is resolved at mount time
+		{
+			"sizes based on the instance",
+			Tuning{ PrefetchMaxIoSize : 64 * MiB, UploadMinChunkSize : 32 * MiB },
+			func() Tuning {
+				t := d
+				t.PrefetchMaxIoSize = 64 * MiB
+				t.UploadMinChunkSize = 32 * MiB
+				return t
+			}(),
+		},
+	}
+	for _, tc := range testCases {
+		if got := tc.tuning.WithDefaults(); got != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		flags   map[string]string
+		tuning  Tuning
+		errMsg  string   // empty if the file is valid
+	}{
+		{ "empty", `{}`, map[string]string{}, Tuning{}, "" },
+		{
+			"flags",
+			`{ "flags" : { "uploadThreads" : 16, "readOnly" : true, "urlDuration" : "24h" } }`,
+			map[string]string{ "uploadThreads" : "16", "readOnly" : "true", "urlDuration" : "24h" },
+			Tuning{},
+			"",
+		},
+		{
+			"units",
+			`{ "tuning" : {
+				"writableFileSizeLimitMiB" : 10,
+				"materializeCacheSizeGiB" : 2,
+				"prefetchMinIoSizeKiB" : 1024,
+				"prefetchMaxIoSizeMiB" : 32,
+				"uploadMinChunkSizeMiB" : 16,
+				"fileWriteInactivityThresh" : "90s"
+			} }`,
+			map[string]string{},
+			Tuning{
+				WritableFileSizeLimit : 10 * MiB,
+				MaterializeCacheSize : 2 * GiB,
+				PrefetchMinIoSize : MiB,
+				PrefetchMaxIoSize : 32 * MiB,
+				UploadMinChunkSize : 16 * MiB,
+				FileWriteInactivityThresh : 90 * time.Second,
+			},
+			"",
+		},
+		{ "not json", `{ "tuning" : `, nil, Tuning{}, "could not parse" },
+		{ "unknown knob", `{ "tuning" : { "numThreads" : 4 } }`, nil, Tuning{}, "could not parse" },
+		{ "unknown section", `{ "mount" : {} }`, nil, Tuning{}, "could not parse" },
+		{ "bad flag value", `{ "flags" : { "uploadThreads" : [ 1 ] } }`, nil, Tuning{}, "bad value for flag" },
+		{
+			"bad duration",
+			`{ "tuning" : { "fileWriteInactivityThresh" : "soon" } }`,
+			nil, Tuning{}, "bad fileWriteInactivityThresh",
+		},
+		{ "invalid knob", `{ "tuning" : { "materializeCacheSizeGiB" : -1 } }`, nil, Tuning{}, "materializeCacheSizeGiB" },
+	}
+	for _, tc := range testCases {
+		cf, err := ReadConfigFile(writeConfigFile(t, tc.content))
+		if tc.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Errorf("%s: expected an error about %s, got %v", tc.name, tc.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if len(cf.Flags) != len(tc.flags) {
+			t.Errorf("%s: expected flags %v, got %v", tc.name, tc.flags, cf.Flags)
+		}
+		for name, value := range tc.flags {
+			if cf.Flags[name] != value {
+				t.Errorf("%s: expected %s=%s, got %s", tc.name, name, value, cf.Flags[name])
+			}
+		}
+		if cf.Tuning != tc.tuning {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.tuning, cf.Tuning)
+		}
+	}
+
+	if _, err := ReadConfigFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("a missing file should be an error")
+	}
+}
@@ -0,0 +1,106 @@
+package dxfuse
+
+// Object descriptions for the base.* xattrs of files. A description is made
+// the first time one of the extended attributes of a file is read, and kept
+// until the object is renamed or moved, or its metadata is synced.
+//
+// The number of descriptions is bounded. When the cache is full, the least
+// recently used description is dropped.
+//
+// A file is described without the global lock. A description that was
+// dropped while the describe call was in flight may be out of date; the
+// generation tells the caller whether to keep it.
+//
+// The cache is not thread safe, it is protected by the global lock.
+import (
+	"container/list"
+)
+
+// Descriptions are per project, an object cloned to several
+// projects has a different folder, and metadata, in each.
+type describeCacheKey struct {
+	projId string
+	id     string
+}
+
+type describeCacheEntry struct {
+	key  describeCacheKey
+	desc *DxDescribeExtended
+}
+
+type DescribeCache struct {
+	maxEntries int
+
+	// the descriptions, the most recently used is at the front
+	lru        *list.List
+	entries    map[describeCacheKey]*list.Element
+
+	// incremented when descriptions are dropped
+	gen        uint64
+}
+
+func NewDescribeCache(maxEntries int) *DescribeCache {
+	return &DescribeCache{
+		maxEntries : maxEntries,
+		lru : list.New(),
+		entries : make(map[describeCacheKey]*list.Element),
+	}
+}
+
+// Return the description of an object, and mark it as recently used
+func (dc *DescribeCache) Get(projId string, fileId string) (*DxDescribeExtended, bool) {
+	elem, ok := dc.entries[describeCacheKey{ projId, fileId }]
+	if !ok {
+		return nil, false
+	}
+	dc.lru.MoveToFront(elem)
+	return elem.Value.(*describeCacheEntry).desc, true
+}
+
+// Add a description, and drop the least recently used one if
+// the cache is full.
+func (dc *DescribeCache) Add(projId string, fileId string, desc *DxDescribeExtended) {
+	key := describeCacheKey{ projId, fileId }
+	if elem, ok := dc.entries[key]; ok {
+		elem.Value.(*describeCacheEntry).desc = desc
+		dc.lru.MoveToFront(elem)
+		return
+	}
+	for dc.lru.Len() >= dc.maxEntries && dc.lru.Len() > 0 {
+		oldest := dc.lru.Back()
+		dc.lru.Remove(oldest)
+		delete(dc.entries, oldest.Value.(*describeCacheEntry).key)
+	}
+	dc.entries[key] = dc.lru.PushFront(&describeCacheEntry{ key : key, desc : desc })
+}
+
+// The description of an object is out of date
+func (dc *DescribeCache) Drop(projId string, fileId string) {
+	dc.gen++
+	key := describeCacheKey{ projId, fileId }
+	if elem, ok := dc.entries[key]; ok {
+		dc.lru.Remove(elem)
+		delete(dc.entries, key)
+	}
+}
+
+// Drop the descriptions of all the objects in a project
+func (dc *DescribeCache) DropProject(projId string) {
+	dc.gen++
+	for key, elem := range dc.entries {
+		if key.projId == projId {
+			dc.lru.Remove(elem)
+			delete(dc.entries, key)
+		}
+	}
+}
+
+// Changes when descriptions are dropped. A description made while the
+// generation stayed the same is up to date.
+func (dc *DescribeCache) Generation() uint64 {
+	return dc.gen
+}
+
+func (dc *DescribeCache) Len() int {
+	return dc.lru.Len()
+}
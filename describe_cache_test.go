@@ -0,0 +1,100 @@
+package dxfuse
+
+import (
+	"fmt"
+	"testing"
+)
+
+func describeOf(id int) *DxDescribeExtended {
+	return &DxDescribeExtended{ Md5 : fmt.Sprintf("md5-%d", id) }
+}
+
+// Descriptions are dropped, least recently used first, when the cache is full
+func TestDescribeCacheEviction(t *testing.T) {
+	testCases := []struct {
+		maxEntries int
+		adds       []int
+		lookups    []int   // used before the last add
+		kept       []int
+		dropped    []int
+	}{
+		// everything fits
+		{ 3, []int{ 1, 2, 3 }, nil, []int{ 1, 2, 3 }, nil },
+
+		// the oldest description makes room
+		{ 2, []int{ 1, 2, 3 }, nil, []int{ 2, 3 }, []int{ 1 } },
+
+		// a lookup makes a description recently used
+		{ 2, []int{ 1, 2, 3 }, []int{ 1 }, []int{ 1, 3 }, []int{ 2 } },
+
+		// adding a description again replaces it, and does not evict
+		{ 2, []int{ 1, 2, 1 }, nil, []int{ 1, 2 }, nil },
+
+		// the most recent description is always kept
+		{ 1, []int{ 1, 2, 3 }, nil, []int{ 3 }, []int{ 1, 2 } },
+	}
+
+	for i, tc := range testCases {
+		dc := NewDescribeCache(tc.maxEntries)
+		for j, id := range tc.adds {
+			if j == len(tc.adds) - 1 {
+				for _, lid := range tc.lookups {
+					if _, ok := dc.Get("project-1", fmt.Sprintf("file-%d", lid)); !ok {
+						t.Errorf("case %d: file-%d should be cached", i, lid)
+					}
+				}
+			}
+			dc.Add("project-1", fmt.Sprintf("file-%d", id), describeOf(id))
+		}
+
+		for _, id := range tc.kept {
+			desc, ok := dc.Get("project-1", fmt.Sprintf("file-%d", id))
+			if !ok || desc.Md5 != describeOf(id).Md5 {
+				t.Errorf("case %d: file-%d should be cached", i, id)
+			}
+		}
+		for _, id := range tc.dropped {
+			if _, ok := dc.Get("project-1", fmt.Sprintf("file-%d", id)); ok {
+				t.Errorf("case %d: file-%d should be dropped", i, id)
+			}
+		}
+		if dc.Len() != len(tc.kept) || dc.Len() > tc.maxEntries {
+			t.Errorf("case %d: %d descriptions cached, expected %d", i, dc.Len(), len(tc.kept))
+		}
+	}
+}
+
+// Descriptions are per project
+func TestDescribeCacheDrop(t *testing.T) {
+	dc := NewDescribeCache(10)
+	dc.Add("project-1", "file-1", describeOf(1))
+	dc.Add("project-1", "file-2", describeOf(2))
+	dc.Add("project-2", "file-1", describeOf(1))
+
+	gen := dc.Generation()
+	dc.Drop("project-1", "file-1")
+	if _, ok := dc.Get("project-1", "file-1"); ok {
+		t.Errorf("the description should be dropped")
+	}
+	if _, ok := dc.Get("project-2", "file-1"); !ok {
+		t.Errorf("the description in the other project should be kept")
+	}
+	if dc.Generation() == gen {
+		t.Errorf("dropping a description should change the generation")
+	}
+
+	gen = dc.Generation()
+	dc.DropProject("project-1")
+	if _, ok := dc.Get("project-1", "file-2"); ok {
+		t.Errorf("the descriptions of the project should be dropped")
+	}
+	if dc.Len() != 1 {
+		t.Errorf("only the other project should be left, %d descriptions cached", dc.Len())
+	}
+	if dc.Generation() == gen {
+		t.Errorf("dropping a project should change the generation")
+	}
+
+	// dropping a description that is not cached is fine
+	dc.Drop("project-3", "file-3")
+}
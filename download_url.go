@@ -0,0 +1,358 @@
+package dxfuse
+
+// Preauthenticated download URLs are created with the /file-xxxx/download
+// API call. A URL is valid for a limited duration, after which the storage
+// backend starts rejecting it. URLs are kept in a cache shared by all the
+// handles to a file. An entry is renewed when it is about to expire, or when
+// the backend refuses to honor it.
+//
+// URLs are created lazily, on the first read from a file. When several files
+// are likely to be read soon (a directory listing, or files opened together),
+// their URLs are created in the background by a small pool of workers.
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dnanexus/dxda"
+	"github.com/hashicorp/go-retryablehttp" // use http libraries from hashicorp for implement retry logic
+)
+
+const (
+	// Renew a URL this long before it expires. For short durations,
+	// a tenth of the duration is used instead.
+	urlRenewMargin = 5 * time.Minute
+
+	// When the cache grows beyond this size, expired entries are removed
+	maxNumUrlsInCache = 10 * 1000
+
+	// Number of threads creating URLs in the background
+	numUrlPrefetchThreads = 4
+	urlPrefetchQueueSize = 1024
+
+	// Limit on the number of URLs requested in the background for
+	// one directory listing, or one batch of open files.
+	MaxNumUrlPrefetch = 32
+
+	urlPrefetchTimeout = 2 * time.Minute
+)
+
+type urlPrefetchReq struct {
+	fileId string
+	projId string
+}
+
+type urlCacheEntry struct {
+	url     DxDownloadURL
+	expires time.Time
+
+	// closed once the API call creating the URL completes. Concurrent
+	// requests for the same file wait on it, instead of issuing
+	// their own call.
+	ready   chan struct{}
+	err     error
+}
+
+type DownloadUrlCache struct {
+	mutex    sync.Mutex
+	dxEnv    dxda.DXEnvironment
+	options  Options
+	duration time.Duration
+	entries  map[string]*urlCacheEntry
+
+	// error codes returned by the storage backend when a URL has expired,
+	// or is otherwise not accepted anymore. Used for errors that do not
+	// carry an HTTP status.
+	authErrorRe *regexp.Regexp
+
+	// the HTTP status reported by a failed request, for errors
+	// that only have it in their text.
+	statusRe    *regexp.Regexp
+
+	// makes the API call creating a URL
+	newUrl   func(ctx context.Context, client *retryablehttp.Client, fileId string, projId string) (DxDownloadURL, time.Time, error)
+
+	// background URL creation
+	prefetchQueue chan urlPrefetchReq
+	wg            sync.WaitGroup
+	closed        bool
+}
+
+func NewDownloadUrlCache(dxEnv dxda.DXEnvironment, options Options) *DownloadUrlCache {
+	duration := options.DownloadUrlDuration
+	if duration <= 0 {
+		duration = DownloadUrlDurationDefault
+	}
+	uc := &DownloadUrlCache{
+		dxEnv : dxEnv,
+		options : options,
+		duration : duration,
+		entries : make(map[string]*urlCacheEntry),
+		authErrorRe : regexp.MustCompile(`\b(AccessDenied|ExpiredToken|Request has expired)\b`),
+		statusRe : regexp.MustCompile(`\bstatus(?: code)?[ :=]*(\d{3})\b`),
+		prefetchQueue : make(chan urlPrefetchReq, urlPrefetchQueueSize),
+		closed : false,
+	}
+	uc.newUrl = uc.createUrl
+
+	uc.wg.Add(numUrlPrefetchThreads)
+	for i := 0; i < numUrlPrefetchThreads; i++ {
+		go uc.prefetchWorker()
+	}
+	return uc
+}
+
+func (uc *DownloadUrlCache) Shutdown() {
+	uc.mutex.Lock()
+	uc.closed = true
+	close(uc.prefetchQueue)
+	uc.mutex.Unlock()
+
+	uc.wg.Wait()
+}
+
+// write a log message, and add a header
+func (uc *DownloadUrlCache) log(a string, args ...interface{}) {
+	LogMsg("download_url", a, args...)
+}
+
+func (uc *DownloadUrlCache) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "download_url", a, args...)
+}
+
+// write a log message, tagged with the correlation ID of the operation
+func (uc *DownloadUrlCache) logCtx(ctx context.Context, level int, a string, args ...interface{}) {
+	LogMsgCtx(ctx, level, "download_url", a, args...)
+}
+
+func (uc *DownloadUrlCache) logEnabled(level int) bool {
+	return LogEnabled("download_url", level)
+}
+
+// Is this an error returned when using an expired, or revoked, URL?
+func (uc *DownloadUrlCache) IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	status := uc.httpStatus(err)
+	if status != 0 {
+		return status == http.StatusUnauthorized || status == http.StatusForbidden
+	}
+	return uc.authErrorRe.MatchString(err.Error())
+}
+
+// The HTTP status code of a failed request, zero if it is not known
+func (uc *DownloadUrlCache) httpStatus(err error) int {
+	if dxErr, ok := err.(*dxda.DxError); ok && dxErr.HttpCode != 0 {
+		return dxErr.HttpCode
+	}
+	m := uc.statusRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	status, _ := strconv.Atoi(m[1])
+	return status
+}
+
+func (uc *DownloadUrlCache) renewMargin() time.Duration {
+	return MinDuration(urlRenewMargin, uc.duration / 10)
+}
+
+// create a fresh URL with an API call
+func (uc *DownloadUrlCache) createUrl(
+	ctx context.Context,
+	client *retryablehttp.Client,
+	fileId string,
+	projId string) (DxDownloadURL, time.Time, error) {
+	var u DxDownloadURL
+	durationSec := int64(uc.duration.Seconds())
+	payload := fmt.Sprintf("{\"project\": \"%s\", \"duration\": %d}", projId, durationSec)
+
+	startTs := time.Now()
+	body, err := dxAPI(ctx, client, NumRetries, &uc.dxEnv, fmt.Sprintf("%s/download", fileId), payload)
+	if err != nil {
+		return u, startTs, err
+	}
+	if err := json.Unmarshal(body, &u); err != nil {
+		return u, startTs, err
+	}
+
+	// The platform reports the expiration time in milliseconds since the epoch.
+	// Older servers do not, in which case we calculate it conservatively.
+	var expires time.Time
+	if u.Expires > 0 {
+		expires = time.Unix(0, u.Expires * int64(time.Millisecond))
+	} else {
+		expires = startTs.Add(uc.duration)
+	}
+	if uc.logEnabled(LOG_DEBUG) {
+		uc.logCtx(ctx, LOG_DEBUG, "created download URL for %s, expires %s", fileId, expires.String())
+	}
+	return u, expires, nil
+}
+
+// remove expired entries. Called with the lock held.
+func (uc *DownloadUrlCache) pruneExpired() {
+	now := time.Now()
+	for fileId, e := range uc.entries {
+		select {
+		case <- e.ready:
+			if e.err != nil || now.After(e.expires) {
+				delete(uc.entries, fileId)
+			}
+		default:
+			// in flight, leave it alone
+		}
+	}
+}
+
+// Get a valid download URL for a file. Use the cached URL if it isn't
+// about to expire, otherwise create a new one.
+func (uc *DownloadUrlCache) Get(
+	ctx context.Context,
+	client *retryablehttp.Client,
+	fileId string,
+	projId string) (DxDownloadURL, error) {
+	for {
+		uc.mutex.Lock()
+		e, ok := uc.entries[fileId]
+		if !ok {
+			break
+		}
+		select {
+		case <- e.ready:
+			if e.err == nil && time.Now().Add(uc.renewMargin()).Before(e.expires) {
+				u := e.url
+				uc.mutex.Unlock()
+				return u, nil
+			}
+			// stale, or failed, entry. Create a new one.
+			delete(uc.entries, fileId)
+			uc.mutex.Unlock()
+		default:
+			// Another thread is creating a URL for this file, wait for it.
+			uc.mutex.Unlock()
+			select {
+			case <- e.ready:
+			case <- ctx.Done():
+				return DxDownloadURL{}, ctx.Err()
+			}
+		}
+	}
+
+	// We are holding the lock, and there is no entry for the file.
+	// Add an in-flight entry, and make the API call without the lock.
+	if len(uc.entries) >= maxNumUrlsInCache {
+		uc.pruneExpired()
+	}
+	e := &urlCacheEntry{
+		ready : make(chan struct{}),
+	}
+	uc.entries[fileId] = e
+	uc.mutex.Unlock()
+
+	u, expires, err := uc.newUrl(ctx, client, fileId, projId)
+
+	uc.mutex.Lock()
+	e.url = u
+	e.expires = expires
+	e.err = err
+	close(e.ready)
+	if err != nil {
+		// do not cache errors
+		if uc.entries[fileId] == e {
+			delete(uc.entries, fileId)
+		}
+	}
+	uc.mutex.Unlock()
+
+	if err != nil {
+		uc.logAt(LOG_ERROR, "could not create a download URL for %s, err=%s", fileId, err.Error())
+		return DxDownloadURL{}, err
+	}
+	return u, nil
+}
+
+// The storage backend refused to honor [staleUrl]. Get a new URL,
+// unless another thread has already replaced it.
+func (uc *DownloadUrlCache) Refresh(
+	ctx context.Context,
+	client *retryablehttp.Client,
+	fileId string,
+	projId string,
+	staleUrl DxDownloadURL) (DxDownloadURL, error) {
+	uc.mutex.Lock()
+	if e, ok := uc.entries[fileId]; ok {
+		select {
+		case <- e.ready:
+			if e.url.URL == staleUrl.URL {
+				delete(uc.entries, fileId)
+			}
+		default:
+		}
+	}
+	uc.mutex.Unlock()
+
+	uc.log("renewing the download URL for %s", fileId)
+	return uc.Get(ctx, client, fileId, projId)
+}
+
+// The file is not accessible anymore, remove its URL
+func (uc *DownloadUrlCache) Invalidate(fileId string) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	delete(uc.entries, fileId)
+}
+
+func (uc *DownloadUrlCache) prefetchWorker() {
+	client := dxda.NewHttpClient(true)
+	for req := range uc.prefetchQueue {
+		ctx, cancel := context.WithTimeout(context.TODO(), urlPrefetchTimeout)
+
+		// errors are logged, and the URL is created again on first read
+		uc.Get(ctx, client, req.fileId, req.projId)
+		cancel()
+	}
+	uc.wg.Done()
+}
+
+// Create URLs for these files in the background, one API call per file;
+// the platform has no bulk call for this. At most [MaxNumUrlPrefetch] files
+// are taken. Files that already have a URL, or are in the process of getting
+// one, are skipped. This does not block; if the queue is full, the remaining
+// requests are dropped.
+func (uc *DownloadUrlCache) Prefetch(files []File) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	if uc.closed {
+		return
+	}
+	if len(files) > MaxNumUrlPrefetch {
+		files = files[:MaxNumUrlPrefetch]
+	}
+
+	numQueued := 0
+	for _, f := range files {
+		if _, ok := uc.entries[f.Id]; ok {
+			continue
+		}
+		select {
+		case uc.prefetchQueue <- urlPrefetchReq{ fileId : f.Id, projId : f.ProjId }:
+			numQueued++
+		default:
+			// the queue is full
+			if uc.logEnabled(LOG_DEBUG) {
+				uc.logAt(LOG_DEBUG, "prefetch queue is full, queued %d out of %d URLs", numQueued, len(files))
+			}
+			return
+		}
+	}
+	if uc.logEnabled(LOG_TRACE) {
+		uc.logAt(LOG_TRACE, "queued %d URLs for background creation", numQueued)
+	}
+}
@@ -0,0 +1,267 @@
+package dxfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnanexus/dxda"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Creates URLs without calling the platform, and counts the calls
+type fakeUrlSource struct {
+	mutex    sync.Mutex
+	numCalls int
+	lifetime time.Duration
+	failNext bool
+}
+
+func (fs *fakeUrlSource) newUrl(
+	ctx context.Context,
+	client *retryablehttp.Client,
+	fileId string,
+	projId string) (DxDownloadURL, time.Time, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.numCalls++
+	if fs.failNext {
+		fs.failNext = false
+		return DxDownloadURL{}, time.Now(), errors.New("InternalError")
+	}
+	u := DxDownloadURL{
+		URL : fmt.Sprintf("https://dl.example.com/%s/%d", fileId, fs.numCalls),
+	}
+	return u, time.Now().Add(fs.lifetime), nil
+}
+
+func (fs *fakeUrlSource) calls() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.numCalls
+}
+
+func newTestUrlCache(t *testing.T, duration time.Duration, lifetime time.Duration) (*DownloadUrlCache, *fakeUrlSource) {
+	uc := NewDownloadUrlCache(dxda.DXEnvironment{}, Options{ DownloadUrlDuration : duration })
+	t.Cleanup(uc.Shutdown)
+	fs := &fakeUrlSource{ lifetime : lifetime }
+	uc.newUrl = fs.newUrl
+	return uc, fs
+}
+
+func getUrl(t *testing.T, uc *DownloadUrlCache, fileId string) DxDownloadURL {
+	u, err := uc.Get(context.Background(), nil, fileId, "project-A")
+	if err != nil {
+		t.Fatalf("get %s: %s", fileId, err.Error())
+	}
+	return u
+}
+
+// A URL is created once, and shared by later requests
+func TestUrlCacheGet(t *testing.T) {
+	uc, fs := newTestUrlCache(t, time.Hour, time.Hour)
+
+	u1 := getUrl(t, uc, "file-1")
+	u2 := getUrl(t, uc, "file-1")
+	if u1.URL != u2.URL {
+		t.Errorf("expected the cached URL %s, got %s", u1.URL, u2.URL)
+	}
+	getUrl(t, uc, "file-2")
+	if fs.calls() != 2 {
+		t.Errorf("expected 2 API calls, got %d", fs.calls())
+	}
+}
+
+// A URL that is about to expire is renewed
+func TestUrlCacheExpiry(t *testing.T) {
+	testCases := []struct {
+		duration time.Duration
+		lifetime time.Duration
+		renewed  bool
+	}{
+		// the margin is five minutes
+		{ time.Hour, 10 * time.Minute, false },
+		{ time.Hour, 4 * time.Minute, true },
+
+		// for short durations, the margin is a tenth of the duration
+		{ 10 * time.Minute, 2 * time.Minute, false },
+		{ 10 * time.Minute, 30 * time.Second, true },
+
+		// expired already
+		{ time.Hour, -time.Minute, true },
+	}
+
+	for _, tc := range testCases {
+		uc, fs := newTestUrlCache(t, tc.duration, tc.lifetime)
+		u1 := getUrl(t, uc, "file-1")
+		u2 := getUrl(t, uc, "file-1")
+		renewed := (u1.URL != u2.URL)
+		if renewed != tc.renewed {
+			t.Errorf("duration=%s lifetime=%s: expected renewed=%t, got %t (%d calls)",
+				tc.duration, tc.lifetime, tc.renewed, renewed, fs.calls())
+		}
+	}
+}
+
+// Failures are returned to the caller, and not cached
+func TestUrlCacheError(t *testing.T) {
+	uc, fs := newTestUrlCache(t, time.Hour, time.Hour)
+	fs.failNext = true
+
+	if _, err := uc.Get(context.Background(), nil, "file-1", "project-A"); err == nil {
+		t.Fatalf("expected an error")
+	}
+	getUrl(t, uc, "file-1")
+	if fs.calls() != 2 {
+		t.Errorf("expected 2 API calls, got %d", fs.calls())
+	}
+}
+
+// Refresh replaces the URL that was rejected, but not a URL that another
+// thread has already renewed.
+func TestUrlCacheRefresh(t *testing.T) {
+	uc, fs := newTestUrlCache(t, time.Hour, time.Hour)
+
+	stale := getUrl(t, uc, "file-1")
+	fresh, err := uc.Refresh(context.Background(), nil, "file-1", "project-A", stale)
+	if err != nil {
+		t.Fatalf("refresh: %s", err.Error())
+	}
+	if fresh.URL == stale.URL {
+		t.Errorf("refresh should create a new URL")
+	}
+
+	// a second refresh with the same stale URL keeps the new one
+	again, err := uc.Refresh(context.Background(), nil, "file-1", "project-A", stale)
+	if err != nil {
+		t.Fatalf("refresh: %s", err.Error())
+	}
+	if again.URL != fresh.URL {
+		t.Errorf("expected %s, got %s", fresh.URL, again.URL)
+	}
+	if fs.calls() != 2 {
+		t.Errorf("expected 2 API calls, got %d", fs.calls())
+	}
+}
+
+func TestUrlCacheInvalidate(t *testing.T) {
+	uc, fs := newTestUrlCache(t, time.Hour, time.Hour)
+
+	u1 := getUrl(t, uc, "file-1")
+	uc.Invalidate("file-1")
+	u2 := getUrl(t, uc, "file-1")
+	if u1.URL == u2.URL || fs.calls() != 2 {
+		t.Errorf("an invalidated URL should be created again")
+	}
+
+	// invalidating a file that has no URL is fine
+	uc.Invalidate("file-2")
+}
+
+// Concurrent requests for the same file make a single API call
+func TestUrlCacheConcurrentGet(t *testing.T) {
+	uc, fs := newTestUrlCache(t, time.Hour, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			getUrl(t, uc, "file-1")
+		}()
+	}
+	wg.Wait()
+	if fs.calls() != 1 {
+		t.Errorf("expected 1 API call, got %d", fs.calls())
+	}
+}
+
+func TestUrlCacheIsAuthError(t *testing.T) {
+	uc, _ := newTestUrlCache(t, time.Hour, time.Hour)
+
+	testCases := []struct {
+		err     error
+		isAuth  bool
+	}{
+		{ nil, false },
+		{ &dxda.DxError{ EType : "PermissionDenied", HttpCode : 401 }, true },
+		{ &dxda.DxError{ EType : "PermissionDenied", HttpCode : 403 }, true },
+		{ &dxda.DxError{ EType : "ResourceNotFound", HttpCode : 404 }, false },
+		{ errors.New("GET request failed with status code 403"), true },
+		{ errors.New("request failed, status 503"), false },
+		{ errors.New("<Code>AccessDenied</Code>"), true },
+		{ errors.New("Request has expired"), true },
+
+		// numbers that happen to look like a status
+		{ errors.New("short read of 4030 bytes at offset 401"), false },
+		{ errors.New("file-B403xyz401 not found"), false },
+	}
+
+	for _, tc := range testCases {
+		if isAuth := uc.IsAuthError(tc.err); isAuth != tc.isAuth {
+			t.Errorf("%v: expected %t, got %t", tc.err, tc.isAuth, isAuth)
+		}
+	}
+}
+
+func makePrefetchFiles(n int) []File {
+	var files []File
+	for i := 0; i < n; i++ {
+		files = append(files, File{
+			Id : fmt.Sprintf("file-%d", i),
+			ProjId : "project-A",
+		})
+	}
+	return files
+}
+
+// Background creation is capped, and skips files that have a URL. The
+// workers are done once the cache is shut down.
+func TestUrlCachePrefetch(t *testing.T) {
+	testCases := []struct {
+		numFiles   int
+		numCached  int
+		numCalls   int
+	}{
+		{ 0, 0, 0 },
+		{ 5, 0, 5 },
+		{ 5, 2, 5 },
+		{ MaxNumUrlPrefetch, 0, MaxNumUrlPrefetch },
+		{ 100, 0, MaxNumUrlPrefetch },
+		{ 100, 10, MaxNumUrlPrefetch },
+	}
+
+	for _, tc := range testCases {
+		uc := NewDownloadUrlCache(dxda.DXEnvironment{}, Options{})
+		fs := &fakeUrlSource{ lifetime : time.Hour }
+		uc.newUrl = fs.newUrl
+
+		files := makePrefetchFiles(tc.numFiles)
+		for _, f := range files[:tc.numCached] {
+			getUrl(t, uc, f.Id)
+		}
+		uc.Prefetch(files)
+		uc.Shutdown()
+
+		if fs.calls() != tc.numCalls {
+			t.Errorf("files=%d cached=%d: expected %d API calls, got %d",
+				tc.numFiles, tc.numCached, tc.numCalls, fs.calls())
+		}
+	}
+}
+
+// After shutdown, nothing is queued
+func TestUrlCachePrefetchClosed(t *testing.T) {
+	uc := NewDownloadUrlCache(dxda.DXEnvironment{}, Options{})
+	fs := &fakeUrlSource{ lifetime : time.Hour }
+	uc.newUrl = fs.newUrl
+	uc.Shutdown()
+
+	uc.Prefetch(makePrefetchFiles(3))
+	if fs.calls() != 0 {
+		t.Errorf("expected no API calls, got %d", fs.calls())
+	}
+}
@@ -1,10 +1,13 @@
 package dxfuse
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"path/filepath"
+	"strings"
 
 	// The dxda package has the get-environment code
 	"github.com/dnanexus/dxda"
@@ -52,13 +55,8 @@ type DxDescribePrj struct {
 	MtimeSeconds   int64
 	UploadParams   FileUploadParameters
 	Level          int // one of VIEW, UPLOAD, CONTRIBUTE, ADMINISTER
-}
-
-// a DNAx directory. It holds files and sub-directories.
-type DxFolder struct {
-	path  string  // Full directory name, for example: { "/A/B/C", "foo/bar/baz" }
-	dataObjects  map[string]DxDescribeDataObject
-	subdirs []string
+	Tags           []string
+	Properties     map[string]string
 }
 
 // -------------------------------------------------------------------
@@ -95,6 +93,48 @@ type DxDescribeRaw struct {
 	SymlinkPath     *DxSymLink `json:"symlinkPath,omitempty"`
 }
 
+// Limit the number of fields returned, because by default we
+// get too much information, which is a burden on the server side.
+func describeFields() map[string]bool {
+	return map[string]bool {
+		"id" : true,
+		"project" : true,
+		"name" : true,
+		"state" : true,
+		"archivalState" : true,
+		"folder" : true,
+		"created" : true,
+		"modified" : true,
+		"size" : true,
+		"tags" : true,
+		"properties" : true,
+		"symlinkPath" : true,
+		"drive" : true,
+	}
+}
+
+func describeRawToObject(descRaw DxDescribeRaw) DxDescribeDataObject {
+	symlinkUrl := ""
+	if descRaw.SymlinkPath != nil {
+		symlinkUrl = descRaw.SymlinkPath.Url
+	}
+
+	return DxDescribeDataObject{
+		Id :  descRaw.Id,
+		ProjId : descRaw.ProjId,
+		Name : descRaw.Name,
+		State : descRaw.State,
+		ArchivalState : descRaw.ArchivalState,
+		Folder : descRaw.Folder,
+		Size : descRaw.Size,
+		CtimeSeconds : descRaw.CreatedMillisec / 1000,
+		MtimeSeconds : descRaw.ModifiedMillisec / 1000,
+		Tags : descRaw.Tags,
+		Properties : descRaw.Properties,
+		SymlinkPath : symlinkUrl,
+	}
+}
+
 // Describe a large number of file-ids in one API call.
 func submit(
 	ctx context.Context,
@@ -102,25 +142,9 @@ func submit(
 	dxEnv *dxda.DXEnvironment,
 	fileIds []string) (map[string]DxDescribeDataObject, error) {
 
-	// Limit the number of fields returned, because by default we
-	// get too much information, which is a burden on the server side.
 	describeOptions := map[string]map[string]map[string]bool {
 		"*" : map[string]map[string]bool {
-			"fields" : map[string]bool {
-				"id" : true,
-				"project" : true,
-				"name" : true,
-				"state" : true,
-				"archivalState" : true,
-				"folder" : true,
-				"created" : true,
-				"modified" : true,
-				"size" : true,
-				"tags" : true,
-				"properties" : true,
-				"symlinkPath" : true,
-				"drive" : true,
-			},
+			"fields" : describeFields(),
 		},
 	}
 	request := Request{
@@ -134,7 +158,7 @@ func submit(
 	}
 	//fmt.Printf("payload = %s", string(payload))
 
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, dxEnv, "system/describeDataObjects", string(payload))
+	repJs, err := dxAPI(ctx, httpClient, NumRetries, dxEnv, "system/describeDataObjects", string(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -146,27 +170,7 @@ func submit(
 
 	var files = make(map[string]DxDescribeDataObject)
 	for _, descRawTop := range(reply.Results) {
-		descRaw := descRawTop.Describe
-
-		symlinkUrl := ""
-		if descRaw.SymlinkPath != nil {
-			symlinkUrl = descRaw.SymlinkPath.Url
-		}
-
-		desc := DxDescribeDataObject{
-			Id :  descRaw.Id,
-			ProjId : descRaw.ProjId,
-			Name : descRaw.Name,
-			State : descRaw.State,
-			ArchivalState : descRaw.ArchivalState,
-			Folder : descRaw.Folder,
-			Size : descRaw.Size,
-			CtimeSeconds : descRaw.CreatedMillisec / 1000,
-			MtimeSeconds : descRaw.ModifiedMillisec / 1000,
-			Tags : descRaw.Tags,
-			Properties : descRaw.Properties,
-			SymlinkPath : symlinkUrl,
-		}
+		desc := describeRawToObject(descRawTop.Describe)
 		//fmt.Printf("%v\n", desc)
 		files[desc.Id] = desc
 	}
@@ -215,6 +219,29 @@ type ListFolderRequest struct {
 	IncludeHidden bool `json:"includeHidden"`
 }
 
+// Does a folder exist in a project?
+func DxFolderExists(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	dxEnv *dxda.DXEnvironment,
+	projectId string,
+	folder string) (bool, error) {
+	folder = filepath.Clean(folder)
+	if folder == "/" {
+		return true, nil
+	}
+	parentInfo, err := listFolder(ctx, httpClient, dxEnv, projectId, filepath.Dir(folder), "folders")
+	if err != nil {
+		return false, err
+	}
+	for _, subdir := range parentInfo.subdirs {
+		if subdir == folder {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 type ListFolderResponse struct {
 	Objects []ObjInfo  `json:"objects"`
 	Folders []string   `json:"folders"`
@@ -230,17 +257,19 @@ type DxListFolder struct {
 }
 
 // Issue a /project-xxxx/listFolder API call. Get
-// back a list of object-ids and sub-directories.
+// back a list of object-ids and sub-directories. [only] is one of
+// "all", "objects", or "folders".
 func listFolder(
 	ctx context.Context,
 	httpClient *retryablehttp.Client,
 	dxEnv *dxda.DXEnvironment,
 	projectId string,
-	dir string) (*DxListFolder, error) {
+	dir string,
+	only string) (*DxListFolder, error) {
 
 	request := ListFolderRequest{
 		Folder : dir,
-		Only : "all",
+		Only : only,
 		IncludeHidden : false,
 	}
 	var payload []byte
@@ -249,7 +278,7 @@ func listFolder(
 		return nil, err
 	}
 	dxRequest := fmt.Sprintf("%s/listFolder", projectId)
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, dxEnv, dxRequest , string(payload))
+	repJs, err := dxAPI(ctx, httpClient, NumRetries, dxEnv, dxRequest , string(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -269,44 +298,6 @@ func listFolder(
 }
 
 
-func DxDescribeFolder(
-	ctx context.Context,
-	httpClient *retryablehttp.Client,
-	dxEnv *dxda.DXEnvironment,
-	projectId string,
-	folder string) (*DxFolder, error) {
-	// The listFolder API call returns a list of object ids and folders.
-	// We could describe the objects right here, but we do that separately.
-	folderInfo, err := listFolder(ctx, httpClient, dxEnv, projectId, folder)
-	if err != nil {
-		log.Printf("listFolder(%s) error %s", folder, err.Error())
-		return nil, err
-	}
-	// limit the number of directory elements
-	numElementsInDir := len(folderInfo.objIds)
-	if numElementsInDir > MaxDirSize {
-		return nil, fmt.Errorf(
-			"Too many elements (%d) in a directory, the limit is %d",
-			numElementsInDir, MaxDirSize)
-	}
-
-	dxObjs, err := DxDescribeBulkObjects(ctx, httpClient, dxEnv, folderInfo.objIds)
-	if err != nil {
-		log.Printf("describeBulkObjects(%v) error %s", folderInfo.objIds, err.Error())
-		return nil, err
-	}
-
-	dataObjects := make(map[string]DxDescribeDataObject)
-	for _,oDesc := range dxObjs {
-		dataObjects[oDesc.Id] = oDesc
-	}
-	return &DxFolder{
-		path : folder,
-		dataObjects : dataObjects,
-		subdirs : folderInfo.subdirs,
-	}, nil
-}
-
 type RequestDescribeProject struct {
 	Fields map[string]bool `json:"fields"`
 }
@@ -321,6 +312,8 @@ type ReplyDescribeProject struct {
 	ModifiedMillisec int64 `json:"modified"`
 	UploadParams     FileUploadParameters  `json:"fileUploadParameters"`
 	Level            string `json:"level"`
+	Tags             []string `json:"tags"`
+	Properties       map[string]string `json:"properties"`
 }
 
 func projectPermissionsToInt(perm string) int {
@@ -335,6 +328,16 @@ func projectPermissionsToInt(perm string) int {
 	return 0
 }
 
+func projectPermissionsToString(perm int) string {
+	switch perm {
+	case PERM_VIEW: return "VIEW"
+	case PERM_UPLOAD: return "UPLOAD"
+	case PERM_CONTRIBUTE: return "CONTRIBUTE"
+	case PERM_ADMINISTER: return "ADMINISTER"
+	}
+	return "NONE"
+}
+
 func DxDescribeProject(
 	ctx context.Context,
 	httpClient *retryablehttp.Client,
@@ -352,6 +355,8 @@ func DxDescribeProject(
 		"modified" : true,
 		"fileUploadParameters" : true,
 		"level" : true,
+		"tags" : true,
+		"properties" : true,
 	}
 	var payload []byte
 	payload, err := json.Marshal(request)
@@ -360,7 +365,7 @@ func DxDescribeProject(
 	}
 
 	dxRequest := fmt.Sprintf("%s/describe", projectId)
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, dxEnv, dxRequest, string(payload))
+	repJs, err := dxAPI(ctx, httpClient, NumRetries, dxEnv, dxRequest, string(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -380,10 +385,188 @@ func DxDescribeProject(
 		MtimeSeconds : reply.ModifiedMillisec/ 1000,
 		UploadParams : reply.UploadParams,
 		Level :        projectPermissionsToInt(reply.Level),
+		Tags :         reply.Tags,
+		Properties :   reply.Properties,
 	}
 	return &prj, nil
 }
 
+// Fields of an object that are not kept in the database. They are
+// described only when asked for.
+type DxDescribeExtended struct {
+	CreatedMillisec  int64
+	ModifiedMillisec int64
+	CreatedBy        string
+	Md5              string   // empty if the object has none
+	Media            string
+	Folder           string
+	ProjId           string
+	Hidden           bool
+	Sponsored        bool
+	Details          json.RawMessage
+}
+
+type DxCreatedBy struct {
+	User string `json:"user"`
+}
+
+type DxDescribeExtendedRaw struct {
+	CreatedMillisec  int64            `json:"created"`
+	ModifiedMillisec int64            `json:"modified"`
+	CreatedBy        DxCreatedBy      `json:"createdBy"`
+	Md5              *string          `json:"md5,omitempty"`
+	Media            string           `json:"media"`
+	Folder           string           `json:"folder"`
+	ProjId           string           `json:"project"`
+	Hidden           bool             `json:"hidden"`
+	Sponsored        bool             `json:"sponsored"`
+	Details          json.RawMessage  `json:"details"`
+}
+
+type RequestDescribeExtended struct {
+	ProjId string          `json:"project"`
+	Fields map[string]bool `json:"fields"`
+}
+
+func DxDescribeObjectExtended(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	dxEnv *dxda.DXEnvironment,
+	projId string,
+	objId string) (*DxDescribeExtended, error) {
+	request := RequestDescribeExtended{
+		ProjId : projId,
+		Fields : map[string]bool {
+			"created" : true,
+			"modified" : true,
+			"createdBy" : true,
+			"folder" : true,
+			"project" : true,
+			"hidden" : true,
+			"details" : true,
+		},
+	}
+	if strings.HasPrefix(objId, "file-") {
+		// fields that only files have
+		request.Fields["md5"] = true
+		request.Fields["media"] = true
+		request.Fields["sponsored"] = true
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	dxRequest := fmt.Sprintf("%s/describe", objId)
+	repJs, err := dxAPI(ctx, httpClient, NumRetries, dxEnv, dxRequest, string(payload))
+	if err != nil {
+		return nil, err
+	}
+	var reply DxDescribeExtendedRaw
+	if err := json.Unmarshal(repJs, &reply); err != nil {
+		return nil, err
+	}
+
+	md5 := ""
+	if reply.Md5 != nil {
+		md5 = *reply.Md5
+	}
+	return &DxDescribeExtended{
+		CreatedMillisec : reply.CreatedMillisec,
+		ModifiedMillisec : reply.ModifiedMillisec,
+		CreatedBy : reply.CreatedBy.User,
+		Md5 : md5,
+		Media : reply.Media,
+		Folder : reply.Folder,
+		ProjId : reply.ProjId,
+		Hidden : reply.Hidden,
+		Sponsored : reply.Sponsored,
+		Details : reply.Details,
+	}, nil
+}
+
+type RequestDescribeJson struct {
+	ProjId        string          `json:"project"`
+	DefaultFields bool            `json:"defaultFields"`
+	Fields        map[string]bool `json:"fields"`
+}
+
+// The description of an object, including its details, as indented JSON.
+// This is the content of the file that stands for an applet, workflow,
+// record, or database.
+func DxDescribeJson(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	dxEnv *dxda.DXEnvironment,
+	projId string,
+	objId string) ([]byte, error) {
+	request := RequestDescribeJson{
+		ProjId : projId,
+		DefaultFields : true,
+		Fields : map[string]bool {
+			"details" : true,
+			"properties" : true,
+		},
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	dxRequest := fmt.Sprintf("%s/describe", objId)
+	repJs, err := dxAPI(ctx, httpClient, NumRetries, dxEnv, dxRequest, string(payload))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, repJs, "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+type RequestDescribeArchival struct {
+	ProjId string          `json:"project"`
+	Fields map[string]bool `json:"fields"`
+}
+
+type ReplyDescribeArchival struct {
+	ArchivalState string `json:"archivalState"`
+}
+
+// The archival state of a file, in a particular project. The state is per
+// project, a file that is cloned into several projects may be archived in some
+// of them only.
+func DxArchivalState(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	dxEnv *dxda.DXEnvironment,
+	projId string,
+	fileId string) (string, error) {
+	request := RequestDescribeArchival{
+		ProjId : projId,
+		Fields : map[string]bool {
+			"archivalState" : true,
+		},
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	dxRequest := fmt.Sprintf("%s/describe", fileId)
+	repJs, err := dxAPI(ctx, httpClient, NumRetries, dxEnv, dxRequest, string(payload))
+	if err != nil {
+		return "", err
+	}
+	var reply ReplyDescribeArchival
+	if err := json.Unmarshal(repJs, &reply); err != nil {
+		return "", err
+	}
+	return reply.ArchivalState, nil
+}
+
 // Describe just one object. Retrieve state even if the object is not closed.
 func DxDescribe(
 	ctx context.Context,
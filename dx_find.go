@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/dnanexus/dxda"
+	"github.com/hashicorp/go-retryablehttp"
 )
 
 type FindProjectRequest struct {
@@ -38,7 +39,7 @@ func DxFindProject(
 	}
 
 	httpClient := dxda.NewHttpClient(false)
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, dxEnv, "system/findProjects", string(payload))
+	repJs, err := dxAPI(ctx, httpClient, NumRetries, dxEnv, "system/findProjects", string(payload))
 	if err != nil {
 		return "", err
 	}
@@ -57,3 +58,170 @@ func DxFindProject(
 		return "", err
 	}
 }
+
+const (
+	maxNumObjectsInFind = 1000
+)
+
+// A search for data objects. Empty fields do not restrict the search.
+type DxFindDataObjectsQuery struct {
+	ProjId         string
+	Folder         string
+	Recurse        bool               // search the subfolders too
+	Class          string             // file, record, applet, ...
+	State          string             // open, closing, closed
+	Name           string             // an exact name
+	NameGlob       string             // a glob pattern, such as "*.bam"
+	Tags           []string           // the object must have all the tags
+	Properties     map[string]string  // the object must have all the properties. An empty value matches any value.
+
+	// milliseconds since the epoch, zero means no limit
+	CreatedAfter   int64
+	CreatedBefore  int64
+	ModifiedAfter  int64
+	ModifiedBefore int64
+}
+
+type FindScope struct {
+	Project string `json:"project"`
+	Folder  string `json:"folder,omitempty"`
+	Recurse bool   `json:"recurse"`
+}
+
+type FindDataObjectsRequest struct {
+	Scope      FindScope                 `json:"scope"`
+	Class      string                    `json:"class,omitempty"`
+	State      string                    `json:"state,omitempty"`
+	Name       interface{}               `json:"name,omitempty"`
+	Tags       map[string][]string       `json:"tags,omitempty"`
+	Properties map[string][]interface{}  `json:"properties,omitempty"`
+	Created    map[string]int64          `json:"created,omitempty"`
+	Modified   map[string]int64          `json:"modified,omitempty"`
+	Describe   map[string]map[string]bool `json:"describe"`
+	Limit      int                       `json:"limit"`
+	Starting   json.RawMessage           `json:"starting,omitempty"`
+}
+
+type FindDataObjectsResult struct {
+	Id       string        `json:"id"`
+	Describe DxDescribeRaw `json:"describe"`
+}
+
+type FindDataObjectsReply struct {
+	Results []FindDataObjectsResult `json:"results"`
+	Next    json.RawMessage         `json:"next"`
+}
+
+func timeRange(after int64, before int64) map[string]int64 {
+	if after == 0 && before == 0 {
+		return nil
+	}
+	r := make(map[string]int64)
+	if after != 0 {
+		r["after"] = after
+	}
+	if before != 0 {
+		r["before"] = before
+	}
+	return r
+}
+
+func (q DxFindDataObjectsQuery) request() FindDataObjectsRequest {
+	req := FindDataObjectsRequest{
+		Scope : FindScope{
+			Project : q.ProjId,
+			Folder : q.Folder,
+			Recurse : q.Recurse,
+		},
+		Class : q.Class,
+		State : q.State,
+		Created : timeRange(q.CreatedAfter, q.CreatedBefore),
+		Modified : timeRange(q.ModifiedAfter, q.ModifiedBefore),
+		Describe : map[string]map[string]bool{
+			"fields" : describeFields(),
+		},
+		Limit : maxNumObjectsInFind,
+	}
+	if q.Name != "" {
+		req.Name = q.Name
+	} else if q.NameGlob != "" {
+		req.Name = map[string]string{ "glob" : q.NameGlob }
+	}
+	if len(q.Tags) > 0 {
+		req.Tags = map[string][]string{ "$and" : q.Tags }
+	}
+	if len(q.Properties) > 0 {
+		var conds []interface{}
+		for key, value := range q.Properties {
+			if value == "" {
+				// the property is present, with any value
+				conds = append(conds, map[string]bool{ key : true })
+			} else {
+				conds = append(conds, map[string]string{ key : value })
+			}
+		}
+		req.Properties = map[string][]interface{}{ "$and" : conds }
+	}
+	return req
+}
+
+// Find the data objects matching a query, and describe them. The results
+// come in pages, we keep asking until there are no more. Each page is passed
+// to [pageFn] as it arrives, so the caller does not need to hold all the results.
+func DxFindDataObjectsPages(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	dxEnv *dxda.DXEnvironment,
+	query DxFindDataObjectsQuery,
+	pageFn func([]DxDescribeDataObject) error) error {
+	request := query.request()
+
+	for {
+		payload, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		repJs, err := dxAPI(ctx, httpClient, NumRetries, dxEnv, "system/findDataObjects", string(payload))
+		if err != nil {
+			return err
+		}
+		var reply FindDataObjectsReply
+		if err := json.Unmarshal(repJs, &reply); err != nil {
+			return err
+		}
+		dxObjs := make([]DxDescribeDataObject, 0, len(reply.Results))
+		for _, result := range reply.Results {
+			desc := describeRawToObject(result.Describe)
+			if desc.Id == "" {
+				desc.Id = result.Id
+			}
+			dxObjs = append(dxObjs, desc)
+		}
+		if err := pageFn(dxObjs); err != nil {
+			return err
+		}
+
+		if len(reply.Next) == 0 || string(reply.Next) == "null" {
+			return nil
+		}
+		request.Starting = reply.Next
+	}
+}
+
+// Find all the data objects matching a query
+func DxFindDataObjects(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	dxEnv *dxda.DXEnvironment,
+	query DxFindDataObjectsQuery) ([]DxDescribeDataObject, error) {
+	var dxObjs []DxDescribeDataObject
+	err := DxFindDataObjectsPages(ctx, httpClient, dxEnv, query,
+		func(page []DxDescribeDataObject) error {
+			dxObjs = append(dxObjs, page...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return dxObjs, nil
+}
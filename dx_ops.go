@@ -39,6 +39,19 @@ func (ops *DxOps) log(a string, args ...interface{}) {
 	LogMsg("dx_ops", a, args...)
 }
 
+func (ops *DxOps) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "dx_ops", a, args...)
+}
+
+// write a log message, tagged with the correlation ID of the operation
+func (ops *DxOps) logCtx(ctx context.Context, level int, a string, args ...interface{}) {
+	LogMsgCtx(ctx, level, "dx_ops", a, args...)
+}
+
+func (ops *DxOps) logEnabled(level int) bool {
+	return LogEnabled("dx_ops", level)
+}
+
 
 type RequestFolderNew struct {
 	ProjId   string `json:"project"`
@@ -55,8 +68,8 @@ func (ops *DxOps) DxFolderNew(
 	httpClient *retryablehttp.Client,
 	projId string,
 	folder string) error {
-	if ops.options.Verbose {
-		ops.log("new-folder %s:%s", projId, folder)
+	if ops.logEnabled(LOG_DEBUG) {
+		ops.logCtx(ctx, LOG_DEBUG, "new-folder %s:%s", projId, folder)
 	}
 
 	var request RequestFolderNew
@@ -68,10 +81,10 @@ func (ops *DxOps) DxFolderNew(
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
+	repJs, err := dxAPI(
 		ctx,
 		httpClient,
-		NumRetriesDefault,
+		NumRetries,
 		&ops.dxEnv,
 		fmt.Sprintf("%s/newFolder", projId),
 		string(payload))
@@ -91,6 +104,7 @@ func (ops *DxOps) DxFolderNew(
 type RequestFolderRemove struct {
 	ProjId   string `json:"project"`
 	Folder   string `json:"folder"`
+	Recurse  bool   `json:"recurse"`
 }
 
 type ReplyFolderRemove struct {
@@ -101,23 +115,25 @@ func (ops *DxOps) DxFolderRemove(
 	ctx context.Context,
 	httpClient *retryablehttp.Client,
 	projId string,
-	folder string) error {
-	if ops.options.Verbose {
-		ops.log("remove-folder %s:%s", projId, folder)
+	folder string,
+	recurse bool) error {
+	if ops.logEnabled(LOG_DEBUG) {
+		ops.logCtx(ctx, LOG_DEBUG, "remove-folder %s:%s recurse=%t", projId, folder, recurse)
 	}
 
 	var request RequestFolderRemove
 	request.ProjId = projId
 	request.Folder = folder
+	request.Recurse = recurse
 
 	payload, err := json.Marshal(request)
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
+	repJs, err := dxAPI(
 		ctx,
 		httpClient,
-		NumRetriesDefault,
+		NumRetries,
 		&ops.dxEnv,
 		fmt.Sprintf("%s/removeFolder", projId),
 		string(payload))
@@ -149,8 +165,8 @@ func (ops *DxOps) DxRemoveObjects(
 	httpClient *retryablehttp.Client,
 	projId string,
 	objectIds []string) error {
-	if ops.options.Verbose {
-		ops.log("Removing %d objects from project %s", len(objectIds), projId)
+	if ops.logEnabled(LOG_DEBUG) {
+		ops.logCtx(ctx, LOG_DEBUG, "Removing %d objects from project %s", len(objectIds), projId)
 	}
 
 	var request RequestRemoveObjects
@@ -161,10 +177,10 @@ func (ops *DxOps) DxRemoveObjects(
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
+	repJs, err := dxAPI(
 		ctx,
 		httpClient,
-		NumRetriesDefault,
+		NumRetries,
 		&ops.dxEnv,
 		fmt.Sprintf("%s/removeObjects", projId),
 		string(payload))
@@ -199,8 +215,8 @@ func (ops *DxOps) DxFileNew(
 	projId string,
 	fname string,
 	folder string) (string, error) {
-	if ops.options.Verbose {
-		ops.log("file-new %s:%s/%s", projId, folder, fname)
+	if ops.logEnabled(LOG_DEBUG) {
+		ops.logCtx(ctx, LOG_DEBUG, "file-new %s:%s/%s", projId, folder, fname)
 	}
 
 	var request RequestNewFile
@@ -214,7 +230,7 @@ func (ops *DxOps) DxFileNew(
 	if err != nil {
 		return "", err
 	}
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, &ops.dxEnv, "file/new", string(payload))
+	repJs, err := dxAPI(ctx, httpClient, NumRetries, &ops.dxEnv, "file/new", string(payload))
 	if err != nil {
 		return "", err
 	}
@@ -232,14 +248,14 @@ func (ops *DxOps) DxFileCloseAndWait(
 	ctx context.Context,
 	httpClient *retryablehttp.Client,
 	fid string) error {
-	if ops.options.Verbose {
-		ops.log("file close-and-wait %s", fid)
+	if ops.logEnabled(LOG_DEBUG) {
+		ops.logCtx(ctx, LOG_DEBUG, "file close-and-wait %s", fid)
 	}
 
-	_, err := dxda.DxAPI(
+	_, err := dxAPI(
 		ctx,
 		httpClient,
-		NumRetriesDefault,
+		NumRetries,
 		&ops.dxEnv,
 		fmt.Sprintf("%s/close", fid),
 		"{}")
@@ -261,9 +277,9 @@ func (ops *DxOps) DxFileCloseAndWait(
 			return nil
 		case "closing":
 			// not done yet.
-			if ops.options.Verbose {
+			if ops.logEnabled(LOG_DEBUG) {
 				elapsed := time.Now().Sub(start)
-				ops.log("Waited %s for file %s to close", elapsed.String(), fid)
+				ops.logCtx(ctx, LOG_DEBUG, "Waited %s for file %s to close", elapsed.String(), fid)
 			}
 			time.Sleep(fileCloseWaitTime)
 
@@ -322,16 +338,16 @@ func (ops *DxOps) DxFileUploadPart(
 		return err
 	}
 
-	for i := 0; i < NumRetriesDefault; i++ {
-		replyJs, err := dxda.DxAPI(
+	for i := 0; i < NumRetries; i++ {
+		replyJs, err := dxAPI(
 			ctx,
 			httpClient,
-			NumRetriesDefault,
+			NumRetries,
 			&ops.dxEnv,
 			fmt.Sprintf("%s/upload", fileId),
 			string(reqJson))
 		if err != nil {
-			ops.log("DxFileUploadPart: error in dxapi call [%s/upload] %v",
+			ops.logAt(LOG_ERROR, "DxFileUploadPart: error in dxapi call [%s/upload] %v",
 				fileId, err.Error())
 			return err
 		}
@@ -342,14 +358,14 @@ func (ops *DxOps) DxFileUploadPart(
 		}
 
 		// bulk data upload
-		_, err = dxda.DxHttpRequest(ctx, httpClient, 1, "PUT", reply.Url, reply.Headers, data)
+		_, err = dxHttpRequest(ctx, httpClient, 1, "PUT", reply.Url, reply.Headers, data)
 		if err != nil {
 			if ops.isRetryableUploadError(err) {
 				// This is a retryable error, try again
-				ops.log("Retrying part upload, timeout expired")
+				ops.logAt(LOG_WARN, "Retrying part upload, timeout expired")
 				continue
 			}
-			ops.log("DxFileUploadPart: failure in data upload %s", err.Error())
+			ops.logAt(LOG_ERROR, "DxFileUploadPart: failure in data upload %s", err.Error())
 			return err
 		}
 	}
@@ -375,8 +391,8 @@ func (ops *DxOps) DxRename(
 	projId string,
 	fileId string,
 	newName string) error {
-	if ops.options.Verbose {
-		ops.log("file rename %s:%s %s", projId, fileId, newName)
+	if ops.logEnabled(LOG_DEBUG) {
+		ops.logCtx(ctx, LOG_DEBUG, "file rename %s:%s %s", projId, fileId, newName)
 	}
 
 	var request RequestRename
@@ -387,8 +403,8 @@ func (ops *DxOps) DxRename(
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, NumRetries, &ops.dxEnv,
 		fmt.Sprintf("%s/rename", fileId),
 		string(payload))
 	if err != nil {
@@ -425,8 +441,8 @@ func (ops *DxOps) DxMove(
 	folders   []string,
 	destination string) error {
 
-	if ops.options.Verbose {
-		ops.log("%s source folders=%v  -> %s", projId, folders, destination)
+	if ops.logEnabled(LOG_DEBUG) {
+		ops.logCtx(ctx, LOG_DEBUG, "%s source folders=%v  -> %s", projId, folders, destination)
 	}
 	var request RequestMove
 	request.Objects = objectIds
@@ -437,8 +453,8 @@ func (ops *DxOps) DxMove(
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, NumRetries, &ops.dxEnv,
 		fmt.Sprintf("%s/move", projId),
 		string(payload))
 	if err != nil {
@@ -478,8 +494,8 @@ func (ops *DxOps) DxRenameFolder(
 		return err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, NumRetries, &ops.dxEnv,
 		fmt.Sprintf("%s/renameFolder", projId),
 		string(payload))
 	if err != nil {
@@ -517,46 +533,79 @@ func (ops *DxOps) DxClone(
 	destProjId string,
 	destProjFolder string) (bool, error) {
 
-	var request RequestClone
 	objs := make([]string, 1)
 	objs[0] = srcId
-	request.Objects = objs
-	request.Folders = make([]string, 0)
+	reply, err := ops.DxCloneObjects(
+		ctx, httpClient, srcProjId, objs, nil, destProjId, destProjFolder)
+	if err != nil {
+		return false, err
+	}
+
+	for _,id := range reply.Exists {
+		if id == srcId {
+			// was not copied, because there is an existing
+			// copy in the destination project.
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+//  API method: /project-xxxx/clone
+//
+// Clone data objects and folders into a destination folder in another project. A folder
+// is cloned with its entire contents, and placed under the destination folder. Objects
+// that already exist in the destination project are not copied; they are reported in the
+// "exists" field of the reply.
+func (ops *DxOps) DxCloneObjects(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	srcProjId string,
+	objectIds []string,
+	folders []string,
+	destProjId string,
+	destProjFolder string) (ReplyClone, error) {
+	if ops.logEnabled(LOG_DEBUG) {
+		ops.logCtx(ctx, LOG_DEBUG, "clone %s objects=%v folders=%v -> %s:%s",
+			srcProjId, objectIds, folders, destProjId, destProjFolder)
+	}
+
+	var request RequestClone
+	request.Objects = objectIds
+	if request.Objects == nil {
+		request.Objects = make([]string, 0)
+	}
+	request.Folders = folders
+	if request.Folders == nil {
+		request.Folders = make([]string, 0)
+	}
 	request.Project = destProjId
 	request.Destination = destProjFolder
 	request.Parents = false
 
+	var reply ReplyClone
 	payload, err := json.Marshal(request)
 	if err != nil {
-		return false, err
+		return reply, err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, NumRetries, &ops.dxEnv,
 		fmt.Sprintf("%s/clone", srcProjId),
 		string(payload))
 	if err != nil {
-		return false, err
+		return reply, err
 	}
-
-	var reply ReplyClone
 	if err := json.Unmarshal(repJs, &reply); err != nil {
-		return false, err
-	}
-
-	for _,id := range reply.Exists {
-		if id == srcId {
-			// was not copied, because there is an existing
-			// copy in the destination project.
-			return false, nil
-		}
+		return reply, err
 	}
-
-	return true, nil
+	return reply, nil
 }
 
+// The project is left out when the object is itself a project
 type RequestSetProperties struct {
-	ProjId     string               `json:"project"`
+	ProjId     string               `json:"project,omitempty"`
 	Properties map[string](*string) `json:"properties"`
 }
 
@@ -580,8 +629,8 @@ func (ops *DxOps) DxSetProperties(
 		return err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, NumRetries, &ops.dxEnv,
 		fmt.Sprintf("%s/setProperties", objId),
 		string(payload))
 	if err != nil {
@@ -597,7 +646,7 @@ func (ops *DxOps) DxSetProperties(
 }
 
 type RequestAddTags struct {
-	ProjId    string  `json:"project"`
+	ProjId    string  `json:"project,omitempty"`
 	Tags    []string  `json:"tags"`
 }
 
@@ -621,8 +670,8 @@ func (ops *DxOps) DxAddTags(
 		return err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, NumRetries, &ops.dxEnv,
 		fmt.Sprintf("%s/addTags", objId),
 		string(payload))
 	if err != nil {
@@ -639,7 +688,7 @@ func (ops *DxOps) DxAddTags(
 
 
 type RequestRemoveTags struct {
-	ProjId    string  `json:"project"`
+	ProjId    string  `json:"project,omitempty"`
 	Tags    []string  `json:"tags"`
 }
 
@@ -663,8 +712,8 @@ func (ops *DxOps) DxRemoveTags(
 		return err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, NumRetries, &ops.dxEnv,
 		fmt.Sprintf("%s/removeTags", objId),
 		string(payload))
 	if err != nil {
@@ -678,3 +727,45 @@ func (ops *DxOps) DxRemoveTags(
 
 	return nil
 }
+
+type RequestUnarchive struct {
+	ProjId  string `json:"project"`
+}
+
+type ReplyUnarchive struct {
+	Id  string `json:"id"`
+}
+
+// Ask the platform to restore an archived file. This only starts the
+// process, the file becomes live hours later.
+func (ops *DxOps) DxUnarchive(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	projId string,
+	fileId string) error {
+	if ops.logEnabled(LOG_DEBUG) {
+		ops.logCtx(ctx, LOG_DEBUG, "unarchive %s:%s", projId, fileId)
+	}
+
+	var request RequestUnarchive
+	request.ProjId = projId
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	repJs, err := dxAPI(
+		ctx, httpClient, NumRetries, &ops.dxEnv,
+		fmt.Sprintf("%s/unarchive", fileId),
+		string(payload))
+	if err != nil {
+		return err
+	}
+
+	var reply ReplyUnarchive
+	if err := json.Unmarshal(repJs, &reply); err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package dxfuse
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,12 +9,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dnanexus/dxda"
 	"github.com/hashicorp/go-retryablehttp" // use http libraries from hashicorp for implement retry logic
@@ -30,6 +32,18 @@ const (
 	XATTR_TAG = "tag"
 	XATTR_PROP = "prop"
 	XATTR_BASE = "base"
+
+	// setting this attribute downloads the file to local disk
+	XATTR_MATERIALIZE = "base.materialize"
+
+	// setting this attribute to "live" unarchives the file
+	XATTR_ARCHIVAL_STATE = "base.archivalState"
+
+	// limit on the number of object descriptions kept for the base.* xattrs
+	maxNumExtendedDescribe = 10 * 1000
+
+	// how often an open checks if a file that is being written has closed
+	openFilePollInterval = 10 * time.Second
 )
 
 type Filesys struct {
@@ -60,6 +74,12 @@ type Filesys struct {
 	// prefetch state for all files
 	pgs *PrefetchGlobalState
 
+	// download URLs, shared by all handles to a file
+	urlCache *DownloadUrlCache
+
+	// files that are being unarchived
+	archival *ArchivalTracker
+
 	// sync daemon
 	sybx *SyncDbDx
 
@@ -72,6 +92,14 @@ type Filesys struct {
 	// description for each mounted project
 	projId2Desc map[string]DxDescribePrj
 
+	// project descriptions, with tags and properties, for the xattrs
+	// of directories that stand for projects. Filled in on first use.
+	projXattrs map[string]*DxDescribePrj
+
+	// object descriptions for the base.* xattrs of files. They are dropped
+	// when the object is renamed or moved, or its metadata is synced.
+	describeCache *DescribeCache
+
 	// all open files
 	fhCounter uint64
 	fhTable map[fuseops.HandleID]*FileHandle
@@ -82,11 +110,33 @@ type Filesys struct {
 
 	tmpFileCounter uint64
 
+	// files that are being downloaded to local disk, and the files
+	// whose last download failed
+	materializing map[int64]bool
+	materializeFailed map[int64]bool
+
+	// local copies of remote files that were downloaded
+	materialized *MaterializedCache
+
+	// the downloads run in the background, they are stopped on shutdown
+	materializeCtx    context.Context
+	materializeCancel context.CancelFunc
+	materializeWg     sync.WaitGroup
+
 	// is the the system shutting down (unmounting)
 	shutdownCalled bool
+
+	// Set when unmounting starts. Modifications are refused from this point,
+	// so that the pending uploads could be completed.
+	draining bool
+
+	// the files that were not uploaded, as of the last drain
+	drained   bool
+	leftovers []string
 }
 
-// Files can be in two access modes: remote-read-only or local-read-write
+// Files can be in several access modes: remote-read-only, local-read-write,
+// and a few read-only variants.
 const (
 	// read only file that is on the cloud
 	AM_RO_Remote = 1
@@ -94,6 +144,14 @@ const (
 	// file that has a local copy and can be modified.
 	// updates will be propagated with the background daemon.
 	AM_RW_Local = 2
+
+	// the description of an applet, workflow, record, or database,
+	// read when the file is opened.
+	AM_RO_Content = 3
+
+	// read only file that is on the cloud, and has a materialized
+	// copy on local disk.
+	AM_RO_Local = 4
 )
 
 type FileHandle struct {
@@ -103,33 +161,59 @@ type FileHandle struct {
 	size      int64   // this is up-to-date only for remote files
 	hid       fuseops.HandleID
 
-	// URL used for downloading file ranges.
-	// Used for read-only files.
+	// URL used for downloading symbolic links. Regular files
+	// get their URLs from the cache, on first read.
 	url      *DxDownloadURL
 
-	// A file-descriptor for files with a local copy
+	// The file and project used for getting a download URL.
+	// Empty for symbolic links.
+	fileId   string
+	projId   string
+
+	// has a download URL been requested for this handle
+	urlRequested bool
+
+	// A file-descriptor for files with a local copy, or
+	// a materialized copy
 	fd       *os.File
+
+	// The content of a file that stands for an object description
+	content  []byte
 }
 
+// An open directory. The entries are read from the database a batch
+// at a time, as the kernel asks for them.
 type DirHandle struct {
 	d Dir
-	entries []fuseutil.Dirent
+
+	// number of files whose download URLs were prefetched by the listing
+	numUrlPrefetch int
 }
 
 func NewDxfuse(
 	dxEnv dxda.DXEnvironment,
 	manifest Manifest,
 	options Options) (*Filesys, error) {
+	options.Tuning = options.Tuning.WithDefaults()
+	if err := options.Tuning.Validate(); err != nil {
+		return nil, err
+	}
 
 	// initialize a pool of http-clients.
-	httpIoPool := make(chan *retryablehttp.Client, HttpClientPoolSize)
-	for i:=0; i < HttpClientPoolSize; i++ {
+	httpIoPool := make(chan *retryablehttp.Client, options.Tuning.HttpClientPoolSize)
+	for i:=0; i < options.Tuning.HttpClientPoolSize; i++ {
 		httpIoPool <- dxda.NewHttpClient(true)
 	}
+	// A read-only filesystem keeps its metadata in memory, and does not
+	// need a writable state directory.
+	dbFullPath := DatabaseFile
+	if options.ReadOnly {
+		dbFullPath = DatabaseInMemory
+	}
 	fsys := &Filesys{
 		dxEnv : dxEnv,
 		options: options,
-		dbFullPath : DatabaseFile,
+		dbFullPath : dbFullPath,
 		mutex : &sync.Mutex{},
 		httpClientPool: httpIoPool,
 		ops : NewDxOps(dxEnv, options),
@@ -138,24 +222,33 @@ func NewDxfuse(
 		dhCounter : 1,
 		dhTable : make(map[fuseops.HandleID]*DirHandle),
 		tmpFileCounter : 0,
+		materializing : make(map[int64]bool),
+		materializeFailed : make(map[int64]bool),
+		materialized : NewMaterializedCache(options.Tuning.MaterializeCacheSize),
+		projXattrs : make(map[string]*DxDescribePrj),
+		describeCache : NewDescribeCache(maxNumExtendedDescribe),
 		shutdownCalled : false,
+		draining : false,
+		drained : false,
 	}
 
-	// Create a fresh SQL database
-	dbParentFolder := filepath.Dir(DatabaseFile)
-	if _, err := os.Stat(dbParentFolder); os.IsNotExist(err) {
-		os.Mkdir(dbParentFolder, 0755)
-	}
-	fsys.log("Removing old version of the database (%s)", DatabaseFile)
-	if err := os.RemoveAll(DatabaseFile); err != nil {
-		fsys.log("error removing old database %b", err)
-		os.Exit(1)
-	}
+	if !options.ReadOnly {
+		// Create a fresh SQL database
+		dbParentFolder := filepath.Dir(DatabaseFile)
+		if _, err := os.Stat(dbParentFolder); os.IsNotExist(err) {
+			os.Mkdir(dbParentFolder, 0755)
+		}
+		fsys.log("Removing old version of the database (%s)", DatabaseFile)
+		if err := os.RemoveAll(DatabaseFile); err != nil {
+			fsys.logAt(LOG_ERROR, "error removing old database %b", err)
+			os.Exit(1)
+		}
 
-	// Create a directory for new files
-	os.RemoveAll(CreatedFilesDir)
-	if _, err := os.Stat(CreatedFilesDir); os.IsNotExist(err) {
-		os.Mkdir(CreatedFilesDir, 0755)
+		// Create a directory for new files
+		os.RemoveAll(CreatedFilesDir)
+		if _, err := os.Stat(CreatedFilesDir); os.IsNotExist(err) {
+			os.Mkdir(CreatedFilesDir, 0755)
+		}
 	}
 
 	// create the metadata database
@@ -168,14 +261,24 @@ func NewDxfuse(
 		return nil, err
 	}
 
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(context.TODO())
 	if err := fsys.mdb.PopulateRoot(context.TODO(), oph, manifest); err != nil {
 		fsys.opClose(oph)
 		return nil, err
 	}
 	fsys.opClose(oph)
 
-	fsys.pgs = NewPrefetchGlobalState(options.VerboseLevel, dxEnv)
+	fsys.urlCache = NewDownloadUrlCache(dxEnv, options)
+	fsys.pgs = NewPrefetchGlobalState(dxEnv, fsys.urlCache, options.Tuning)
+	fsys.materializeCtx, fsys.materializeCancel = context.WithCancel(context.Background())
+	fsys.archival = NewArchivalTracker(dxEnv, fsys.mdb, fsys.mutex)
+
+	if options.ReadOnly {
+		// We don't need the project descriptions, the file upload module,
+		// or the command server.
+		fsys.log("read-only mount, the upload subsystem and command port are disabled")
+		return fsys, nil
+	}
 
 	// describe all the projects, we need their upload parameters
 	httpClient := <- fsys.httpClientPool
@@ -183,16 +286,11 @@ func NewDxfuse(
 		fsys.httpClientPool <- httpClient
 	} ()
 
-	if options.ReadOnly {
-		// we don't need the file upload module
-		return fsys, nil
-	}
-
 	projId2Desc := make(map[string]DxDescribePrj)
 	for _, d := range manifest.Directories {
 		pDesc, err := DxDescribeProject(context.TODO(), httpClient, &fsys.dxEnv, d.ProjId)
 		if err != nil {
-			fsys.log("Could not describe project %s, check permissions", d.ProjId)
+			fsys.logAt(LOG_ERROR, "Could not describe project %s, check permissions", d.ProjId)
 			return nil, err
 		}
 		projId2Desc[pDesc.Id] = *pDesc
@@ -200,10 +298,10 @@ func NewDxfuse(
 	fsys.projId2Desc = projId2Desc
 
 	// initialize sync daemon
-	fsys.sybx = NewSyncDbDx(options, dxEnv, projId2Desc, mdb, fsys.mutex)
+	fsys.sybx = NewSyncDbDx(options, dxEnv, projId2Desc, mdb, fsys.mutex, fsys.metadataSynced)
 
 	// create an endpoint for communicating with the user
-	fsys.cmdSrv = NewCmdServer(options, fsys.sybx)
+	fsys.cmdSrv = NewCmdServer(options, fsys.sybx, fsys)
 	fsys.cmdSrv.Init()
 
 	return fsys, nil
@@ -214,15 +312,63 @@ func (fsys *Filesys) log(a string, args ...interface{}) {
 	LogMsg("dxfuse", a, args...)
 }
 
-func (fsys *Filesys) Shutdown() {
+func (fsys *Filesys) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "dxfuse", a, args...)
+}
+
+// write a log message, tagged with the correlation ID of the operation
+func (fsys *Filesys) logCtx(ctx context.Context, level int, a string, args ...interface{}) {
+	LogMsgCtx(ctx, level, "dxfuse", a, args...)
+}
+
+func (fsys *Filesys) logEnabled(level int) bool {
+	return LogEnabled("dxfuse", level)
+}
+
+// Stop all the background threads, and close the database. Called after the
+// filesystem is unmounted. Returns the paths of files whose changes were not
+// uploaded to the platform.
+func (fsys *Filesys) Shutdown() []string {
 	if fsys.shutdownCalled {
 		// shutdown has already been called.
 		// We are not waiting for anything, and just
 		// unmounting the filesystem here.
 		fsys.log("Shutdown called a second time, skipping the normal sequence")
-		return
+		return nil
 	}
 	fsys.shutdownCalled = true
+	fsys.log("Shutting down dxfuse")
+
+	// close the command server, this frees up the port
+	if fsys.cmdSrv != nil {
+		fsys.cmdSrv.Close()
+	}
+
+	// Upload the pending changes, if this hasn't been done already. Then, stop
+	// the synchronization daemon. It uses the database, so it is stopped first.
+	fsys.mutex.Lock()
+	drained := fsys.drained
+	fsys.mutex.Unlock()
+	if !drained {
+		fsys.Drain()
+	}
+	workersStopped := true
+	if fsys.sybx != nil {
+		workersStopped = fsys.sybx.Shutdown()
+	}
+
+	// stop the downloads to local disk, they use the prefetch module
+	fsys.materializeCancel()
+	fsys.materializeWg.Wait()
+
+	// stop the running threads in the prefetch module
+	fsys.pgs.Shutdown()
+
+	// stop creating download URLs in the background
+	fsys.urlCache.Shutdown()
+
+	// stop following files that are being unarchived
+	fsys.archival.Shutdown()
 
 	// Close the sql database.
 	//
@@ -230,29 +376,59 @@ func (fsys *Filesys) Shutdown() {
 	// to do with it.
 	//
 	// We do not remove the metadata database file, so it could be inspected offline.
-	fsys.log("Shutting down dxfuse")
-
-	// stop any background operations the metadata database may be running.
+	if !workersStopped {
+		// the upload threads are still using the database. It is
+		// closed when the process exits.
+		fsys.logAt(LOG_WARN, "the upload threads are still running, leaving the database open")
+		return fsys.leftovers
+	}
 	fsys.mdb.Shutdown()
+	return fsys.leftovers
+}
 
-	// stop the running threads in the prefetch module
-	fsys.pgs.Shutdown()
-
-	// close the command server, this frees up the port
-	fsys.cmdSrv.Close()
+// Stop accepting modifications, and upload all the pending changes to the
+// platform, waiting up to the shutdown timeout. Returns the paths of files
+// whose changes were not uploaded; these are also written to the log.
+func (fsys *Filesys) Drain() []string {
+	fsys.mutex.Lock()
+	fsys.draining = true
+	fsys.mutex.Unlock()
 
-	// Stop the synchronization daemon. Do not complete
-	// outstanding operations.
-	if fsys.sybx != nil {
-		fsys.sybx.Shutdown()
+	if fsys.sybx == nil {
+		// read only filesystem, there is nothing to upload
+		fsys.mutex.Lock()
+		fsys.drained = true
+		fsys.mutex.Unlock()
+		return nil
+	}
+	timeout := fsys.options.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = ShutdownTimeoutDefault
+	}
+	leftovers := fsys.sybx.Drain(timeout)
+	fsys.mutex.Lock()
+	fsys.drained = true
+	fsys.leftovers = leftovers
+	fsys.mutex.Unlock()
+	if len(leftovers) > 0 {
+		fsys.logAt(LOG_WARN, "%d files have changes that were not uploaded to the platform:", len(leftovers))
+		for _, p := range leftovers {
+			fsys.logAt(LOG_WARN, "    %s", p)
+		}
 	}
+	return leftovers
 }
 
 // check if a user has sufficient permissions to read/write a project
 func (fsys *Filesys) checkProjectPermissions(projId string, requiredPerm int) bool {
 	if fsys.options.ReadOnly {
-		// if the filesystem is mounted read-only, we
-		// allow only operations that require VIEW level access
+		// The projects are not described on a read-only mount. We could
+		// list them, so we have at least VIEW level access.
+		return requiredPerm <= PERM_VIEW
+	}
+	if fsys.draining {
+		// if the filesystem is being unmounted, we allow only operations
+		// that require VIEW level access
 		if requiredPerm > PERM_VIEW {
 			return false
 		}
@@ -261,7 +437,97 @@ func (fsys *Filesys) checkProjectPermissions(projId string, requiredPerm int) bo
 	return pDesc.Level >= requiredPerm
 }
 
-func (fsys *Filesys) opOpen() *OpHandle {
+// Start the trace span of a filesystem operation, and assign it a
+// correlation ID. The inode and handle the operation refers to are
+// recorded as attributes, so it can be linked to the prefetch IOs
+// done on behalf of the handle.
+func (fsys *Filesys) startOp(ctx context.Context, name string, op interface{}) (context.Context, *Span) {
+	ctx = NewOpContext(ctx)
+	ctx, span := StartSpan(ctx, "Filesys." + name)
+	if span == nil {
+		return ctx, nil
+	}
+	switch x := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		span.SetAttr("dxfuse.inode", int64(x.Parent))
+		span.SetAttr("dxfuse.name", x.Name)
+	case *fuseops.GetInodeAttributesOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+	case *fuseops.SetInodeAttributesOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+	case *fuseops.ForgetInodeOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+	case *fuseops.MkDirOp:
+		span.SetAttr("dxfuse.inode", int64(x.Parent))
+		span.SetAttr("dxfuse.name", x.Name)
+	case *fuseops.RmDirOp:
+		span.SetAttr("dxfuse.inode", int64(x.Parent))
+		span.SetAttr("dxfuse.name", x.Name)
+	case *fuseops.CreateFileOp:
+		span.SetAttr("dxfuse.inode", int64(x.Parent))
+		span.SetAttr("dxfuse.name", x.Name)
+	case *fuseops.RenameOp:
+		span.SetAttr("dxfuse.inode", int64(x.OldParent))
+		span.SetAttr("dxfuse.name", x.OldName)
+	case *fuseops.UnlinkOp:
+		span.SetAttr("dxfuse.inode", int64(x.Parent))
+		span.SetAttr("dxfuse.name", x.Name)
+	case *fuseops.OpenDirOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+	case *fuseops.ReadDirOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+		span.SetAttr("dxfuse.handle_id", int64(x.Handle))
+	case *fuseops.ReadDirPlusOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+		span.SetAttr("dxfuse.handle_id", int64(x.Handle))
+	case *fuseops.ReleaseDirHandleOp:
+		span.SetAttr("dxfuse.handle_id", int64(x.Handle))
+	case *fuseops.OpenFileOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+	case *fuseops.ReadFileOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+		span.SetAttr("dxfuse.handle_id", int64(x.Handle))
+		span.SetAttr("dxfuse.offset", x.Offset)
+		span.SetAttr("dxfuse.size", len(x.Dst))
+	case *fuseops.WriteFileOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+		span.SetAttr("dxfuse.handle_id", int64(x.Handle))
+		span.SetAttr("dxfuse.offset", x.Offset)
+		span.SetAttr("dxfuse.size", len(x.Data))
+	case *fuseops.FlushFileOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+		span.SetAttr("dxfuse.handle_id", int64(x.Handle))
+	case *fuseops.SyncFileOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+		span.SetAttr("dxfuse.handle_id", int64(x.Handle))
+	case *fuseops.ReleaseFileHandleOp:
+		span.SetAttr("dxfuse.handle_id", int64(x.Handle))
+	case *fuseops.GetXattrOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+		span.SetAttr("dxfuse.xattr", x.Name)
+	case *fuseops.SetXattrOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+		span.SetAttr("dxfuse.xattr", x.Name)
+	case *fuseops.RemoveXattrOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+		span.SetAttr("dxfuse.xattr", x.Name)
+	case *fuseops.ListXattrOp:
+		span.SetAttr("dxfuse.inode", int64(x.Inode))
+	}
+	return ctx, span
+}
+
+// Acquire the global lock. The time spent waiting for it is recorded
+// in a span.
+func (fsys *Filesys) lockOp(ctx context.Context) {
+	_, span := StartSpan(ctx, "Filesys.mutex_wait")
+	fsys.mutex.Lock()
+	span.End()
+}
+
+// The transaction records its statements as children of the span
+// held by the context, if any.
+func (fsys *Filesys) opOpen(ctx context.Context) *OpHandle {
 	txn, err := fsys.mdb.BeginTxn()
 	if err != nil {
 		log.Panic("Could not open transaction")
@@ -270,12 +536,12 @@ func (fsys *Filesys) opOpen() *OpHandle {
 
 	return &OpHandle{
 		httpClient : httpClient,
-		txn : txn,
+		txn : NewTracedTx(ctx, txn),
 		err : nil,
 	}
 }
 
-func (fsys *Filesys) opOpenNoHttpClient() *OpHandle {
+func (fsys *Filesys) opOpenNoHttpClient(ctx context.Context) *OpHandle {
 	txn, err := fsys.mdb.BeginTxn()
 	if err != nil {
 		log.Panic("Could not open transaction")
@@ -283,7 +549,7 @@ func (fsys *Filesys) opOpenNoHttpClient() *OpHandle {
 
 	return &OpHandle{
 		httpClient : nil,
-		txn : txn,
+		txn : NewTracedTx(ctx, txn),
 		err : nil,
 	}
 }
@@ -293,6 +559,11 @@ func (fsys *Filesys) opClose(oph *OpHandle) {
 		fsys.httpClientPool <- oph.httpClient
 	}
 
+	defer fsys.mdb.EndTxn()
+
+	// mark the operation as failed in the trace
+	SpanFromContext(oph.txn.ctx).SetError(oph.err)
+
 	if oph.err == nil {
 		err := oph.txn.Commit()
 		if err != nil {
@@ -319,7 +590,7 @@ func (fsys *Filesys) dxErrorToFilesystemError(dxErr dxda.DxError) error {
 	case "Unauthorized":
 		return syscall.EPERM
 	default:
-		fsys.log("unexpected dnanexus error type (%s), returning EIO which will unmount the filesystem",
+		fsys.logAt(LOG_ERROR, "unexpected dnanexus error type (%s), returning EIO which will unmount the filesystem",
 			dxErr.EType)
 		return fuse.EIO
 	}
@@ -333,12 +604,15 @@ func (fsys *Filesys) translateError(err error) error {
 		return fsys.dxErrorToFilesystemError(*dxErr)
 	default:
 		// A "regular" error
-		fsys.log("A regular error from an API call %s, converting to EIO", err.Error())
+		fsys.logAt(LOG_ERROR, "A regular error from an API call %s, converting to EIO", err.Error())
 		return fuse.EIO
 	}
 }
 
 func (fsys *Filesys) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
+	ctx, span := fsys.startOp(ctx, "StatFS", op)
+	defer span.End()
+
 	//return fuse.ENOSYS
 	return nil
 }
@@ -347,8 +621,8 @@ func (fsys *Filesys) calcExpirationTime(a fuseops.InodeAttributes) time.Time {
 	if !a.Mode.IsDir() && a.Mode != 0444 {
 		// A file created locally. It is probably being written to,
 		// so there is no sense in caching for a long time
-		if fsys.options.Verbose {
-			fsys.log("Setting small attribute expiration time")
+		if fsys.logEnabled(LOG_DEBUG) {
+			fsys.logAt(LOG_DEBUG, "Setting small attribute expiration time")
 		}
 
 		return time.Now().Add(1 * time.Second)
@@ -359,15 +633,38 @@ func (fsys *Filesys) calcExpirationTime(a fuseops.InodeAttributes) time.Time {
 	return time.Now().Add(365 * 24 * time.Hour)
 }
 
+// The attributes of some remote objects are cached only briefly. A file that
+// is not closed yet gets its final size when it closes, and an object shown as
+// its description is sized when it is first opened.
+func (fsys *Filesys) calcExpirationTimeObj(a fuseops.InodeAttributes, state string, kind int) time.Time {
+	if (state != "" && state != "closed") ||
+		(isDescribedKind(kind) && a.Size == 0) {
+		return time.Now().Add(1 * time.Second)
+	}
+	return fsys.calcExpirationTime(a)
+}
+
+func nodeStateKind(node Node) (string, int) {
+	if file, ok := node.(File); ok {
+		return file.State, file.Kind
+	}
+	return "", 0
+}
+
 func (fsys *Filesys) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "LookUpInode", op)
+	defer span.End()
+	if err := fsys.populateDir(ctx, int64(op.Parent)); err != nil {
+		return err
+	}
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
 	parentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.Parent))
 	if err != nil {
-		fsys.log("database error in LookupInode: %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in LookupInode: %s", err.Error())
 		return fuse.EIO
 	}
 	if !ok {
@@ -377,7 +674,7 @@ func (fsys *Filesys) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp)
 
 	node, ok, err := fsys.mdb.LookupInDir(ctx, oph, &parentDir, op.Name)
 	if err != nil {
-		fsys.log("database error in LookUpInode: %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in LookUpInode: %s", err.Error())
 		return fuse.EIO
 	}
 	if !ok {
@@ -391,34 +688,39 @@ func (fsys *Filesys) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp)
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = fsys.calcExpirationTime(op.Entry.Attributes)
+	state, kind := nodeStateKind(node)
+	op.Entry.AttributesExpiration = fsys.calcExpirationTimeObj(op.Entry.Attributes, state, kind)
 	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
 
 	return nil
 }
 
 func (fsys *Filesys) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "GetInodeAttributes", op)
+	defer span.End()
+
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
 	// Grab the inode.
 	node, ok, err := fsys.mdb.LookupByInode(ctx, oph, int64(op.Inode))
 	if err != nil {
-		fsys.log("database error in GetInodeAttributes: %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in GetInodeAttributes: %s", err.Error())
 		return fuse.EIO
 	}
 	if !ok {
 		return fuse.ENOENT
 	}
-	if fsys.options.Verbose {
-		fsys.log("GetInodeAttributes(inode=%d, %v)", int64(op.Inode), node)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "GetInodeAttributes(inode=%d, %v)", int64(op.Inode), node)
 	}
 
 	// Fill in the response.
 	op.Attributes = node.GetAttrs()
-	op.AttributesExpiration = fsys.calcExpirationTime(op.Attributes)
+	state, kind := nodeStateKind(node)
+	op.AttributesExpiration = fsys.calcExpirationTimeObj(op.Attributes, state, kind)
 
 	return nil
 }
@@ -426,22 +728,29 @@ func (fsys *Filesys) GetInodeAttributes(ctx context.Context, op *fuseops.GetInod
 // if the file is writable, we can modify some of the attributes.
 // otherwise, this is a permission error.
 func (fsys *Filesys) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "SetInodeAttributes", op)
+	defer span.End()
+
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
+	if fsys.draining {
+		return syscall.EROFS
+	}
+
 	// Grab the inode.
 	node, ok, err := fsys.mdb.LookupByInode(ctx, oph, int64(op.Inode))
 	if err != nil {
-		fsys.log("SetInodeAttributes: database error %s", err.Error())
+		fsys.logAt(LOG_ERROR, "SetInodeAttributes: database error %s", err.Error())
 		return fuse.EIO
 	}
 	if !ok {
 		return fuse.ENOENT
 	}
-	if fsys.options.Verbose {
-		fsys.log("SetInodeAttributes(inode=%d, %v)", int64(op.Inode), node)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "SetInodeAttributes(inode=%d, %v)", int64(op.Inode), node)
 	}
 
 	var file File
@@ -477,14 +786,17 @@ func (fsys *Filesys) SetInodeAttributes(ctx context.Context, op *fuseops.SetInod
 	// we don't handle atime
 	err = fsys.mdb.UpdateFileAttrs(ctx, oph, file.Inode, int64(attrs.Size), attrs.Mtime, &attrs.Mode);
 	if err != nil {
-		fsys.log("database error in OpenFile %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in OpenFile %s", err.Error())
 		return fuse.EIO
 	}
 
+	if op.Size != nil && fsys.sybx != nil {
+		fsys.sybx.StreamSetSize(file.Inode, int64(*op.Size))
+	}
 	if op.Size != nil && *op.Size != oldSize {
 		// The size changed, truncate the file
 		if err := os.Truncate(file.LocalPath, int64(*op.Size)); err != nil {
-			fsys.log("Error truncating inode=%d from %d to %d",
+			fsys.logAt(LOG_ERROR, "Error truncating inode=%d from %d to %d",
 				op.Inode, oldSize, op.Size)
 			return err
 		}
@@ -528,11 +840,14 @@ func (fsys *Filesys) removeDirHandlesWithInode(inode int64) {
 // This may be the wrong way to do it. We may need to actually delete the inode at this point,
 // instead of inside RmDir/Unlink.
 func (fsys *Filesys) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "ForgetInode", op)
+	defer span.End()
+
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
 
-	if fsys.options.Verbose {
-		fsys.log("ForgetInode (%d)", op.Inode)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "ForgetInode (%d)", op.Inode)
 	}
 
 	fsys.removeFileHandlesWithInode(int64(op.Inode))
@@ -542,30 +857,39 @@ func (fsys *Filesys) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp)
 }
 
 func (fsys *Filesys) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "MkDir", op)
+	defer span.End()
+	if err := fsys.populateDir(ctx, int64(op.Parent)); err != nil {
+		return err
+	}
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("CreateDir(%s)", op.Name)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "CreateDir(%s)", op.Name)
 	}
 
 	// the parent is supposed to be a directory
 	parentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.Parent))
 	if err != nil {
-		fsys.log("database error in MkDir")
+		fsys.logAt(LOG_ERROR, "database error in MkDir")
 		return fuse.EIO
 	}
 	if !ok {
 		// parent directory does not exist
 		return fuse.ENOENT
 	}
+	if parentDir.faux {
+		// faux directories, and databases, have no project folder
+		return syscall.EPERM
+	}
 
 	// Check if the directory exists
 	_, ok, err = fsys.mdb.LookupInDir(ctx, oph, &parentDir, op.Name)
 	if err != nil {
-		fsys.log("database error in MkDir")
+		fsys.logAt(LOG_ERROR, "database error in MkDir")
 		return fuse.EIO
 	}
 	if ok {
@@ -584,7 +908,7 @@ func (fsys *Filesys) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
 	folderFullPath := parentDir.ProjFolder + "/" + op.Name
 	err = fsys.ops.DxFolderNew(ctx, oph.httpClient, parentDir.ProjId, folderFullPath)
 	if err != nil {
-		fsys.log("Error in creating directory (%s:%s) on dnanexus: %s",
+		fsys.logAt(LOG_ERROR, "Error in creating directory (%s:%s) on dnanexus: %s",
 			parentDir.ProjId, folderFullPath, err.Error())
 		oph.RecordError(err)
 		return fsys.translateError(err)
@@ -602,7 +926,7 @@ func (fsys *Filesys) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
 		mode,
 		parentDir.FullPath + "/" + op.Name)
 	if err != nil {
-		fsys.log("database error in MkDir")
+		fsys.logAt(LOG_ERROR, "database error in MkDir")
 		return fuse.EIO
 	}
 
@@ -629,19 +953,24 @@ func (fsys *Filesys) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
 
 
 func (fsys *Filesys) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "RmDir", op)
+	defer span.End()
+	if err := fsys.populateChildDir(ctx, int64(op.Parent), op.Name); err != nil {
+		return err
+	}
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("RemoveDir(%s)", op.Name)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "RemoveDir(%s)", op.Name)
 	}
 
 	// the parent is supposed to be a directory
 	parentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.Parent))
 	if err != nil {
-		fsys.log("database error in RmDir")
+		fsys.logAt(LOG_ERROR, "database error in RmDir")
 		return fuse.EIO
 	}
 	if !ok {
@@ -652,7 +981,7 @@ func (fsys *Filesys) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 	// Check if the directory exists
 	childNode, ok, err := fsys.mdb.LookupInDir(ctx, oph, &parentDir, op.Name)
 	if err != nil {
-		fsys.log("database error in RmDir")
+		fsys.logAt(LOG_ERROR, "database error in RmDir")
 		return fuse.EIO
 	}
 	if !ok {
@@ -672,19 +1001,19 @@ func (fsys *Filesys) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 	}
 
 	// check that the directory is empty
-	dentries, err := fsys.readEntireDir(ctx, oph, childDir)
+	empty, err := fsys.dirIsEmpty(ctx, oph, childDir)
 	if err != nil {
 		return err
 	}
-	if len(dentries) > 0 {
+	if !empty {
 		return fuse.ENOTEMPTY
 	}
 	if !childDir.faux {
 		// The directory exists and is empty, we can remove it.
 		folderFullPath := parentDir.ProjFolder + "/" + op.Name
-		err = fsys.ops.DxFolderRemove(ctx, oph.httpClient, parentDir.ProjId, folderFullPath)
+		err = fsys.ops.DxFolderRemove(ctx, oph.httpClient, parentDir.ProjId, folderFullPath, false)
 		if err != nil {
-			fsys.log("Error in removing directory (%s:%s) on dnanexus: %s",
+			fsys.logAt(LOG_ERROR, "Error in removing directory (%s:%s) on dnanexus: %s",
 				parentDir.ProjId, folderFullPath, err.Error())
 			oph.RecordError(err)
 			return fsys.translateError(err)
@@ -722,24 +1051,52 @@ func (fsys *Filesys) insertIntoDirHandleTable(dh *DirHandle) fuseops.HandleID {
 	return did
 }
 
+// The longest file name we add to a local path. The counter prefix
+// keeps the paths unique, and the total below NAME_MAX (255 bytes).
+const maxLocalNameLen = 200
+
 // Create a file in a protected directory, used only
 // by dxfuse.
 func (fsys *Filesys) createLocalPath(filename string) string {
 	cnt := atomic.AddUint64(&fsys.tmpFileCounter, 1)
-	localPath := fmt.Sprintf("%s/%d_%s", CreatedFilesDir, cnt)
+	if len(filename) > maxLocalNameLen {
+		// do not cut a multi-byte character in half
+		end := maxLocalNameLen
+		for end > 0 && !utf8.RuneStart(filename[end]) {
+			end--
+		}
+		filename = filename[:end]
+	}
+	localPath := fmt.Sprintf("%s/%d_%s", CreatedFilesDir, cnt, filename)
 	return localPath
 }
 
+// Copy a local file into an open file descriptor
+func copyLocalFile(srcPath string, dst *os.File) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
 // A CreateRequest asks to create and open a file (not a directory).
 //
 func (fsys *Filesys) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "CreateFile", op)
+	defer span.End()
+	if err := fsys.populateDir(ctx, int64(op.Parent)); err != nil {
+		return err
+	}
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("CreateFile(%s)", op.Name)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "CreateFile(%s)", op.Name)
 	}
 
 	// the parent is supposed to be a directory
@@ -819,10 +1176,18 @@ func (fsys *Filesys) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) e
 		fd : writer,
 	}
 	op.Handle = fsys.insertIntoFileHandleTable(&fh)
+
+	if fsys.sybx != nil && fsys.options.StreamingUpload {
+		// upload the file while it is being written
+		fsys.sybx.StreamOpen(file.Inode, op.Handle, parentDir.ProjId, localPath)
+	}
 	return nil
 }
 
 func (fsys *Filesys) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) error {
+	ctx, span := fsys.startOp(ctx, "CreateLink", op)
+	defer span.End()
+
 	// not supporting creation of hard links now
 	return fuse.ENOSYS
 }
@@ -836,7 +1201,7 @@ func (fsys *Filesys) renameFile(
 	newName string) error {
 	err := fsys.mdb.MoveFile(ctx, oph, file.Inode, newParentDir, newName)
 	if err != nil {
-		fsys.log("database error in rename")
+		fsys.logAt(LOG_ERROR, "database error in rename")
 		return fuse.EIO
 	}
 
@@ -850,7 +1215,7 @@ func (fsys *Filesys) renameFile(
 		// /file-xxxx/rename  API call
 		err := fsys.ops.DxRename(ctx, oph.httpClient, file.ProjId, file.Id, newName)
 		if err != nil {
-			fsys.log("Error in renaming file (%s:%s%s) on dnanexus: %s",
+			fsys.logAt(LOG_ERROR, "Error in renaming file (%s:%s%s) on dnanexus: %s",
 				file.ProjId, oldParentDir.ProjFolder, file.Name,
 				err.Error())
 			oph.RecordError(err)
@@ -865,7 +1230,7 @@ func (fsys *Filesys) renameFile(
 		err := fsys.ops.DxMove(ctx, oph.httpClient, file.ProjId,
 			objIds, nil, newParentDir.ProjFolder)
 		if err != nil {
-			fsys.log("Error in moving file (%s:%s/%s) on dnanexus: %s",
+			fsys.logAt(LOG_ERROR, "Error in moving file (%s:%s/%s) on dnanexus: %s",
 				file.ProjId, oldParentDir.ProjFolder, file.Name,
 				err.Error())
 			oph.RecordError(err)
@@ -873,6 +1238,7 @@ func (fsys *Filesys) renameFile(
 		}
 	}
 
+	fsys.describeCacheDrop(file.ProjId, file.Id)
 	return nil
 }
 
@@ -893,7 +1259,7 @@ func (fsys *Filesys) renameDir(
 			oldDir.ProjFolder,
 			newName)
 		if err != nil {
-			fsys.log("Error in folder rename %s -> %s on dnanexus, %s",
+			fsys.logAt(LOG_ERROR, "Error in folder rename %s -> %s on dnanexus, %s",
 				oldDir.FullPath, newName, err.Error())
 			oph.RecordError(err)
 			return fsys.translateError(err)
@@ -917,7 +1283,7 @@ func (fsys *Filesys) renameDir(
 			objIds, folders,
 			newParentDir.ProjFolder)
 		if err != nil {
-			fsys.log("Error in moving directory %s:%s -> %s on dnanexus: %s",
+			fsys.logAt(LOG_ERROR, "Error in moving directory %s:%s -> %s on dnanexus: %s",
 				projId, oldDir.ProjFolder, newParentDir.ProjFolder,
 				err.Error())
 			oph.RecordError(err)
@@ -927,22 +1293,282 @@ func (fsys *Filesys) renameDir(
 
 	err := fsys.mdb.MoveDir(ctx, oph, oldParentDir, newParentDir, oldDir, newName)
 	if err != nil {
-		fsys.log("Database error in moving directory %s -> %s/%s",
+		fsys.logAt(LOG_ERROR, "Database error in moving directory %s -> %s/%s",
+			oldDir.FullPath, newParentDir.FullPath, newName)
+		return fuse.EIO
+	}
+
+	fsys.describeCacheDropProject(projId)
+	return nil
+}
+
+// Files were moved to another project. Download URLs are created in the context
+// of a project, so the cached URLs are dropped, and the open handles switch
+// to the new project. Called with the global lock held.
+func (fsys *Filesys) filesMovedToProject(fileIds map[int64]string, projId string) {
+	for _, fileId := range fileIds {
+		fsys.urlCache.Invalidate(fileId)
+	}
+	for hid, fh := range fsys.fhTable {
+		if _, ok := fileIds[fh.inode]; !ok || fh.projId == "" {
+			continue
+		}
+		fh.projId = projId
+		fsys.pgs.UpdateStreamProject(hid, projId)
+	}
+}
+
+// Undo a partial cross project move, by removing the copies made in the
+// destination project. Failures are logged, because there isn't much else
+// we can do about them.
+func (fsys *Filesys) rollbackClone(
+	ctx context.Context,
+	oph *OpHandle,
+	destProjId string,
+	objIds []string,
+	destFolder string) {
+	if len(objIds) > 0 {
+		err := fsys.ops.DxRemoveObjects(ctx, oph.httpClient, destProjId, objIds)
+		if err != nil {
+			fsys.logAt(LOG_ERROR, "Rollback failed, could not remove the copies of %v from project %s: %s",
+				objIds, destProjId, err.Error())
+		}
+	}
+	if destFolder != "" {
+		err := fsys.ops.DxFolderRemove(ctx, oph.httpClient, destProjId, destFolder, true)
+		if err != nil {
+			fsys.logAt(LOG_ERROR, "Rollback failed, could not remove folder %s:%s: %s",
+				destProjId, destFolder, err.Error())
+		}
+	}
+}
+
+// Move a file to a directory in a different project. The file is cloned into
+// the destination, renamed if needed, and then removed from the source project.
+// The file-id does not change. If any step fails, the copy in the destination
+// project is removed.
+//
+// Without CONTRIBUTE access to the source project, the file cannot be removed
+// from it. The move is then a copy; the mount shows the original in its
+// directory, as well as the copy.
+func (fsys *Filesys) renameFileAcrossProjects(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	file File,
+	newName string) error {
+	err := fsys.mdb.MoveFile(ctx, oph, file.Inode, newParentDir, newName)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "database error in rename")
+		return fuse.EIO
+	}
+
+	if file.Id == "" {
+		// The file exists only locally. It will be uploaded to the
+		// new project by the sync daemon.
+		return nil
+	}
+
+	srcProjId := file.ProjId
+	destProjId := newParentDir.ProjId
+	objIds := []string{ file.Id }
+	reply, err := fsys.ops.DxCloneObjects(
+		ctx, oph.httpClient, srcProjId, objIds, nil, destProjId, newParentDir.ProjFolder)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Error in cloning file %s from %s to %s:%s: %s",
+			file.Id, srcProjId, destProjId, newParentDir.ProjFolder, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	if len(reply.Exists) > 0 {
+		// The file is already in the destination project, in some other
+		// folder. We can't move it without disturbing the existing copy.
+		fsys.logAt(LOG_WARN, "File %s already exists in project %s, can not move it there",
+			file.Id, destProjId)
+		oph.RecordError(syscall.EEXIST)
+		return syscall.EEXIST
+	}
+
+	if newName != file.Name {
+		err := fsys.ops.DxRename(ctx, oph.httpClient, destProjId, file.Id, newName)
+		if err != nil {
+			fsys.logAt(LOG_ERROR, "Error in renaming file (%s:%s) to %s after clone: %s",
+				destProjId, file.Id, newName, err.Error())
+			fsys.rollbackClone(ctx, oph, destProjId, objIds, "")
+			oph.RecordError(err)
+			return fsys.translateError(err)
+		}
+	}
+
+	if fsys.checkProjectPermissions(srcProjId, PERM_CONTRIBUTE) {
+		err = fsys.ops.DxRemoveObjects(ctx, oph.httpClient, srcProjId, objIds)
+	} else {
+		err = fsys.restoreCopiedFile(ctx, oph, oldParentDir, file)
+	}
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Error in removing file (%s:%s%s) after cloning it to %s: %s",
+			srcProjId, oldParentDir.ProjFolder, file.Name, destProjId, err.Error())
+		fsys.rollbackClone(ctx, oph, destProjId, objIds, "")
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+
+	fsys.describeCacheDrop(srcProjId, file.Id)
+	fsys.filesMovedToProject(map[int64]string{ file.Inode : file.Id }, destProjId)
+	return nil
+}
+
+// The source of a copy between projects is still on the platform, show
+// it in its directory again. It is described, because the file may
+// have been modified locally.
+func (fsys *Filesys) restoreCopiedFile(ctx context.Context, oph *OpHandle, dir Dir, file File) error {
+	fsys.logAt(LOG_INFO, "No permission to remove (%s:%s), it was copied", file.ProjId, file.Id)
+	desc, err := DxDescribe(ctx, oph.httpClient, &fsys.dxEnv, file.Id)
+	if err != nil {
+		return err
+	}
+	desc.Name = file.Name
+	if err := fsys.mdb.RestoreCopiedFile(ctx, oph, dir, desc); err != nil {
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Move a directory to a different project. The folder is cloned, with all of its
+// contents, into the destination. It is then renamed if needed, and the source
+// folder is removed. Files that have not been uploaded yet are moved in the
+// database only.
+//
+// Without CONTRIBUTE access to the source project, the folder is copied, and
+// the source folder stays. It is read again from the platform when accessed.
+func (fsys *Filesys) renameDirAcrossProjects(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	oldDir Dir,
+	newName string) error {
+	srcProjId := oldParentDir.ProjId
+	destProjId := newParentDir.ProjId
+
+	// The clone merges into an existing folder, that the database may not
+	// know about. A rollback removes the cloned folder recursively, so it
+	// has to be one that the clone created.
+	destFolder := filepath.Join(newParentDir.ProjFolder, oldDir.Dname)
+	exists, err := DxFolderExists(ctx, oph.httpClient, &fsys.dxEnv, destProjId, destFolder)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Error in checking for folder %s:%s: %s", destProjId, destFolder, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	if exists {
+		fsys.logAt(LOG_WARN, "Can not move directory %s to project %s, folder %s already exists there",
+			oldDir.FullPath, destProjId, destFolder)
+		oph.RecordError(syscall.EEXIST)
+		return syscall.EEXIST
+	}
+
+	// the files that are moved, for updating their handles
+	fileIds, err := fsys.mdb.SubtreeFileIds(ctx, oph, oldDir)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Database error in moving directory %s: %s", oldDir.FullPath, err.Error())
+		return fuse.EIO
+	}
+
+	err = fsys.mdb.MoveDir(ctx, oph, oldParentDir, newParentDir, oldDir, newName)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Database error in moving directory %s -> %s/%s",
 			oldDir.FullPath, newParentDir.FullPath, newName)
 		return fuse.EIO
 	}
 
+	folders := []string{ oldDir.ProjFolder }
+	reply, err := fsys.ops.DxCloneObjects(
+		ctx, oph.httpClient, srcProjId, nil, folders, destProjId, newParentDir.ProjFolder)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Error in cloning folder %s:%s to %s:%s: %s",
+			srcProjId, oldDir.ProjFolder, destProjId, newParentDir.ProjFolder, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+
+	if len(reply.Exists) > 0 {
+		// Some of the files are already in the destination project. They
+		// were not copied, so the new folder is incomplete.
+		fsys.logAt(LOG_WARN, "Can not move directory %s to project %s, %d files already exist there: %v",
+			oldDir.FullPath, destProjId, len(reply.Exists), reply.Exists)
+		fsys.rollbackClone(ctx, oph, destProjId, nil, destFolder)
+		oph.RecordError(syscall.EEXIST)
+		return syscall.EEXIST
+	}
+
+	if newName != oldDir.Dname {
+		err := fsys.ops.DxRenameFolder(ctx, oph.httpClient, destProjId, destFolder, newName)
+		if err != nil {
+			fsys.logAt(LOG_ERROR, "Error in renaming folder %s:%s to %s after clone: %s",
+				destProjId, destFolder, newName, err.Error())
+			fsys.rollbackClone(ctx, oph, destProjId, nil, destFolder)
+			oph.RecordError(err)
+			return fsys.translateError(err)
+		}
+		destFolder = filepath.Join(newParentDir.ProjFolder, newName)
+	}
+
+	if fsys.checkProjectPermissions(srcProjId, PERM_CONTRIBUTE) {
+		err = fsys.ops.DxFolderRemove(ctx, oph.httpClient, srcProjId, oldDir.ProjFolder, true)
+	} else {
+		fsys.logAt(LOG_INFO, "No permission to remove %s:%s, it was copied to %s:%s",
+			srcProjId, oldDir.ProjFolder, destProjId, destFolder)
+		if err = fsys.mdb.RestoreCopiedDir(ctx, oph, oldDir); err != nil {
+			err = fuse.EIO
+		}
+	}
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Error in removing folder %s:%s after cloning it to %s:%s: %s",
+			srcProjId, oldDir.ProjFolder, destProjId, destFolder, err.Error())
+		fsys.rollbackClone(ctx, oph, destProjId, nil, destFolder)
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+
+	for _, fileId := range fileIds {
+		fsys.describeCacheDrop(srcProjId, fileId)
+	}
+	fsys.filesMovedToProject(fileIds, destProjId)
 	return nil
 }
 
+// A database is shown as a faux directory, holding its description.
+func (fsys *Filesys) isDatabaseDir(ctx context.Context, oph *OpHandle, dir Dir) (bool, error) {
+	if !dir.faux {
+		return false, nil
+	}
+	node, ok, err := fsys.mdb.LookupInDir(ctx, oph, &dir, databaseDescribeFile)
+	if err != nil || !ok {
+		return false, err
+	}
+	file, isFile := node.(File)
+	return isFile && file.Kind == FK_Database, nil
+}
+
 func (fsys *Filesys) Rename(ctx context.Context, op *fuseops.RenameOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "Rename", op)
+	defer span.End()
+	// A target directory is replaced only if it is empty, it is read too
+	if err := fsys.populateDir(ctx, int64(op.OldParent)); err != nil {
+		return err
+	}
+	if err := fsys.populateChildDir(ctx, int64(op.NewParent), op.NewName); err != nil {
+		return err
+	}
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("Rename (inode=%d name=%s) -> (inode=%d, name=%s)",
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "Rename (inode=%d name=%s) -> (inode=%d, name=%s)",
 			op.OldParent, op.OldName,
 			op.NewParent, op.NewName)
 	}
@@ -967,7 +1593,7 @@ func (fsys *Filesys) Rename(ctx context.Context, op *fuseops.RenameOp) error {
 		return fuse.ENOENT
 	}
 	if newParentDir.faux {
-		fsys.log("can not move files into a faux dir")
+		fsys.logAt(LOG_WARN, "can not move files into a faux dir")
 		return syscall.EPERM
 	}
 
@@ -981,75 +1607,264 @@ func (fsys *Filesys) Rename(ctx context.Context, op *fuseops.RenameOp) error {
 		return fuse.ENOENT
 	}
 
-	// check if the target exists.
-	_, ok, err = fsys.mdb.LookupInDir(ctx, oph, &newParentDir, op.NewName)
+	// check if the target exists. If so, it is replaced.
+	targetNode, targetExists, err := fsys.mdb.LookupInDir(ctx, oph, &newParentDir, op.NewName)
 	if err != nil {
 		return err
 	}
-	if ok {
-		fsys.log(`
-Target already exists. We do not support atomically remove in conjunction with
-a rename. You will need to issue a separate remove operation prior to rename.
-`)
-		return syscall.EPERM
-	}
-	if !fsys.checkProjectPermissions(oldParentDir.ProjId, PERM_CONTRIBUTE) {
-		return syscall.EPERM
-	}
 
 	oldDir := filepath.Clean(oldParentDir.FullPath + "/" + op.OldName)
 	if oldDir == "/" {
-		fsys.log("can not move the root directory")
+		fsys.logAt(LOG_WARN, "can not move the root directory")
 		return syscall.EPERM
 	}
 	if oldParentDir.Inode == InodeRoot {
 		// project directories are immediate children of the root.
 		// these cannot be moved
-		fsys.log("Can not move a project directory")
+		fsys.logAt(LOG_WARN, "Can not move a project directory")
 		return syscall.EPERM
 	}
 	if newParentDir.Inode == InodeRoot {
 		// can't move into the root directory
-		fsys.log("Can not move into the root directory")
+		fsys.logAt(LOG_WARN, "Can not move into the root directory")
+		return syscall.EPERM
+	}
+	crossProject := (oldParentDir.ProjId != newParentDir.ProjId)
+	if crossProject &&
+		!fsys.checkProjectPermissions(newParentDir.ProjId, PERM_UPLOAD) {
+		// moving between projects requires write access to the destination
 		return syscall.EPERM
 	}
-	if oldParentDir.ProjId != newParentDir.ProjId {
-		// can't move between projects
-		fsys.log("Can not move objects between projects")
+	if !crossProject &&
+		!fsys.checkProjectPermissions(oldParentDir.ProjId, PERM_CONTRIBUTE) {
+		// Without permission to remove objects from the source, a move
+		// to another project is a copy. Within a project, it is not allowed.
 		return syscall.EPERM
 	}
 
 	if oldParentDir.Inode == newParentDir.Inode &&
 		op.OldName == op.NewName {
-		fsys.log("can't move a file onto itself")
+		fsys.logAt(LOG_WARN, "can't move a file onto itself")
 		return syscall.EPERM
 	}
 
-	switch srcNode.(type) {
-	case File:
-		return fsys.renameFile(ctx, oph, oldParentDir, newParentDir, srcNode.(File), op.NewName)
-	case Dir:
-		srcDir := srcNode.(Dir)
+	// The description of a database can not be moved out of its directory,
+	// there is no folder on the platform that holds it.
+	if srcFile, ok := srcNode.(File); ok && srcFile.Kind == FK_Database {
+		fsys.logAt(LOG_WARN, "can not move the description of a database")
+		return syscall.EPERM
+	}
+	isDb, err := fsys.isDatabaseDir(ctx, oph, oldParentDir)
+	if err != nil {
+		return err
+	}
+	if isDb {
+		fsys.logAt(LOG_WARN, "can not move entries out of database directory %s", oldParentDir.FullPath)
+		return syscall.EPERM
+	}
+
+	if srcDir, ok := srcNode.(Dir); ok {
 		if srcDir.faux {
-			fsys.log("can not move a faux directory")
+			fsys.logAt(LOG_WARN, "can not move a faux directory")
 			return syscall.EPERM
 		}
-		return fsys.renameDir(ctx, oph, oldParentDir, newParentDir, srcDir, op.NewName)
+		if crossProject && op.NewName != srcDir.Dname {
+			// The clone places the folder under its original name. Make sure
+			// that it does not collide with an existing entry.
+			_, ok, err := fsys.mdb.LookupInDir(ctx, oph, &newParentDir, srcDir.Dname)
+			if err != nil {
+				return err
+			}
+			if ok {
+				fsys.logAt(LOG_WARN, "Can not move directory %s to %s/%s, the name %s is already in use in the destination",
+					srcDir.FullPath, newParentDir.FullPath, op.NewName, srcDir.Dname)
+				return syscall.EEXIST
+			}
+		}
+	}
+	if targetExists {
+		if err := fsys.renameCheckTarget(ctx, oph, newParentDir, srcNode, targetNode); err != nil {
+			return err
+		}
+	}
+
+	// All the checks passed, from here on, the database is modified. An error
+	// rolls back the transaction, including the removal of the target.
+	err = fsys.renameExecute(ctx, oph, oldParentDir, newParentDir, srcNode, targetNode, targetExists, op.NewName)
+	if err != nil {
+		oph.RecordError(err)
+	}
+	return err
+}
+
+func (fsys *Filesys) renameExecute(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	srcNode Node,
+	targetNode Node,
+	targetExists bool,
+	newName string) error {
+	if targetExists {
+		if err := fsys.renameRemoveTarget(ctx, oph, targetNode); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	crossProject := (oldParentDir.ProjId != newParentDir.ProjId)
+	switch srcNode.(type) {
+	case File:
+		if crossProject {
+			err = fsys.renameFileAcrossProjects(ctx, oph, oldParentDir, newParentDir, srcNode.(File), newName)
+		} else {
+			err = fsys.renameFile(ctx, oph, oldParentDir, newParentDir, srcNode.(File), newName)
+		}
+	case Dir:
+		if crossProject {
+			err = fsys.renameDirAcrossProjects(ctx, oph, oldParentDir, newParentDir, srcNode.(Dir), newName)
+		} else {
+			err = fsys.renameDir(ctx, oph, oldParentDir, newParentDir, srcNode.(Dir), newName)
+		}
 	default:
 		log.Panicf("bad type for srcNode %v", srcNode)
 	}
+
+	if targetExists {
+		fsys.renameTargetDone(ctx, oph, targetNode, err)
+	}
+	return err
+}
+
+// The target of a rename exists, and is going to be replaced. Check that this is
+// allowed. Nothing is modified here, so that a failed check leaves the target in place.
+func (fsys *Filesys) renameCheckTarget(
+	ctx context.Context,
+	oph *OpHandle,
+	newParentDir Dir,
+	srcNode Node,
+	targetNode Node) error {
+	if !fsys.checkProjectPermissions(newParentDir.ProjId, PERM_CONTRIBUTE) {
+		return syscall.EPERM
+	}
+
+	switch targetNode.(type) {
+	case File:
+		if _, ok := srcNode.(Dir); ok {
+			return fuse.ENOTDIR
+		}
+		return nil
+
+	case Dir:
+		if _, ok := srcNode.(File); ok {
+			return syscall.EISDIR
+		}
+		target := targetNode.(Dir)
+		if target.faux {
+			fsys.logAt(LOG_WARN, "can not replace a faux directory")
+			return syscall.EPERM
+		}
+		empty, err := fsys.dirIsEmpty(ctx, oph, target)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fuse.ENOTEMPTY
+		}
+		return nil
+
+	default:
+		log.Panicf("bad type for targetNode %v", targetNode)
+	}
+	return nil
+}
+
+// Remove the target of a rename from the database. This happens in the same transaction
+// as the rename, so other operations see either the old target, or the moved object.
+//
+// An empty target directory is also removed from the platform, because a folder cannot
+// be renamed, or moved, onto an existing folder.
+func (fsys *Filesys) renameRemoveTarget(
+	ctx context.Context,
+	oph *OpHandle,
+	targetNode Node) error {
+	switch targetNode.(type) {
+	case File:
+		target := targetNode.(File)
+		if err := fsys.mdb.Unlink(ctx, oph, target); err != nil {
+			fsys.logAt(LOG_ERROR, "database error in removing the rename target %s", err.Error())
+			return fuse.EIO
+		}
+
+	case Dir:
+		target := targetNode.(Dir)
+		err := fsys.ops.DxFolderRemove(ctx, oph.httpClient, target.ProjId, target.ProjFolder, false)
+		if err != nil {
+			fsys.logAt(LOG_ERROR, "Error in removing the rename target directory (%s:%s) on dnanexus: %s",
+				target.ProjId, target.ProjFolder, err.Error())
+			return fsys.translateError(err)
+		}
+		if err := fsys.mdb.RemoveEmptyDir(oph, target.Inode); err != nil {
+			return err
+		}
+
+	default:
+		log.Panicf("bad type for targetNode %v", targetNode)
+	}
 	return nil
 }
 
+// The rename completed, successfully or not. A target file is removed from the platform
+// only now, after the moved file has taken its place. If the rename failed, the database
+// changes are rolled back, and an empty target directory is recreated.
+func (fsys *Filesys) renameTargetDone(
+	ctx context.Context,
+	oph *OpHandle,
+	targetNode Node,
+	err error) {
+	switch targetNode.(type) {
+	case File:
+		target := targetNode.(File)
+		if err != nil || target.Id == "" {
+			return
+		}
+		objectIds := make([]string, 1)
+		objectIds[0] = target.Id
+		if err := fsys.ops.DxRemoveObjects(ctx, oph.httpClient, target.ProjId, objectIds); err != nil {
+			// The rename itself succeeded, so we do not fail the operation.
+			fsys.logAt(LOG_WARN, "The file (%s:%s) was replaced by rename, but could not be removed from dnanexus: %s",
+				target.ProjId, target.Id, err.Error())
+		}
+		fsys.urlCache.Invalidate(target.Id)
+		fsys.materialized.Remove(target.Inode)
+
+	case Dir:
+		target := targetNode.(Dir)
+		if err == nil {
+			return
+		}
+		if err := fsys.ops.DxFolderNew(ctx, oph.httpClient, target.ProjId, target.ProjFolder); err != nil {
+			fsys.logAt(LOG_ERROR, "Could not recreate directory (%s:%s) after a failed rename: %s",
+				target.ProjId, target.ProjFolder, err.Error())
+		}
+	}
+}
+
 // Decrement the link count, and remove the file if it hits zero.
 func (fsys *Filesys) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "Unlink", op)
+	defer span.End()
+	if err := fsys.populateDir(ctx, int64(op.Parent)); err != nil {
+		return err
+	}
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("Unlink(%s)", op.Name)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "Unlink(%s)", op.Name)
 	}
 
 	// the parent is supposed to be a directory
@@ -1083,11 +1898,17 @@ func (fsys *Filesys) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
 		// can't unlink a directory
 		return fuse.EINVAL
 	}
+	if fileToRemove.Kind == FK_Database {
+		// the description of a database, removing it would
+		// remove the database.
+		return syscall.EPERM
+	}
 
 	if err := fsys.mdb.Unlink(ctx, oph, fileToRemove); err != nil {
-		fsys.log("database error in unlink %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in unlink %s", err.Error())
 		return fuse.EIO
 	}
+	fsys.materialized.Remove(fileToRemove.Inode)
 
 	// The file has not been created on the platform yet, there is no need to
 	// remove it
@@ -1099,7 +1920,7 @@ func (fsys *Filesys) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
 	objectIds := make([]string, 1)
 	objectIds[0] = fileToRemove.Id
 	if err := fsys.ops.DxRemoveObjects(ctx, oph.httpClient, parentDir.ProjId, objectIds); err != nil {
-		fsys.log("Error in removing file (%s:%s/%s) on dnanexus: %s",
+		fsys.logAt(LOG_ERROR, "Error in removing file (%s:%s/%s) on dnanexus: %s",
 			parentDir.ProjId, parentDir.ProjFolder, op.Name,
 			err.Error())
 		return fsys.translateError(err)
@@ -1112,143 +1933,355 @@ func (fsys *Filesys) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
 // Directory handling
 //
 
-func (fsys *Filesys) readEntireDir(ctx context.Context, oph *OpHandle, dir Dir) ([]fuseutil.Dirent, error) {
-	// normalize the filename. For example, we can get "//" when reading
-	// the root directory (instead of "/").
-	if fsys.options.Verbose {
-		fsys.log("ReadDirAll dir=(%s)\n", dir.FullPath)
-	}
+const (
+	// number of directory entries read from the database in one query
+	dirEntriesPerQuery = 256
+)
 
-	dxObjs, subdirs, err := fsys.mdb.ReadDirAll(ctx, oph, &dir)
-	if err != nil {
-		fsys.log("database error in read entire dir %s", err.Error())
-		return nil, fuse.EIO
+func direntType(e DirEntry) fuseutil.DirentType {
+	if e.ObjType == nsDirType {
+		return fuseutil.DT_Directory
 	}
-
-	if fsys.options.Verbose {
-		fsys.log("%d data objects, %d subdirs", len(dxObjs), len(subdirs))
+	switch e.Kind {
+	case FK_Regular:
+		return fuseutil.DT_File
+	case FK_Symlink:
+		return fuseutil.DT_File
+	case FK_Applet, FK_Workflow, FK_Record, FK_Database:
+		return fuseutil.DT_File
+	default:
+		// There is no good way to represent these
+		// in the filesystem.
+		return fuseutil.DT_Block
 	}
+}
 
-	var dEntries []fuseutil.Dirent
+// Read a directory from DNAx, if it has not been read yet. Operations call this
+// before they take the global lock. The platform is queried without the lock, and
+// each page of the listing is inserted in a transaction of its own, so that a
+// large directory does not stall the filesystem. The directory is marked populated
+// only once it is complete; an operation that needs it in the meantime waits
+// for the read to end.
+func (fsys *Filesys) populateDir(ctx context.Context, dinode int64) error {
+	for {
+		fsys.lockOp(ctx)
+		oph := fsys.opOpenNoHttpClient(ctx)
+		node, ok, err := fsys.mdb.LookupByInode(ctx, oph, dinode)
+		fsys.opClose(oph)
+		if err != nil {
+			fsys.mutex.Unlock()
+			fsys.logAt(LOG_ERROR, "database error in reading directory %s", err.Error())
+			return fuse.EIO
+		}
+		dir, isDir := node.(Dir)
+		if !ok || !isDir || dir.Populated {
+			// a missing directory is reported by the operation itself
+			fsys.mutex.Unlock()
+			return nil
+		}
+		done, isReader := fsys.mdb.dirReadRegister(dinode)
+		fsys.mutex.Unlock()
 
-	// Add entries for Unix files, representing DNAx data objects
-	for oname, oDesc := range dxObjs {
-		var dType fuseutil.DirentType
-		switch oDesc.Kind {
-		case FK_Regular:
-			dType = fuseutil.DT_File
-		case FK_Symlink:
-			dType = fuseutil.DT_File
-		default:
-			// There is no good way to represent these
-			// in the filesystem.
-			dType = fuseutil.DT_Block
+		if isReader {
+			return fsys.readDirFromDNAx(ctx, dir)
 		}
-		dirEnt := fuseutil.Dirent{
-			Offset: 0,
-			Inode : fuseops.InodeID(oDesc.Inode),
-			Name : oname,
-			Type : dType,
+
+		// Another operation is reading the directory. If its read
+		// fails, we try ourselves.
+		select {
+		case <- done:
+		case <- ctx.Done():
+			return syscall.EINTR
 		}
-		dEntries = append(dEntries, dirEnt)
 	}
+}
+
+// Read the directory named [name] in a directory, if it has not been read yet
+func (fsys *Filesys) populateChildDir(ctx context.Context, parentInode int64, name string) error {
+	if err := fsys.populateDir(ctx, parentInode); err != nil {
+		return err
+	}
+
+	fsys.lockOp(ctx)
+	oph := fsys.opOpenNoHttpClient(ctx)
+	var child Node
+	node, ok, err := fsys.mdb.LookupByInode(ctx, oph, parentInode)
+	if parentDir, isDir := node.(Dir); err == nil && ok && isDir {
+		child, ok, err = fsys.mdb.LookupInDir(ctx, oph, &parentDir, name)
+	}
+	fsys.opClose(oph)
+	fsys.mutex.Unlock()
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "database error in reading directory %s", err.Error())
+		return fuse.EIO
+	}
+	if childDir, isDir := child.(Dir); ok && isDir && !childDir.Populated {
+		return fsys.populateDir(ctx, childDir.Inode)
+	}
+	return nil
+}
 
-	// Add entries for subdirs
-	for subDirName, dirDesc := range subdirs {
-		dirEnt := fuseutil.Dirent{
-			Offset: 0,
-			Inode : fuseops.InodeID(dirDesc.Inode),
-			Name : subDirName,
-			Type : fuseutil.DT_Directory,
+// Called by the operation that registered the read of the directory
+func (fsys *Filesys) readDirFromDNAx(ctx context.Context, dir Dir) error {
+	httpClient := <- fsys.httpClientPool
+	dr, err := fsys.mdb.dirReadStart(ctx, httpClient, dir)
+	if err == nil {
+		query := DxFindDataObjectsQuery{
+			ProjId : dir.ProjId,
+			Folder : dir.ProjFolder,
+			Recurse : false,
 		}
-		dEntries = append(dEntries, dirEnt)
+		err = DxFindDataObjectsPages(ctx, httpClient, &fsys.dxEnv, query,
+			func(page []DxDescribeDataObject) error {
+				return fsys.dirReadStep(ctx, dr, func(oph *OpHandle) error {
+					return fsys.mdb.dirReadPage(oph, dr, page)
+				})
+			})
+	}
+	fsys.httpClientPool <- httpClient
+	if err == nil {
+		err = fsys.dirReadStep(ctx, dr, func(oph *OpHandle) error {
+			return fsys.mdb.dirReadFinish(ctx, oph, dr)
+		})
 	}
 
-	// directory entries need to be sorted
-	sort.Slice(dEntries, func(i, j int) bool { return dEntries[i].Name < dEntries[j].Name })
-	if fsys.options.Verbose {
-		fsys.log("dentries=%v", dEntries)
+	fsys.lockOp(ctx)
+	defer fsys.mutex.Unlock()
+	if err != nil && dr != nil {
+		// Remove the pages that were inserted, so the directory can be read
+		// again. They are under the current path of the directory.
+		oph := fsys.opOpenNoHttpClient(ctx)
+		if cur, ok, _ := fsys.mdb.LookupDirByInode(ctx, oph, dir.Inode); ok && !cur.Populated {
+			dr.dirFullName = cur.FullPath
+			fsys.mdb.dirReadDiscard(oph, dr)
+		}
+		fsys.opClose(oph)
 	}
+	fsys.mdb.dirReadUnregister(dir.Inode)
 
-	// fix the offsets. We need to do this -after- sorting, because the sort
-	// operation reorders the entries.
-	//
-	// The offsets are one-based, due to how OpenDir works.
-	for i := 0; i < len(dEntries); i++ {
-		dEntries[i].Offset = fuseops.DirOffset(i) + 1
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "error reading directory %s:%s, %s", dir.ProjId, dir.ProjFolder, err.Error())
+		return fuse.EIO
 	}
+	return nil
+}
 
-	return dEntries, nil
+// Run a step of a directory read, with the global lock held, in a transaction
+// of its own. Operations that add or remove entries read the directory first,
+// but it can still be moved while it is read. That fails the read.
+func (fsys *Filesys) dirReadStep(ctx context.Context, dr *dirRead, step func(oph *OpHandle) error) error {
+	fsys.lockOp(ctx)
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient(ctx)
+	defer fsys.opClose(oph)
+
+	dir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, dr.dinode)
+	if err != nil {
+		return oph.RecordError(err)
+	}
+	if !ok || dir.FullPath != dr.dirFullName || dir.Populated {
+		return oph.RecordError(fmt.Errorf("directory %s was modified while it was read", dr.dirFullName))
+	}
+	if err := step(oph); err != nil {
+		return oph.RecordError(err)
+	}
+	return nil
 }
 
+// Read the directory from DNAx if needed, and check if it has any entries
+func (fsys *Filesys) dirIsEmpty(ctx context.Context, oph *OpHandle, dir Dir) (bool, error) {
+	if err := fsys.mdb.PopulateDir(ctx, oph, &dir); err != nil {
+		fsys.logAt(LOG_ERROR, "database error in reading directory %s", err.Error())
+		return false, fuse.EIO
+	}
+	entries, err := fsys.mdb.ReadDirEntries(ctx, oph, dir.FullPath, 0, 1)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "database error in reading directory %s", err.Error())
+		return false, fuse.EIO
+	}
+	return len(entries) == 0, nil
+}
 
 // OpenDir return nil error allows open dir
 // COMMON for drivers
 func (fsys *Filesys) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "OpenDir", op)
+	defer span.End()
+	if err := fsys.populateDir(ctx, int64(op.Inode)); err != nil {
+		return err
+	}
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
 	// the parent is supposed to be a directory
 	dir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.Inode))
 	if err != nil {
-		fsys.log("database error in OpenDir %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in OpenDir %s", err.Error())
 		return fuse.EIO
 	}
 	if !ok {
 		return fuse.ENOENT
 	}
 
-	// Read the entire directory into memory, and sort
-	// the entries properly.
-	dentries, err := fsys.readEntireDir(ctx, oph, dir)
-	if err != nil {
-		return err
+	// Make sure the directory is in the database. The entries
+	// themselves are read by ReadDir.
+	if err := fsys.mdb.PopulateDir(ctx, oph, &dir); err != nil {
+		fsys.logAt(LOG_ERROR, "database error in OpenDir %s", err.Error())
+		return fuse.EIO
 	}
 
 	dh := &DirHandle{
 		d : dir,
-		entries: dentries,
 	}
 	op.Handle = fsys.insertIntoDirHandleTable(dh)
 	return nil
 }
 
+// Write the entries of an open directory into [dst], starting after [offset].
+// With [plus], each entry carries the attributes of the inode, as
+// LookUpInode would return them. Return the number of bytes written.
+//
+// The offset of an entry is its cookie in the database. The kernel passes
+// back the offset of the last entry it received, and we continue from there.
+func (fsys *Filesys) listDir(
+	ctx context.Context,
+	oph *OpHandle,
+	dh *DirHandle,
+	offset fuseops.DirOffset,
+	dst []byte,
+	plus bool) (int, error) {
+	// The directory may have been renamed since it was opened
+	dir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, dh.d.Inode)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "database error in ReadDir %s", err.Error())
+		return 0, fuse.EIO
+	}
+	if !ok {
+		// The directory has been removed
+		return 0, nil
+	}
+
+	cookie := int64(offset)
+	numEntries := 0
+	bytesRead := 0
+	var remoteFiles []File
+	for {
+		entries, err := fsys.mdb.ReadDirEntries(ctx, oph, dir.FullPath, cookie, dirEntriesPerQuery)
+		if err != nil {
+			fsys.logAt(LOG_ERROR, "database error in ReadDir %s", err.Error())
+			return 0, fuse.EIO
+		}
+
+		full := false
+		for _, e := range entries {
+			dirEnt := fuseutil.Dirent{
+				Offset : fuseops.DirOffset(e.Cookie),
+				Inode : fuseops.InodeID(e.Inode),
+				Name : e.Name,
+				Type : direntType(e),
+			}
+			var n int
+			if plus {
+				attrs := e.GetAttrs()
+				expiration := fsys.calcExpirationTimeObj(attrs, e.State, e.Kind)
+				n = fuseutil.WriteDirentPlus(dst[bytesRead:], fuseutil.DirentPlus{
+					Dirent : dirEnt,
+					Entry : fuseops.ChildInodeEntry{
+						Child : fuseops.InodeID(e.Inode),
+						Attributes : attrs,
+						AttributesExpiration : expiration,
+						EntryExpiration : expiration,
+					},
+				})
+			} else {
+				n = fuseutil.WriteDirent(dst[bytesRead:], dirEnt)
+			}
+			if n == 0 {
+				full = true
+				break
+			}
+			bytesRead += n
+			cookie = e.Cookie
+			numEntries++
+
+			if e.ObjType == nsDataObjType &&
+				e.Kind == FK_Regular &&
+				dh.numUrlPrefetch < MaxNumUrlPrefetch {
+				f, ok, err := fsys.mdb.lookupDataObjectByInode(oph, e.Name, e.Inode)
+				if err == nil && ok &&
+					f.LocalPath == "" &&
+					!fsys.materialized.Contains(f.Inode, f.Id) &&
+					f.State == "closed" &&
+					f.ArchivalState == "live" {
+					remoteFiles = append(remoteFiles, f)
+					dh.numUrlPrefetch++
+				}
+			}
+		}
+		if full || len(entries) < dirEntriesPerQuery {
+			break
+		}
+	}
+
+	// files in a directory that is being listed are likely to be read
+	// soon. Create their download URLs in the background.
+	if len(remoteFiles) > 0 {
+		fsys.urlCache.Prefetch(remoteFiles)
+	}
+
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "ReadDir  offset=%d  bytesRead=%d nEntriesReported=%d plus=%t",
+			offset, bytesRead, numEntries, plus)
+	}
+	return bytesRead, nil
+}
+
 // ReadDir lists files into readdirop
 func (fsys *Filesys) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) (err error) {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "ReadDir", op)
+	defer span.End()
+
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient(ctx)
+	defer fsys.opClose(oph)
 
 	dh, ok := fsys.dhTable[op.Handle]
 	if !ok {
 		return fuse.EIO
 	}
+	op.BytesRead, err = fsys.listDir(ctx, oph, dh, op.Offset, op.Dst, false)
+	return
+}
 
-	index := int(op.Offset)
+// ReadDirPlus lists files together with their attributes. This saves
+// the kernel a LookUpInode call for each entry, when it needs the
+// attributes, as in "ls -l".
+func (fsys *Filesys) ReadDirPlus(ctx context.Context, op *fuseops.ReadDirPlusOp) (err error) {
+	ctx, span := fsys.startOp(ctx, "ReadDirPlus", op)
+	defer span.End()
 
-	if index > len(dh.entries) {
-		return fuse.EINVAL
-	}
-	var i int
-	op.BytesRead = 0
-	for i = index; i < len(dh.entries); i++ {
-		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], dh.entries[i])
-		if n == 0 {
-			break
-		}
-		op.BytesRead += n
-	}
-	if fsys.options.Verbose {
-		fsys.log("ReadDir  offset=%d  bytesRead=%d nEntriesReported=%d",
-			index, op.BytesRead, i)
+	fsys.lockOp(ctx)
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient(ctx)
+	defer fsys.opClose(oph)
+
+	dh, ok := fsys.dhTable[op.Handle]
+	if !ok {
+		return fuse.EIO
 	}
+	op.BytesRead, err = fsys.listDir(ctx, oph, dh, op.Offset, op.Dst, true)
 	return
 }
 
 // ReleaseDirHandle deletes file handle entry
 func (fsys *Filesys) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "ReleaseDirHandle", op)
+	defer span.End()
+
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
 
 	delete(fsys.dhTable, op.Handle)
@@ -1269,7 +2302,7 @@ func (fsys *Filesys) openRegularFile(
 		// a regular file that has a local copy
 		reader, err := os.OpenFile(f.LocalPath, os.O_RDWR, 0644)
 		if err != nil {
-			fsys.log("Could not open local file %s, err=%s", f.LocalPath, err.Error())
+			fsys.logAt(LOG_ERROR, "Could not open local file %s, err=%s", f.LocalPath, err.Error())
 			return nil, err
 		}
 		fh := &FileHandle{
@@ -1283,25 +2316,35 @@ func (fsys *Filesys) openRegularFile(
 		return fh, nil
 	}
 
-	// A remote (immutable) file.
-	// create a download URL for this file.
-	const secondsInYear int = 60 * 60 * 24 * 365
-	payload := fmt.Sprintf("{\"project\": \"%s\", \"duration\": %d}",
-		f.ProjId, secondsInYear)
-
-	body, err := dxda.DxAPI(ctx, oph.httpClient, NumRetriesDefault, &fsys.dxEnv, fmt.Sprintf("%s/download", f.Id), payload)
-	if err != nil {
-		oph.RecordError(err)
-		return nil, err
+	if path, ok := fsys.materialized.Lookup(f.Inode, f.Id); ok {
+		// a remote file that was materialized, read the copy
+		reader, err := os.Open(path)
+		if err == nil {
+			fh := &FileHandle{
+				accessMode : AM_RO_Local,
+				inode : f.Inode,
+				size : f.Size,
+				url : nil,
+				fileId : f.Id,
+				projId : f.ProjId,
+				fd : reader,
+			}
+			return fh, nil
+		}
+		fsys.logAt(LOG_WARN, "Could not open the copy of (%s,%s), reading remotely, err=%s",
+			f.Name, f.Id, err.Error())
+		fsys.materialized.Remove(f.Inode)
 	}
-	var u DxDownloadURL
-	json.Unmarshal(body, &u)
 
+	// A remote (immutable) file. The download URL is created
+	// on the first read, many open calls are never followed by reads.
 	fh := &FileHandle{
 		accessMode: AM_RO_Remote,
 		inode : f.Inode,
 		size : f.Size,
-		url: &u,
+		url: nil,
+		fileId : f.Id,
+		projId : f.ProjId,
 		fd : nil,
 	}
 
@@ -1311,31 +2354,111 @@ func (fsys *Filesys) openRegularFile(
 // Note: What happens if the file is opened for writing?
 //
 func (fsys *Filesys) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "OpenFile", op)
+	defer span.End()
+
+	file, err := fsys.openFile(ctx, op)
+	if file == nil {
+		return err
+	}
+	if isDescribedKind(file.Kind) {
+		return fsys.openDescribedObject(ctx, op, *file)
+	}
+
+	// The file is still being written, or it is being unarchived. Wait
+	// for it without holding the global lock, and try again.
+	if file.State != "closed" {
+		if !fsys.waitForClose(ctx, *file) {
+			return syscall.EACCES
+		}
+	} else {
+		if fsys.logEnabled(LOG_DEBUG) {
+			fsys.logCtx(ctx, LOG_DEBUG, "OpenFile waiting for (%s,%s) to be unarchived", file.Name, file.Id)
+		}
+		if !fsys.archival.WaitLive(ctx, file.Id, file.ProjId, fsys.options.UnarchiveWait) {
+			return syscall.EACCES
+		}
+	}
+	_, err = fsys.openFile(ctx, op)
+	return err
+}
+
+// Poll the platform until a file closes, and update the database. Return
+// false if it does not close within the wait limit.
+func (fsys *Filesys) waitForClose(ctx context.Context, file File) bool {
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "OpenFile waiting for (%s,%s) to close", file.Name, file.Id)
+	}
+
+	// A long wait should not hold on to a client from the pool, it
+	// is taken for each describe call.
+	deadline := time.Now().Add(fsys.options.WaitForClose)
+	for true {
+		httpClient := <- fsys.httpClientPool
+		fDesc, err := DxDescribe(ctx, httpClient, &fsys.dxEnv, file.Id)
+		fsys.httpClientPool <- httpClient
+		if err != nil {
+			fsys.logAt(LOG_ERROR, "OpenFile: could not describe %s, %s", file.Id, err.Error())
+			return false
+		}
+		if fDesc.State == "closed" {
+			fsys.lockOp(ctx)
+			oph := fsys.opOpenNoHttpClient(ctx)
+			err = fsys.mdb.UpdateClosedFile(ctx, oph, fDesc)
+			fsys.opClose(oph)
+			fsys.mutex.Unlock()
+			if err != nil {
+				fsys.logAt(LOG_ERROR, "database error in OpenFile %s", err.Error())
+				return false
+			}
+			return true
+		}
+
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			fsys.logAt(LOG_WARN, "File (%s,%s) did not close within %s", file.Name, file.Id,
+				fsys.options.WaitForClose.String())
+			return false
+		}
+		select {
+		case <- time.After(MinDuration(openFilePollInterval, remaining)):
+		case <- ctx.Done():
+			return false
+		}
+	}
+	return false
+}
+
+// Open a file, with the global lock held. If the file is not closed yet, or is
+// being unarchived, and opens are allowed to wait for it, the file is returned
+// together with the error. Objects that are shown as their description are
+// returned with no error, and opened by the caller.
+func (fsys *Filesys) openFile(ctx context.Context, op *fuseops.OpenFileOp) (*File, error) {
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpenNoHttpClient(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("OpenFile inode=%d", op.Inode)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "OpenFile inode=%d", op.Inode)
 	}
 
 	// find the file by its inode
 	node, ok, err := fsys.mdb.LookupByInode(ctx, oph, int64(op.Inode))
 	if err != nil {
-		fsys.log("database error in OpenFile %s", err.Error())
-		return fuse.EIO
+		fsys.logAt(LOG_ERROR, "database error in OpenFile %s", err.Error())
+		return nil, fuse.EIO
 	}
 	if !ok {
 		// file doesn't exist
-		return fuse.ENOENT
+		return nil, fuse.ENOENT
 	}
 
 	var file File
 	switch node.(type) {
 	case Dir:
 		// not allowed to open a directory
-		return syscall.EACCES
+		return nil, syscall.EACCES
 	case File:
 		// cast to a File type
 		file = node.(File)
@@ -1343,15 +2466,35 @@ func (fsys *Filesys) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error
 		log.Panic(fmt.Sprintf("bad type for node %v", node))
 	}
 
+	if isDescribedKind(file.Kind) {
+		// The description can be read in any state. It is
+		// read from the platform without the lock.
+		return &file, nil
+	}
 	if file.State != "closed" {
-		fsys.log("File (%s,%s) is not closed, it cannot be accessed",
+		fsys.logAt(LOG_WARN, "File (%s,%s) is not closed, it cannot be accessed",
 			file.Name, file.Id)
-		return syscall.EACCES
+		// Files that are written from this mount are closed by the
+		// upload, there is nothing to wait for on the platform.
+		local := file.LocalPath != "" || (fsys.sybx != nil && fsys.sybx.uploadPending(file.Inode))
+		if fsys.options.WaitForClose > 0 && file.Id != "" && !local {
+			return &file, syscall.EACCES
+		}
+		return nil, syscall.EACCES
 	}
 	if file.ArchivalState != "live" {
-		fsys.log("File (%s,%s) is in state %s, it cannot be accessed",
+		fsys.logAt(LOG_WARN, "File (%s,%s) is in state %s, it cannot be accessed",
 			file.Name, file.Id, file.ArchivalState)
-		return syscall.EACCES
+		if file.ArchivalState != "unarchiving" {
+			return nil, syscall.EACCES
+		}
+		// keep track of the file, so its state is refreshed
+		// once it is live.
+		fsys.archival.Track(file.Id, file.ProjId)
+		if fsys.options.UnarchiveWait > 0 {
+			return &file, syscall.EACCES
+		}
+		return nil, syscall.EACCES
 	}
 
 	var fh *FileHandle
@@ -1359,7 +2502,7 @@ func (fsys *Filesys) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error
 	case FK_Regular:
 		fh, err = fsys.openRegularFile(ctx, oph, op, file)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	case FK_Symlink:
 		// A symbolic link can use the remote URL address
@@ -1377,7 +2520,7 @@ func (fsys *Filesys) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error
 		}
 	default:
 		// can't open an applet/workflow/etc.
-		return fuse.ENOSYS
+		return nil, fuse.ENOSYS
 	}
 
 	// add to the open-file table, so we can recognize future accesses to
@@ -1388,14 +2531,52 @@ func (fsys *Filesys) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error
 
 	if fh.accessMode == AM_RO_Remote {
 		// Create an entry in the prefetch table, if the file is eligable
-		fsys.pgs.CreateStreamEntry(fh.hid, file, *fh.url)
+		fsys.pgs.CreateStreamEntry(fh.hid, file, fh.symlinkUrl())
 	}
-	return nil
+	return nil, nil
 }
 
-
-func (fsys *Filesys) getWritableFD(ctx context.Context, handle fuseops.HandleID) (*os.File, error) {
-	fsys.mutex.Lock()
+// Open an applet, workflow, record, or database. The file content is the
+// object description, read from the platform now, without holding the
+// global lock. Its size is recorded, so that later lookups report it.
+func (fsys *Filesys) openDescribedObject(
+	ctx context.Context,
+	op *fuseops.OpenFileOp,
+	file File) error {
+	httpClient := <- fsys.httpClientPool
+	content, err := DxDescribeJson(ctx, httpClient, &fsys.dxEnv, file.ProjId, file.Id)
+	fsys.httpClientPool <- httpClient
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Could not describe (%s,%s): %s", file.Name, file.Id, err.Error())
+		return fsys.translateError(err)
+	}
+
+	fsys.lockOp(ctx)
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient(ctx)
+	defer fsys.opClose(oph)
+	if int64(len(content)) != file.Size {
+		if err := fsys.mdb.UpdateObjectSize(ctx, oph, file.Inode, int64(len(content))); err != nil {
+			fsys.logAt(LOG_ERROR, "database error in OpenFile %s", err.Error())
+			oph.RecordError(err)
+			return fuse.EIO
+		}
+	}
+
+	fh := &FileHandle{
+		accessMode : AM_RO_Content,
+		inode : file.Inode,
+		size : int64(len(content)),
+		fd : nil,
+		content : content,
+	}
+	op.Handle = fsys.insertIntoFileHandleTable(fh)
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fsys *Filesys) getWritableFD(ctx context.Context, handle fuseops.HandleID) (*os.File, error) {
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
 
 	fh, ok := fsys.fhTable[handle]
@@ -1415,6 +2596,42 @@ func (fsys *Filesys) getWritableFD(ctx context.Context, handle fuseops.HandleID)
 }
 
 
+// The URL for a symbolic link, this is the empty URL for regular files.
+func (fh *FileHandle) symlinkUrl() DxDownloadURL {
+	if fh.url == nil {
+		return DxDownloadURL{}
+	}
+	return *fh.url
+}
+
+// First read from a remote file. Other files that were opened, but not read
+// yet, are likely to be read soon. Create their URLs in the background, together
+// with this one. Called with the global lock held.
+func (fsys *Filesys) prefetchUrlsForOpenFiles(fh *FileHandle) {
+	fh.urlRequested = true
+
+	var files []File
+	for _, other := range fsys.fhTable {
+		if len(files) >= MaxNumUrlPrefetch {
+			break
+		}
+		if other == fh ||
+			other.accessMode != AM_RO_Remote ||
+			other.fileId == "" ||
+			other.urlRequested {
+			continue
+		}
+		other.urlRequested = true
+		files = append(files, File{
+			Id : other.fileId,
+			ProjId : other.projId,
+		})
+	}
+	if len(files) > 0 {
+		fsys.urlCache.Prefetch(files)
+	}
+}
+
 // read a remote immutable file
 //
 func (fsys *Filesys) readRemoteFile(ctx context.Context, op *fuseops.ReadFileOp, fh *FileHandle) error {
@@ -1436,7 +2653,12 @@ func (fsys *Filesys) readRemoteFile(ctx context.Context, op *fuseops.ReadFileOp,
 
 	// See if the data has already been prefetched.
 	// This call will wait, if a prefetch IO is in progress.
+	_, lookupSpan := StartSpan(ctx, "Prefetch.CacheLookup")
 	len := fsys.pgs.CacheLookup(fh.hid, op.Offset, endOfs, op.Dst)
+	if lookupSpan != nil {
+		lookupSpan.SetAttr("dxfuse.hit", len > 0)
+	}
+	lookupSpan.End()
 	if len > 0 {
 		op.BytesRead = len
 		return nil
@@ -1444,26 +2666,54 @@ func (fsys *Filesys) readRemoteFile(ctx context.Context, op *fuseops.ReadFileOp,
 
 	// The data has not been prefetched. Get the data from DNAx with an
 	// http request.
-	headers := make(map[string]string)
-
-	// Copy the immutable headers
-	for key, value := range fh.url.Headers {
-		headers[key] = value
-	}
-
-	// add an extent in the file that we want to read
-	headers["Range"] = fmt.Sprintf("bytes=%d-%d", op.Offset, endOfs)
-	if fsys.options.Verbose {
-		fsys.log("network read (inode=%d) ofs=%d len=%d endOfs=%d lastByteInFile=%d",
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "network read (inode=%d) ofs=%d len=%d endOfs=%d lastByteInFile=%d",
 			fh.inode, op.Offset, reqSize, endOfs, lastByteInFile)
 	}
 
 	// Take an http client from the pool. Return it when done.
 	httpClient := <- fsys.httpClientPool
-	body,err := dxda.DxHttpRequest(ctx, httpClient, NumRetriesDefault, "GET", fh.url.URL, headers, []byte("{}"))
-	fsys.httpClientPool <- httpClient
-	if err != nil {
-		return err
+	defer func() {
+		fsys.httpClientPool <- httpClient
+	} ()
+
+	// get the download URL, it is created on first use
+	url := fh.symlinkUrl()
+	if fh.fileId != "" {
+		u, err := fsys.urlCache.Get(ctx, httpClient, fh.fileId, fh.projId)
+		if err != nil {
+			return err
+		}
+		url = u
+	}
+
+	var body []byte
+	var err error
+	for renewed := false; ; renewed = true {
+		headers := make(map[string]string)
+
+		// Copy the immutable headers
+		for key, value := range url.Headers {
+			headers[key] = value
+		}
+
+		// add an extent in the file that we want to read
+		headers["Range"] = fmt.Sprintf("bytes=%d-%d", op.Offset, endOfs)
+
+		body, err = dxHttpRequest(ctx, httpClient, NumRetries, "GET", url.URL, headers, []byte("{}"))
+		if err == nil {
+			break
+		}
+		if fh.fileId == "" || renewed || !fsys.urlCache.IsAuthError(err) {
+			return err
+		}
+
+		// The URL has expired, or was revoked. Get a new one, and retry.
+		fsys.logAt(LOG_WARN, "download URL for inode=%d was rejected, renewing it (%s)", fh.inode, err.Error())
+		url, err = fsys.urlCache.Refresh(ctx, httpClient, fh.fileId, fh.projId, url)
+		if err != nil {
+			return err
+		}
 	}
 
 	op.BytesRead = copy(op.Dst, body)
@@ -1471,20 +2721,30 @@ func (fsys *Filesys) readRemoteFile(ctx context.Context, op *fuseops.ReadFileOp,
 }
 
 func (fsys *Filesys) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	ctx, span := fsys.startOp(ctx, "ReadFile", op)
+	defer span.End()
 	// Here, we start from the file handle
-	fsys.mutex.Lock()
+	fsys.lockOp(ctx)
 	fh,ok := fsys.fhTable[op.Handle]
 	if !ok {
 		// invalid file handle. It doesn't exist in the table
 		fsys.mutex.Unlock()
 		return fuse.EINVAL
 	}
+	if fh.accessMode == AM_RO_Remote && fh.fileId != "" && !fh.urlRequested {
+		fsys.prefetchUrlsForOpenFiles(fh)
+	}
 	fsys.mutex.Unlock()
 
 	switch fh.accessMode {
 	case AM_RO_Remote:
 		return fsys.readRemoteFile(ctx, op, fh)
-	case AM_RW_Local:
+	case AM_RO_Content:
+		if op.Offset < int64(len(fh.content)) {
+			op.BytesRead = copy(op.Dst, fh.content[op.Offset:])
+		}
+		return nil
+	case AM_RW_Local, AM_RO_Local:
 		// the file has a local copy
 		n, err := fh.fd.ReadAt(op.Dst, op.Offset)
 		if err == io.ErrUnexpectedEOF || err == io.EOF {
@@ -1512,7 +2772,7 @@ func (fsys *Filesys) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error
 // may need to either limit file size, or. We are holding the global lock
 // while we are downloading the file. This really needs to be improved.
 func (fsys *Filesys) prepareFileForWrite(ctx context.Context, op *fuseops.WriteFileOp) (*FileHandle, error) {
-	fsys.mutex.Lock()
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
 
 	fh,ok := fsys.fhTable[op.Handle]
@@ -1520,25 +2780,60 @@ func (fsys *Filesys) prepareFileForWrite(ctx context.Context, op *fuseops.WriteF
 		// invalid file handle. It doesn't exist in the table
 		return nil, fuse.EINVAL
 	}
+	if fsys.draining {
+		// the filesystem is being unmounted
+		return nil, syscall.EROFS
+	}
 	if fh.accessMode == AM_RW_Local {
 		// file is already local
 		return fh, nil
 	}
-	if fh.size > WritableFileSizeLimit {
-		fsys.log("File (inode=%d) is larger than the maximum supported writable file limit",
-			WritableFileSizeLimit)
+	if fh.accessMode == AM_RO_Content {
+		// an object description cannot be modified
+		return nil, syscall.EPERM
+	}
+	if fh.size > fsys.options.Tuning.WritableFileSizeLimit {
+		fsys.logAt(LOG_WARN, "File (inode=%d) is larger than the maximum supported writable file limit",
+			fsys.options.Tuning.WritableFileSizeLimit)
 		return nil, fuse.EINVAL
 	}
 
 	// We need to convert to a local file.
-	if fsys.options.Verbose {
-		fsys.log("Downloading inode=%d to local disk, only then can we modify it", fh.inode)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "Downloading inode=%d to local disk, only then can we modify it", fh.inode)
 	}
 
 	// Do not perform prefetch on a file that has a local copy
 	fsys.pgs.RemoveStreamEntry(fh.hid)
 
-	// do not hold the global lock while downloading the file
+	oph := fsys.opOpen(ctx)
+	defer fsys.opClose(oph)
+
+	// The file may have been materialized after it was opened, in which
+	// case there is already a local copy.
+	file, isDir, err := fsys.lookupFileByInode(ctx, oph, fh.inode)
+	if isDir {
+		return nil, fuse.EIO
+	}
+	if err != nil {
+		return nil, err
+	}
+	if file.LocalPath != "" {
+		fd, err := os.OpenFile(file.LocalPath, os.O_RDWR, 0644)
+		if err != nil {
+			fsys.logAt(LOG_ERROR, "Could not open local file %s, err=%s", file.LocalPath, err.Error())
+			return nil, err
+		}
+		if fh.fd != nil {
+			fh.fd.Close()
+		}
+		fh.accessMode = AM_RW_Local
+		fh.url = nil
+		fh.fileId = ""
+		fh.projId = ""
+		fh.fd = fd
+		return fh, nil
+	}
 
 	// create the local file
 	localPath := fsys.createLocalPath("")
@@ -1547,28 +2842,37 @@ func (fsys *Filesys) prepareFileForWrite(ctx context.Context, op *fuseops.WriteF
 		return nil, err
 	}
 
-	oph := fsys.opOpen()
-	defer fsys.opClose(oph)
-
-	// Note: we are holding the global lock while downloading this file.
-	// This could probably be improved with a per-inode lock.
-	err = fsys.pgs.DownloadEntireFile(oph.httpClient, fh.inode, fh.size, *fh.url, fd, localPath)
+	if copyPath, ok := fsys.materialized.Lookup(fh.inode, file.Id); ok {
+		// The file was materialized. The copy stays a snapshot of the
+		// remote file, the writes go to a separate local file.
+		err = copyLocalFile(copyPath, fd)
+	} else {
+		// Note: we are holding the global lock while downloading this file.
+		// This could probably be improved with a per-inode lock.
+		err = fsys.pgs.DownloadEntireFile(oph.httpClient, fh.inode, fh.size, fh.symlinkUrl(), fh.fileId, fh.projId, fd, localPath)
+	}
 	if err != nil {
-		fsys.log("failed to download file inode=%d", fh.inode, err.Error())
+		fsys.logAt(LOG_ERROR, "failed to download file inode=%d, %s", fh.inode, err.Error())
 		// Should we erase the partial file to save space?
 		return nil, err
 	}
+	fsys.materialized.Remove(fh.inode)
 
 	// update the database, match the file with its local path
 	err = fsys.mdb.UpdateFileLocalPath(context.TODO(), oph, fh.inode, localPath)
 	if err != nil {
-		fsys.log("database error in updating file for write %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in updating file for write %s", err.Error())
 		return nil, oph.RecordError(fuse.EIO)
 	}
 
 	// update the file-handle.
+	if fh.fd != nil {
+		fh.fd.Close()
+	}
 	fh.accessMode = AM_RW_Local
 	fh.url = nil
+	fh.fileId = ""
+	fh.projId = ""
 	fh.fd = fd
 
 	return fh, nil
@@ -1582,9 +2886,11 @@ func (fsys *Filesys) prepareFileForWrite(ctx context.Context, op *fuseops.WriteF
 // Note: the file-open operation doesn't state if the file is going to be opened for
 // reading or writing.
 func (fsys *Filesys) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	ctx, span := fsys.startOp(ctx, "WriteFile", op)
+	defer span.End()
 	fh, err := fsys.prepareFileForWrite(ctx, op)
 	if err != nil {
-		fsys.log("Error while converting file from remote-read-only to a local file")
+		fsys.logAt(LOG_ERROR, "Error while converting file from remote-read-only to a local file")
 		return err
 	}
 
@@ -1597,22 +2903,29 @@ func (fsys *Filesys) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) err
 	mtime := time.Now()
 
 	// Update the file attributes in the database (size, mtime)
-	fsys.mutex.Lock()
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpenNoHttpClient()
+	oph := fsys.opOpenNoHttpClient(ctx)
 	defer fsys.opClose(oph)
 
 	if err := fsys.mdb.UpdateFileAttrs(ctx, oph, fh.inode, fSize, mtime, nil); err != nil {
-		fsys.log("database error in updating attributes for WriteFile %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in updating attributes for WriteFile %s", err.Error())
 		return fuse.EIO
 	}
+	if fsys.sybx != nil {
+		// the file may be uploaded while it is written
+		fsys.sybx.StreamWrite(fh.inode, fh.hid, op.Offset, nBytes)
+	}
 
 	return err
 }
 
 func (fsys *Filesys) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
-	if fsys.options.Verbose {
-		fsys.log("Flush inode %d", op.Inode)
+	ctx, span := fsys.startOp(ctx, "FlushFile", op)
+	defer span.End()
+
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "Flush inode %d", op.Inode)
 	}
 
 	fd, err := fsys.getWritableFD(ctx, op.Handle)
@@ -1628,8 +2941,11 @@ func (fsys *Filesys) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) err
 }
 
 func (fsys *Filesys) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error {
-	if fsys.options.Verbose {
-		fsys.log("Sync inode %d", op.Inode)
+	ctx, span := fsys.startOp(ctx, "SyncFile", op)
+	defer span.End()
+
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "Sync inode %d", op.Inode)
 	}
 
 	fd, err := fsys.getWritableFD(ctx, op.Handle)
@@ -1645,9 +2961,12 @@ func (fsys *Filesys) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error
 }
 
 func (fsys *Filesys) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "ReleaseFileHandle", op)
+	defer span.End()
+
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
 	fh, ok := fsys.fhTable[op.Handle]
@@ -1666,11 +2985,20 @@ func (fsys *Filesys) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseF
 		fsys.pgs.RemoveStreamEntry(fh.hid)
 		return nil
 
+	case AM_RO_Content:
+		return nil
+
+	case AM_RO_Local:
+		// Read-only file that has a materialized copy
+		err := fh.fd.Close()
+		fh.fd = nil
+		return err
+
 	case AM_RW_Local:
 		// A new file created locally. We need to upload it
 		// to the platform.
-		if fsys.options.Verbose {
-			fsys.log("Close new file (inode=%d)", fh.inode)
+		if fsys.logEnabled(LOG_DEBUG) {
+			fsys.logCtx(ctx, LOG_DEBUG, "Close new file (inode=%d)", fh.inode)
 		}
 
 		// flush and close the local file
@@ -1684,6 +3012,11 @@ func (fsys *Filesys) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseF
 		}
 		fh.fd = nil
 
+		if fsys.sybx != nil {
+			// if the file is streamed, upload the last part
+			fsys.sybx.StreamRelease(fh.inode, fh.hid)
+		}
+
 		// the sync daemon will upload the file asynchronously
 		return nil
 
@@ -1693,6 +3026,154 @@ func (fsys *Filesys) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseF
 	return nil
 }
 
+// ===
+// Materializing files
+//
+// A remote file is downloaded to local disk with many parallel range requests.
+// Once done, the copy is added to the materialized cache, and further opens read
+// it at disk speed. Handles that are already open continue to read remotely. The
+// file is still a remote file, the copy is not recorded in the database, and it
+// may be evicted to make room for other copies.
+
+func (fsys *Filesys) materializeStart(ctx context.Context, inode int64) (File, bool, error) {
+	if fsys.options.ReadOnly {
+		// there is no local directory to download into
+		return File{}, false, syscall.EROFS
+	}
+	fsys.lockOp(ctx)
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient(ctx)
+	defer fsys.opClose(oph)
+
+	node, ok, err := fsys.mdb.LookupByInode(ctx, oph, inode)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "database error in materialize: %s", err.Error())
+		return File{}, false, fuse.EIO
+	}
+	if !ok {
+		return File{}, false, fuse.ENOENT
+	}
+	var file File
+	switch node.(type) {
+	case File:
+		file = node.(File)
+	default:
+		return File{}, false, syscall.EISDIR
+	}
+
+	if file.LocalPath != "" || fsys.materialized.Contains(file.Inode, file.Id) {
+		// there is already a local copy
+		return file, false, nil
+	}
+	if file.Kind != FK_Regular {
+		return File{}, false, syscall.EINVAL
+	}
+	if !fsys.materialized.Fits(file.Size) {
+		fsys.logAt(LOG_WARN, "File (%s,%s) is larger than the space for materialized copies (%d bytes)",
+			file.Name, file.Id, fsys.options.Tuning.MaterializeCacheSize)
+		return File{}, false, syscall.EFBIG
+	}
+	if file.State != "closed" || file.ArchivalState != "live" {
+		fsys.logAt(LOG_WARN, "File (%s,%s) is in state (%s,%s), it cannot be materialized",
+			file.Name, file.Id, file.State, file.ArchivalState)
+		return File{}, false, syscall.EACCES
+	}
+	if fsys.materializing[inode] {
+		return File{}, false, syscall.EBUSY
+	}
+	fsys.materializing[inode] = true
+	delete(fsys.materializeFailed, inode)
+	return file, true, nil
+}
+
+// Report on the download of a file to local disk. Called with the global lock held.
+func (fsys *Filesys) materializeState(file File) string {
+	if file.LocalPath != "" || fsys.materialized.Contains(file.Inode, file.Id) {
+		return "local"
+	}
+	if fsys.materializing[file.Inode] {
+		return "downloading"
+	}
+	if fsys.materializeFailed[file.Inode] {
+		return "failed"
+	}
+	return "remote"
+}
+
+func (fsys *Filesys) materializeEnd(ctx context.Context, file File, localPath string) error {
+	fsys.lockOp(ctx)
+	defer fsys.mutex.Unlock()
+	delete(fsys.materializing, file.Inode)
+	oph := fsys.opOpenNoHttpClient(ctx)
+	defer fsys.opClose(oph)
+
+	// the file may have been removed, or downloaded for writing, while
+	// we were not holding the lock.
+	current, isDir, err := fsys.lookupFileByInode(ctx, oph, file.Inode)
+	if err != nil || isDir {
+		return fuse.ENOENT
+	}
+	if current.Id != file.Id || current.LocalPath != "" {
+		fsys.logAt(LOG_WARN, "File (inode=%d) changed while it was being materialized, discarding the copy",
+			file.Inode)
+		os.Remove(localPath)
+		return nil
+	}
+
+	// this may evict the copies of other files
+	fsys.materialized.Add(file.Inode, file.Id, localPath, file.Size)
+	return nil
+}
+
+// Start downloading a file to local disk. The checks are done here, so that
+// errors are reported to the caller. The download itself runs in the background,
+// without holding the global lock, and its progress is reported through
+// the base.materialize attribute.
+func (fsys *Filesys) Materialize(ctx context.Context, inode int64) error {
+	ctx, span := fsys.startOp(ctx, "Materialize", nil)
+	defer span.End()
+
+	file, needed, err := fsys.materializeStart(ctx, inode)
+	if err != nil || !needed {
+		return err
+	}
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "Materialize (inode=%d, %s) size=%d", inode, file.Id, file.Size)
+	}
+
+	fsys.materializeWg.Add(1)
+	go fsys.materializeDownload(file)
+	return nil
+}
+
+func (fsys *Filesys) materializeDownload(file File) {
+	defer fsys.materializeWg.Done()
+	ctx := fsys.materializeCtx
+
+	localPath := fsys.createLocalPath(file.Name)
+	fd, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err == nil {
+		err = fsys.pgs.MaterializeFile(ctx, file.Inode, file.Size, file.Id, file.ProjId, fd, localPath)
+		if cErr := fd.Close(); err == nil {
+			err = cErr
+		}
+	}
+	if err == nil {
+		err = fsys.materializeEnd(ctx, file, localPath)
+	} else {
+		os.Remove(localPath)
+	}
+	if err == nil {
+		return
+	}
+
+	fsys.logAt(LOG_ERROR, "failed to materialize file inode=%d, %s", file.Inode, err.Error())
+	fsys.lockOp(ctx)
+	delete(fsys.materializing, file.Inode)
+	fsys.materializeFailed[file.Inode] = true
+	fsys.mutex.Unlock()
+}
+
 // ===
 // Extended attributes (xattrs)
 //
@@ -1700,7 +3181,7 @@ func (fsys *Filesys) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseF
 func (fsys *Filesys) lookupFileByInode(ctx context.Context, oph *OpHandle, inode int64) (File, bool, error) {
 	node, ok, err := fsys.mdb.LookupByInode(ctx, oph, inode)
 	if err != nil {
-		fsys.log("database error in xattr op: %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in xattr op: %s", err.Error())
 		return File{}, false, fuse.EIO
 	}
 	if !ok {
@@ -1718,10 +3199,98 @@ func (fsys *Filesys) lookupFileByInode(ctx context.Context, oph *OpHandle, inode
 	return file, false, nil
 }
 
+func (fsys *Filesys) lookupNodeByInode(ctx context.Context, oph *OpHandle, inode int64) (Node, error) {
+	node, ok, err := fsys.mdb.LookupByInode(ctx, oph, inode)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "database error in xattr op: %s", err.Error())
+		return nil, fuse.EIO
+	}
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return node, nil
+}
+
+// The base.tags and base.properties attributes hold all the tags, or all
+// the properties, of a file as JSON. A list of strings for the tags,
+// and an object with string values for the properties.
+func xattrTagsPropsEncode(file File, attrName string) (string, error) {
+	var data []byte
+	var err error
+	if attrName == "tags" {
+		tags := file.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		data, err = json.Marshal(tags)
+	} else {
+		props := file.Properties
+		if props == nil {
+			props = make(map[string]string)
+		}
+		data, err = json.Marshal(props)
+	}
+	return string(data), err
+}
+
+func xattrTagsPropsDecode(file *File, attrName string, value []byte) error {
+	if attrName == "tags" {
+		var tags []string
+		if err := json.Unmarshal(value, &tags); err != nil {
+			return fmt.Errorf("tags must be a JSON list of strings: %s", err.Error())
+		}
+		// remove duplicates
+		seen := make(map[string]bool)
+		uniqueTags := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			if !seen[tag] {
+				seen[tag] = true
+				uniqueTags = append(uniqueTags, tag)
+			}
+		}
+		file.Tags = uniqueTags
+		return nil
+	}
+
+	var props map[string]string
+	if err := json.Unmarshal(value, &props); err != nil {
+		return fmt.Errorf("properties must be a JSON object with string values: %s", err.Error())
+	}
+	if props == nil {
+		props = make(map[string]string)
+	}
+	file.Properties = props
+	return nil
+}
+
+// The flags of a set operation: create only, replace only, or either
+func (fsys *Filesys) xattrCheckFlags(flags uint32, attrExists bool) error {
+	switch flags {
+	case 0x1:
+		if attrExists {
+			return fuse.EEXIST
+		}
+	case 0x2:
+		if !attrExists {
+			return fuse.ENOATTR
+		}
+	case 0x0:
+		// can accept both cases
+	default:
+		fsys.logAt(LOG_WARN, "invalid SetAttr flag value %d, expecting one of {0x0, 0x1, 0x2}",
+			flags)
+		return syscall.EINVAL
+	}
+	return nil
+}
+
 func (fsys *Filesys) xattrParseName(name string) (string, string, error) {
+	// On Linux, the attributes are in the user namespace
+	name = strings.TrimPrefix(name, "user.")
+
 	prefixLen := strings.Index(name, ".")
 	if prefixLen == -1 {
-		fsys.log("property must start with one of {%s ,%s, %s}",
+		fsys.logAt(LOG_WARN, "property must start with one of {%s ,%s, %s}",
 			XATTR_TAG, XATTR_PROP, XATTR_BASE)
 		return "", "", fuse.EINVAL
 	}
@@ -1731,20 +3300,26 @@ func (fsys *Filesys) xattrParseName(name string) (string, string, error) {
 }
 
 func (fsys *Filesys) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "RemoveXattr", op)
+	defer span.End()
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("RemoveXattr %d", op.Inode)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "RemoveXattr %d", op.Inode)
 	}
 
 	// Grab the inode.
-	file, _, err := fsys.lookupFileByInode(ctx, oph, int64(op.Inode))
+	node, err := fsys.lookupNodeByInode(ctx, oph, int64(op.Inode))
 	if err != nil {
 		return err
 	}
+	if dir, ok := node.(Dir); ok {
+		return fsys.removeDirXattr(ctx, oph, dir, op.Name)
+	}
+	file := node.(File)
 	if !fsys.checkProjectPermissions(file.ProjId, PERM_CONTRIBUTE) {
 		return syscall.EPERM
 	}
@@ -1774,7 +3349,7 @@ func (fsys *Filesys) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp)
 			}
 		}
 	case XATTR_BASE:
-		fsys.log("property must start with one of {%s ,%s}", XATTR_TAG, XATTR_PROP)
+		fsys.logAt(LOG_WARN, "property must start with one of {%s ,%s}", XATTR_TAG, XATTR_PROP)
 		return fuse.EINVAL
 	}
 
@@ -1800,7 +3375,7 @@ func (fsys *Filesys) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp)
 
 	// update the database
 	if err := fsys.mdb.UpdateFileTagsAndProperties(ctx, oph, file); err != nil {
-		fsys.log("database error in RemoveXattr: %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in RemoveXattr: %s", err.Error())
 		return fuse.EIO
 	}
 	return nil
@@ -1821,28 +3396,51 @@ func (fsys *Filesys) getXattrFill(op *fuseops.GetXattrOp, val_str string) error
 }
 
 func (fsys *Filesys) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "GetXattr", op)
+	defer span.End()
+	file, gen, err := fsys.getXattr(ctx, op)
+	if err != nil || file == nil {
+		return err
+	}
+
+	// The attribute is in the description of the file, which is not
+	// cached. The platform is called without the global lock.
+	_, attrName, _ := fsys.xattrParseName(op.Name)
+	desc, err := fsys.describeExtended(ctx, *file, gen)
+	if err != nil {
+		span.SetError(err)
+		return err
+	}
+	return fsys.getXattrExtendedFill(op, desc, attrName)
+}
+
+// Get an attribute, with the global lock held. If the attribute comes from
+// a description of the file that is not cached, return the file, and the
+// generation of the describe cache.
+func (fsys *Filesys) getXattr(ctx context.Context, op *fuseops.GetXattrOp) (*File, uint64, error) {
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("GetXattr %d", op.Inode)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "GetXattr %d", op.Inode)
 	}
 
 	// Grab the inode.
-	file, isDir, err := fsys.lookupFileByInode(ctx, oph, int64(op.Inode))
-	if isDir {
-		return fuse.ENOATTR
-	}
+	node, err := fsys.lookupNodeByInode(ctx, oph, int64(op.Inode))
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+	if dir, ok := node.(Dir); ok {
+		return nil, 0, fsys.getDirXattr(ctx, oph, op, dir)
 	}
+	file := node.(File)
 
 	// look for the attribute
 	namespace, attrName, err := fsys.xattrParseName(op.Name)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
 	switch namespace {
@@ -1851,7 +3449,7 @@ func (fsys *Filesys) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error
 		// If so, return an empty string
 		for _, tag := range file.Tags {
 			if tag == attrName {
-				return fsys.getXattrFill(op, "")
+				return nil, 0, fsys.getXattrFill(op, "")
 			}
 		}
 	case XATTR_PROP:
@@ -1859,7 +3457,7 @@ func (fsys *Filesys) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error
 		// If so, return the value.
 		for key, value := range file.Properties {
 			if key == attrName {
-				return fsys.getXattrFill(op, value)
+				return nil, 0, fsys.getXattrFill(op, value)
 			}
 		}
 	case XATTR_BASE:
@@ -1868,50 +3466,85 @@ func (fsys *Filesys) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error
 		// attributes here.
 		switch attrName {
 		case "state":
-			return fsys.getXattrFill(op, file.State)
+			return nil, 0, fsys.getXattrFill(op, file.State)
 		case "archivalState":
-			return fsys.getXattrFill(op, file.ArchivalState)
+			if file.ArchivalState == "unarchiving" {
+				fsys.archival.Track(file.Id, file.ProjId)
+			}
+			return nil, 0, fsys.getXattrFill(op, file.ArchivalState)
 		case "id" :
-			return fsys.getXattrFill(op, file.Id)
+			return nil, 0, fsys.getXattrFill(op, file.Id)
+		case "materialize":
+			return nil, 0, fsys.getXattrFill(op, fsys.materializeState(file))
+		case "tags", "properties":
+			value, err := xattrTagsPropsEncode(file, attrName)
+			if err != nil {
+				return nil, 0, fuse.EIO
+			}
+			return nil, 0, fsys.getXattrFill(op, value)
+		default:
+			if file.Id == "" || !isFileExtendedXattr(attrName) {
+				break
+			}
+			if desc, ok := fsys.describeCache.Get(file.ProjId, file.Id); ok {
+				return nil, 0, fsys.getXattrExtendedFill(op, desc, attrName)
+			}
+			return &file, fsys.describeCache.Generation(), nil
 		}
 	}
 
 	// There is no such attribute
-	return fuse.ENOATTR
+	return nil, 0, fuse.ENOATTR
 }
 
 // Make a list of all the extended attributes
 func (fsys *Filesys) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "ListXattr", op)
+	defer span.End()
+
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("ListXattr %d", op.Inode)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "ListXattr %d", op.Inode)
 	}
 
 	// Grab the inode.
-	file, _, err := fsys.lookupFileByInode(ctx, oph, int64(op.Inode))
+	node, err := fsys.lookupNodeByInode(ctx, oph, int64(op.Inode))
 	if err != nil {
 		return err
 	}
 
 	// collect all the properties into one array
 	var xattrKeys []string
-	for _, tag := range file.Tags {
-		xattrKeys = append(xattrKeys, XATTR_TAG + "." + tag)
-	}
-	for key, _ := range file.Properties {
-		xattrKeys = append(xattrKeys, XATTR_PROP + "." + key)
-	}
-	// Special attributes
-	for _, key := range []string{ "state", "archivalState", "id"} {
-		xattrKeys = append(xattrKeys, XATTR_BASE + "." + key)
+	switch node.(type) {
+	case File:
+		file := node.(File)
+		for _, tag := range file.Tags {
+			xattrKeys = append(xattrKeys, XATTR_TAG + "." + tag)
+		}
+		for key, _ := range file.Properties {
+			xattrKeys = append(xattrKeys, XATTR_PROP + "." + key)
+		}
+		// Special attributes. The same names are listed for every file, an
+		// attribute that a file does not have is reported as missing when read.
+		for _, key := range []string{ "state", "archivalState", "id", "tags", "properties"} {
+			xattrKeys = append(xattrKeys, XATTR_BASE + "." + key)
+		}
+		for _, key := range fileExtendedXattrNames {
+			xattrKeys = append(xattrKeys, XATTR_BASE + "." + key)
+		}
+	case Dir:
+		xattrKeys, err = fsys.dirXattrKeys(ctx, oph, node.(Dir))
+		if err != nil {
+			return err
+		}
 	}
-	if fsys.options.Verbose {
-		fsys.log("attribute keys: %v", xattrKeys)
-		fsys.log("output buffer len=%d", len(op.Dst))
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "attribute keys: %v", xattrKeys)
+		fsys.logCtx(ctx, LOG_DEBUG, "output buffer len=%d", len(op.Dst))
 	}
 
 	// encode the names as a sequence of null-terminated strings
@@ -1932,20 +3565,106 @@ func (fsys *Filesys) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) err
 	return nil
 }
 
+// Writing "live" to base.archivalState asks the platform to unarchive the
+// file. The state changes to unarchiving right away, and to live when the
+// platform has restored the file. The API call is made without holding
+// the global lock.
+func (fsys *Filesys) unarchive(ctx context.Context, inode int64, value string) error {
+	if value != "live" {
+		fsys.logAt(LOG_WARN, "the archival state can only be set to live, not %s", value)
+		return syscall.EINVAL
+	}
+	file, needed, err := fsys.unarchiveStart(ctx, inode)
+	if err != nil || !needed {
+		return err
+	}
+
+	httpClient := <- fsys.httpClientPool
+	err = fsys.ops.DxUnarchive(ctx, httpClient, file.ProjId, file.Id)
+	fsys.httpClientPool <- httpClient
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "unarchive %s: %s", file.Id, err.Error())
+		return fuse.EIO
+	}
+
+	fsys.lockOp(ctx)
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient(ctx)
+	defer fsys.opClose(oph)
+	if err := fsys.mdb.UpdateArchivalState(ctx, oph, file.Id, file.ProjId, "unarchiving"); err != nil {
+		fsys.logAt(LOG_ERROR, "database error in unarchive %s", err.Error())
+		oph.RecordError(err)
+		return fuse.EIO
+	}
+	fsys.archival.Track(file.Id, file.ProjId)
+	return nil
+}
+
+// Check that a file can be unarchived. Return false if there is
+// nothing to do.
+func (fsys *Filesys) unarchiveStart(ctx context.Context, inode int64) (File, bool, error) {
+	fsys.lockOp(ctx)
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient(ctx)
+	defer fsys.opClose(oph)
+
+	file, _, err := fsys.lookupFileByInode(ctx, oph, inode)
+	if err != nil {
+		return File{}, false, err
+	}
+	if !fsys.checkProjectPermissions(file.ProjId, PERM_CONTRIBUTE) {
+		return File{}, false, syscall.EPERM
+	}
+	switch file.ArchivalState {
+	case "live", "unarchiving":
+		// nothing to do
+		return file, false, nil
+	case "archival", "archived":
+	default:
+		return File{}, false, syscall.EINVAL
+	}
+	if file.Id == "" {
+		// a new file, it was never archived
+		return File{}, false, syscall.EINVAL
+	}
+	return file, true, nil
+}
+
 func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
-	fsys.mutex.Lock()
+	ctx, span := fsys.startOp(ctx, "SetXattr", op)
+	defer span.End()
+	if strings.TrimPrefix(op.Name, "user.") == XATTR_MATERIALIZE {
+		// this is a command, not an attribute. The attribute always
+		// exists, and reports the state of the download.
+		if err := fsys.xattrCheckFlags(op.Flags, true); err != nil {
+			return err
+		}
+		if string(op.Value) != "1" {
+			fsys.logAt(LOG_WARN, "%s must be set to 1", XATTR_MATERIALIZE)
+			return syscall.EINVAL
+		}
+		return fsys.Materialize(ctx, int64(op.Inode))
+	}
+	if strings.TrimPrefix(op.Name, "user.") == XATTR_ARCHIVAL_STATE {
+		if err := fsys.xattrCheckFlags(op.Flags, true); err != nil {
+			return err
+		}
+		return fsys.unarchive(ctx, int64(op.Inode), string(op.Value))
+	}
+
+	fsys.lockOp(ctx)
 	defer fsys.mutex.Unlock()
-	oph := fsys.opOpen()
+	oph := fsys.opOpen(ctx)
 	defer fsys.opClose(oph)
 
-	if fsys.options.Verbose {
-		fsys.log("SetXattr %d", op.Inode)
+	if fsys.logEnabled(LOG_DEBUG) {
+		fsys.logCtx(ctx, LOG_DEBUG, "SetXattr %d", op.Inode)
 	}
 
 	// Grab the inode.
 	node, ok, err := fsys.mdb.LookupByInode(ctx, oph, int64(op.Inode))
 	if err != nil {
-		fsys.log("database error in SetXattr: %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in SetXattr: %s", err.Error())
 		return fuse.EIO
 	}
 	if !ok {
@@ -1957,12 +3676,9 @@ func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error
 	case File:
 		file = node.(File)
 	case Dir:
-		// directories do not have attributes
-		//
-		// Note: we may want to change this for directories
-		// representing projects. This would allow reporting project
-		// tags and properties.
-		return syscall.EINVAL
+		// only directories representing projects have tags and
+		// properties.
+		return fsys.setDirXattr(ctx, oph, op, node.(Dir))
 	}
 	if !fsys.checkProjectPermissions(file.ProjId, PERM_CONTRIBUTE) {
 		return syscall.EPERM
@@ -1977,7 +3693,21 @@ func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error
 	if err != nil {
 		return err
 	}
-
+	if namespace == XATTR_BASE && (attrName == "tags" || attrName == "properties") {
+		// replace all the tags, or all the properties, at once
+		if err := fsys.xattrCheckFlags(op.Flags, true); err != nil {
+			return err
+		}
+		if err := xattrTagsPropsDecode(&file, attrName, op.Value); err != nil {
+			fsys.logAt(LOG_ERROR, "SetXattr %s: %s", op.Name, err.Error())
+			return syscall.EINVAL
+		}
+		if err := fsys.mdb.UpdateFileTagsAndProperties(ctx, oph, file); err != nil {
+			fsys.logAt(LOG_ERROR, "database error in SetXattr %s", err.Error())
+			return fuse.EIO
+		}
+		return nil
+	}
 	switch namespace {
 	case XATTR_TAG:
 		// this is in the tag namespace
@@ -1996,26 +3726,13 @@ func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error
 			}
 		}
 	default:
-		fsys.log("property must start with one of {%s ,%s}", XATTR_TAG, XATTR_PROP)
+		fsys.logAt(LOG_WARN, "property must start with one of {%s ,%s}", XATTR_TAG, XATTR_PROP)
 		return fuse.EINVAL
 	}
 
 	// cases of early return
-	switch op.Flags {
-	case 0x1:
-		if attrExists {
-			return fuse.EEXIST
-		}
-	case 0x2:
-		if !attrExists {
-			return fuse.ENOATTR
-		}
-	case 0x0:
-		// can accept both cases
-	default:
-		fsys.log("invalid SetAttr flag value %d, expecting one of {0x0, 0x1, 0x2}",
-			op.Flags)
-		return syscall.EINVAL
+	if err := fsys.xattrCheckFlags(op.Flags, attrExists); err != nil {
+		return err
 	}
 
 	// update the file in-memory representation
@@ -2037,8 +3754,351 @@ func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error
 
 	// update the database
 	if err := fsys.mdb.UpdateFileTagsAndProperties(ctx, oph, file); err != nil {
-		fsys.log("database error in SetXattr %s", err.Error())
+		fsys.logAt(LOG_ERROR, "database error in SetXattr %s", err.Error())
 		return fuse.EIO
 	}
 	return nil
 }
+
+// ===
+// Extended base attributes of files
+//
+// These come from a describe call, made the first time one of them is read.
+// They are read-only.
+
+var fileExtendedXattrNames = []string{
+	"created", "modified", "createdBy", "md5", "media",
+	"folder", "project", "hidden", "sponsored", "details",
+}
+
+func isFileExtendedXattr(name string) bool {
+	for _, n := range fileExtendedXattrNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The value of an extended attribute, and false if the object does not have it.
+// Times are in milliseconds since the epoch, details are JSON.
+func fileExtendedXattr(desc *DxDescribeExtended, name string) (string, bool) {
+	switch name {
+	case "created":
+		return strconv.FormatInt(desc.CreatedMillisec, 10), true
+	case "modified":
+		return strconv.FormatInt(desc.ModifiedMillisec, 10), true
+	case "createdBy":
+		return desc.CreatedBy, desc.CreatedBy != ""
+	case "md5":
+		return desc.Md5, desc.Md5 != ""
+	case "media":
+		return desc.Media, desc.Media != ""
+	case "folder":
+		return desc.Folder, true
+	case "project":
+		return desc.ProjId, true
+	case "hidden":
+		return strconv.FormatBool(desc.Hidden), true
+	case "sponsored":
+		return strconv.FormatBool(desc.Sponsored), true
+	case "details":
+		if len(desc.Details) == 0 {
+			return "{}", true
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, desc.Details); err != nil {
+			return string(desc.Details), true
+		}
+		return buf.String(), true
+	}
+	return "", false
+}
+
+// Describe a file for its extended attributes, without the global lock. The
+// description is cached by object ID; a file that is modified gets a new ID
+// once it is uploaded. If descriptions were dropped since [gen], this one may
+// predate a rename or a metadata sync, and is not cached.
+func (fsys *Filesys) describeExtended(ctx context.Context, file File, gen uint64) (*DxDescribeExtended, error) {
+	httpClient := <- fsys.httpClientPool
+	desc, err := DxDescribeObjectExtended(ctx, httpClient, &fsys.dxEnv, file.ProjId, file.Id)
+	fsys.httpClientPool <- httpClient
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Could not describe %s: %s", file.Id, err.Error())
+		return nil, fsys.translateError(err)
+	}
+
+	fsys.lockOp(ctx)
+	defer fsys.mutex.Unlock()
+	if fsys.describeCache.Generation() == gen {
+		fsys.describeCache.Add(file.ProjId, file.Id, desc)
+	}
+	return desc, nil
+}
+
+// An extended attribute that the object does not have is reported as missing
+func (fsys *Filesys) getXattrExtendedFill(op *fuseops.GetXattrOp, desc *DxDescribeExtended, attrName string) error {
+	if value, ok := fileExtendedXattr(desc, attrName); ok {
+		return fsys.getXattrFill(op, value)
+	}
+	return fuse.ENOATTR
+}
+
+// The description of an object is out of date. Called with the global lock held.
+func (fsys *Filesys) describeCacheDrop(projId string, fileId string) {
+	fsys.describeCache.Drop(projId, fileId)
+}
+
+// Drop the descriptions of all the objects in a project. This is used when a folder
+// is renamed or moved, instead of finding the objects it holds.
+func (fsys *Filesys) describeCacheDropProject(projId string) {
+	fsys.describeCache.DropProject(projId)
+}
+
+// The tags and properties of a file were updated on the platform, by the
+// sync daemon. It does not hold the global lock.
+func (fsys *Filesys) metadataSynced(projId string, fileId string) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	fsys.describeCacheDrop(projId, fileId)
+}
+
+// ===
+// Directory xattrs
+//
+// Every directory backed by a project folder has a base.projFolder
+// attribute. A directory that stands for an entire project also reports
+// the project's description, tags, and properties. The tags and properties
+// of a project can be modified, the changes are applied on the platform right
+// away.
+
+// The order in which the base attributes of a directory are listed
+var dirBaseXattrNames = []string{ "projFolder", "id", "name", "region", "level", "dataUsageGiB" }
+
+func (fsys *Filesys) isProjectRoot(dir Dir) bool {
+	return dir.ProjId != "" && dir.ProjFolder == "/"
+}
+
+// Describe a project, with its tags and properties. The description is
+// cached, and kept up to date when the tags and properties are modified.
+func (fsys *Filesys) projectDescribe(ctx context.Context, oph *OpHandle, projId string) (*DxDescribePrj, error) {
+	if pDesc, ok := fsys.projXattrs[projId]; ok {
+		return pDesc, nil
+	}
+	pDesc, err := DxDescribeProject(ctx, oph.httpClient, &fsys.dxEnv, projId)
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Could not describe project %s: %s", projId, err.Error())
+		oph.RecordError(err)
+		return nil, fsys.translateError(err)
+	}
+	if pDesc.Properties == nil {
+		pDesc.Properties = make(map[string]string)
+	}
+	fsys.projXattrs[projId] = pDesc
+	return pDesc, nil
+}
+
+// The base attributes of a directory. For a project directory, also
+// return the project description.
+func (fsys *Filesys) dirBaseXattrs(ctx context.Context, oph *OpHandle, dir Dir) (map[string]string, *DxDescribePrj, error) {
+	base := make(map[string]string)
+	if dir.ProjFolder != "" {
+		base["projFolder"] = dir.ProjFolder
+	}
+	if !fsys.isProjectRoot(dir) {
+		return base, nil, nil
+	}
+
+	pDesc, err := fsys.projectDescribe(ctx, oph, dir.ProjId)
+	if err != nil {
+		return nil, nil, err
+	}
+	base["id"] = pDesc.Id
+	base["name"] = pDesc.Name
+	base["region"] = pDesc.Region
+	base["level"] = projectPermissionsToString(pDesc.Level)
+	base["dataUsageGiB"] = strconv.FormatFloat(pDesc.DataUsageGiB, 'f', -1, 64)
+	return base, pDesc, nil
+}
+
+func (fsys *Filesys) dirXattrKeys(ctx context.Context, oph *OpHandle, dir Dir) ([]string, error) {
+	base, pDesc, err := fsys.dirBaseXattrs(ctx, oph, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var xattrKeys []string
+	if pDesc != nil {
+		for _, tag := range pDesc.Tags {
+			xattrKeys = append(xattrKeys, XATTR_TAG + "." + tag)
+		}
+		for key, _ := range pDesc.Properties {
+			xattrKeys = append(xattrKeys, XATTR_PROP + "." + key)
+		}
+	}
+	for _, key := range dirBaseXattrNames {
+		if _, ok := base[key]; ok {
+			xattrKeys = append(xattrKeys, XATTR_BASE + "." + key)
+		}
+	}
+	return xattrKeys, nil
+}
+
+func (fsys *Filesys) getDirXattr(ctx context.Context, oph *OpHandle, op *fuseops.GetXattrOp, dir Dir) error {
+	namespace, attrName, err := fsys.xattrParseName(op.Name)
+	if err != nil {
+		return err
+	}
+	switch namespace {
+	case XATTR_TAG, XATTR_PROP, XATTR_BASE:
+	default:
+		// not one of ours, there is no need to describe the project
+		return fuse.ENOATTR
+	}
+
+	base, pDesc, err := fsys.dirBaseXattrs(ctx, oph, dir)
+	if err != nil {
+		return err
+	}
+	switch namespace {
+	case XATTR_TAG:
+		if pDesc == nil {
+			break
+		}
+		for _, tag := range pDesc.Tags {
+			if tag == attrName {
+				return fsys.getXattrFill(op, "")
+			}
+		}
+	case XATTR_PROP:
+		if pDesc == nil {
+			break
+		}
+		if value, ok := pDesc.Properties[attrName]; ok {
+			return fsys.getXattrFill(op, value)
+		}
+	case XATTR_BASE:
+		if value, ok := base[attrName]; ok {
+			return fsys.getXattrFill(op, value)
+		}
+	}
+
+	// There is no such attribute
+	return fuse.ENOATTR
+}
+
+func (fsys *Filesys) setDirXattr(ctx context.Context, oph *OpHandle, op *fuseops.SetXattrOp, dir Dir) error {
+	if !fsys.isProjectRoot(dir) {
+		// only directories representing projects have tags and properties
+		return syscall.EINVAL
+	}
+	if !fsys.checkProjectPermissions(dir.ProjId, PERM_CONTRIBUTE) {
+		return syscall.EPERM
+	}
+	namespace, attrName, err := fsys.xattrParseName(op.Name)
+	if err != nil {
+		return err
+	}
+	pDesc, err := fsys.projectDescribe(ctx, oph, dir.ProjId)
+	if err != nil {
+		return err
+	}
+
+	attrExists := false
+	switch namespace {
+	case XATTR_TAG:
+		for _, tag := range pDesc.Tags {
+			if tag == attrName {
+				attrExists = true
+				break
+			}
+		}
+	case XATTR_PROP:
+		_, attrExists = pDesc.Properties[attrName]
+	default:
+		fsys.logAt(LOG_WARN, "property must start with one of {%s ,%s}", XATTR_TAG, XATTR_PROP)
+		return fuse.EINVAL
+	}
+	if err := fsys.xattrCheckFlags(op.Flags, attrExists); err != nil {
+		return err
+	}
+
+	// update the project on the platform, and then the cached description
+	switch namespace {
+	case XATTR_TAG:
+		if attrExists {
+			// The tag is already set. There is no need
+			// to tag again.
+			return nil
+		}
+		err = fsys.ops.DxAddTags(ctx, oph.httpClient, "", dir.ProjId, []string{ attrName })
+		if err == nil {
+			pDesc.Tags = append(pDesc.Tags, attrName)
+		}
+	case XATTR_PROP:
+		value := string(op.Value)
+		err = fsys.ops.DxSetProperties(ctx, oph.httpClient, "", dir.ProjId,
+			map[string](*string){ attrName : &value })
+		if err == nil {
+			pDesc.Properties[attrName] = value
+		}
+	}
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Error setting attribute %s on project %s: %s", op.Name, dir.ProjId, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	return nil
+}
+
+func (fsys *Filesys) removeDirXattr(ctx context.Context, oph *OpHandle, dir Dir, name string) error {
+	if !fsys.isProjectRoot(dir) {
+		return fuse.ENOATTR
+	}
+	if !fsys.checkProjectPermissions(dir.ProjId, PERM_CONTRIBUTE) {
+		return syscall.EPERM
+	}
+	namespace, attrName, err := fsys.xattrParseName(name)
+	if err != nil {
+		return err
+	}
+	pDesc, err := fsys.projectDescribe(ctx, oph, dir.ProjId)
+	if err != nil {
+		return err
+	}
+
+	switch namespace {
+	case XATTR_TAG:
+		var tags []string
+		for _, tag := range pDesc.Tags {
+			if tag != attrName {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == len(pDesc.Tags) {
+			return fuse.ENOATTR
+		}
+		err = fsys.ops.DxRemoveTags(ctx, oph.httpClient, "", dir.ProjId, []string{ attrName })
+		if err == nil {
+			pDesc.Tags = tags
+		}
+	case XATTR_PROP:
+		if _, ok := pDesc.Properties[attrName]; !ok {
+			return fuse.ENOATTR
+		}
+		err = fsys.ops.DxSetProperties(ctx, oph.httpClient, "", dir.ProjId,
+			map[string](*string){ attrName : nil })
+		if err == nil {
+			delete(pDesc.Properties, attrName)
+		}
+	default:
+		fsys.logAt(LOG_WARN, "property must start with one of {%s ,%s}", XATTR_TAG, XATTR_PROP)
+		return fuse.EINVAL
+	}
+	if err != nil {
+		fsys.logAt(LOG_ERROR, "Error removing attribute %s from project %s: %s", name, dir.ProjId, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	return nil
+}
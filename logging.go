@@ -0,0 +1,303 @@
+package dxfuse
+
+// Leveled logging, with per-module filters.
+//
+// Every module writes through LogMsg, or one of its variants, with its name as
+// a header (prefetch, sync_db_dx, posix, CmdServer, manifest, ...). A message is
+// written if its level is enabled for the module. The output is either plain
+// text, or one JSON object per line.
+//
+// FUSE operations that may call the platform are assigned a correlation ID,
+// carried in their context. Messages logged with that context, including the
+// ones for the API calls the operation makes, are tagged with the ID.
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LOG_ERROR = 0
+	LOG_WARN = 1
+	LOG_INFO = 2
+	LOG_DEBUG = 3
+	LOG_TRACE = 4
+)
+
+var logLevelNames = []string{ "error", "warn", "info", "debug", "trace" }
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+type LogConfig struct {
+	Level        int             // applies to modules without a filter
+	ModuleLevels map[string]int  // per module filters
+	Format       string          // text or json
+
+	// Where to write the log. If nil, messages go through the standard
+	// log package.
+	Output       io.Writer
+}
+
+type logState struct {
+	mutex   sync.Mutex
+	cfg     LogConfig
+}
+
+var logSt = &logState{
+	cfg : LogConfig{
+		Level : LOG_INFO,
+		ModuleLevels : make(map[string]int),
+		Format : LOG_FORMAT_TEXT,
+		Output : nil,
+	},
+}
+
+// The levels are checked on every log call, including the ones that end up
+// being filtered out. They are kept in an immutable table, that is replaced
+// as a whole, so that the check does not take a lock.
+type logLevelTable struct {
+	level        int
+	moduleLevels map[string]int
+}
+
+var logLevels atomic.Value
+
+func init() {
+	logLevels.Store(&logLevelTable{
+		level : LOG_INFO,
+		moduleLevels : make(map[string]int),
+	})
+}
+
+func InitLogging(cfg LogConfig) {
+	if cfg.ModuleLevels == nil {
+		cfg.ModuleLevels = make(map[string]int)
+	}
+	if cfg.Format == "" {
+		cfg.Format = LOG_FORMAT_TEXT
+	}
+	levels := &logLevelTable{
+		level : cfg.Level,
+		moduleLevels : make(map[string]int),
+	}
+	for name, level := range cfg.ModuleLevels {
+		levels.moduleLevels[name] = level
+	}
+
+	logSt.mutex.Lock()
+	logSt.cfg = cfg
+	logSt.mutex.Unlock()
+	logLevels.Store(levels)
+}
+
+// Convert a level name (error, warn, info, debug, trace) to a level
+func ParseLogLevel(name string) (int, error) {
+	for i, lvl := range logLevelNames {
+		if strings.ToLower(name) == lvl {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s, should be one of %v", name, logLevelNames)
+}
+
+// Parse a list of module filters, such as "prefetch=debug,sync_db_dx=error".
+func ParseLogModules(spec string) (map[string]int, error) {
+	moduleLevels := make(map[string]int)
+	if spec == "" {
+		return moduleLevels, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.Split(item, "=")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("bad module filter %s, should be MODULE=LEVEL", item)
+		}
+		level, err := ParseLogLevel(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		moduleLevels[parts[0]] = level
+	}
+	return moduleLevels, nil
+}
+
+// The log level matching the -verbose flag
+func VerboseToLogLevel(verboseLevel int) int {
+	switch {
+	case verboseLevel <= 0:
+		return LOG_INFO
+	case verboseLevel == 1:
+		return LOG_DEBUG
+	default:
+		return LOG_TRACE
+	}
+}
+
+// Is this level enabled for the module?
+func LogEnabled(moduleName string, level int) bool {
+	levels := logLevels.Load().(*logLevelTable)
+	if mLevel, ok := levels.moduleLevels[moduleName]; ok {
+		return level <= mLevel
+	}
+	return level <= levels.level
+}
+
+type logRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Module  string `json:"module"`
+	OpId    uint64 `json:"op,omitempty"`
+	Msg     string `json:"msg"`
+}
+
+func logWrite(level int, moduleName string, opId uint64, a string, args ...interface{}) {
+	if !LogEnabled(moduleName, level) {
+		return
+	}
+	msg := fmt.Sprintf(a, args...)
+	now := time.Now()
+
+	logSt.mutex.Lock()
+	defer logSt.mutex.Unlock()
+
+	if logSt.cfg.Format == LOG_FORMAT_JSON {
+		rec := logRecord{
+			Time : now.Format(time.RFC3339Nano),
+			Level : logLevelNames[level],
+			Module : moduleName,
+			OpId : opId,
+			Msg : msg,
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return
+		}
+		line = append(line, '\n')
+		if logSt.cfg.Output != nil {
+			logSt.cfg.Output.Write(line)
+		} else {
+			os.Stderr.Write(line)
+		}
+		return
+	}
+
+	hdr := moduleName
+	if level != LOG_INFO {
+		hdr = fmt.Sprintf("%s %s", strings.ToUpper(logLevelNames[level]), moduleName)
+	}
+	if opId != 0 {
+		hdr = fmt.Sprintf("%s op=%d", hdr, opId)
+	}
+	if logSt.cfg.Output != nil {
+		fmt.Fprintf(logSt.cfg.Output, "%s %s: %s\n", Time2string(now), hdr, msg)
+	} else {
+		log.Printf("%s %s: %s", Time2string(now), hdr, msg)
+	}
+}
+
+// Write an informational message
+func LogMsg(moduleName string, a string, args ...interface{}) {
+	logWrite(LOG_INFO, moduleName, 0, a, args...)
+}
+
+func LogMsgLevel(level int, moduleName string, a string, args ...interface{}) {
+	logWrite(level, moduleName, 0, a, args...)
+}
+
+// Write a message tagged with the correlation ID of the operation, if any
+func LogMsgCtx(ctx context.Context, level int, moduleName string, a string, args ...interface{}) {
+	logWrite(level, moduleName, OpIdFromContext(ctx), a, args...)
+}
+
+// Correlation IDs
+type opIdKey struct {}
+
+var opIdCounter uint64 = 0
+
+// Assign a fresh correlation ID to an operation
+func NewOpContext(ctx context.Context) context.Context {
+	id := atomic.AddUint64(&opIdCounter, 1)
+	return context.WithValue(ctx, opIdKey{}, id)
+}
+
+func OpIdFromContext(ctx context.Context) uint64 {
+	if ctx == nil {
+		return 0
+	}
+	if id, ok := ctx.Value(opIdKey{}).(uint64); ok {
+		return id
+	}
+	return 0
+}
+
+// A log file that is rotated when it grows beyond a size limit. The current file
+// is renamed to PATH.1, the previous PATH.1 to PATH.2, and so on. Only [maxBackups]
+// old files are kept.
+type RotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64   // zero means no rotation
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE | os.O_APPEND | os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &RotatingFile{
+		path : path,
+		maxSize : maxSize,
+		maxBackups : maxBackups,
+		f : f,
+		size : 0,
+	}, nil
+}
+
+// Called with the lock held
+func (rf *RotatingFile) rotate() error {
+	rf.f.Close()
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if rf.maxBackups > 0 {
+		os.Rename(rf.path, rf.path + ".1")
+	}
+	f, err := os.OpenFile(rf.path, os.O_RDWR | os.O_CREATE | os.O_APPEND | os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	rf.f = f
+	rf.size = 0
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.maxSize > 0 && rf.size + int64(len(p)) > rf.maxSize && rf.size > 0 {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.f.Close()
+}
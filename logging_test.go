@@ -0,0 +1,249 @@
+package dxfuse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	testCases := []struct {
+		name  string
+		level int
+		ok    bool
+	}{
+		{ "error", LOG_ERROR, true },
+		{ "warn", LOG_WARN, true },
+		{ "info", LOG_INFO, true },
+		{ "debug", LOG_DEBUG, true },
+		{ "trace", LOG_TRACE, true },
+		{ "DEBUG", LOG_DEBUG, true },
+		{ "Warn", LOG_WARN, true },
+		{ "", 0, false },
+		{ "verbose", 0, false },
+		{ "3", 0, false },
+	}
+	for _, tc := range testCases {
+		level, err := ParseLogLevel(tc.name)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: expected ok=%t, got error %v", tc.name, tc.ok, err)
+			continue
+		}
+		if tc.ok && level != tc.level {
+			t.Errorf("%q: expected level %d, got %d", tc.name, tc.level, level)
+		}
+	}
+}
+
+func TestParseLogModules(t *testing.T) {
+	testCases := []struct {
+		spec    string
+		modules map[string]int
+		ok      bool
+	}{
+		{ "", map[string]int{}, true },
+		{ "prefetch=debug", map[string]int{ "prefetch" : LOG_DEBUG }, true },
+		{
+			"prefetch=debug,sync_db_dx=error",
+			map[string]int{ "prefetch" : LOG_DEBUG, "sync_db_dx" : LOG_ERROR },
+			true,
+		},
+
+		// the last filter for a module wins
+		{ "posix=info,posix=trace", map[string]int{ "posix" : LOG_TRACE }, true },
+
+		{ "prefetch", nil, false },
+		{ "=debug", nil, false },
+		{ "prefetch=", nil, false },
+		{ "prefetch=loud", nil, false },
+		{ "prefetch=debug=trace", nil, false },
+		{ "prefetch=debug,", nil, false },
+	}
+	for _, tc := range testCases {
+		modules, err := ParseLogModules(tc.spec)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: expected ok=%t, got error %v", tc.spec, tc.ok, err)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if len(modules) != len(tc.modules) {
+			t.Errorf("%q: expected %v, got %v", tc.spec, tc.modules, modules)
+			continue
+		}
+		for name, level := range tc.modules {
+			if modules[name] != level {
+				t.Errorf("%q: expected %s=%d, got %d", tc.spec, name, level, modules[name])
+			}
+		}
+	}
+}
+
+func TestVerboseToLogLevel(t *testing.T) {
+	testCases := []struct {
+		verbose int
+		level   int
+	}{
+		{ -1, LOG_INFO },
+		{ 0, LOG_INFO },
+		{ 1, LOG_DEBUG },
+		{ 2, LOG_TRACE },
+		{ 5, LOG_TRACE },
+	}
+	for _, tc := range testCases {
+		if level := VerboseToLogLevel(tc.verbose); level != tc.level {
+			t.Errorf("verbose=%d: expected level %d, got %d", tc.verbose, tc.level, level)
+		}
+	}
+}
+
+// A module filter overrides the global level, in both directions
+func TestLogEnabled(t *testing.T) {
+	defer InitLogging(LogConfig{ Level : LOG_INFO })
+	InitLogging(LogConfig{
+		Level : LOG_INFO,
+		ModuleLevels : map[string]int{ "prefetch" : LOG_TRACE, "posix" : LOG_ERROR },
+	})
+
+	testCases := []struct {
+		module  string
+		level   int
+		enabled bool
+	}{
+		{ "manifest", LOG_ERROR, true },
+		{ "manifest", LOG_INFO, true },
+		{ "manifest", LOG_DEBUG, false },
+		{ "prefetch", LOG_DEBUG, true },
+		{ "prefetch", LOG_TRACE, true },
+		{ "posix", LOG_ERROR, true },
+		{ "posix", LOG_WARN, false },
+		{ "posix", LOG_INFO, false },
+	}
+	for _, tc := range testCases {
+		if LogEnabled(tc.module, tc.level) != tc.enabled {
+			t.Errorf("%s level %d: expected enabled=%t", tc.module, tc.level, tc.enabled)
+		}
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	defer InitLogging(LogConfig{ Level : LOG_INFO })
+
+	testCases := []struct {
+		format string
+		level  int
+		opId   uint64
+		check  func(line string) error
+	}{
+		{ LOG_FORMAT_TEXT, LOG_INFO, 0, func(line string) error {
+			if !strings.HasSuffix(line, " manifest: hello 7\n") {
+				return fmt.Errorf("bad text line %q", line)
+			}
+			return nil
+		}},
+		{ LOG_FORMAT_TEXT, LOG_WARN, 12, func(line string) error {
+			if !strings.HasSuffix(line, " WARN manifest op=12: hello 7\n") {
+				return fmt.Errorf("bad text line %q", line)
+			}
+			return nil
+		}},
+		{ LOG_FORMAT_JSON, LOG_DEBUG, 12, func(line string) error {
+			var rec logRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				return err
+			}
+			if rec.Level != "debug" || rec.Module != "manifest" || rec.OpId != 12 || rec.Msg != "hello 7" {
+				return fmt.Errorf("bad json record %+v", rec)
+			}
+			return nil
+		}},
+	}
+	for i, tc := range testCases {
+		var buf bytes.Buffer
+		InitLogging(LogConfig{
+			Level : LOG_TRACE,
+			Format : tc.format,
+			Output : &buf,
+		})
+		logWrite(tc.level, "manifest", tc.opId, "hello %d", 7)
+		if err := tc.check(buf.String()); err != nil {
+			t.Errorf("case %d: %v", i, err)
+		}
+	}
+
+	// filtered messages are not written
+	var buf bytes.Buffer
+	InitLogging(LogConfig{ Level : LOG_WARN, Output : &buf })
+	LogMsg("manifest", "hello")
+	if buf.Len() != 0 {
+		t.Errorf("an info message was written at level warn: %q", buf.String())
+	}
+}
+
+// The current file is rotated when a write would grow it beyond the limit,
+// and only [maxBackups] old files are kept.
+func TestRotatingFile(t *testing.T) {
+	testCases := []struct {
+		maxSize    int64
+		maxBackups int
+		writes     []int
+		current    int64     // size of the current file
+		backups    []int64   // sizes of PATH.1, PATH.2, ...
+	}{
+		// no rotation
+		{ 0, 3, []int{ 10, 10, 10 }, 30, nil },
+
+		// below the limit
+		{ 100, 3, []int{ 10, 10 }, 20, nil },
+
+		// exactly at the limit
+		{ 20, 3, []int{ 10, 10 }, 20, nil },
+
+		// one rotation
+		{ 20, 3, []int{ 10, 10, 5 }, 5, []int64{ 20 } },
+
+		// the backups shift
+		{ 10, 3, []int{ 10, 6, 7, 8 }, 8, []int64{ 7, 6, 10 } },
+
+		// the oldest backup is dropped
+		{ 10, 2, []int{ 10, 6, 7, 8 }, 8, []int64{ 7, 6 } },
+
+		// a write larger than the limit goes into an empty file
+		{ 10, 2, []int{ 25, 5 }, 5, []int64{ 25 } },
+
+		// no backups, the file starts over
+		{ 10, 0, []int{ 8, 8 }, 8, nil },
+	}
+
+	for i, tc := range testCases {
+		path := filepath.Join(t.TempDir(), "dxfuse.log")
+		rf, err := NewRotatingFile(path, tc.maxSize, tc.maxBackups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range tc.writes {
+			if _, err := rf.Write(bytes.Repeat([]byte("x"), n)); err != nil {
+				t.Fatalf("case %d: %v", i, err)
+			}
+		}
+		rf.Close()
+
+		if st, err := os.Stat(path); err != nil || st.Size() != tc.current {
+			t.Errorf("case %d: expected the current file to hold %d bytes, %v %v", i, tc.current, st, err)
+		}
+		for j, size := range tc.backups {
+			st, err := os.Stat(fmt.Sprintf("%s.%d", path, j + 1))
+			if err != nil || st.Size() != size {
+				t.Errorf("case %d: expected backup %d to hold %d bytes, %v", i, j + 1, size, err)
+			}
+		}
+		if _, err := os.Stat(fmt.Sprintf("%s.%d", path, len(tc.backups) + 1)); err == nil {
+			t.Errorf("case %d: there should be %d backups", i, len(tc.backups))
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/dnanexus/dxda"
 )
@@ -40,9 +41,35 @@ type ManifestDir struct {
 	MtimeSeconds int64  `json:"mtime,omitempty"`
 }
 
+// Selects the files in a project folder that match a set of filters.
+// Selectors are resolved into files when the filesystem is mounted.
+type ManifestSelector struct {
+	ProjId        string            `json:"proj_id"`
+	Folder        string            `json:"folder"`
+	Recurse       bool              `json:"recurse,omitempty"`
+
+	// Filters, these may be missing.
+	Name          string            `json:"name,omitempty"`        // glob pattern, such as "*.bam"
+	Class         string            `json:"class,omitempty"`       // only files are supported
+	Tags          []string          `json:"tags,omitempty"`        // the file must have all the tags
+	Properties    map[string]string `json:"properties,omitempty"`  // an empty value matches any value
+
+	// A date (2020-01-31), or a time (2020-01-31T10:00:00Z)
+	CreatedAfter   string           `json:"created_after,omitempty"`
+	CreatedBefore  string           `json:"created_before,omitempty"`
+	ModifiedAfter  string           `json:"modified_after,omitempty"`
+	ModifiedBefore string           `json:"modified_before,omitempty"`
+
+	// The local directory where the files are placed. If [keep_folders] is
+	// set, files in subfolders are placed in matching subdirectories.
+	Parent        string            `json:"parent"`
+	KeepFolders   bool              `json:"keep_folders,omitempty"`
+}
+
 type Manifest struct {
 	Files        []ManifestFile  `json:"files"`
 	Directories  []ManifestDir   `json:"directories"`
+	Selectors    []ManifestSelector `json:"selectors,omitempty"`
 }
 
 
@@ -91,14 +118,86 @@ func (m *Manifest)Validate() error {
 		}
 	}
 
+	for _, sel := range m.Selectors {
+		if _, err := sel.query(); err != nil {
+			return err
+		}
+		if err := validateDirName(sel.Parent); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// Parse a date, or a time, into milliseconds since the epoch
+func parseManifestDate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", s)
+		if err != nil {
+			return 0, fmt.Errorf("bad date %s, should be YYYY-MM-DD, or an RFC3339 time", s)
+		}
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// Build the search for the files matching a selector
+func (sel ManifestSelector) query() (DxFindDataObjectsQuery, error) {
+	var q DxFindDataObjectsQuery
+	if !validProject(sel.ProjId) {
+		return q, fmt.Errorf("project has invalid ID %s", sel.ProjId)
+	}
+	if err := validateDirName(sel.Folder); err != nil {
+		return q, err
+	}
+	if sel.Class != "" && sel.Class != "file" {
+		return q, fmt.Errorf("selector class %s is not supported, only files can be selected", sel.Class)
+	}
+	if sel.Name != "" {
+		if _, err := filepath.Match(sel.Name, ""); err != nil {
+			return q, fmt.Errorf("bad name pattern %s in selector", sel.Name)
+		}
+	}
+
+	q = DxFindDataObjectsQuery{
+		ProjId : sel.ProjId,
+		Folder : filepath.Clean(sel.Folder),
+		Recurse : sel.Recurse,
+		Class : "file",
+		State : "closed",
+		NameGlob : sel.Name,
+		Tags : sel.Tags,
+		Properties : sel.Properties,
+	}
+	var err error
+	if q.CreatedAfter, err = parseManifestDate(sel.CreatedAfter); err != nil {
+		return q, err
+	}
+	if q.CreatedBefore, err = parseManifestDate(sel.CreatedBefore); err != nil {
+		return q, err
+	}
+	if q.ModifiedAfter, err = parseManifestDate(sel.ModifiedAfter); err != nil {
+		return q, err
+	}
+	if q.ModifiedBefore, err = parseManifestDate(sel.ModifiedBefore); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
 // write a log message, and add a header
 func (m Manifest) log(a string, args ...interface{}) {
 	LogMsg("manifest", a, args...)
 }
 
+func (m Manifest) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "manifest", a, args...)
+}
+
 
 func (m *Manifest) Clean() {
 	for i, _ := range m.Files {
@@ -109,6 +208,136 @@ func (m *Manifest) Clean() {
 		d := &m.Directories[i]
 		d.Dirname = filepath.Clean(d.Dirname)
 	}
+	for i, _ := range m.Selectors {
+		sel := &m.Selectors[i]
+		sel.Folder = filepath.Clean(sel.Folder)
+		sel.Parent = filepath.Clean(sel.Parent)
+	}
+}
+
+// Search for the files matching the selectors, and add them to the
+// file list. The search describes the files, so there is no need to
+// query for their details later.
+//
+// A selected file cannot take the place of another file, or of a directory.
+// Such a collision is an error, the selector needs to be narrowed down.
+func (m *Manifest) ResolveSelectors(ctx context.Context, dxEnv dxda.DXEnvironment) error {
+	if len(m.Selectors) == 0 {
+		return nil
+	}
+	tmpHttpClient := dxda.NewHttpClient(false)
+
+	// The files listed by ID may be missing their names. We need
+	// them to detect collisions.
+	var unnamed []string
+	for _, fl := range m.Files {
+		if fl.Fname == "" {
+			unnamed = append(unnamed, fl.FileId)
+		}
+	}
+	if len(unnamed) > 0 {
+		dataObjs, err := DxDescribeBulkObjects(ctx, tmpHttpClient, &dxEnv, unnamed)
+		if err != nil {
+			return err
+		}
+		for i, _ := range m.Files {
+			fl := &m.Files[i]
+			if fDesc, ok := dataObjs[fl.FileId]; ok && fl.Fname == "" {
+				fl.Fname = fDesc.Name
+			}
+		}
+	}
+
+	// a file could be picked by more than one selector
+	type placement struct {
+		fileId string
+		parent string
+	}
+	seen := make(map[placement]bool)
+	usedNames := make(map[string]string)
+	for _, fl := range m.Files {
+		seen[placement{ fl.FileId, fl.Parent }] = true
+		usedNames[filepath.Join(fl.Parent, fl.Fname)] = fl.FileId
+	}
+
+	for _, sel := range m.Selectors {
+		q, err := sel.query()
+		if err != nil {
+			return err
+		}
+		dxObjs, err := DxFindDataObjects(ctx, tmpHttpClient, &dxEnv, q)
+		if err != nil {
+			m.logAt(LOG_ERROR, "Could not search for files in %s:%s", sel.ProjId, sel.Folder)
+			return err
+		}
+		m.log("selector %s:%s name=%s matched %d files", sel.ProjId, sel.Folder, sel.Name, len(dxObjs))
+
+		for _, o := range dxObjs {
+			parent := sel.Parent
+			if sel.KeepFolders {
+				// the folder of the object, relative to the selector folder
+				rel, err := filepath.Rel(q.Folder, o.Folder)
+				if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+					parent = filepath.Join(parent, rel)
+				}
+			}
+			key := placement{ o.Id, parent }
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			if strings.Contains(o.Name, "/") {
+				return fmt.Errorf("selector %s:%s matched file %s, whose name (%s) contains a slash",
+					sel.ProjId, sel.Folder, o.Id, o.Name)
+			}
+
+			// a directory cannot hold two files with the same name
+			fullPath := filepath.Join(parent, o.Name)
+			if otherId, ok := usedNames[fullPath]; ok {
+				return fmt.Errorf("selector %s:%s places file %s at %s, where there is already file %s",
+					sel.ProjId, sel.Folder, o.Id, fullPath, otherId)
+			}
+			if err := m.checkSelectedPath(parent, fullPath); err != nil {
+				return fmt.Errorf("selector %s:%s, file %s: %s", sel.ProjId, sel.Folder, o.Id, err.Error())
+			}
+			usedNames[fullPath] = o.Id
+
+			m.Files = append(m.Files, ManifestFile{
+				ProjId : sel.ProjId,
+				FileId : o.Id,
+				Parent : parent,
+				State : o.State,
+				ArchivalState : o.ArchivalState,
+				Fname : o.Name,
+				Size : o.Size,
+				CtimeSeconds : o.CtimeSeconds,
+				MtimeSeconds : o.MtimeSeconds,
+			})
+		}
+	}
+
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	m.Clean()
+	return nil
+}
+
+// A selected file is placed in a local directory. The directories in the manifest
+// are populated from their project folders, so the file cannot be placed inside one
+// of them, or take the place of one of them, or of their parents.
+func (m *Manifest) checkSelectedPath(parent string, fullPath string) error {
+	for _, d := range m.Directories {
+		if parent == d.Dirname || strings.HasPrefix(parent, d.Dirname + "/") {
+			return fmt.Errorf("%s is inside directory %s, which is mounted from %s:%s",
+				fullPath, d.Dirname, d.ProjId, d.Folder)
+		}
+		if fullPath == d.Dirname || strings.HasPrefix(d.Dirname, fullPath + "/") {
+			return fmt.Errorf("%s collides with directory %s", fullPath, d.Dirname)
+		}
+	}
+	return nil
 }
 
 // read the manifest from a file into a memory structure
@@ -146,7 +375,7 @@ func MakeManifestFromProjectIds(
 	for _, pId := range projectIds {
 		pDesc, err := DxDescribeProject(ctx, tmpHttpClient, &dxEnv, pId)
 		if err != nil {
-			LogMsg("Could not describe project %s, check permissions", pId)
+			LogMsgLevel(LOG_ERROR, "manifest", "Could not describe project %s, check permissions", pId)
 			return nil, err
 		}
 		projDescs[pDesc.Id] = *pDesc
@@ -203,6 +432,105 @@ func ancestors(p string) []string {
 	return append(ators, filepath.Clean(p))
 }
 
+// A path in a project, given on the command line as project:/folder, or
+// project:/folder/file.
+type ProjectPath struct {
+	ProjId  string
+	Path    string
+}
+
+// Add folders and files, given as project paths, to the manifest. A folder is
+// mounted under the project name, at the same path it has in the project. For
+// example, project-xxxx:/runs/2020, where the project name is "mammals", is
+// mounted as /mammals/runs/2020. A path ending with a slash is always a folder;
+// otherwise, we look for a file first, and then for a folder.
+func (m *Manifest) AddProjectPaths(
+	ctx context.Context,
+	dxEnv dxda.DXEnvironment,
+	paths []ProjectPath) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	tmpHttpClient := dxda.NewHttpClient(false)
+
+	projDescs := make(map[string]DxDescribePrj)
+	for _, pp := range paths {
+		if _, ok := projDescs[pp.ProjId]; ok {
+			continue
+		}
+		pDesc, err := DxDescribeProject(ctx, tmpHttpClient, &dxEnv, pp.ProjId)
+		if err != nil {
+			m.logAt(LOG_ERROR, "Could not describe project %s, check permissions", pp.ProjId)
+			return err
+		}
+		if !FilenameIsPosixCompliant(pDesc.Name) {
+			return fmt.Errorf("Project %s has a non posix compliant name (%s)",
+				pDesc.Id, pDesc.Name)
+		}
+		projDescs[pp.ProjId] = *pDesc
+	}
+
+	for _, pp := range paths {
+		if err := validateDirName(pp.Path); err != nil {
+			return err
+		}
+		pDesc := projDescs[pp.ProjId]
+		projRoot := filepath.Clean("/" + pDesc.Name)
+		isFolder := strings.HasSuffix(pp.Path, "/")
+		remotePath := filepath.Clean(pp.Path)
+
+		if !isFolder {
+			// is it a file?
+			q := DxFindDataObjectsQuery{
+				ProjId : pp.ProjId,
+				Folder : filepath.Dir(remotePath),
+				Recurse : false,
+				Class : "file",
+				Name : filepath.Base(remotePath),
+			}
+			dxObjs, err := DxFindDataObjects(ctx, tmpHttpClient, &dxEnv, q)
+			if err != nil {
+				return err
+			}
+			if len(dxObjs) > 0 {
+				// several files may have the same name, choose the newest. This
+				// is the creation time, as when a directory is listed (posix.go).
+				newest := dxObjs[0]
+				for _, o := range dxObjs[1:] {
+					if o.CtimeSeconds > newest.CtimeSeconds {
+						newest = o
+					}
+				}
+				if len(dxObjs) > 1 {
+					m.logAt(LOG_WARN, "%d files are named %s:%s, using the newest (%s)",
+						len(dxObjs), pp.ProjId, remotePath, newest.Id)
+				}
+				m.Files = append(m.Files, ManifestFile{
+					ProjId : pp.ProjId,
+					FileId : newest.Id,
+					Parent : filepath.Join(projRoot, filepath.Dir(remotePath)),
+				})
+				continue
+			}
+		}
+
+		exists, err := DxFolderExists(ctx, tmpHttpClient, &dxEnv, pp.ProjId, remotePath)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s:%s is not a file or a folder", pp.ProjId, pp.Path)
+		}
+		m.Directories = append(m.Directories, ManifestDir{
+			ProjId : pp.ProjId,
+			Folder : remotePath,
+			Dirname : filepath.Join(projRoot, remotePath),
+		})
+	}
+
+	return m.Validate()
+}
+
 // We need all of this, to be able to sort the list of directories according
 // to the number of parts they have.
 // for example
@@ -295,7 +623,10 @@ It is a node in the middle, which is illegal.
 	return retval, nil
 }
 
-func (m *Manifest) FillInMissingFields(ctx context.Context, dxEnv dxda.DXEnvironment) error {
+// Describe the files whose details are missing. A file that is not closed yet
+// is an error, unless [allowOpen] is set; such a file can be opened only once
+// it closes.
+func (m *Manifest) FillInMissingFields(ctx context.Context, dxEnv dxda.DXEnvironment, allowOpen bool) error {
 	tmpHttpClient := dxda.NewHttpClient(false)
 
 	// Make a list of all the files that are missing details
@@ -324,7 +655,7 @@ func (m *Manifest) FillInMissingFields(ctx context.Context, dxEnv dxda.DXEnviron
 		fl := &m.Files[i]
 		fDesc, ok := dataObjs[fl.FileId]
 		if ok {
-			if fDesc.State != "closed" {
+			if fDesc.State != "closed" && !allowOpen {
 				return fmt.Errorf("File %s is not closed, it is %s",
 					fDesc.Id, fDesc.State)
 			}
@@ -355,7 +686,7 @@ func (m *Manifest) FillInMissingFields(ctx context.Context, dxEnv dxda.DXEnviron
 	for pId, _ := range projectIds {
 		pDesc, err := DxDescribeProject(ctx, tmpHttpClient, &dxEnv, pId)
 		if err != nil {
-			m.log("Could not describe project %s, check permissions", pId)
+			m.logAt(LOG_ERROR, "Could not describe project %s, check permissions", pId)
 			return err
 		}
 		projDescs[pDesc.Id] = *pDesc
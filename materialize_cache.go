@@ -0,0 +1,108 @@
+package dxfuse
+
+// Local copies of remote files, downloaded with the base.materialize attribute,
+// or the fetch command. A copy is a read-only snapshot of a platform file, it
+// is kept apart from the files written through the mount, which have a local
+// path in the database. Opening a file that has a copy reads it at disk speed,
+// and the file keeps its remote semantics: it is not uploaded on close, and
+// writing to it makes a separate local file.
+//
+// The copies are bounded in total size. When a new copy does not fit, the
+// least recently used copies are removed. Handles that have a copy open keep
+// reading it after it is removed from disk.
+//
+// The cache is not thread safe, it is protected by the global lock.
+import (
+	"container/list"
+	"os"
+)
+
+type materializedCopy struct {
+	inode  int64
+	fileId string
+	path   string
+	size   int64
+}
+
+type MaterializedCache struct {
+	maxSize int64
+	size    int64
+
+	// the copies, the most recently used is at the front
+	lru    *list.List
+	copies map[int64]*list.Element
+}
+
+func NewMaterializedCache(maxSize int64) *MaterializedCache {
+	return &MaterializedCache{
+		maxSize : maxSize,
+		size : 0,
+		lru : list.New(),
+		copies : make(map[int64]*list.Element),
+	}
+}
+
+// Does the file have a copy. A copy of an older version of the file, one that
+// has since been modified, does not count.
+func (mc *MaterializedCache) Contains(inode int64, fileId string) bool {
+	elem, ok := mc.copies[inode]
+	return ok && elem.Value.(*materializedCopy).fileId == fileId
+}
+
+// Return the path of a copy, and mark it as recently used. A copy of an older
+// version of the file is removed.
+func (mc *MaterializedCache) Lookup(inode int64, fileId string) (string, bool) {
+	elem, ok := mc.copies[inode]
+	if !ok {
+		return "", false
+	}
+	mc.lru.MoveToFront(elem)
+	mcp := elem.Value.(*materializedCopy)
+	if mcp.fileId != fileId {
+		mc.Remove(inode)
+		return "", false
+	}
+	return mcp.path, true
+}
+
+// Can a file of this size be kept at all
+func (mc *MaterializedCache) Fits(size int64) bool {
+	return size <= mc.maxSize
+}
+
+// Add a copy, and make room for it by removing the least recently
+// used copies.
+func (mc *MaterializedCache) Add(inode int64, fileId string, path string, size int64) {
+	mc.Remove(inode)
+	for mc.size + size > mc.maxSize && mc.lru.Len() > 0 {
+		oldest := mc.lru.Back().Value.(*materializedCopy)
+		mc.Remove(oldest.inode)
+	}
+
+	mcp := &materializedCopy{
+		inode : inode,
+		fileId : fileId,
+		path : path,
+		size : size,
+	}
+	mc.copies[inode] = mc.lru.PushFront(mcp)
+	mc.size += size
+}
+
+// Remove the copy of a file, if there is one
+func (mc *MaterializedCache) Remove(inode int64) {
+	elem, ok := mc.copies[inode]
+	if !ok {
+		return
+	}
+	mcp := elem.Value.(*materializedCopy)
+	mc.lru.Remove(elem)
+	delete(mc.copies, inode)
+	mc.size -= mcp.size
+	os.Remove(mcp.path)
+}
+
+// The total size of the copies
+func (mc *MaterializedCache) Size() int64 {
+	return mc.size
+}
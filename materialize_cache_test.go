@@ -0,0 +1,171 @@
+package dxfuse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Create a copy on disk, and return its path
+func makeCopy(t *testing.T, dir string, name string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Copies are evicted, least recently used first, when a new copy
+// does not fit.
+func TestMaterializedCacheEviction(t *testing.T) {
+	type addOp struct {
+		inode int64
+		size  int64
+	}
+	testCases := []struct {
+		maxSize  int64
+		adds     []addOp
+		lookups  []int64   // used after the first two adds
+		kept     []int64
+		evicted  []int64
+	}{
+		// everything fits
+		{ 100, []addOp{ {1, 10}, {2, 10}, {3, 10} }, nil, []int64{1, 2, 3}, nil },
+
+		// the oldest copy makes room for the new one
+		{ 25, []addOp{ {1, 10}, {2, 10}, {3, 10} }, nil, []int64{2, 3}, []int64{1} },
+
+		// a lookup makes a copy recently used
+		{ 25, []addOp{ {1, 10}, {2, 10}, {3, 10} }, []int64{1}, []int64{1, 3}, []int64{2} },
+
+		// a large copy evicts several
+		{ 30, []addOp{ {1, 10}, {2, 10}, {3, 10}, {4, 25} }, nil, []int64{4}, []int64{1, 2, 3} },
+
+		// adding a copy of the same file again replaces it
+		{ 25, []addOp{ {1, 10}, {2, 10}, {1, 10} }, nil, []int64{1, 2}, nil },
+	}
+
+	for i, tc := range testCases {
+		dir := t.TempDir()
+		mc := NewMaterializedCache(tc.maxSize)
+		paths := make(map[int64]string)
+		for j, a := range tc.adds {
+			if j == 2 {
+				for _, inode := range tc.lookups {
+					if _, ok := mc.Lookup(inode, fmt.Sprintf("file-%d", inode)); !ok {
+						t.Errorf("case %d: inode %d should have a copy", i, inode)
+					}
+				}
+			}
+			paths[a.inode] = makeCopy(t, dir, fmt.Sprintf("%d_copy", j))
+			mc.Add(a.inode, fmt.Sprintf("file-%d", a.inode), paths[a.inode], a.size)
+		}
+
+		var total int64
+		for _, inode := range tc.kept {
+			if !mc.Contains(inode, fmt.Sprintf("file-%d", inode)) || !fileExists(paths[inode]) {
+				t.Errorf("case %d: the copy of inode %d should be kept", i, inode)
+			}
+		}
+		sizes := make(map[int64]int64)
+		for _, a := range tc.adds {
+			sizes[a.inode] = a.size
+		}
+		for _, inode := range tc.kept {
+			total += sizes[inode]
+		}
+		for _, inode := range tc.evicted {
+			if mc.Contains(inode, fmt.Sprintf("file-%d", inode)) || fileExists(paths[inode]) {
+				t.Errorf("case %d: the copy of inode %d should be evicted", i, inode)
+			}
+		}
+		if mc.Size() != total || mc.Size() > tc.maxSize {
+			t.Errorf("case %d: size is %d, expected %d", i, mc.Size(), total)
+		}
+	}
+}
+
+// A copy of an older version of a file is not used, and is removed
+func TestMaterializedCacheStale(t *testing.T) {
+	dir := t.TempDir()
+	mc := NewMaterializedCache(100)
+	path := makeCopy(t, dir, "1_copy")
+	mc.Add(1, "file-old", path, 10)
+
+	if mc.Contains(1, "file-new") {
+		t.Errorf("a copy of another version should not count")
+	}
+	if _, ok := mc.Lookup(1, "file-new"); ok {
+		t.Errorf("a copy of another version should not be used")
+	}
+	if mc.Contains(1, "file-old") || fileExists(path) || mc.Size() != 0 {
+		t.Errorf("a stale copy should be removed")
+	}
+}
+
+func TestMaterializedCacheRemove(t *testing.T) {
+	dir := t.TempDir()
+	mc := NewMaterializedCache(100)
+	path := makeCopy(t, dir, "1_copy")
+	mc.Add(1, "file-1", path, 10)
+
+	mc.Remove(1)
+	if mc.Contains(1, "file-1") || fileExists(path) || mc.Size() != 0 {
+		t.Errorf("the copy should be removed")
+	}
+
+	// removing a file that has no copy is fine
+	mc.Remove(2)
+}
+
+func TestMaterializedCacheFits(t *testing.T) {
+	testCases := []struct {
+		maxSize int64
+		size    int64
+		fits    bool
+	}{
+		{ 100, 0, true },
+		{ 100, 100, true },
+		{ 100, 101, false },
+		{ 0, 1, false },
+	}
+	for _, tc := range testCases {
+		mc := NewMaterializedCache(tc.maxSize)
+		if mc.Fits(tc.size) != tc.fits {
+			t.Errorf("max=%d size=%d: expected %t", tc.maxSize, tc.size, tc.fits)
+		}
+	}
+}
+
+// The name of a local file stays below NAME_MAX, and a multi-byte
+// character is not cut.
+func TestCreateLocalPath(t *testing.T) {
+	fsys := &Filesys{}
+	testCases := []struct {
+		name   string
+		suffix string
+	}{
+		{ "A.txt", "_A.txt" },
+		{ strings.Repeat("a", 300), "_" + strings.Repeat("a", maxLocalNameLen) },
+		{ "a" + strings.Repeat("é", 150), "_a" + strings.Repeat("é", 99) },
+		{ strings.Repeat("é", 150), "_" + strings.Repeat("é", 100) },
+	}
+
+	for _, tc := range testCases {
+		base := filepath.Base(fsys.createLocalPath(tc.name))
+		if len(base) > 255 {
+			t.Errorf("the local name is %d bytes long", len(base))
+		}
+		if !strings.HasSuffix(base, tc.suffix) || !utf8.ValidString(base) {
+			t.Errorf("expected a name ending with %q, got %q", tc.suffix, base)
+		}
+	}
+}
@@ -10,9 +10,13 @@ import (
 	"path/filepath"
 	"os"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dnanexus/dxda"
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/jacobsa/fuse/fuseops"
 )
 
 
@@ -34,6 +38,17 @@ type MetadataDb struct {
 
 	inodeCnt          int64
 	options           Options
+
+	// The in-memory database has a single connection. A transaction opened
+	// while another one is in progress waits for the connection forever. The
+	// global lock serializes the transactions; this counts the open ones, to
+	// catch a violation before it deadlocks.
+	singleConn        bool
+	numOpenTxns       int32
+
+	// Directories that are being read from DNAx without the global lock. The
+	// channel is closed when the read ends. Protected by the global lock.
+	populating        map[int64]chan struct{}
 }
 
 func NewMetadataDb(
@@ -41,18 +56,34 @@ func NewMetadataDb(
 	dxEnv dxda.DXEnvironment,
 	options Options) (*MetadataDb, error) {
 	// create a connection to the database, that will be kept open
-	db, err := sql.Open("sqlite3", dbFullPath + "?mode=rwc")
+	dsn := dbFullPath + "?mode=rwc"
+	if dbFullPath == DatabaseInMemory {
+		dsn = dbFullPath
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("Could not open the database %s", dbFullPath)
 	}
+	singleConn := false
+	if dbFullPath == DatabaseInMemory {
+		// Every connection to an in-memory database sees a different
+		// database. Use a single connection, and never close it. Nested
+		// transactions are therefore not allowed.
+		db.SetMaxOpenConns(1)
+		db.SetConnMaxLifetime(0)
+		singleConn = true
+	}
 
 	return &MetadataDb{
 		db : db,
 		dbFullPath : dbFullPath,
 		dxEnv : dxEnv,
 		baseDir2ProjectId: make(map[string]string),
+		singleConn : singleConn,
+		numOpenTxns : 0,
 		inodeCnt : InodeRoot + 1,
 		options : options,
+		populating : make(map[int64]chan struct{}),
 	}, nil
 }
 
@@ -61,24 +92,47 @@ func (mdb *MetadataDb) log(a string, args ...interface{}) {
 	LogMsg("metadata_db", a, args...)
 }
 
+func (mdb *MetadataDb) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "metadata_db", a, args...)
+}
+
+// write a log message, tagged with the correlation ID of the operation
+func (mdb *MetadataDb) logCtx(ctx context.Context, level int, a string, args ...interface{}) {
+	LogMsgCtx(ctx, level, "metadata_db", a, args...)
+}
+
+func (mdb *MetadataDb) logEnabled(level int) bool {
+	return LogEnabled("metadata_db", level)
+}
+
+// Open a transaction. It must be ended with EndTxn, after it is
+// committed or rolled back.
 func (mdb *MetadataDb) BeginTxn() (*sql.Tx, error) {
+	if atomic.AddInt32(&mdb.numOpenTxns, 1) > 1 && mdb.singleConn {
+		log.Panic("sanity: nested transaction on a single connection database, this would deadlock")
+	}
 	return mdb.db.Begin()
 }
 
+func (mdb *MetadataDb) EndTxn() {
+	atomic.AddInt32(&mdb.numOpenTxns, -1)
+}
+
 func (mdb *MetadataDb) opOpen() *OpHandle {
-	txn, err := mdb.db.Begin()
+	txn, err := mdb.BeginTxn()
 	if err != nil {
 		log.Panic("Could not open transaction")
 	}
 
 	return &OpHandle{
 		httpClient : nil,
-		txn : txn,
+		txn : NewTracedTx(context.Background(), txn),
 		err : nil,
 	}
 }
 
 func (mdb *MetadataDb) opClose(oph *OpHandle) {
+	defer mdb.EndTxn()
 	if oph.err == nil {
 		err := oph.txn.Commit()
 		if err != nil {
@@ -207,7 +261,7 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 	);
 	`
 	if _, err := txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not create table data_objects")
 	}
 
@@ -216,7 +270,7 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 	ON data_objects (dirty_data);
 	`
 	if _, err := txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not create index on dirty_data column in table data_objects")
 	}
 
@@ -225,7 +279,7 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 	ON data_objects (dirty_metadata);
 	`
 	if _, err := txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not create index on dirty_metdata column in table data_objects")
 	}
 
@@ -246,7 +300,7 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 	);
 	`
 	if _, err := txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not create table namespace")
 	}
 
@@ -255,7 +309,7 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 	ON namespace (parent);
 	`
 	if _, err := txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not create index parent_index on table namespace")
 	}
 
@@ -266,7 +320,7 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 	ON namespace (inode);
 	`
 	if _, err := txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not create index inode_rev_index on table namespace")
 	}
 
@@ -287,7 +341,7 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 	);
 	`
 	if _, err := txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not create table directories")
 	}
 
@@ -302,7 +356,7 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 		InodeRoot, "", "", boolToInt(false),
 		nowSeconds, nowSeconds, dirReadOnlyMode)
 	if _, err := txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not create root directory")
 	}
 
@@ -313,7 +367,7 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 			VALUES ('%s', '%s', '%d', '%d');`,
 		rParent, rBase, nsDirType, InodeRoot)
 	if _, err := txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not create root inode (%d)", InodeRoot)
 	}
 
@@ -322,38 +376,38 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 
 // construct an initial empty database, representing an entire project.
 func (mdb *MetadataDb) Init() error {
-	if mdb.options.Verbose {
-		mdb.log("Initializing metadata database\n")
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logAt(LOG_DEBUG, "Initializing metadata database\n")
 	}
 
 	txn, err := mdb.db.Begin()
 	if err != nil {
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not open transaction")
 	}
 
 	if err := mdb.init2(txn); err != nil {
 		txn.Rollback()
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Could not initialize database")
 	}
 
 	if err := txn.Commit(); err != nil {
 		txn.Rollback()
-		mdb.log(err.Error())
+		mdb.logAt(LOG_ERROR, err.Error())
 		return fmt.Errorf("Error during commit")
 	}
 
-	if mdb.options.Verbose {
-		mdb.log("Completed creating files and directories tables\n")
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logAt(LOG_DEBUG, "Completed creating files and directories tables\n")
 	}
 	return nil
 }
 
 func (mdb *MetadataDb) Shutdown() {
 	if err := mdb.db.Close(); err != nil {
-		mdb.log(err.Error())
-		mdb.log("Error closing the sqlite database %s", mdb.dbFullPath)
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "Error closing the sqlite database %s", mdb.dbFullPath)
 	}
 }
 
@@ -380,7 +434,7 @@ func (mdb *MetadataDb) lookupDataObjectByInode(oph *OpHandle, oname string, inod
 		inode)
 	rows, err := oph.txn.Query(sqlStmt)
 	if err != nil {
-		mdb.log("lookupDataObjectByInode %s inode=%d err=%s", oname, inode, err.Error())
+		mdb.logAt(LOG_ERROR, "lookupDataObjectByInode %s inode=%d err=%s", oname, inode, err.Error())
 		return File{}, false, oph.RecordError(err)
 	}
 
@@ -440,7 +494,7 @@ func (mdb *MetadataDb) lookupDirByInode(oph *OpHandle, parent string, dname stri
 		inode)
 	rows, err := oph.txn.Query(sqlStmt)
 	if err != nil {
-		mdb.log("lookupDirByInode inode=%d err=%s", inode, err.Error())
+		mdb.logAt(LOG_ERROR, "lookupDirByInode inode=%d err=%s", inode, err.Error())
 		return Dir{}, false, oph.RecordError(err)
 	}
 
@@ -494,7 +548,7 @@ func (mdb *MetadataDb) LookupByInode(ctx context.Context, oph *OpHandle, inode i
 		inode)
 	rows, err := oph.txn.Query(sqlStmt)
 	if err != nil {
-		mdb.log("LookupByInode: error in query  err=%s", err.Error())
+		mdb.logAt(LOG_ERROR, "LookupByInode: error in query  err=%s", err.Error())
 		return nil, false, oph.RecordError(err)
 	}
 	var parent string
@@ -544,8 +598,8 @@ func (mdb *MetadataDb) LookupDirByInode(ctx context.Context, oph *OpHandle, inod
 //
 func (mdb *MetadataDb) lookupDirByName(oph *OpHandle, dirname string) (string, string, error) {
 	parentDir, basename := splitPath(dirname)
-	if mdb.options.Verbose {
-		mdb.log("lookupDirByName (%s)", dirname)
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logAt(LOG_DEBUG, "lookupDirByName (%s)", dirname)
 	}
 
 	// Extract information for all the subdirectories
@@ -592,101 +646,83 @@ func (mdb *MetadataDb) UpdateInodeFileId(inode int64, fileId string) error {
 			WHERE inode = '%d';`,
 		fileId, inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log("UpdateInodeFileId Error updating data_object table, %s",
+		mdb.logAt(LOG_ERROR, "UpdateInodeFileId Error updating data_object table, %s",
 			err.Error())
 		return err
 	}
 	return nil
 }
 
-
-// The directory is in the database, read it in its entirety.
-func (mdb *MetadataDb) directoryReadAllEntries(
+// The archival state of a file changed on the platform. The same file-id may
+// appear in several places, and in several projects, the state belongs to
+// one project.
+func (mdb *MetadataDb) UpdateArchivalState(
+	ctx context.Context,
 	oph *OpHandle,
-	dirFullName string) (map[string]File, map[string]Dir, error) {
-	if mdb.options.Verbose {
-		mdb.log("directoryReadAllEntries %s", dirFullName)
+	fileId string,
+	projId string,
+	archivalState string) error {
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "UpdateArchivalState %s:%s %s", projId, fileId, archivalState)
 	}
 
-	// Extract information for all the subdirectories
 	sqlStmt := fmt.Sprintf(`
- 		        SELECT directories.inode, directories.proj_id, namespace.name, directories.ctime, directories.mtime, directories.mode
-                        FROM directories
-                        JOIN namespace
-                        ON directories.inode = namespace.inode
-			WHERE namespace.parent = '%s' AND namespace.obj_type = '%d';
-			`, dirFullName, nsDirType)
-	rows, err := oph.txn.Query(sqlStmt)
-	if err != nil {
-		mdb.log("Error in directories query, err=%s", err.Error())
-		return nil, nil, oph.RecordError(err)
+ 		        UPDATE data_objects
+                        SET archival_state = '%s'
+			WHERE id = '%s' AND proj_id = '%s';`,
+		archivalState, fileId, projId)
+	if _, err := oph.txn.Exec(sqlStmt); err != nil {
+		mdb.logAt(LOG_ERROR, "UpdateArchivalState Error updating data_object table, %s",
+			err.Error())
+		return oph.RecordError(err)
 	}
+	return nil
+}
 
-	subdirs := make(map[string]Dir)
-	for rows.Next() {
-		var inode int64
-		var dname string
-		var projId string
-		var ctime int64
-		var mtime int64
-		var mode int
-		rows.Scan(&inode, &projId, &dname, &ctime, &mtime, &mode)
-
-		subdirs[dname] = Dir{
-			Parent : dirFullName,
-			Dname : dname,
-			FullPath : filepath.Clean(filepath.Join(dirFullName, dname)),
-			Inode : inode,
-			Ctime : SecondsToTime(ctime),
-			Mtime : SecondsToTime(mtime),
-			Mode : os.FileMode(mode),
-		}
+// The size of an object shown as JSON is known once its description is read
+func (mdb *MetadataDb) UpdateObjectSize(
+	ctx context.Context,
+	oph *OpHandle,
+	inode int64,
+	size int64) error {
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "UpdateObjectSize inode=%d size=%d", inode, size)
 	}
-	rows.Close()
 
-	// Extract information for all the files
-	sqlStmt = fmt.Sprintf(`
- 		        SELECT dos.kind, dos.id, dos.proj_id, dos.state, dos.archival_state, dos.inode, dos.size, dos.ctime, dos.mtime, dos.mode, dos.tags, dos.properties, dos.symlink, dos.local_path, dos.dirty_data, dos.dirty_metadata, namespace.name
-                        FROM data_objects as dos
-                        JOIN namespace
-                        ON dos.inode = namespace.inode
-			WHERE namespace.parent = '%s' AND namespace.obj_type = '%d';
-			`, dirFullName, nsDataObjType)
-	rows, err = oph.txn.Query(sqlStmt)
-	if err != nil {
-		mdb.log("Error in data object query, err=%s", err.Error())
-		return nil, nil, oph.RecordError(err)
+	sqlStmt := fmt.Sprintf(`
+ 		        UPDATE data_objects
+                        SET size = '%d'
+			WHERE inode = '%d';`,
+		size, inode)
+	if _, err := oph.txn.Exec(sqlStmt); err != nil {
+		mdb.logAt(LOG_ERROR, "UpdateObjectSize Error updating data_object table, %s",
+			err.Error())
+		return oph.RecordError(err)
 	}
+	return nil
+}
 
-	// Find the files in the directory
-	files := make(map[string]File)
-	for rows.Next() {
-		var f File
-
-		var ctime int64
-		var mtime int64
-		var tags string
-		var props string
-		var mode int
-		var dirtyData int
-		var dirtyMetadata int
-		rows.Scan(&f.Kind,&f.Id, &f.ProjId, &f.State, &f.ArchivalState, &f.Inode,
-			&f.Size, &ctime, &mtime, &mode,
-			&tags, &props, &f.Symlink, &f.LocalPath, &dirtyData, &dirtyMetadata, &f.Name)
-		f.Ctime = SecondsToTime(ctime)
-		f.Mtime = SecondsToTime(mtime)
-		f.Tags = tagsUnmarshal(tags)
-		f.Properties = propertiesUnmarshal(props)
-		f.Mode = os.FileMode(mode)
-		f.dirtyData = intToBool(dirtyData)
-		f.dirtyMetadata = intToBool(dirtyMetadata)
-
-		files[f.Name] = f
+// A file that was being written on the platform has closed. Its final size
+// and modification time are known now.
+func (mdb *MetadataDb) UpdateClosedFile(
+	ctx context.Context,
+	oph *OpHandle,
+	fDesc DxDescribeDataObject) error {
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "UpdateClosedFile %s size=%d", fDesc.Id, fDesc.Size)
 	}
 
-	//mdb.log("  #files=%d", len(files))
-	//mdb.log("]")
-	return files, subdirs, nil
+	sqlStmt := fmt.Sprintf(`
+ 		        UPDATE data_objects
+                        SET state = '%s', size = '%d', mtime = '%d'
+			WHERE id = '%s';`,
+		fDesc.State, fDesc.Size, fDesc.MtimeSeconds, fDesc.Id)
+	if _, err := oph.txn.Exec(sqlStmt); err != nil {
+		mdb.logAt(LOG_ERROR, "UpdateClosedFile Error updating data_object table, %s",
+			err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
 }
 
 // Create an entry representing one remote file. This has
@@ -714,8 +750,8 @@ func (mdb *MetadataDb) createDataObject(
 	fname string,
 	symlink string,
 	localPath string) (int64, error) {
-	if mdb.options.VerboseLevel > 1 {
-		mdb.log("createDataObject %s:%s %s", projId, objId,
+	if mdb.logEnabled(LOG_TRACE) {
+		mdb.logAt(LOG_TRACE, "createDataObject %s:%s %s", projId, objId,
 			filepath.Clean(parentDir + "/" + fname))
 	}
 	// File doesn't exist, we need to choose a new inode number.
@@ -734,8 +770,8 @@ func (mdb *MetadataDb) createDataObject(
 		mTags, mProps, symlink, localPath,
 		boolToInt(dirtyData), boolToInt(dirtyMetadata))
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("Error inserting into data objects table")
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "Error inserting into data objects table")
 		return 0, oph.RecordError(err)
 	}
 
@@ -744,7 +780,7 @@ func (mdb *MetadataDb) createDataObject(
 			VALUES ('%s', '%s', '%d', '%d');`,
 		parentDir, fname, nsDataObjType, inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log("Error inserting %s/%s into the namespace table  err=%s", parentDir, fname, err.Error())
+		mdb.logAt(LOG_ERROR, "Error inserting %s/%s into the namespace table  err=%s", parentDir, fname, err.Error())
 		return 0, oph.RecordError(err)
 	}
 
@@ -770,8 +806,8 @@ func (mdb *MetadataDb) createEmptyDir(
 	// choose unused inode number. It is on stable stoage, and will not change.
 	inode := mdb.allocInodeNum()
 	parentDir, basename := splitPath(dirPath)
-	if mdb.options.VerboseLevel > 1 {
-		mdb.log("createEmptyDir %s:%s %s populated=%t",
+	if mdb.logEnabled(LOG_TRACE) {
+		mdb.logAt(LOG_TRACE, "createEmptyDir %s:%s %s populated=%t",
 			projId, projFolder, dirPath, populated)
 	}
 
@@ -780,7 +816,7 @@ func (mdb *MetadataDb) createEmptyDir(
 			VALUES ('%s', '%s', '%d', '%d');`,
 		parentDir, basename, nsDirType,	inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log("createEmptyDir: error inserting into namespace table %s/%s, err=%s",
+		mdb.logAt(LOG_ERROR, "createEmptyDir: error inserting into namespace table %s/%s, err=%s",
 			parentDir, basename, err.Error())
 		return 0, oph.RecordError(err)
 	}
@@ -792,8 +828,8 @@ func (mdb *MetadataDb) createEmptyDir(
                        VALUES ('%d', '%s', '%s', '%d', '%d', '%d', '%d');`,
 		inode, projId, projFolder, boolToInt(populated), ctime, mtime, int(mode))
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("createEmptyDir: error inserting into directories table %d",
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "createEmptyDir: error inserting into directories table %d",
 			inode)
 		return 0, oph.RecordError(err)
 	}
@@ -811,7 +847,7 @@ func (mdb *MetadataDb) CreateDir(
 	dirPath string) (int64, error) {
 	dnode, err := mdb.createEmptyDir(oph, projId, projFolder, ctime, mtime, mode, dirPath, true)
 	if err != nil {
-		mdb.log("error in create dir")
+		mdb.logAt(LOG_ERROR, "error in create dir")
 		return 0, oph.RecordError(err)
 	}
 	return dnode, nil
@@ -824,7 +860,7 @@ func (mdb *MetadataDb) RemoveEmptyDir(oph *OpHandle, inode int64) error {
                 WHERE inode='%d';`,
 		inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log("RemoveEmptyDir(%d): error in directories table removal", inode)
+		mdb.logAt(LOG_ERROR, "RemoveEmptyDir(%d): error in directories table removal", inode)
 		return oph.RecordError(err)
 	}
 
@@ -833,7 +869,7 @@ func (mdb *MetadataDb) RemoveEmptyDir(oph *OpHandle, inode int64) error {
                 WHERE inode='%d';`,
 		inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log("RemoveEmptyDir(%d): error in namespace table removal", inode)
+		mdb.logAt(LOG_ERROR, "RemoveEmptyDir(%d): error in namespace table removal", inode)
 		return oph.RecordError(err)
 	}
 
@@ -848,7 +884,7 @@ func (mdb *MetadataDb) setDirectoryToPopulated(oph *OpHandle, dinode int64) erro
                 WHERE inode = '%d'`,
 		dinode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log("Error set directory %d to populated", dinode)
+		mdb.logAt(LOG_ERROR, "Error set directory %d to populated", dinode)
 		return oph.RecordError(err)
 	}
 	return nil
@@ -868,7 +904,7 @@ func (mdb *MetadataDb) kindOfFile(o DxDescribeDataObject) int {
 		kind = FK_Database
 	}
 	if kind == 0 {
-		mdb.log("A data object has an unknown prefix (%s)", o.Id)
+		mdb.logAt(LOG_WARN, "A data object has an unknown prefix (%s)", o.Id)
 		kind = FK_Other
 	}
 
@@ -894,33 +930,31 @@ func symlinkOfFile(kind int, o DxDescribeDataObject) string {
 	}
 }
 
-// Create a directory with: an i-node, files, and empty unpopulated subdirectories.
-func (mdb *MetadataDb) populateDir(
+// Create a database entry for each data object in a directory
+func (mdb *MetadataDb) createDataObjects(
 	oph *OpHandle,
-	dinode int64,
-	projId string,
-	projFolder string,
-	ctime int64,
-	mtime int64,
 	dirPath string,
-	dxObjs []DxDescribeDataObject,
-	subdirs []string) error {
-	if mdb.options.VerboseLevel > 1 {
-		var objNames []string
-		for _, oDesc := range dxObjs {
-			objNames = append(objNames, oDesc.Name)
-		}
-		mdb.log("populateDir(%s)  data-objects=%v  subdirs=%v", dirPath, objNames, subdirs)
-	}
-
-	// Create a database entry for each file
-	if mdb.options.VerboseLevel > 1 {
-		mdb.log("inserting files")
+	dxObjs []DxDescribeDataObject) error {
+	if mdb.logEnabled(LOG_TRACE) {
+		mdb.logAt(LOG_TRACE, "inserting %d files into %s", len(dxObjs), dirPath)
 	}
 
 	for _, o := range dxObjs {
 		kind := mdb.kindOfFile(o)
 		symlink := symlinkOfFile(kind, o)
+		if kind == FK_Database {
+			if err := mdb.createDatabaseDir(oph, dirPath, o); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Objects other than files are shown as their description,
+		// in JSON. This cannot be modified.
+		mode := os.FileMode(fileReadWriteMode)
+		if kind != FK_Regular && kind != FK_Symlink {
+			mode = fileReadOnlyMode
+		}
 
 		_, err := mdb.createDataObject(
 			oph,
@@ -936,7 +970,7 @@ func (mdb *MetadataDb) populateDir(
 			o.MtimeSeconds,
 			o.Tags,
 			o.Properties,
-			fileReadWriteMode,
+			mode,
 			dirPath,
 			o.Name,
 			symlink,
@@ -945,10 +979,107 @@ func (mdb *MetadataDb) populateDir(
 			return oph.RecordError(err)
 		}
 	}
+	return nil
+}
+
+// A file was copied to another project, and moved there in the database. The
+// original remains on the platform, add it back to its directory, with a
+// new inode.
+func (mdb *MetadataDb) RestoreCopiedFile(
+	ctx context.Context,
+	oph *OpHandle,
+	dir Dir,
+	o DxDescribeDataObject) error {
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "RestoreCopiedFile %s/%s", dir.FullPath, o.Name)
+	}
+	o.ProjId = dir.ProjId
+	return mdb.createDataObjects(oph, dir.FullPath, []DxDescribeDataObject{ o })
+}
+
+// A folder was copied to another project, and moved there in the database.
+// The original remains on the platform, add it back as an unpopulated
+// directory; its contents are read from the platform when it is accessed.
+func (mdb *MetadataDb) RestoreCopiedDir(ctx context.Context, oph *OpHandle, dir Dir) error {
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "RestoreCopiedDir %s", dir.FullPath)
+	}
+	_, err := mdb.createEmptyDir(
+		oph, dir.ProjId, dir.ProjFolder,
+		dir.Ctime.Unix(), dir.Mtime.Unix(), dir.Mode, dir.FullPath, false)
+	return err
+}
+
+// A database is a directory, with a single file holding its description. Like
+// a faux directory, it has no matching project folder, so nothing can be
+// created inside it.
+func (mdb *MetadataDb) createDatabaseDir(
+	oph *OpHandle,
+	dirPath string,
+	o DxDescribeDataObject) error {
+	dbDirPath := filepath.Clean(dirPath + "/" + o.Name)
+	_, err := mdb.createEmptyDir(
+		oph, o.ProjId, "",
+		o.CtimeSeconds, o.MtimeSeconds,
+		dirReadOnlyMode,
+		dbDirPath, true)
+	if err != nil {
+		mdb.logAt(LOG_ERROR, "Error creating a directory for database %s at %s", o.Id, dbDirPath)
+		return err
+	}
+
+	_, err = mdb.createDataObject(
+		oph,
+		FK_Database,
+		false,
+		false,
+		o.ProjId,
+		o.State,
+		o.ArchivalState,
+		o.Id,
+		0,
+		o.CtimeSeconds,
+		o.MtimeSeconds,
+		o.Tags,
+		o.Properties,
+		fileReadOnlyMode,
+		dbDirPath,
+		databaseDescribeFile,
+		"",
+		"")
+	if err != nil {
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// Create a directory with: an i-node, files, and empty unpopulated subdirectories.
+func (mdb *MetadataDb) populateDir(
+	oph *OpHandle,
+	dinode int64,
+	projId string,
+	projFolder string,
+	ctime int64,
+	mtime int64,
+	dirPath string,
+	dxObjs []DxDescribeDataObject,
+	subdirs []string) error {
+	if mdb.logEnabled(LOG_TRACE) {
+		var objNames []string
+		for _, oDesc := range dxObjs {
+			objNames = append(objNames, oDesc.Name)
+		}
+		mdb.logAt(LOG_TRACE, "populateDir(%s)  data-objects=%v  subdirs=%v", dirPath, objNames, subdirs)
+	}
+
+	// Create a database entry for each file
+	if err := mdb.createDataObjects(oph, dirPath, dxObjs); err != nil {
+		return err
+	}
 
 	// Create a database entry for each sub-directory
-	if mdb.options.VerboseLevel > 1 {
-		mdb.log("inserting subdirs")
+	if mdb.logEnabled(LOG_TRACE) {
+		mdb.logAt(LOG_TRACE, "inserting subdirs")
 	}
 	for _, subDirName := range subdirs {
 		// Create an entry for the subdirectory.
@@ -962,14 +1093,14 @@ func (mdb *MetadataDb) populateDir(
 			filepath.Clean(dirPath + "/" + subDirName),
 			false)
 		if err != nil {
-			mdb.log("Error creating empty directory %s while populating directory %s",
+			mdb.logAt(LOG_ERROR, "Error creating empty directory %s while populating directory %s",
 				filepath.Clean(projFolder + "/" + subDirName), dirPath)
 			return err
 		}
 	}
 
-	if mdb.options.VerboseLevel > 1 {
-		mdb.log("setting populated for directory %s", dirPath)
+	if mdb.logEnabled(LOG_TRACE) {
+		mdb.logAt(LOG_TRACE, "setting populated for directory %s", dirPath)
 	}
 
 	// Update the directory populated flag to TRUE
@@ -977,86 +1108,103 @@ func (mdb *MetadataDb) populateDir(
 	return nil
 }
 
-// Query DNAx about a folder, and encode all the information in the database.
-//
-// assumptions:
-// 1. An empty directory has been created on the database.
-// 1. The directory has not been queried yet.
-// 2. The global lock is held
-func (mdb *MetadataDb) directoryReadFromDNAx(
-	ctx context.Context,
-	oph *OpHandle,
-	dinode int64,
-	projId string,
-	projFolder string,
-	ctime int64,
-	mtime int64,
-	dirFullName string) error {
-
-	if mdb.options.Verbose {
-		mdb.log("directoryReadFromDNAx: describe folder %s:%s", projId, projFolder)
-	}
-
-	// describe all (closed) files
-	dxDir, err := DxDescribeFolder(ctx, oph.httpClient, &mdb.dxEnv, projId, projFolder)
-	if err != nil {
-		fmt.Printf(err.Error())
-		fmt.Printf("reading directory frmo DNAx error")
-		return err
-	}
-
-	if mdb.options.Verbose {
-		mdb.log("read dir from DNAx #data_objects=%d #subdirs=%d",
-			len(dxDir.dataObjects),
-			len(dxDir.subdirs))
-	}
+// A directory that is being read from DNAx. The data objects are described a
+// page at a time. Objects that do not conflict with others are inserted as
+// they arrive, so a large directory is never held in memory.
+type dirRead struct {
+	dinode         int64
+	projId         string
+	projFolder     string
+	dirFullName    string
+	posixDir       *PosixDirStream
 
 	// Approximate the ctime/mtime using the file timestamps.
 	// - The directory creation time is the minimum of all file creates.
 	// - The directory modification time is the maximum across all file modifications.
-	ctimeApprox := ctime
-	mtimeApprox := mtime
-	for _, f := range dxDir.dataObjects {
-		ctimeApprox = MinInt64(ctimeApprox, f.CtimeSeconds)
-		mtimeApprox = MaxInt64(mtimeApprox, f.MtimeSeconds)
+	ctimeApprox    int64
+	mtimeApprox    int64
+	numDataObjects int
+}
+
+// Start reading a directory, list its subfolders. Does not access the database.
+func (mdb *MetadataDb) dirReadStart(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	dir Dir) (*dirRead, error) {
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "directoryReadFromDNAx: describe folder %s:%s", dir.ProjId, dir.ProjFolder)
 	}
 
 	// The DNAx storage system does not adhere to POSIX. Try
 	// to fix the elements in the directory, so they would comply. This
 	// comes at the cost of renaming the original files, which can
 	// very well mislead the user.
-	px := NewPosix(mdb.options)
-	posixDir, err := px.FixDir(dxDir)
+	folderInfo, err := listFolder(ctx, httpClient, &mdb.dxEnv, dir.ProjId, dir.ProjFolder, "folders")
 	if err != nil {
-		return err
+		mdb.logAt(LOG_ERROR, "directoryReadFromDNAx: listFolder(%s) error %s", dir.ProjFolder, err.Error())
+		return nil, err
 	}
+	px := NewPosix(mdb.options)
+	return &dirRead{
+		dinode : dir.Inode,
+		projId : dir.ProjId,
+		projFolder : dir.ProjFolder,
+		dirFullName : dir.FullPath,
+		posixDir : px.NewDirStream(dir.ProjFolder, folderInfo.subdirs),
+		ctimeApprox : int64(dir.Ctime.Second()),
+		mtimeApprox : int64(dir.Mtime.Second()),
+		numDataObjects : 0,
+	}, nil
+}
 
-	// build the top level directory
-	err = mdb.populateDir(
-		oph, dinode,
-		projId, projFolder,
-		ctimeApprox, mtimeApprox,
-		dirFullName, posixDir.dataObjects, posixDir.subdirs)
-	if err != nil {
-		mdb.log("directoryReadFromDNAx: Error populating directory, err=%s", err.Error())
-		return oph.RecordError(err)
+// Insert a page of data objects
+func (mdb *MetadataDb) dirReadPage(oph *OpHandle, dr *dirRead, page []DxDescribeDataObject) error {
+	dr.numDataObjects += len(page)
+	maxDirSize := mdb.options.Tuning.MaxDirSize
+	if maxDirSize > 0 && dr.numDataObjects > maxDirSize {
+		return fmt.Errorf(
+			"Too many elements in directory %s, the limit is %d",
+			dr.projFolder, maxDirSize)
+	}
+
+	topLevelObjs := make([]DxDescribeDataObject, 0, len(page))
+	for _, o := range page {
+		dr.ctimeApprox = MinInt64(dr.ctimeApprox, o.CtimeSeconds)
+		dr.mtimeApprox = MaxInt64(dr.mtimeApprox, o.MtimeSeconds)
+		if oNorm, ok := dr.posixDir.Add(o); ok {
+			topLevelObjs = append(topLevelObjs, oNorm)
+		}
+	}
+	return mdb.createDataObjects(oph, dr.dirFullName, topLevelObjs)
+}
+
+// All the pages were inserted. Create the faux directories, and the
+// subdirectories, and mark the directory as populated.
+func (mdb *MetadataDb) dirReadFinish(ctx context.Context, oph *OpHandle, dr *dirRead) error {
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "read dir from DNAx #data_objects=%d #subdirs=%d",
+			dr.numDataObjects,
+			len(dr.posixDir.Subdirs()))
 	}
+	fixup := dr.posixDir.Finish()
+	projId := dr.projId
+	dirFullName := dr.dirFullName
 
 	// create the faux sub directories. These have no additional depth, and are fully
 	// populated. They contains all the files with multiple versions.
 	//
 	// Note: these directories DO NOT have a matching project folder.
-	for dName, fauxFiles := range posixDir.fauxSubdirs {
+	for dName, fauxFiles := range fixup.fauxSubdirs {
 		fauxDirPath := filepath.Clean(dirFullName + "/" + dName)
 
 		// create the directory in the namespace, as if it is unpopulated.
 		fauxDirInode, err := mdb.createEmptyDir(
 			oph, projId, "",
-			ctimeApprox, mtimeApprox,
+			dr.ctimeApprox, dr.mtimeApprox,
 			dirReadWriteMode,
 			fauxDirPath, true)
 		if err != nil {
-			mdb.log("directoryReadFromDNAx: creating faux directory %s, err=%s", fauxDirPath, err.Error())
+			mdb.logAt(LOG_ERROR, "directoryReadFromDNAx: creating faux directory %s, err=%s", fauxDirPath, err.Error())
 			return oph.RecordError(err)
 		}
 
@@ -1064,42 +1212,257 @@ func (mdb *MetadataDb) directoryReadFromDNAx(
 		err = mdb.populateDir(
 			oph, fauxDirInode,
 			projId, "",
-			ctimeApprox, mtimeApprox,
+			dr.ctimeApprox, dr.mtimeApprox,
 			fauxDirPath, fauxFiles, no_subdirs)
 		if err != nil {
-			mdb.log("directoryReadFromDNAx: populating faux directory %s, %s", fauxDirPath, err.Error())
+			mdb.logAt(LOG_ERROR, "directoryReadFromDNAx: populating faux directory %s, %s", fauxDirPath, err.Error())
+			return oph.RecordError(err)
+		}
+	}
+
+	// Older versions that were placed at the top level before a newer
+	// version arrived, move to their faux directory.
+	for oName, dName := range fixup.demoted {
+		fauxDirPath := filepath.Clean(dirFullName + "/" + dName)
+		sqlStmt := fmt.Sprintf(`
+ 		        UPDATE namespace
+                        SET parent = '%s'
+			WHERE parent = '%s' AND name = '%s';`,
+			fauxDirPath, dirFullName, oName)
+		if _, err := oph.txn.Exec(sqlStmt); err != nil {
+			mdb.logAt(LOG_ERROR, "directoryReadFromDNAx: moving %s/%s to %s, err=%s",
+				dirFullName, oName, fauxDirPath, err.Error())
+			return oph.RecordError(err)
+		}
+
+		// A database is a directory, its description file moves with it
+		sqlStmt = fmt.Sprintf(`
+ 		        UPDATE namespace
+                        SET parent = '%s'
+			WHERE parent = '%s';`,
+			filepath.Clean(fauxDirPath + "/" + oName),
+			filepath.Clean(dirFullName + "/" + oName))
+		if _, err := oph.txn.Exec(sqlStmt); err != nil {
+			mdb.logAt(LOG_ERROR, "directoryReadFromDNAx: moving the contents of %s/%s, err=%s",
+				dirFullName, oName, err.Error())
+			return oph.RecordError(err)
+		}
+	}
+
+	// build the top level directory
+	err := mdb.populateDir(
+		oph, dr.dinode,
+		projId, dr.projFolder,
+		dr.ctimeApprox, dr.mtimeApprox,
+		dirFullName, fixup.dataObjects, dr.posixDir.Subdirs())
+	if err != nil {
+		mdb.logAt(LOG_ERROR, "directoryReadFromDNAx: Error populating directory, err=%s", err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// The read failed after some pages were inserted. Remove them, so that the
+// directory can be read again. The pages hold data objects, and database
+// directories with their description file.
+func (mdb *MetadataDb) dirReadDiscard(oph *OpHandle, dr *dirRead) error {
+	prefix := dr.dirFullName + "/"
+	entries := fmt.Sprintf(`
+                        SELECT inode FROM namespace
+                        WHERE parent = '%s' OR substr(parent, 1, %d) = '%s'`,
+		dr.dirFullName, len(prefix), prefix)
+	for _, table := range []string{ "data_objects", "directories" } {
+		sqlStmt := fmt.Sprintf(`
+                        DELETE FROM %s
+                        WHERE inode IN (%s);`,
+			table, entries)
+		if _, err := oph.txn.Exec(sqlStmt); err != nil {
+			mdb.logAt(LOG_ERROR, "directoryReadFromDNAx: discarding the entries of %s, err=%s",
+				dr.dirFullName, err.Error())
 			return oph.RecordError(err)
 		}
 	}
+	sqlStmt := fmt.Sprintf(`
+                        DELETE FROM namespace
+                        WHERE parent = '%s' OR substr(parent, 1, %d) = '%s';`,
+		dr.dirFullName, len(prefix), prefix)
+	if _, err := oph.txn.Exec(sqlStmt); err != nil {
+		mdb.logAt(LOG_ERROR, "directoryReadFromDNAx: discarding the entries of %s, err=%s",
+			dr.dirFullName, err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// Query DNAx about a folder, and encode all the information in the database,
+// in the transaction of the operation.
+//
+// assumptions:
+// 1. An empty directory has been created on the database.
+// 1. The directory has not been queried yet.
+// 2. The global lock is held
+func (mdb *MetadataDb) directoryReadFromDNAx(
+	ctx context.Context,
+	oph *OpHandle,
+	dir Dir) error {
+	dr, err := mdb.dirReadStart(ctx, oph.httpClient, dir)
+	if err != nil {
+		return err
+	}
+	query := DxFindDataObjectsQuery{
+		ProjId : dir.ProjId,
+		Folder : dir.ProjFolder,
+		Recurse : false,
+	}
+	err = DxFindDataObjectsPages(ctx, oph.httpClient, &mdb.dxEnv, query,
+		func(page []DxDescribeDataObject) error {
+			return mdb.dirReadPage(oph, dr, page)
+		})
+	if err != nil {
+		mdb.logAt(LOG_ERROR, "directoryReadFromDNAx: error reading folder %s:%s, err=%s",
+			dir.ProjId, dir.ProjFolder, err.Error())
+		return oph.RecordError(err)
+	}
+	return mdb.dirReadFinish(ctx, oph, dr)
+}
 
+// Make sure the contents of a directory have been read from DNAx.
+//
+// Operations normally read their directories beforehand, without the global lock,
+// see Filesys.populateDir. This reads a directory that was missed, while holding
+// the lock. A directory that another operation is reading is not complete yet,
+// and cannot be waited for here.
+func (mdb *MetadataDb) PopulateDir(ctx context.Context, oph *OpHandle, dir *Dir) error {
+	if dir.Populated {
+		return nil
+	}
+	if _, ok := mdb.populating[dir.Inode]; ok {
+		mdb.logAt(LOG_WARN, "PopulateDir %s: the directory is being read by another operation", dir.FullPath)
+		return syscall.EAGAIN
+	}
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "PopulateDir %s", dir.FullPath)
+	}
+	if err := mdb.directoryReadFromDNAx(ctx, oph, *dir); err != nil {
+		return err
+	}
+	dir.Populated = true
 	return nil
 }
 
+// Register a read of a directory that is done without the global lock. If another
+// read of the directory is in progress, return its channel instead, it is closed
+// when that read ends. Called with the global lock held.
+func (mdb *MetadataDb) dirReadRegister(dinode int64) (chan struct{}, bool) {
+	if ch, ok := mdb.populating[dinode]; ok {
+		return ch, false
+	}
+	ch := make(chan struct{})
+	mdb.populating[dinode] = ch
+	return ch, true
+}
 
-// Add a directory with its contents to an exisiting database
-func (mdb *MetadataDb) ReadDirAll(ctx context.Context, oph *OpHandle, dir *Dir) (map[string]File, map[string]Dir, error) {
-	if mdb.options.Verbose {
-		mdb.log("ReadDirAll %s", dir.FullPath)
+// Called with the global lock held
+func (mdb *MetadataDb) dirReadUnregister(dinode int64) {
+	if ch, ok := mdb.populating[dinode]; ok {
+		close(ch)
+		delete(mdb.populating, dinode)
 	}
+}
 
-	if !dir.Populated {
-		err := mdb.directoryReadFromDNAx(
-			ctx,
-			oph,
-			dir.Inode,
-			dir.ProjId,
-			dir.ProjFolder,
-			int64(dir.Ctime.Second()),
-			int64(dir.Mtime.Second()),
-			dir.FullPath)
-		if err != nil {
-			return nil, nil, err
+// An entry in a directory listing. The cookie is the rowid of the entry in
+// the namespace table. It does not change while the entry exists, so a listing
+// can be resumed from it, even if the directory was modified in the meantime.
+//
+// The attributes come with the entry, so a listing does not need
+// a separate lookup for each one.
+type DirEntry struct {
+	Cookie   int64
+	Name     string
+	Inode    int64
+	ObjType  int   // nsDirType or nsDataObjType
+	Kind     int   // for a data object, the kind of file
+	Size     int64
+	Ctime    time.Time
+	Mtime    time.Time
+	Mode     os.FileMode
+	Uid      uint32
+	Gid      uint32
+	State    string  // for a data object, one of {open, closing, closed}
+}
+
+// The attributes of the entry, the same as a lookup would return
+func (e DirEntry) GetAttrs() fuseops.InodeAttributes {
+	if e.ObjType == nsDirType {
+		d := Dir{
+			Ctime : e.Ctime,
+			Mtime : e.Mtime,
+			Mode : e.Mode,
+			Uid : e.Uid,
+			Gid : e.Gid,
 		}
-		dir.Populated = true
+		return d.GetAttrs()
+	}
+	f := File{
+		Size : e.Size,
+		Ctime : e.Ctime,
+		Mtime : e.Mtime,
+		Mode : e.Mode,
+		Uid : e.Uid,
+		Gid : e.Gid,
+	}
+	return f.GetAttrs()
+}
+
+// Read up to [limit] entries of a populated directory, starting after
+// [cookie]. A zero cookie starts from the beginning. The entries
+// are returned in cookie order.
+func (mdb *MetadataDb) ReadDirEntries(
+	ctx context.Context,
+	oph *OpHandle,
+	dirFullName string,
+	cookie int64,
+	limit int) ([]DirEntry, error) {
+	if mdb.logEnabled(LOG_TRACE) {
+		mdb.logCtx(ctx, LOG_TRACE, "ReadDirEntries %s cookie=%d limit=%d", dirFullName, cookie, limit)
+	}
+
+	sqlStmt := fmt.Sprintf(`
+ 		        SELECT namespace.rowid, namespace.name, namespace.obj_type, namespace.inode,
+                               IFNULL(dos.kind, 0), IFNULL(dos.size, 0),
+                               IFNULL(dos.ctime, dirs.ctime), IFNULL(dos.mtime, dirs.mtime), IFNULL(dos.mode, dirs.mode),
+                               IFNULL(dos.state, '')
+                        FROM namespace
+                        LEFT JOIN data_objects AS dos
+                        ON namespace.obj_type = '%d' AND dos.inode = namespace.inode
+                        LEFT JOIN directories AS dirs
+                        ON namespace.obj_type = '%d' AND dirs.inode = namespace.inode
+			WHERE namespace.parent = '%s' AND namespace.rowid > '%d'
+                        ORDER BY namespace.rowid
+                        LIMIT %d;`,
+		nsDataObjType, nsDirType, dirFullName, cookie, limit)
+	rows, err := oph.txn.Query(sqlStmt)
+	if err != nil {
+		mdb.logAt(LOG_ERROR, "Error in directory entries query, err=%s", err.Error())
+		return nil, oph.RecordError(err)
 	}
+	defer rows.Close()
 
-	// Now that the directory is in the database, we can read it with a local query.
-	return mdb.directoryReadAllEntries(oph, dir.FullPath)
+	entries := make([]DirEntry, 0, limit)
+	for rows.Next() {
+		var e DirEntry
+		var ctime int64
+		var mtime int64
+		var mode int
+		rows.Scan(&e.Cookie, &e.Name, &e.ObjType, &e.Inode, &e.Kind, &e.Size, &ctime, &mtime, &mode, &e.State)
+		e.Ctime = SecondsToTime(ctime)
+		e.Mtime = SecondsToTime(mtime)
+		e.Mode = os.FileMode(mode)
+		e.Uid = mdb.options.Uid
+		e.Gid = mdb.options.Gid
+		entries = append(entries, e)
+	}
+	return entries, nil
 }
 
 
@@ -1112,8 +1475,8 @@ func (mdb *MetadataDb) ReadDirAll(ctx context.Context, oph *OpHandle, dir *Dir)
 //
 // Note: the file might not exist.
 func (mdb *MetadataDb) LookupInDir(ctx context.Context, oph *OpHandle, dir *Dir, dirOrFileName string) (Node, bool, error) {
-	if !dir.Populated {
-		mdb.ReadDirAll(ctx, oph, dir)
+	if err := mdb.PopulateDir(ctx, oph, dir); err != nil {
+		return nil, false, err
 	}
 
 	// point lookup in the namespace
@@ -1165,11 +1528,11 @@ func (mdb *MetadataDb) PopulateRoot(ctx context.Context, oph *OpHandle, manifest
 
 	dirSkel, err := manifest.DirSkeleton()
 	if err != nil {
-		mdb.log("PopulateRoot: Error creating a manifest skeleton")
+		mdb.logAt(LOG_ERROR, "PopulateRoot: Error creating a manifest skeleton")
 		return err
 	}
-	if mdb.options.Verbose {
-		mdb.log("dirSkeleton = %v", dirSkel)
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "dirSkeleton = %v", dirSkel)
 	}
 
 	// build the supporting directory structure.
@@ -1184,20 +1547,24 @@ func (mdb *MetadataDb) PopulateRoot(ctx context.Context, oph *OpHandle, manifest
 			dirReadOnlyMode, // skeleton directories are scaffolding, they cannot be modified.
 			d, true)
 		if err != nil {
-			mdb.log("PopulateRoot: Error creating empty dir")
+			mdb.logAt(LOG_ERROR, "PopulateRoot: Error creating empty dir")
 			return oph.RecordError(err)
 		}
 	}
 
 	// create individual files
 	for _, fl := range manifest.Files {
+		state := fl.State
+		if state == "" {
+			state = "closed"
+		}
 		_, err := mdb.createDataObject(
 			oph,
 			FK_Regular,
 			false,
 			false,
 			fl.ProjId,
-			"closed",
+			state,
 			fl.ArchivalState,
 			fl.FileId,
 			fl.Size,
@@ -1211,8 +1578,8 @@ func (mdb *MetadataDb) PopulateRoot(ctx context.Context, oph *OpHandle, manifest
 			"",
 			"")
 		if err != nil {
-			mdb.log(err.Error())
-			mdb.log("PopulateRoot: error creating singleton file")
+			mdb.logAt(LOG_ERROR, err.Error())
+			mdb.logAt(LOG_ERROR, "PopulateRoot: error creating singleton file")
 			return oph.RecordError(err)
 		}
 	}
@@ -1227,14 +1594,14 @@ func (mdb *MetadataDb) PopulateRoot(ctx context.Context, oph *OpHandle, manifest
 			dirReadWriteMode,
 			d.Dirname, false)
 		if err != nil {
-			mdb.log("PopulateRoot: error creating empty manifest directory")
+			mdb.logAt(LOG_ERROR, "PopulateRoot: error creating empty manifest directory")
 			return oph.RecordError(err)
 		}
 	}
 
 	// set the root to be populated
 	if err := mdb.setDirectoryToPopulated(oph, InodeRoot); err != nil {
-		mdb.log("PopulateRoot: error setting root directory to populated")
+		mdb.logAt(LOG_ERROR, "PopulateRoot: error setting root directory to populated")
 		return oph.RecordError(err)
 	}
 
@@ -1249,8 +1616,8 @@ func (mdb *MetadataDb) CreateFile(
 	fname string,
 	mode os.FileMode,
 	localPath string) (File, error) {
-	if mdb.options.Verbose {
-		mdb.log("CreateFile %s/%s  localPath=%s proj=%s",
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "CreateFile %s/%s  localPath=%s proj=%s",
 			dir.FullPath, fname, localPath, dir.ProjId)
 	}
 
@@ -1281,7 +1648,7 @@ func (mdb *MetadataDb) CreateFile(
 		"",
 		localPath)
 	if err != nil {
-		mdb.log("CreateFile error creating data object")
+		mdb.logAt(LOG_ERROR, "CreateFile error creating data object")
 		return File{}, err
 	}
 
@@ -1311,8 +1678,8 @@ func (mdb *MetadataDb) Unlink(ctx context.Context, oph *OpHandle, file File) err
                            WHERE inode='%d';`,
 		file.Inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("could not delete row for inode=%d from the namespace table",
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "could not delete row for inode=%d from the namespace table",
 			file.Inode)
 		return oph.RecordError(err)
 	}
@@ -1322,8 +1689,8 @@ func (mdb *MetadataDb) Unlink(ctx context.Context, oph *OpHandle, file File) err
                            WHERE inode='%d';`,
 		file.Inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("could not delete row for inode=%d from the data_objects table",
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "could not delete row for inode=%d from the data_objects table",
 			file.Inode)
 		return oph.RecordError(err)
 	}
@@ -1342,8 +1709,8 @@ func (mdb *MetadataDb) UpdateFileAttrs(
 	sqlStmt := ""
 	if mode == nil {
 		// don't update the mode
-		if mdb.options.Verbose {
-			mdb.log("Update inode=%d size=%d", inode, fileSize)
+		if mdb.logEnabled(LOG_DEBUG) {
+			mdb.logCtx(ctx, LOG_DEBUG, "Update inode=%d size=%d", inode, fileSize)
 		}
 		sqlStmt = fmt.Sprintf(`
  		        UPDATE data_objects
@@ -1351,8 +1718,8 @@ func (mdb *MetadataDb) UpdateFileAttrs(
 			WHERE inode = '%d';`,
 			fileSize, modTimeSec, inode)
 	} else {
-		if mdb.options.Verbose {
-			mdb.log("Update inode=%d size=%d mode=%d", inode, fileSize, mode)
+		if mdb.logEnabled(LOG_DEBUG) {
+			mdb.logCtx(ctx, LOG_DEBUG, "Update inode=%d size=%d mode=%d", inode, fileSize, mode)
 		}
 		sqlStmt = fmt.Sprintf(`
  		        UPDATE data_objects
@@ -1362,8 +1729,8 @@ func (mdb *MetadataDb) UpdateFileAttrs(
 	}
 
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("UpdateFile error executing transaction")
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "UpdateFile error executing transaction")
 		return oph.RecordError(err)
 	}
 	return nil
@@ -1374,8 +1741,8 @@ func (mdb *MetadataDb) UpdateFileLocalPath(
 	oph *OpHandle,
 	inode int64,
 	localPath string) error {
-	if mdb.options.Verbose {
-		mdb.log("Update inode=%d localPath=%s", inode, localPath)
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "Update inode=%d localPath=%s", inode, localPath)
 	}
 	sqlStmt := fmt.Sprintf(`
  		        UPDATE data_objects
@@ -1384,8 +1751,8 @@ func (mdb *MetadataDb) UpdateFileLocalPath(
 		localPath, inode)
 
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("UpdateFileLocalPath error executing transaction")
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "UpdateFileLocalPath error executing transaction")
 		return oph.RecordError(err)
 	}
 	return nil
@@ -1403,8 +1770,8 @@ func (mdb *MetadataDb) MoveFile(
 	inode int64,
 	newParentDir Dir,
 	newName string) error {
-	if mdb.options.Verbose {
-		mdb.log("MoveFile -> %s/%s", newParentDir.FullPath, newName)
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "MoveFile -> %s/%s", newParentDir.FullPath, newName)
 	}
 	sqlStmt := fmt.Sprintf(`
  		        UPDATE namespace
@@ -1413,8 +1780,20 @@ func (mdb *MetadataDb) MoveFile(
 		newParentDir.FullPath, newName, inode)
 
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("MoveFile error executing transaction")
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "MoveFile error executing transaction")
+		return oph.RecordError(err)
+	}
+
+	// The file may have moved to a different project
+	sqlStmt = fmt.Sprintf(`
+ 		        UPDATE data_objects
+                        SET proj_id = '%s'
+			WHERE inode = '%d';`,
+		newParentDir.ProjId, inode)
+	if _, err := oph.txn.Exec(sqlStmt); err != nil {
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "MoveFile error executing transaction")
 		return oph.RecordError(err)
 	}
 	return nil
@@ -1426,14 +1805,15 @@ type MoveRecord struct  {
 	name          string
 	newParent     string
 	newProjFolder string
+	newProjId     string  // set when moving to a different project
 	inode         int64
 	nsObjType     int
 }
 
 func (mdb *MetadataDb) execModifyRecord(oph *OpHandle, r MoveRecord) error {
 	// Modify the parent fields in the namespace table.
-	if mdb.options.Verbose {
-		mdb.log("%s -> %s/%s", r.oldFullPath, r.newParent, r.name)
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logAt(LOG_DEBUG, "%s -> %s/%s", r.oldFullPath, r.newParent, r.name)
 	}
 	sqlStmt := fmt.Sprintf(`
  		        UPDATE namespace
@@ -1441,19 +1821,32 @@ func (mdb *MetadataDb) execModifyRecord(oph *OpHandle, r MoveRecord) error {
 			WHERE inode = '%d';`,
 		r.newParent, r.name, r.inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("MoveDir error executing transaction")
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "MoveDir error executing transaction")
 		return oph.RecordError(err)
 	}
 
 	if r.nsObjType == nsDataObjType {
+		if r.newProjId == "" {
+			return nil
+		}
+		sqlStmt = fmt.Sprintf(`
+ 		        UPDATE data_objects
+                        SET proj_id = '%s'
+			WHERE inode = '%d';`,
+			r.newProjId, r.inode)
+		if _, err := oph.txn.Exec(sqlStmt); err != nil {
+			mdb.logAt(LOG_ERROR, err.Error())
+			mdb.logAt(LOG_ERROR, "MoveDir error executing transaction")
+			return oph.RecordError(err)
+		}
 		return nil
 	}
 	//  /dxfuse_test_data/A/fruit ->  proj-xxxx:/D/K/A/fruit
 	//  /dxfuse_test_data/A       ->  proj-xxxx:/D/K/A
 	//
-	if mdb.options.Verbose {
-		mdb.log("move subdir (%s) project-folder %s", r.oldFullPath, r.newProjFolder)
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logAt(LOG_DEBUG, "move subdir (%s) project-folder %s", r.oldFullPath, r.newProjFolder)
 	}
 
 	sqlStmt = fmt.Sprintf(`
@@ -1462,10 +1855,23 @@ func (mdb *MetadataDb) execModifyRecord(oph *OpHandle, r MoveRecord) error {
 			WHERE inode = '%d';`,
 		r.newProjFolder, r.inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("MoveDir error executing transaction")
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "MoveDir error executing transaction")
 		return oph.RecordError(err)
 	}
+
+	if r.newProjId != "" {
+		sqlStmt = fmt.Sprintf(`
+ 		        UPDATE directories
+                        SET proj_id = '%s'
+			WHERE inode = '%d';`,
+			r.newProjId, r.inode)
+		if _, err := oph.txn.Exec(sqlStmt); err != nil {
+			mdb.logAt(LOG_ERROR, err.Error())
+			mdb.logAt(LOG_ERROR, "MoveDir error executing transaction")
+			return oph.RecordError(err)
+		}
+	}
 	return nil
 }
 
@@ -1498,9 +1904,10 @@ func (mdb *MetadataDb) MoveDir(
 	// all the:
 	// 1) namespace records olddir -> newDir
 	// 2) directory records for proj_folder: olddir -> newDir
+	// 3) the project of all records, if moving to a different project
 
-	if mdb.options.Verbose {
-		mdb.log("MoveDir %s -> %s/%s", oldDir.FullPath, newParentDir.FullPath, newName)
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "MoveDir %s -> %s/%s", oldDir.FullPath, newParentDir.FullPath, newName)
 	}
 
 	// Find all directories and data objects in the subtree rooted at
@@ -1511,6 +1918,10 @@ func (mdb *MetadataDb) MoveDir(
                         FROM namespace
 			WHERE parent LIKE '%s';`,
 		oldDir.FullPath + "%")
+	var newProjId string
+	if oldParentDir.ProjId != newParentDir.ProjId {
+		newProjId = newParentDir.ProjId
+	}
 	rows, err := oph.txn.Query(sqlStmt)
 	if err != nil {
 		return oph.RecordError(err)
@@ -1546,6 +1957,7 @@ func (mdb *MetadataDb) MoveDir(
 			name : name,
 			newParent : filepath.Clean(newParentDir.FullPath + "/" + midPath),
 			newProjFolder : newProjFolder,
+			newProjId : newProjId,
 			inode : inode,
 			nsObjType : nsObjType,
 		}
@@ -1560,11 +1972,12 @@ func (mdb *MetadataDb) MoveDir(
 		name : newName,
 		newParent : filepath.Clean(newParentDir.FullPath),
 		newProjFolder : filepath.Clean(filepath.Join(newParentDir.ProjFolder, newName)),
+		newProjId : newProjId,
 		inode : oldDir.Inode,
 		nsObjType: nsDirType,
 	})
-	if mdb.options.Verbose {
-		mdb.log("found %d records under directory %s: %v", len(records), oldDir.FullPath, records)
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "found %d records under directory %s: %v", len(records), oldDir.FullPath, records)
 	}
 
 	for _, r := range records {
@@ -1575,12 +1988,40 @@ func (mdb *MetadataDb) MoveDir(
 	return nil
 }
 
+// Find the files in the subtree rooted at a directory that are on the platform.
+// Returns a mapping from inode to file-id.
+func (mdb *MetadataDb) SubtreeFileIds(ctx context.Context, oph *OpHandle, dir Dir) (map[int64]string, error) {
+	sqlStmt := fmt.Sprintf(`
+ 		        SELECT dos.inode, dos.id
+                        FROM data_objects as dos
+                        JOIN namespace
+                        ON dos.inode = namespace.inode
+			WHERE (namespace.parent = '%s' OR namespace.parent LIKE '%s')
+                        AND dos.id != '';`,
+		dir.FullPath, dir.FullPath + "/%")
+	rows, err := oph.txn.Query(sqlStmt)
+	if err != nil {
+		mdb.logAt(LOG_ERROR, "SubtreeFileIds err=%s", err.Error())
+		return nil, oph.RecordError(err)
+	}
+
+	fileIds := make(map[int64]string)
+	for rows.Next() {
+		var inode int64
+		var fileId string
+		rows.Scan(&inode, &fileId)
+		fileIds[inode] = fileId
+	}
+	rows.Close()
+	return fileIds, nil
+}
+
 func (mdb *MetadataDb) UpdateFileTagsAndProperties(
 	ctx context.Context,
 	oph *OpHandle,
 	file File) error {
-	if mdb.options.Verbose {
-		mdb.log("UpdateFileTagsAndProperties tags=%v properties=%v",
+	if mdb.logEnabled(LOG_DEBUG) {
+		mdb.logCtx(ctx, LOG_DEBUG, "UpdateFileTagsAndProperties tags=%v properties=%v",
 			file.Tags, file.Properties)
 	}
 
@@ -1596,8 +2037,8 @@ func (mdb *MetadataDb) UpdateFileTagsAndProperties(
 		mTags, mProps, file.Inode)
 
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("UpdateFileTagsAndProperties error executing transaction")
+		mdb.logAt(LOG_ERROR, err.Error())
+		mdb.logAt(LOG_ERROR, "UpdateFileTagsAndProperties error executing transaction")
 		return oph.RecordError(err)
 	}
 	return nil
@@ -1618,7 +2059,7 @@ func (mdb *MetadataDb) DirtyFilesGetAndReset(flag int) ([]DirtyFileInfo, error)
 		// we only want recently inactive files. Otherwise,
 		// we'll be writing way too much.
 		loThreshSec = time.Now().Unix()
-		loThreshSec -= int64(FileWriteInactivityThresh.Seconds())
+		loThreshSec -= int64(mdb.options.Tuning.FileWriteInactivityThresh.Seconds())
 	}
 
 	// join all the tables so we can get the file attributes, the
@@ -1645,7 +2086,7 @@ func (mdb *MetadataDb) DirtyFilesGetAndReset(flag int) ([]DirtyFileInfo, error)
 
 	rows, err := oph.txn.Query(sqlStmt)
 	if err != nil {
-		mdb.log("DirtyFilesGetAllAndReset err=%s", err.Error())
+		mdb.logAt(LOG_ERROR, "DirtyFilesGetAllAndReset err=%s", err.Error())
 		return nil, err
 	}
 
@@ -1692,8 +2133,136 @@ func (mdb *MetadataDb) DirtyFilesGetAndReset(flag int) ([]DirtyFileInfo, error)
 		loThreshSec)
 
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log("Error erasing dirty_data|dirty_metadata flags (%s)", err.Error())
+		mdb.logAt(LOG_ERROR, "Error erasing dirty_data|dirty_metadata flags (%s)", err.Error())
 		return nil, err
 	}
 	return fAr, nil
 }
+
+// Get the upload information for one file, without changing its dirty flags
+func (mdb *MetadataDb) FileUploadInfo(inode int64) (DirtyFileInfo, bool, error) {
+	oph := mdb.opOpen()
+	defer mdb.opClose(oph)
+
+	sqlStmt := fmt.Sprintf(`
+ 		        SELECT dos.dirty_data as dirty_data,
+                               dos.dirty_metadata as dirty_metadata,
+                               dos.id,
+                               dos.size,
+                               dos.mtime as mtime,
+                               dos.local_path,
+                               dos.tags,
+                               dos.properties,
+                               namespace.name,
+                               namespace.parent
+                        FROM data_objects as dos
+                        JOIN namespace
+                        ON dos.inode = namespace.inode
+			WHERE dos.inode = '%d';`,
+		inode)
+	rows, err := oph.txn.Query(sqlStmt)
+	if err != nil {
+		mdb.logAt(LOG_ERROR, "FileUploadInfo err=%s", err.Error())
+		return DirtyFileInfo{}, false, err
+	}
+
+	f := DirtyFileInfo{ Inode : inode }
+	numRows := 0
+	for rows.Next() {
+		var dirtyData int
+		var dirtyMetadata int
+		var tags string
+		var props string
+
+		rows.Scan(&dirtyData, &dirtyMetadata, &f.Id,
+			&f.FileSize,
+			&f.Mtime,
+			&f.LocalPath, &tags, &props, &f.Name, &f.Directory)
+		f.dirtyData = intToBool(dirtyData)
+		f.dirtyMetadata = intToBool(dirtyMetadata)
+		f.Tags = tagsUnmarshal(tags)
+		f.Properties = propertiesUnmarshal(props)
+		numRows++
+	}
+	rows.Close()
+
+	switch numRows {
+	case 0:
+		return DirtyFileInfo{}, false, nil
+	case 1:
+	default:
+		log.Panicf("found %d files with inode=%d", numRows, inode)
+	}
+
+	projId, projFolder, err := mdb.lookupDirByName(oph, f.Directory)
+	if err != nil {
+		return DirtyFileInfo{}, false, err
+	}
+	f.ProjId = projId
+	f.ProjFolder = projFolder
+	return f, true, nil
+}
+
+// Set the dirty flags of a file, so that the next sweep will pick it up.
+func (mdb *MetadataDb) MarkDirty(inode int64, dirtyData bool, dirtyMetadata bool) error {
+	oph := mdb.opOpen()
+	defer mdb.opClose(oph)
+
+	sqlStmt := fmt.Sprintf(`
+ 		        UPDATE data_objects
+                        SET dirty_data = MAX(dirty_data, %d), dirty_metadata = MAX(dirty_metadata, %d)
+			WHERE inode = '%d';`,
+		boolToInt(dirtyData), boolToInt(dirtyMetadata), inode)
+	if _, err := oph.txn.Exec(sqlStmt); err != nil {
+		mdb.logAt(LOG_ERROR, "MarkDirty error updating data_object table, %s", err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// The data of a file has been uploaded. Clear the dirty flag, unless the
+// file has been changed in the meantime.
+func (mdb *MetadataDb) ClearDirtyData(inode int64, fileId string, fileSize int64) error {
+	oph := mdb.opOpen()
+	defer mdb.opClose(oph)
+
+	sqlStmt := fmt.Sprintf(`
+ 		        UPDATE data_objects
+                        SET dirty_data = '0'
+			WHERE inode = '%d' AND id = '%s' AND size = '%d';`,
+		inode, fileId, fileSize)
+	if _, err := oph.txn.Exec(sqlStmt); err != nil {
+		mdb.logAt(LOG_ERROR, "ClearDirtyData error updating data_object table, %s", err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// The paths of all files with changes that have not been uploaded. Used
+// for reporting on shutdown; the dirty flags are not modified.
+func (mdb *MetadataDb) DirtyFilePaths() ([]string, error) {
+	oph := mdb.opOpen()
+	defer mdb.opClose(oph)
+
+	sqlStmt := `
+ 		        SELECT namespace.parent, namespace.name
+                        FROM data_objects as dos
+                        JOIN namespace
+                        ON dos.inode = namespace.inode
+			WHERE dirty_data = '1' OR dirty_metadata = '1';`
+	rows, err := oph.txn.Query(sqlStmt)
+	if err != nil {
+		mdb.logAt(LOG_ERROR, "DirtyFilePaths err=%s", err.Error())
+		return nil, oph.RecordError(err)
+	}
+
+	var paths []string
+	for rows.Next() {
+		var parent string
+		var name string
+		rows.Scan(&parent, &name)
+		paths = append(paths, filepath.Join(parent, name))
+	}
+	rows.Close()
+	return paths, nil
+}
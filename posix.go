@@ -31,10 +31,32 @@ import (
 //         1/        faux sub-directory
 //           zoo     regular file
 //
-type PosixDir struct {
-	path          string   // entire directory path
-	dataObjects []DxDescribeDataObject
+// The objects arrive from DNAx in pages. An object whose name is not yet
+// taken is placed at the top level as soon as it arrives, so a large directory
+// does not need to be held in memory. Only the objects with conflicting names
+// are kept until the entire directory has been seen.
+type PosixDirStream struct {
+	px          *Posix
+	path        string   // entire directory path
 	subdirs     []string
+	subdirSet   map[string]bool
+
+	// the name of each object placed at the top level, and its creation time
+	topLevel    map[string]int64
+
+	// objects that could not be placed, because their name was already taken
+	conflicts   map[string]([]DxDescribeDataObject)
+}
+
+// The changes to make, once all the objects in a directory have been seen
+type PosixFixup struct {
+	// objects to add to the top level. Each one is newer than the object
+	// that was placed there first under the same name.
+	dataObjects []DxDescribeDataObject
+
+	// top level objects that were superseded by a newer version. They move
+	// into the faux subdirectory they map to.
+	demoted     map[string]string
 
 	// additional subdirectories holding files that have multiple versions,
 	// and could not be placed in the original location.
@@ -56,6 +78,14 @@ func (px *Posix) log(a string, args ...interface{}) {
 	LogMsg("posix", a, args...)
 }
 
+func (px *Posix) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "posix", a, args...)
+}
+
+func (px *Posix) logEnabled(level int) bool {
+	return LogEnabled("posix", level)
+}
+
 func FilenameIsPosixCompliant(filename string) bool {
 	if strings.Contains(filename, "/") {
 		return false
@@ -68,18 +98,10 @@ func (px *Posix) filenameNormalize(filename string) string {
 	return strings.ReplaceAll(filename, "/", "___")
 }
 
-// Choose [num] directory names that are not taken by existing subdirs or files
-func (px *Posix) pickFauxDirNames(subdirs []string, uniqueFileNames []string, num int) []string {
-	usedNames := make(map[string]bool)
-	for _, dName := range subdirs {
-		usedNames[dName] = true
-	}
-	for _, fName := range uniqueFileNames {
-		usedNames[fName] = true
-	}
-
+// Choose [num] directory names that are not already used
+func (px *Posix) pickFauxDirNames(usedNames map[string]bool, num int) []string {
 	i := 1
-	maxNumIter := (len(subdirs) + len(uniqueFileNames) + num) * 2
+	maxNumIter := (len(usedNames) + num) * 2
 	var dirNames []string
 	for len(dirNames) < num {
 		tentativeName := strconv.Itoa(i)
@@ -102,53 +124,14 @@ func (px *Posix) pickFauxDirNames(subdirs []string, uniqueFileNames []string, nu
 	return dirNames
 }
 
-
-// Find all the unique file names.
-//
-func (px *Posix) uniqueFileNames(dxObjs []DxDescribeDataObject) []string {
-	usedNames := make(map[string]bool)
-
-	var firstTimers []string
-	for _, oDesc := range dxObjs {
-		_, ok := usedNames[oDesc.Name]
-		if !ok {
-			// first time for this name
-			firstTimers = append(firstTimers, oDesc.Name)
-			usedNames[oDesc.Name] = true
-		}
-	}
-	return firstTimers
-}
-
-// pick all the objects with "name" from the list. Return an empty array
-// if none exist. Sort them from newest to oldest.
-func (px *Posix) chooseAllObjectsWithName(
-	dxObjs []DxDescribeDataObject,
-	name string) []DxDescribeDataObject {
-
-	objs := make([]DxDescribeDataObject, 0)
-	for _, o := range(dxObjs) {
-		if o.Name == name {
-			objs = append(objs, o)
-		}
-	}
-
-	// sort by date
-	sort.Slice(objs, func(i, j int) bool { return objs[i].CtimeSeconds > objs[j].CtimeSeconds })
-	return objs
-}
-
-
 // main entry point
 //
-// 1. Keep directory names fixed
-// 2. Change file names to not collide with directories, or with each other.
-func (px *Posix) FixDir(dxFolder *DxFolder) (*PosixDir, error) {
-	if px.options.VerboseLevel > 1 {
-		px.log("PosixFixDir %s #objects=%d #subdirs=%d",
-			dxFolder.path,
-			len(dxFolder.dataObjects),
-			len(dxFolder.subdirs))
+// Start fixing a directory, given its subdirectories. The directory names are
+// kept fixed, the file names are changed to not collide with directories, or
+// with each other.
+func (px *Posix) NewDirStream(path string, dxSubdirs []string) *PosixDirStream {
+	if px.logEnabled(LOG_TRACE) {
+		px.logAt(LOG_TRACE, "PosixFixDir %s #subdirs=%d", path, len(dxSubdirs))
 	}
 
 	// The subdirectories are specified in long paths ("/A/B/C"). Leave just
@@ -156,104 +139,151 @@ func (px *Posix) FixDir(dxFolder *DxFolder) (*PosixDir, error) {
 	//
 	// Remove all subdirectories that contain a slash
 	subdirs := make([]string, 0)
-	for _, subDirName := range dxFolder.subdirs {
+	subdirSet := make(map[string]bool)
+	for _, subDirName := range dxSubdirs {
 		// Make SURE that the subdirectory does not contain a slash.
-		lastPart := strings.TrimPrefix(subDirName, dxFolder.path)
+		lastPart := strings.TrimPrefix(subDirName, path)
 		lastPart = strings.TrimPrefix(lastPart,"/")
 		if strings.Contains(lastPart, "/") {
-			px.log("Dropping subdirectory %s, it contains a slash", lastPart)
+			px.logAt(LOG_WARN, "Dropping subdirectory %s, it contains a slash", lastPart)
 			continue
 		}
 		if lastPart != filepath.Base(subDirName) {
-			px.log("Dropping subdirectory %s, it isn't the same as Base(d)=%s",
+			px.logAt(LOG_WARN, "Dropping subdirectory %s, it isn't the same as Base(d)=%s",
 				lastPart, filepath.Base(subDirName))
 			continue
 		}
 
 		subdirs = append(subdirs, filepath.Base(subDirName))
+		subdirSet[filepath.Base(subDirName)] = true
 	}
-	if px.options.VerboseLevel > 1 {
-		px.log("subdirs = %v", subdirs)
+	if px.logEnabled(LOG_TRACE) {
+		px.logAt(LOG_TRACE, "subdirs = %v", subdirs)
 	}
 
-	// convert the map into an array. Normalize any non Posix names.
-	var allDxObjs []DxDescribeDataObject
-	for _, dxObj := range dxFolder.dataObjects {
-		var objNorm DxDescribeDataObject = dxObj
+	return &PosixDirStream{
+		px : px,
+		path : path,
+		subdirs : subdirs,
+		subdirSet : subdirSet,
+		topLevel : make(map[string]int64),
+		conflicts : make(map[string]([]DxDescribeDataObject)),
+	}
+}
 
-		if !FilenameIsPosixCompliant(objNorm.Name) {
-			// we need to normalize the name
-			objNorm.Name = px.filenameNormalize(objNorm.Name)
-		}
-		allDxObjs = append(allDxObjs, objNorm)
+// Add an object to the directory. Normalize its name if it is not
+// Posix compliant. Return the normalized object, and true if it can be
+// placed at the top level right away.
+func (ds *PosixDirStream) Add(dxObj DxDescribeDataObject) (DxDescribeDataObject, bool) {
+	if !FilenameIsPosixCompliant(dxObj.Name) {
+		// we need to normalize the name
+		dxObj.Name = ds.px.filenameNormalize(dxObj.Name)
 	}
 
-	// TODO: choose the latest object for each name. For example, if we
-	// have two files named zoo, the toplevel one will be the most recent.
-	uniqueFileNames := px.uniqueFileNames(allDxObjs)
-	if px.options.VerboseLevel > 1 {
-		px.log("unique file names=%v", uniqueFileNames)
+	_, isDir := ds.subdirSet[dxObj.Name]
+	_, taken := ds.topLevel[dxObj.Name]
+	if isDir || taken {
+		ds.conflicts[dxObj.Name] = append(ds.conflicts[dxObj.Name], dxObj)
+		return dxObj, false
 	}
+	ds.topLevel[dxObj.Name] = dxObj.CtimeSeconds
+	return dxObj, true
+}
+
+// The subdirectories, with their names fixed
+func (ds *PosixDirStream) Subdirs() []string {
+	return ds.subdirs
+}
+
+// An object competing for a name. It is either waiting to be placed,
+// or already at the top level.
+type posixCandidate struct {
+	obj     DxDescribeDataObject
+	ctime   int64
+	placed  bool
+}
 
-	// Iteratively, take unique files from the remaining objects, and place them in
-	// subdirectories 1, 2, 3, ... Be careful to create unused directory names
-	fauxSubDirs := make(map[string][]DxDescribeDataObject)
-
-	// choose names for faux subdirs for the worst case where all objects
-	// have the same name.
-	var fauxDirNames []string
-	maxNumDirs := len(allDxObjs)
-	fauxDirNames = px.pickFauxDirNames(subdirs, uniqueFileNames, maxNumDirs)
-	if px.options.Verbose {
-		px.log("pickFauxDirNames %v", fauxDirNames)
+// All the objects have been added. Resolve the name conflicts: for each name,
+// the most recent object goes in the top level, and the other versions are spread
+// across faux subdirectories 1, 2, 3, ... For example, if we have two files named
+// zoo, the toplevel one will be the most recent.
+func (ds *PosixDirStream) Finish() *PosixFixup {
+	px := ds.px
+	fixup := &PosixFixup{
+		dataObjects : make([]DxDescribeDataObject, 0),
+		demoted : make(map[string]string),
+		fauxSubdirs : make(map[string]([]DxDescribeDataObject)),
+	}
+	if len(ds.conflicts) == 0 {
+		return fixup
 	}
 
-	subdirSet := make(map[string]bool)
-	for _, dName := range subdirs {
-		subdirSet[dName] = true
+	// Be careful to create unused directory names. Choose enough
+	// names for the name with the largest number of versions.
+	usedNames := make(map[string]bool)
+	for _, dName := range ds.subdirs {
+		usedNames[dName] = true
+	}
+	for fName := range ds.topLevel {
+		usedNames[fName] = true
+	}
+	maxNumDirs := 0
+	for _, objs := range ds.conflicts {
+		maxNumDirs = MaxInt(maxNumDirs, len(objs) + 1)
+	}
+	fauxDirNames := px.pickFauxDirNames(usedNames, maxNumDirs)
+	if px.logEnabled(LOG_DEBUG) {
+		px.logAt(LOG_DEBUG, "pickFauxDirNames %v", fauxDirNames)
 	}
 
-	// Take all the data-objects that have names that aren't already taken
-	// up by subdirs. They go in the top level
-	var topLevelObjs []DxDescribeDataObject
+	for oName, objs := range ds.conflicts {
+		var candidates []posixCandidate
+		for _, o := range objs {
+			candidates = append(candidates, posixCandidate{ obj : o, ctime : o.CtimeSeconds })
+		}
+		ctime, ok := ds.topLevel[oName]
+		if ok {
+			candidates = append(candidates, posixCandidate{ ctime : ctime, placed : true })
+		}
 
-	for _, oName := range(uniqueFileNames) {
-		dxObjs := px.chooseAllObjectsWithName(allDxObjs, oName)
-		if px.options.VerboseLevel > 1 {
-			px.log("name=%s len(objs)=%d", oName, len(dxObjs))
+		// sort by date, from newest to oldest. On a tie, the object
+		// already at the top level stays there.
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if candidates[i].ctime != candidates[j].ctime {
+				return candidates[i].ctime > candidates[j].ctime
+			}
+			return candidates[i].placed && !candidates[j].placed
+		})
+		if px.logEnabled(LOG_TRACE) {
+			px.logAt(LOG_TRACE, "name=%s len(objs)=%d", oName, len(candidates))
 		}
 
-		_, ok := subdirSet[oName]
-		if !ok {
-			// There is no directory with this name, we
-			// place the object at the toplevel
-			topLevelObjs = append(topLevelObjs, dxObjs[0])
-			dxObjs = dxObjs[1:]
+		_, isDir := ds.subdirSet[oName]
+		if !isDir {
+			// There is no directory with this name, the newest
+			// object goes in the toplevel
+			if !candidates[0].placed {
+				fixup.dataObjects = append(fixup.dataObjects, candidates[0].obj)
+			}
+			candidates = candidates[1:]
 		}
 
 		// spread the remaining copies across the faux subdirectories
-		for i, obj := range(dxObjs) {
+		for i, c := range(candidates) {
 			dName := fauxDirNames[i]
-			vec, ok := fauxSubDirs[dName]
-			if !ok {
-				// need to start a new faux subdir called "dName"
-				v := make([]DxDescribeDataObject, 1)
-				v[0] = obj
-				fauxSubDirs[dName] = v
+			if c.placed {
+				fixup.demoted[oName] = dName
+				if _, ok := fixup.fauxSubdirs[dName]; !ok {
+					fixup.fauxSubdirs[dName] = make([]DxDescribeDataObject, 0)
+				}
 			} else {
-				fauxSubDirs[dName] = append(vec, obj)
+				fixup.fauxSubdirs[dName] = append(fixup.fauxSubdirs[dName], c.obj)
 			}
 		}
 	}
 
-	posixDxFolder := &PosixDir{
-		path: dxFolder.path,
-		dataObjects: topLevelObjs,
-		subdirs: subdirs,
-		fauxSubdirs: fauxSubDirs,
-	}
-	if px.options.VerboseLevel > 1 {
-		px.log("%v", posixDxFolder)
+	if px.logEnabled(LOG_TRACE) {
+		px.logAt(LOG_TRACE, "%v", fixup)
 	}
-	return posixDxFolder, nil
+	return fixup
 }
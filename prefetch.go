@@ -25,6 +25,8 @@ const (
 	periodicTime = 30 * time.Second
 	slowIoThresh = 60 // when does a slow IO become worth reporting
 
+	// prefetch sizes, the thread and table limits are defaults, they can be
+	// changed in the configuration file.
 	prefetchMinIoSize = (256 * KiB)   // threshold for deciding the file is sequentially accessed
 	prefetchIoFactor = 4
 
@@ -37,6 +39,9 @@ const (
 	// maximum number of prefetch threads, regardless of machine size
 	maxNumPrefetchThreads = 32
 
+	// maximum number of threads downloading a file that is materialized
+	maxNumMaterializeThreads = 16
+
 	minFileSize = 1 * MiB     // do not track files smaller than this size
 
 	// An prefetch request time limit
@@ -66,6 +71,11 @@ type IoReq struct {
 	size       int64
 	url         DxDownloadURL
 
+	// The file and project the URL was created for. Used to renew the
+	// URL if it expires. Empty for URLs that cannot be renewed (symlinks).
+	fileId      string
+	projId      string
+
 	ioSize      int64   // The io size
 	startByte   int64   // start byte, counting from the beginning of the file.
 	endByte     int64
@@ -112,8 +122,10 @@ type PrefetchFileMetadata struct {
 	hid                  fuseops.HandleID
 	inode                int64
 	id                   string
+	projId               string
 	size                 int64
 	url                  DxDownloadURL
+	renewableUrl         bool      // false for symbolic links
 	state                int
 
 	lastIoTimestamp      time.Time  // Last time an IO hit this file
@@ -130,15 +142,17 @@ type PrefetchFileMetadata struct {
 // global limits
 type PrefetchGlobalState struct {
 	mutex                 sync.Mutex  // Lock used to control the files table
-	verbose               bool
-	verboseLevel          int
 	handlesInfo           map[fuseops.HandleID](*PrefetchFileMetadata) // tracking state per handle
 	ioQueue               chan IoReq    // queue of IOs to prefetch
 	wg                    sync.WaitGroup
+	prefetchMinIoSize     int64
 	prefetchMaxIoSize     int64
+	prefetchIoFactor      int64
+	maxNumEntriesInTable  int
 	numPrefetchThreads    int
 	maxNumChunksReadAhead int
 	ioCounter             uint64
+	urlCache              *DownloadUrlCache
 }
 
 // presumption: there is some intersection
@@ -167,8 +181,20 @@ func (iov Iovec) stateString() string {
 
 // write a log message, and add a header
 func (pfm *PrefetchFileMetadata) log(a string, args ...interface{}) {
-	hdr := fmt.Sprintf("prefetch(%d,%d)", pfm.hid, pfm.inode)
-	LogMsg(hdr, a, args...)
+	pfm.logAt(LOG_INFO, a, args...)
+}
+
+func (pfm *PrefetchFileMetadata) logAt(level int, a string, args ...interface{}) {
+	hdr := fmt.Sprintf("(%d,%d) ", pfm.hid, pfm.inode)
+	LogMsgLevel(level, "prefetch", hdr + a, args...)
+}
+
+// The file the download URL belongs to. Empty if the URL cannot be renewed.
+func (pfm *PrefetchFileMetadata) urlFileId() string {
+	if !pfm.renewableUrl {
+		return ""
+	}
+	return pfm.id
 }
 
 func (pfm *PrefetchFileMetadata) stateString() string {
@@ -216,13 +242,24 @@ func (pgs *PrefetchGlobalState) log(a string, args ...interface{}) {
 	LogMsg("prefetch", a, args...)
 }
 
-func NewPrefetchGlobalState(verboseLevel int, dxEnv dxda.DXEnvironment) *PrefetchGlobalState {
+func (pgs *PrefetchGlobalState) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "prefetch", a, args...)
+}
+
+func (pgs *PrefetchGlobalState) logEnabled(level int) bool {
+	return LogEnabled("prefetch", level)
+}
+
+func NewPrefetchGlobalState(
+	dxEnv dxda.DXEnvironment,
+	urlCache *DownloadUrlCache,
+	tuning Tuning) *PrefetchGlobalState {
 	// We want to:
 	// 1) allow all streams to have a worker available
 	// 2) not have more than two workers per CPU
 	// 3) not go over an overall limit, regardless of machine size
 	numCPUs := runtime.NumCPU()
-	numPrefetchThreads := MinInt(numCPUs * 2, maxNumPrefetchThreads)
+	numPrefetchThreads := MinInt(numCPUs * 2, tuning.PrefetchMaxThreads)
 	log.Printf("Number of prefetch threads=%d", numPrefetchThreads)
 
 	// The number of read-ahead should be limited to 8
@@ -243,12 +280,15 @@ func NewPrefetchGlobalState(verboseLevel int, dxEnv dxda.DXEnvironment) *Prefetc
 		// we have a good network connection to S3 and dnanexus servers
 		prefetchMaxIoSize = 16 * MiB
 	}
+	if tuning.PrefetchMaxIoSize > 0 {
+		prefetchMaxIoSize = tuning.PrefetchMaxIoSize
+	}
 
 	// calculate how much memory will be used in the worst cast.
 	// - Each stream uses two chunks.
 	// - In addition, we are spreading around [maxNumChunksReadAhead] chunks.
 	// Each chunk could be as large as [prefetchMaxIoSize].
-	totalMemoryBytes := 2 * maxNumEntriesInTable * prefetchMaxIoSize
+	totalMemoryBytes := 2 * int64(tuning.PrefetchMaxFiles) * prefetchMaxIoSize
 	totalMemoryBytes += int64(maxNumChunksReadAhead) * prefetchMaxIoSize
 
 	log.Printf("maximal memory usage: %dMiB", totalMemoryBytes / MiB)
@@ -256,13 +296,15 @@ func NewPrefetchGlobalState(verboseLevel int, dxEnv dxda.DXEnvironment) *Prefetc
 	log.Printf("maximal number of read-ahead chunks: %d", maxNumChunksReadAhead)
 
 	pgs := &PrefetchGlobalState{
-		verbose : verboseLevel >= 1,
-		verboseLevel : verboseLevel,
 		handlesInfo : make(map[fuseops.HandleID](*PrefetchFileMetadata)),
 		ioQueue : make(chan IoReq),
+		prefetchMinIoSize : tuning.PrefetchMinIoSize,
 		prefetchMaxIoSize : prefetchMaxIoSize,
+		prefetchIoFactor : int64(tuning.PrefetchIoFactor),
+		maxNumEntriesInTable : tuning.PrefetchMaxFiles,
 		numPrefetchThreads: numPrefetchThreads,
 		maxNumChunksReadAhead : maxNumChunksReadAhead,
+		urlCache : urlCache,
 	}
 
 	// limit the number of prefetch IOs
@@ -278,8 +320,8 @@ func NewPrefetchGlobalState(verboseLevel int, dxEnv dxda.DXEnvironment) *Prefetc
 }
 
 func (pgs *PrefetchGlobalState) resetPfm(pfm *PrefetchFileMetadata) {
-	if pgs.verbose {
-		pfm.log("access is not sequential, reseting stream state inode=%d", pfm.inode)
+	if pgs.logEnabled(LOG_DEBUG) {
+		pfm.logAt(LOG_DEBUG, "access is not sequential, reseting stream state inode=%d", pfm.inode)
 	}
 	pfm.cancelIOs()
 	pfm.hiUserAccessOfs = 0
@@ -325,7 +367,7 @@ func (pgs *PrefetchGlobalState) reportIfSlowIO(
 	endTs := time.Now()
 	deltaSec := int(endTs.Sub(startTs).Seconds())
 	if deltaSec > slowIoThresh {
-		pgs.log("(inode=%d) slow IO [%d -- %d] %d seconds",
+		pgs.logAt(LOG_WARN, "(inode=%d) slow IO [%d -- %d] %d seconds",
 			inode, startByte, endByte, deltaSec)
 	}
 }
@@ -334,19 +376,11 @@ func (pgs *PrefetchGlobalState) readData(client *retryablehttp.Client, ioReq IoR
 	// The data has not been prefetched. Get the data from DNAx with an
 	// http request.
 	expectedLen := ioReq.endByte - ioReq.startByte + 1
-	if pgs.verbose {
-		pgs.log("hid=%d (%s) (io=%d) reading extent from DNAx ofs=%d len=%d",
+	if pgs.logEnabled(LOG_DEBUG) {
+		pgs.logAt(LOG_DEBUG, "hid=%d (inode=%d) (io=%d) reading extent from DNAx ofs=%d len=%d",
 			ioReq.hid, ioReq.inode, ioReq.id, ioReq.startByte, expectedLen)
 	}
 
-	headers := make(map[string]string)
-
-	// Copy the immutable headers
-	for key, value := range ioReq.url.Headers {
-		headers[key] = value
-	}
-	headers["Range"] = fmt.Sprintf("bytes=%d-%d", ioReq.startByte, ioReq.endByte)
-
 	// Safety procedure to force timeout to prevent hanging
 	ctx, cancel := context.WithCancel(context.TODO())
 	timer := time.AfterFunc(readRequestTimeout, func() {
@@ -354,36 +388,81 @@ func (pgs *PrefetchGlobalState) readData(client *retryablehttp.Client, ioReq IoR
 	})
 	defer timer.Stop()
 
+	// The IO runs in the background, it starts its own trace. The handle and
+	// inode link it to the file operations.
+	ctx, span := StartSpan(ctx, "Prefetch.io")
+	if span != nil {
+		span.SetAttr("dxfuse.handle_id", int64(ioReq.hid))
+		span.SetAttr("dxfuse.inode", ioReq.inode)
+		span.SetAttr("dxfuse.io_id", ioReq.id)
+		span.SetAttr("dxfuse.offset", ioReq.startByte)
+		span.SetAttr("dxfuse.size", expectedLen)
+	}
+	defer span.End()
+
 	startTs := time.Now()
 	defer pgs.reportIfSlowIO(startTs, ioReq.inode, ioReq.startByte, ioReq.endByte)
 
-	for tCnt := 0; tCnt < NumRetriesDefault; tCnt++ {
-		data, err := dxda.DxHttpRequest(ctx, client, 1, "GET", ioReq.url.URL, headers, []byte("{}"))
+	// Use the most recent URL for the file, it may have been renewed
+	// since the request was created.
+	url := ioReq.url
+	if ioReq.fileId != "" {
+		u, err := pgs.urlCache.Get(ctx, client, ioReq.fileId, ioReq.projId)
 		if err != nil {
 			return nil, err
 		}
+		url = u
+	}
+	renewed := false
+
+	for tCnt := 0; tCnt < NumRetries; tCnt++ {
+		headers := make(map[string]string)
+
+		// Copy the immutable headers
+		for key, value := range url.Headers {
+			headers[key] = value
+		}
+		headers["Range"] = fmt.Sprintf("bytes=%d-%d", ioReq.startByte, ioReq.endByte)
+
+		data, err := dxHttpRequest(ctx, client, 1, "GET", url.URL, headers, []byte("{}"))
+		if err != nil {
+			if ioReq.fileId == "" || renewed || !pgs.urlCache.IsAuthError(err) {
+				span.SetError(err)
+				return nil, err
+			}
+
+			// The URL has expired, or was revoked. Get a new one, and retry.
+			pgs.logAt(LOG_WARN, "(inode=%d) (io=%d) download URL was rejected, renewing it (%s)",
+				ioReq.inode, ioReq.id, err.Error())
+			url, err = pgs.urlCache.Refresh(ctx, client, ioReq.fileId, ioReq.projId, url)
+			if err != nil {
+				return nil, err
+			}
+			renewed = true
+			continue
+		}
 
 		recvLen := int64(len(data))
 		if recvLen != expectedLen {
 			// retry (only) in the case of short read
-			pgs.log("(inode=%d) (io=%d) received length is wrong, got %d, expected %d. Retrying.",
+			pgs.logAt(LOG_WARN, "(inode=%d) (io=%d) received length is wrong, got %d, expected %d. Retrying.",
 				ioReq.inode, ioReq.id, recvLen, expectedLen)
 			continue
 		}
 
-		if pgs.verbose {
+		if pgs.logEnabled(LOG_DEBUG) {
 			if err == nil {
-				pgs.log("(inode=%d) (io=%d) [%d -- %d] returned correctly",
+				pgs.logAt(LOG_DEBUG, "(inode=%d) (io=%d) [%d -- %d] returned correctly",
 					ioReq.inode, ioReq.id, ioReq.startByte, ioReq.endByte)
 			} else {
-				pgs.log("(inode=%d) (io=%d) [%d -- %d] returned with error %s",
+				pgs.logAt(LOG_DEBUG, "(inode=%d) (io=%d) [%d -- %d] returned with error %s",
 					ioReq.inode, ioReq.id, ioReq.startByte, ioReq.endByte, err.Error())
 			}
 		}
 		return data, err
 	}
 
-	pgs.log("Did not received the data for IO [%d -- %d]", ioReq.startByte, ioReq.endByte)
+	pgs.logAt(LOG_ERROR, "Did not received the data for IO [%d -- %d]", ioReq.startByte, ioReq.endByte)
 	return nil, fmt.Errorf("Did not receive the data")
 }
 
@@ -393,10 +472,12 @@ func (pgs *PrefetchGlobalState) DownloadEntireFile(
 	inode int64,
 	size int64,
 	url DxDownloadURL,
+	fileId string,
+	projId string,
 	fd *os.File,
 	localPath string) error {
-	if pgs.verbose {
-		pgs.log("Downloading entire file (inode=%d) to %s", inode, localPath)
+	if pgs.logEnabled(LOG_DEBUG) {
+		pgs.logAt(LOG_DEBUG, "Downloading entire file (inode=%d) to %s", inode, localPath)
 	}
 
 	endOfs := size - 1
@@ -412,6 +493,8 @@ func (pgs *PrefetchGlobalState) DownloadEntireFile(
 			inode : inode,
 			size : size,
 			url : url,
+			fileId : fileId,
+			projId : projId,
 			ioSize : iovLen,
 			startByte : startByte,
 			endByte : endByte,
@@ -435,6 +518,88 @@ func (pgs *PrefetchGlobalState) DownloadEntireFile(
 	return nil
 }
 
+// Download an entire file with parallel range requests, and write it to disk.
+// Each thread uses its own http client, so the requests do not compete with
+// the prefetch threads.
+func (pgs *PrefetchGlobalState) MaterializeFile(
+	ctx context.Context,
+	inode int64,
+	size int64,
+	fileId string,
+	projId string,
+	fd *os.File,
+	localPath string) error {
+	numThreads := MinInt(pgs.numPrefetchThreads, maxNumMaterializeThreads)
+	if pgs.logEnabled(LOG_DEBUG) {
+		pgs.logAt(LOG_DEBUG, "Materializing file (inode=%d) to %s with %d threads", inode, localPath, numThreads)
+	}
+
+	ioQueue := make(chan IoReq)
+	errChan := make(chan error, numThreads)
+	var failed int32 = 0
+
+	for i := 0; i < numThreads; i++ {
+		go func() {
+			client := dxda.NewHttpClient(true)
+			var firstErr error
+			for ioReq := range ioQueue {
+				if firstErr != nil {
+					// drain the queue
+					continue
+				}
+				data, err := pgs.readData(client, ioReq)
+				if err == nil {
+					var n int
+					n, err = fd.WriteAt(data, ioReq.startByte)
+					if err == nil && int64(n) != ioReq.ioSize {
+						err = errors.New("Length of local io-write is wrong")
+					}
+				}
+				if err != nil {
+					firstErr = err
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+			errChan <- firstErr
+		} ()
+	}
+
+	endOfs := size - 1
+	for startByte := int64(0); startByte <= endOfs; startByte += pgs.prefetchMaxIoSize {
+		if atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+		if ctx.Err() != nil {
+			// the filesystem is shutting down
+			break
+		}
+		endByte := MinInt64(startByte + pgs.prefetchMaxIoSize - 1, endOfs)
+		ioQueue <- IoReq{
+			hid : 0, // Invalid handle, shouldn't be in a table
+			inode : inode,
+			size : size,
+			fileId : fileId,
+			projId : projId,
+			ioSize : endByte - startByte + 1,
+			startByte : startByte,
+			endByte : endByte,
+			id : atomic.AddUint64(&pgs.ioCounter, 1),
+		}
+	}
+	close(ioQueue)
+
+	var err error
+	for i := 0; i < numThreads; i++ {
+		if tErr := <- errChan; tErr != nil && err == nil {
+			err = tErr
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
 // Find the index for this chunk in the cache. The chunks may be different
 // size, so we need to scan.
 func findIovecIndex(pfm *PrefetchFileMetadata, ioReq IoReq) int {
@@ -454,7 +619,7 @@ func (pgs *PrefetchGlobalState) addIoReqToCache(pfm *PrefetchFileMetadata, ioReq
 	// size, so we need to scan.
 	iovIdx := findIovecIndex(pfm, ioReq)
 	if iovIdx == -1 {
-		pfm.log("(#io=%d) Dropping prefetch IO, matching entry in cache not found, ioReq=%v len(cache.iovecs)=%d",
+		pfm.logAt(LOG_WARN, "(#io=%d) Dropping prefetch IO, matching entry in cache not found, ioReq=%v len(cache.iovecs)=%d",
 			ioReq.id, ioReq, len(pfm.cache.iovecs))
 		return
 	}
@@ -467,7 +632,7 @@ func (pgs *PrefetchGlobalState) addIoReqToCache(pfm *PrefetchFileMetadata, ioReq
 		pfm.mw.numBytesPrefetched += int64(len(data))
 		pfm.mw.numPrefetchIOs++
 	} else {
-		pfm.log("(#io=%d) prefetch io error [%d -- %d] %s",
+		pfm.logAt(LOG_ERROR, "(#io=%d) prefetch io error [%d -- %d] %s",
 			ioReq.id, ioReq.startByte, ioReq.endByte, err.Error())
 		pfm.cache.iovecs[iovIdx].state = IOV_ERRORED
 	}
@@ -507,8 +672,8 @@ func (pgs *PrefetchGlobalState) prefetchIoWorker() {
 		// are doing this, because this request could take a long time.
 		data, err := pgs.readData(client, ioReq)
 
-		if pgs.verboseLevel >= 2 {
-			pgs.log("(inode=%d) (io=%d) adding returned data to file", ioReq.inode, ioReq.id)
+		if pgs.logEnabled(LOG_TRACE) {
+			pgs.logAt(LOG_TRACE, "(inode=%d) (io=%d) adding returned data to file", ioReq.inode, ioReq.id)
 		}
 		pfm := pgs.getAndLockPfm(ioReq.hid)
 		if pfm == nil {
@@ -518,14 +683,14 @@ func (pgs *PrefetchGlobalState) prefetchIoWorker() {
 			continue
 		}
 
-		if pgs.verboseLevel >= 2 {
-			pgs.log("(inode=%d) (%d) holding the PFM lock", ioReq.inode, ioReq.id)
+		if pgs.logEnabled(LOG_TRACE) {
+			pgs.logAt(LOG_TRACE, "(inode=%d) (%d) holding the PFM lock", ioReq.inode, ioReq.id)
 		}
 		pgs.addIoReqToCache(pfm, ioReq, data, err)
 		pfm.mutex.Unlock()
 
-		if pgs.verboseLevel >= 2 {
-			pgs.log("(inode=%d) (%d) Done", ioReq.inode, ioReq.id)
+		if pgs.logEnabled(LOG_TRACE) {
+			pgs.logAt(LOG_TRACE, "(inode=%d) (%d) Done", ioReq.inode, ioReq.id)
 		}
 	}
 }
@@ -547,8 +712,8 @@ func (pgs *PrefetchGlobalState) isWorthIt(pfm *PrefetchFileMetadata, now time.Ti
 func (pgs *PrefetchGlobalState) tableCleanupWorker() {
 	for true {
 		time.Sleep(periodicTime)
-		if pgs.verbose {
-			pgs.log("periodic sweep [")
+		if pgs.logEnabled(LOG_DEBUG) {
+			pgs.logAt(LOG_DEBUG, "periodic sweep [")
 		}
 
 		// the entire list of file-handles
@@ -576,8 +741,8 @@ func (pgs *PrefetchGlobalState) tableCleanupWorker() {
 			}
 		}
 
-		if pgs.verbose {
-			pgs.log("]")
+		if pgs.logEnabled(LOG_DEBUG) {
+			pgs.logAt(LOG_DEBUG, "]")
 		}
 	}
 }
@@ -592,8 +757,10 @@ func (pgs *PrefetchGlobalState) newPrefetchFileMetadata(
 		hid : hid,
 		inode : f.Inode,
 		id : f.Id,
+		projId : f.ProjId,
 		size : f.Size,
 		url : url,
+		renewableUrl : f.Kind != FK_Symlink,
 		state : PFM_NIL,  // Initial state of the file; no IOs were detected yet
 		lastIoTimestamp : now,
 		hiUserAccessOfs : 0,
@@ -611,33 +778,33 @@ func (pgs *PrefetchGlobalState) newPrefetchFileMetadata(
 //
 // we set up two io-vectors so they would align on [prefetchMinIoSize] sizes.
 func (pgs *PrefetchGlobalState) firstAccessToStream(pfm *PrefetchFileMetadata, ofs int64) {
-	if pgs.verbose {
-		pfm.log("first IO %d", ofs)
+	if pgs.logEnabled(LOG_DEBUG) {
+		pfm.logAt(LOG_DEBUG, "first IO %d", ofs)
 	}
 
 	pageSize := int64(4 * KiB)
 	startOfs := (ofs / pageSize) * pageSize
 
 	iov1 := &Iovec{
-		ioSize : prefetchMinIoSize,
+		ioSize : pgs.prefetchMinIoSize,
 		startByte : startOfs,
-		endByte : startOfs + prefetchMinIoSize - 1,
+		endByte : startOfs + pgs.prefetchMinIoSize - 1,
 		touched : 0,
 		data : nil,
 		state : IOV_HOLE,
 		cond : sync.NewCond(&pfm.mutex),
 	}
 	iov2 := &Iovec{
-		ioSize : prefetchMinIoSize,
-		startByte : iov1.startByte + prefetchMinIoSize,
-		endByte : iov1.endByte + prefetchMinIoSize,
+		ioSize : pgs.prefetchMinIoSize,
+		startByte : iov1.startByte + pgs.prefetchMinIoSize,
+		endByte : iov1.endByte + pgs.prefetchMinIoSize,
 		touched : 0,
 		data : nil,
 		state : IOV_HOLE,
 		cond : sync.NewCond(&pfm.mutex),
 	}
 	pfm.cache = Cache{
-		prefetchIoSize : prefetchMinIoSize,
+		prefetchIoSize : pgs.prefetchMinIoSize,
 		maxNumIovecs : 2,
 		startByte : iov1.startByte,
 		endByte : iov2.endByte,
@@ -652,7 +819,7 @@ func (pgs *PrefetchGlobalState) CreateStreamEntry(hid fuseops.HandleID, f File,
 	defer pgs.mutex.Unlock()
 
 	// if the table is at the size limit, do not create a new entry
-	if len(pgs.handlesInfo) >= maxNumEntriesInTable {
+	if len(pgs.handlesInfo) >= pgs.maxNumEntriesInTable {
 		return
 	}
 
@@ -662,8 +829,8 @@ func (pgs *PrefetchGlobalState) CreateStreamEntry(hid fuseops.HandleID, f File,
 		return
 	}
 
-	if pgs.verbose {
-		pgs.log("CreateStreamEntry (%d, %s, %d)", hid, f.Name, f.Inode)
+	if pgs.logEnabled(LOG_DEBUG) {
+		pgs.logAt(LOG_DEBUG, "CreateStreamEntry (%d, %s, %d)", hid, f.Name, f.Inode)
 	}
 	pgs.handlesInfo[hid] = pgs.newPrefetchFileMetadata(hid, f, url)
 }
@@ -671,8 +838,8 @@ func (pgs *PrefetchGlobalState) CreateStreamEntry(hid fuseops.HandleID, f File,
 func (pgs *PrefetchGlobalState) RemoveStreamEntry(hid fuseops.HandleID) {
 	pfm := pgs.getAndLockPfm(hid)
 	if pfm != nil {
-		if pgs.verbose {
-			pgs.log("RemoveStreamEntry (%d, inode=%d)", hid, pfm.inode)
+		if pgs.logEnabled(LOG_DEBUG) {
+			pgs.logAt(LOG_DEBUG, "RemoveStreamEntry (%d, inode=%d)", hid, pfm.inode)
 		}
 
 		// wake up any waiting synchronous user IOs
@@ -686,6 +853,16 @@ func (pgs *PrefetchGlobalState) RemoveStreamEntry(hid fuseops.HandleID) {
 	}
 }
 
+// The file was moved to another project. Further IOs create their download
+// URLs in the new project.
+func (pgs *PrefetchGlobalState) UpdateStreamProject(hid fuseops.HandleID, projId string) {
+	pfm := pgs.getAndLockPfm(hid)
+	if pfm != nil {
+		pfm.projId = projId
+		pfm.mutex.Unlock()
+	}
+}
+
 func (pfm *PrefetchFileMetadata) markRangeInIovec(iovec *Iovec, startOfs int64, endOfs int64) {
 	startOfsBoth := MaxInt64(iovec.startByte, startOfs)
 	endOfsBoth := MinInt64(iovec.endByte, endOfs)
@@ -696,7 +873,7 @@ func (pfm *PrefetchFileMetadata) markRangeInIovec(iovec *Iovec, startOfs int64,
 	endSlot := (endOfsBoth - iovec.startByte) / slotSize
 	check(startSlot >= 0)
 	if !(endSlot >= 0 && endSlot <= numSlotsInChunk) {
-		pfm.log("offset(%d -- %d),  slots=(%d -- %d), iovec=(%d -- %d)",
+		pfm.logAt(LOG_ERROR, "offset(%d -- %d),  slots=(%d -- %d), iovec=(%d -- %d)",
 			startOfs, endOfs,
 			startSlot, endSlot,
 			iovec.startByte, iovec.endByte)
@@ -743,8 +920,8 @@ func (pgs *PrefetchGlobalState) findCoveredRange(
 		last = len(pfm.cache.iovecs) - 1
 	}
 
-	if pgs.verboseLevel >= 2 {
-		pfm.log("findCoverRange: first,last=(%d,%d)  IO=[%d -- %d]",
+	if pgs.logEnabled(LOG_TRACE) {
+		pfm.logAt(LOG_TRACE, "findCoverRange: first,last=(%d,%d)  IO=[%d -- %d]",
 			first, last, startOfs, endOfs)
 	}
 
@@ -799,6 +976,8 @@ func (pgs *PrefetchGlobalState) moveCacheWindow(pfm *PrefetchFileMetadata, iovIn
 				inode : pfm.inode,
 				size : pfm.size,
 				url : pfm.url,
+				fileId : pfm.urlFileId(),
+				projId : pfm.projId,
 				ioSize : iov.ioSize,
 				startByte : iov.startByte,
 				endByte : iov.endByte,
@@ -807,8 +986,8 @@ func (pgs *PrefetchGlobalState) moveCacheWindow(pfm *PrefetchFileMetadata, iovIn
 			check(iov.ioSize <= pgs.prefetchMaxIoSize)
 			pfm.cache.iovecs = append(pfm.cache.iovecs, iov)
 
-			if pgs.verbose {
-				pfm.log("Adding chunk %d [%d -- %d]",
+			if pgs.logEnabled(LOG_DEBUG) {
+				pfm.logAt(LOG_DEBUG, "Adding chunk %d [%d -- %d]",
 					len(pfm.cache.iovecs) - 1,
 					iov.startByte,
 					iov.endByte)
@@ -832,8 +1011,8 @@ func (pgs *PrefetchGlobalState) moveCacheWindow(pfm *PrefetchFileMetadata, iovIn
 		}
 		if nRemoved > 0 {
 			pfm.cache.iovecs = pfm.cache.iovecs[nRemoved : ]
-			if pgs.verbose {
-				pfm.log("Removed %d chunks", nRemoved)
+			if pgs.logEnabled(LOG_DEBUG) {
+				pfm.logAt(LOG_DEBUG, "Removed %d chunks", nRemoved)
 			}
 		}
 	}
@@ -844,10 +1023,10 @@ func (pgs *PrefetchGlobalState) moveCacheWindow(pfm *PrefetchFileMetadata, iovIn
 	pfm.cache.startByte = pfm.cache.iovecs[0].startByte
 	pfm.cache.endByte = pfm.cache.iovecs[nIovecs-1].endByte
 
-	if pgs.verboseLevel >= 2 {
-		pfm.log("range =[%d -- %d]", pfm.cache.startByte, pfm.cache.endByte)
+	if pgs.logEnabled(LOG_TRACE) {
+		pfm.logAt(LOG_TRACE, "range =[%d -- %d]", pfm.cache.startByte, pfm.cache.endByte)
 		for i, iovec := range pfm.cache.iovecs {
-			pfm.log("cache %d -> [%d -- %d]  %s", i, iovec.startByte, iovec.endByte,
+			pfm.logAt(LOG_TRACE, "cache %d -> [%d -- %d]  %s", i, iovec.startByte, iovec.endByte,
 				iovec.stateString())
 		}
 	}
@@ -871,8 +1050,8 @@ func (pgs *PrefetchGlobalState) markAccessedAndMaybeStartPrefetch(
 	// of the IO.
 	currentIovec := pfm.cache.iovecs[last]
 	numAccessed := bits.OnesCount64(currentIovec.touched)
-	if pgs.verboseLevel >= 2 {
-		pfm.log("touch: ofs=%d  len=%d  numAccessed=%d",
+	if pgs.logEnabled(LOG_TRACE) {
+		pfm.logAt(LOG_TRACE, "touch: ofs=%d  len=%d  numAccessed=%d",
 			startOfs, endOfs - startOfs, numAccessed)
 	}
 	if numAccessed < numSlotsInChunk {
@@ -888,7 +1067,7 @@ func (pgs *PrefetchGlobalState) markAccessedAndMaybeStartPrefetch(
 	// increase io size, using a bounded exponential formula
 	if pfm.cache.prefetchIoSize < pgs.prefetchMaxIoSize {
 		pfm.cache.prefetchIoSize =
-			MinInt64(pgs.prefetchMaxIoSize, pfm.cache.prefetchIoSize * prefetchIoFactor)
+			MinInt64(pgs.prefetchMaxIoSize, pfm.cache.prefetchIoSize * pgs.prefetchIoFactor)
 	}
 	if pfm.cache.prefetchIoSize == pgs.prefetchMaxIoSize {
 		// Give each stream at least one read-ahead request. If there
@@ -950,8 +1129,8 @@ func (pgs *PrefetchGlobalState) isDataInCache(
 			// waiting for prefetch to come back with data.
 			// note: when we wake up, the IO may have come back
 			// with an error.
-			if pgs.verboseLevel >= 2 {
-				pfm.log("isDataInCache: wait")
+			if pgs.logEnabled(LOG_TRACE) {
+				pfm.logAt(LOG_TRACE, "isDataInCache: wait")
 			}
 			iov.cond.Wait()
 			return DATA_WAIT
@@ -961,7 +1140,7 @@ func (pgs *PrefetchGlobalState) isDataInCache(
 			continue
 
 		case IOV_ERRORED:
-			pfm.log("isDataInCache: IO errored")
+			pfm.logAt(LOG_ERROR, "isDataInCache: IO errored")
 			return DATA_OUTSIDE_CACHE
 		}
 	}
@@ -1001,8 +1180,8 @@ func (pgs *PrefetchGlobalState) getDataFromCache(
 	numTries := 3
 	for i := 0; i < numTries; i++ {
 		retCode := pgs.isDataInCache(pfm, startOfs, endOfs)
-		if pgs.verboseLevel >= 2 {
-			pfm.log("isDataInCache=%s", cacheCode2string(retCode))
+		if pgs.logEnabled(LOG_TRACE) {
+			pfm.logAt(LOG_TRACE, "isDataInCache=%s", cacheCode2string(retCode))
 		}
 		switch retCode {
 		case DATA_OUTSIDE_CACHE:
@@ -1027,7 +1206,7 @@ func (pgs *PrefetchGlobalState) getDataFromCache(
 		}
 	}
 
-	pfm.log("strange: we waited %d times for IOs to return from prefetch, but got nothing", numTries)
+	pfm.logAt(LOG_WARN, "strange: we waited %d times for IOs to return from prefetch, but got nothing", numTries)
 	return DATA_OUTSIDE_CACHE, 0
 }
 
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"time"
@@ -18,6 +19,15 @@ import (
 const (
 	maxNumBulkDataThreads = 8
 	numFileThreads = 4
+
+	// number of file threads that handle only small files
+	numSmallFileThreads = 1
+
+	// threads that update tags and properties, and how
+	// long they wait before retrying a failed update
+	numMetadataThreads = 2
+	metadataRetryDelay = 5 * time.Second
+
 	sweepPeriodicTime = 1 * time.Minute
 )
 
@@ -39,7 +49,10 @@ type SyncDbDx struct {
 	dxEnv               dxda.DXEnvironment
 	options             Options
 	projId2Desc         map[string]DxDescribePrj
-	fileUpdateQueue     chan FileUpdateReq
+	sched              *UploadScheduler
+	metadataQueue       chan DirtyFileInfo
+	metadataWg          sync.WaitGroup
+	limiter            *TokenBucket
 	chunkQueue          chan *Chunk
 	sweepStopChan       chan struct{}
 	sweepStoppedChan    chan struct{}
@@ -50,6 +63,29 @@ type SyncDbDx struct {
 	mdb                *MetadataDb
 	ops                *DxOps
 	nonce              *Nonce
+
+	// files that are uploaded while they are being written
+	streamsMutex        sync.Mutex
+	streams             map[int64]*UploadStream
+	streamsWg           sync.WaitGroup
+
+	// Files taken off the dirty list by a sweep, and not uploaded yet. Files
+	// whose upload failed stay here, so they can be reported on shutdown.
+	unsyncedMutex       sync.Mutex
+	unsynced            map[int64]string
+
+	// Files whose data is queued for upload, or being uploaded. Also
+	// protected by [unsyncedMutex].
+	uploading           map[int64]bool
+
+	// serializes sync commands and draining
+	cmdMutex            sync.Mutex
+	draining            bool
+	workersDone         chan struct{}
+
+	// called when the tags and properties of a file reach the platform.
+	// The global lock is not held.
+	metadataSynced      func(projId string, fileId string)
 }
 
 func NewSyncDbDx(
@@ -57,10 +93,15 @@ func NewSyncDbDx(
 	dxEnv dxda.DXEnvironment,
 	projId2Desc map[string]DxDescribePrj,
 	mdb *MetadataDb,
-	mutex *sync.Mutex) *SyncDbDx {
+	mutex *sync.Mutex,
+	metadataSynced func(projId string, fileId string)) *SyncDbDx {
 
 	numCPUs := runtime.NumCPU()
-	numBulkDataThreads := MinInt(numCPUs, maxNumBulkDataThreads)
+	numBulkDataThreads := MinInt(numCPUs, options.Tuning.UploadMaxThreads)
+	if options.UploadThreads > 0 {
+		// the user chose the concurrency for this mount
+		numBulkDataThreads = options.UploadThreads
+	}
 
 	// limit the size of the chunk queue, so we don't
 	// have too many chunks stored in memory.
@@ -79,13 +120,17 @@ func NewSyncDbDx(
 		// we have a good network connection to S3 and dnanexus servers
 		minChunkSize = 16 * MiB
 	}
+	if options.Tuning.UploadMinChunkSize > 0 {
+		minChunkSize = options.Tuning.UploadMinChunkSize
+	}
 
 
 	sybx := &SyncDbDx{
 		dxEnv : dxEnv,
 		options : options,
 		projId2Desc : projId2Desc,
-		fileUpdateQueue : nil,
+		sched : nil,
+		limiter : NewTokenBucket(options.UploadBandwidth),
 		chunkQueue : chunkQueue,
 		sweepStopChan : nil,
 		sweepStoppedChan : nil,
@@ -95,6 +140,16 @@ func NewSyncDbDx(
 		mdb : mdb,
 		ops : NewDxOps(dxEnv, options),
 		nonce : NewNonce(),
+		streams : make(map[int64]*UploadStream),
+		unsynced : make(map[int64]string),
+		uploading : make(map[int64]bool),
+		draining : false,
+		workersDone : nil,
+		metadataSynced : metadataSynced,
+	}
+	sybx.log("number of upload threads=%d", numBulkDataThreads)
+	if options.UploadBandwidth > 0 {
+		sybx.log("upload bandwidth limit=%d MiB/sec", options.UploadBandwidth / MiB)
 	}
 
 	// bunch of background threads to upload bulk file data.
@@ -116,6 +171,14 @@ func (sybx *SyncDbDx) log(a string, args ...interface{}) {
 	LogMsg("sync_db_dx", a, args...)
 }
 
+func (sybx *SyncDbDx) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "sync_db_dx", a, args...)
+}
+
+func (sybx *SyncDbDx) logEnabled(level int) bool {
+	return LogEnabled("sync_db_dx", level)
+}
+
 
 func (sybx *SyncDbDx) startSweepWorker() {
 	// start a periodic thread to synchronize the database with
@@ -134,28 +197,172 @@ func (sybx *SyncDbDx) stopSweepWorker() {
 }
 
 func (sybx *SyncDbDx) startBackgroundWorkers() {
-	// Create a bunch of threads to update files and metadata
-	sybx.fileUpdateQueue = make(chan FileUpdateReq)
+	// Create a bunch of threads to update files, and separate
+	// ones to update metadata
+	sybx.sched = NewUploadScheduler()
 	for i := 0; i < numFileThreads; i++ {
 		sybx.wg.Add(1)
-		go sybx.updateFileWorker()
+		go sybx.updateFileWorker(i < numSmallFileThreads)
 	}
+	sybx.metadataQueue = make(chan DirtyFileInfo, maxNumObjectsInDescribe)
+	for i := 0; i < numMetadataThreads; i++ {
+		sybx.metadataWg.Add(1)
+		go sybx.metadataWorker()
+	}
+}
+
+// Wait for the upload threads, and then for the metadata threads. The upload
+// threads pass on the metadata of the files they create, so they stop first.
+func (sybx *SyncDbDx) waitForBackgroundWorkers() {
+	sybx.wg.Wait()
+	close(sybx.metadataQueue)
+	sybx.metadataWg.Wait()
 }
 
 func (sybx *SyncDbDx) stopBackgroundWorkers() {
-	// signal all upload and modification threads to stop
-	close(sybx.fileUpdateQueue)
+	// signal all upload and modification threads to stop, once
+	// the pending requests are done.
+	sybx.sched.Close()
 
 	// wait for all of them to complete
-	sybx.wg.Wait()
+	sybx.waitForBackgroundWorkers()
 
-	sybx.fileUpdateQueue = nil
+	sybx.sched = nil
+	sybx.metadataQueue = nil
 }
 
-func (sybx *SyncDbDx) Shutdown() {
-	sybx.stopSweepWorker()
-	sybx.stopBackgroundWorkers()
-	close(sybx.chunkQueue)
+// Upload one part of a file, within the bandwidth limit
+func (sybx *SyncDbDx) uploadPart(
+	ctx context.Context,
+	client *retryablehttp.Client,
+	fileId string,
+	index int,
+	data []byte) error {
+	sybx.limiter.Wait(int64(len(data)))
+	return sybx.ops.DxFileUploadPart(ctx, client, fileId, index, data)
+}
+
+// Stop the upload threads. This should be called after Drain. If the drain did not
+// complete, the threads are left running, and are terminated when the process exits.
+// Returns false in that case; the threads still use the database, so it must
+// not be closed.
+func (sybx *SyncDbDx) Shutdown() bool {
+	sybx.cmdMutex.Lock()
+	defer sybx.cmdMutex.Unlock()
+
+	if !sybx.draining {
+		sybx.stopSweepWorker()
+		sybx.stopStreams()
+		sybx.stopBackgroundWorkers()
+		close(sybx.chunkQueue)
+		return true
+	}
+	select {
+	case <- sybx.workersDone:
+		if !sybx.streamsIdle() {
+			sybx.logAt(LOG_WARN, "streaming uploads are still running, not waiting for them")
+			return false
+		}
+		close(sybx.chunkQueue)
+		return true
+	default:
+		sybx.logAt(LOG_WARN, "upload threads are still running, not waiting for them")
+		return false
+	}
+}
+
+// Upload all the pending changes, and stop accepting new ones. The filesystem
+// should not allow modifications at this point. Wait up to [timeout]
+// for the uploads to complete, and return the paths of files whose changes
+// were not uploaded.
+//
+// The files that are not streamed are queued first. Then, the streams of files
+// that were closed get up to half of the time to upload their last part; the
+// streams of files that are still open are abandoned, and their files are
+// queued for a normal upload.
+//
+// Drain can be called more than once; later calls wait again for the
+// uploads that are still in progress.
+func (sybx *SyncDbDx) Drain(timeout time.Duration) []string {
+	sybx.cmdMutex.Lock()
+	defer sybx.cmdMutex.Unlock()
+	deadline := time.Now().Add(timeout)
+
+	if !sybx.draining {
+		sybx.draining = true
+		sybx.log("draining pending uploads, timeout=%s", timeout.String())
+		sybx.stopSweepWorker()
+
+		// Queue the files that are not streamed first, so that their
+		// uploads start right away.
+		if err := sybx.sweep(DIRTY_FILES_ALL); err != nil {
+			sybx.logAt(LOG_ERROR, "Error in sweep: %s", err.Error())
+		}
+
+		// The streams of files that were closed upload their last part,
+		// the rest are abandoned. They get up to half of the time.
+		sybx.finishStreams(time.Now().Add(timeout / 2))
+
+		// the files of abandoned streams are uploaded from the start
+		if err := sybx.sweep(DIRTY_FILES_ALL); err != nil {
+			sybx.logAt(LOG_ERROR, "Error in sweep: %s", err.Error())
+		}
+
+		// let the workers complete the pending requests, and exit
+		sybx.sched.Close()
+		sybx.workersDone = make(chan struct{})
+		go func() {
+			sybx.waitForBackgroundWorkers()
+			close(sybx.workersDone)
+		} ()
+	}
+
+	select {
+	case <- sybx.workersDone:
+		sybx.log("all uploads completed")
+	case <- time.After(time.Until(deadline)):
+		sybx.logAt(LOG_WARN, "timed out waiting for uploads to complete")
+	}
+	return sybx.unsyncedPaths()
+}
+
+// The files whose changes have not reached the platform. These are the files
+// that are still dirty, and the ones that a sweep picked up, but have not been
+// uploaded successfully.
+func (sybx *SyncDbDx) unsyncedPaths() []string {
+	sybx.mutex.Lock()
+	paths, err := sybx.mdb.DirtyFilePaths()
+	sybx.mutex.Unlock()
+	if err != nil {
+		sybx.logAt(LOG_ERROR, "database error listing dirty files: %s", err.Error())
+	}
+
+	sybx.unsyncedMutex.Lock()
+	defer sybx.unsyncedMutex.Unlock()
+	for _, p := range sybx.unsynced {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func (sybx *SyncDbDx) markSynced(inode int64) {
+	sybx.unsyncedMutex.Lock()
+	defer sybx.unsyncedMutex.Unlock()
+	delete(sybx.unsynced, inode)
+}
+
+// The data of the file was uploaded, or the upload failed.
+func (sybx *SyncDbDx) uploadDone(inode int64) {
+	sybx.unsyncedMutex.Lock()
+	defer sybx.unsyncedMutex.Unlock()
+	delete(sybx.uploading, inode)
+}
+
+// Is there an upload of the file data that has not completed?
+func (sybx *SyncDbDx) uploadPending(inode int64) bool {
+	sybx.unsyncedMutex.Lock()
+	defer sybx.unsyncedMutex.Unlock()
+	return sybx.uploading[inode]
 }
 
 // A worker dedicated to performing data-upload operations
@@ -168,24 +375,24 @@ func (sybx *SyncDbDx) bulkDataWorker() {
 		if !ok {
 			return
 		}
-		if sybx.options.Verbose {
-			sybx.log("Uploading chunk=%d len=%d", chunk.index, len(chunk.data))
+		if sybx.logEnabled(LOG_DEBUG) {
+			sybx.logAt(LOG_DEBUG, "Uploading chunk=%d len=%d", chunk.index, len(chunk.data))
 		}
 
 		// upload the data, and report the error if any
-		err := sybx.ops.DxFileUploadPart(
+		err := sybx.uploadPart(
 			context.TODO(),
 			client,
 			chunk.fileId, chunk.index, chunk.data)
 		if err != nil {
-			sybx.log("failed to upload file %s part %d, error=%s",
+			sybx.logAt(LOG_ERROR, "failed to upload file %s part %d, error=%s",
 				chunk.fileId, chunk.index, err)
 			chunk.errorReports <- err
 		}
 		chunk.fwg.Done()
 
-		if sybx.options.Verbose {
-			sybx.log("Chunk %d complete", chunk.index)
+		if sybx.logEnabled(LOG_DEBUG) {
+			sybx.logAt(LOG_DEBUG, "Chunk %d complete", chunk.index)
 		}
 	}
 }
@@ -195,6 +402,27 @@ func divideRoundUp(x int64, y int64) int64 {
 	return (x + y - 1) / y
 }
 
+// A range of bytes in a file, uploaded as one part
+type filePart struct {
+	ofs  int64
+	size int64
+}
+
+// Split a file into parts. All the parts are of the same size,
+// except the last one, which could be smaller.
+func splitIntoParts(fileSize int64, partSize int64) []filePart {
+	var parts []filePart
+	fileEndOfs := fileSize - 1
+	for ofs := int64(0); ofs <= fileEndOfs; ofs += partSize {
+		partEndOfs := MinInt64(ofs + partSize - 1, fileEndOfs)
+		parts = append(parts, filePart{
+			ofs : ofs,
+			size : partEndOfs - ofs + 1,
+		})
+	}
+	return parts
+}
+
 // Check if a part size can work for a file
 func checkPartSizeSolution(param FileUploadParameters, fileSize int64, partSize int64) bool {
 	if partSize < param.MinimumPartSize {
@@ -287,7 +515,7 @@ func (sybx *SyncDbDx) uploadFileData(
 		if err != nil {
 			return err
 		}
-		return sybx.ops.DxFileUploadPart(
+		return sybx.uploadPart(
 			context.TODO(),
 			client,
 			fileId, 1, data)
@@ -298,23 +526,18 @@ func (sybx *SyncDbDx) uploadFileData(
 	// a channel for reporting errors. It needs to
 	// accomodate the maximal number of errors, so that the worker
 	// threads will not block.
-	numParts := divideRoundUp(upReq.dfi.FileSize, upReq.partSize)
-	errorReports := make(chan error, numParts)
+	parts := splitIntoParts(upReq.dfi.FileSize, upReq.partSize)
+	errorReports := make(chan error, len(parts))
 
 	var fileWg sync.WaitGroup
-	fileEndOfs := upReq.dfi.FileSize - 1
-	ofs := int64(0)
-	cIndex := 1
-	for ofs <= fileEndOfs {
-		chunkEndOfs := MinInt64(ofs + upReq.partSize - 1, fileEndOfs)
-		chunkLen := chunkEndOfs - ofs
-		buf, err := readLocalFileExtent(upReq.dfi.LocalPath, ofs, int(chunkLen))
+	for i, part := range parts {
+		buf, err := readLocalFileExtent(upReq.dfi.LocalPath, part.ofs, int(part.size))
 		if err != nil {
 			return err
 		}
 		chunk := &Chunk{
 			fileId : fileId,
-			index : cIndex,
+			index : i + 1,
 			data : buf,
 			fwg : &fileWg,
 			errorReports : errorReports,
@@ -323,9 +546,6 @@ func (sybx *SyncDbDx) uploadFileData(
 		// are many chunks.
 		fileWg.Add(1)
 		sybx.chunkQueue <- chunk
-
-		ofs += upReq.partSize
-		cIndex++
 	}
 
 	// wait for all requests to complete
@@ -348,9 +568,9 @@ func (sybx *SyncDbDx) createEmptyFileData(
 		// we need to upload an empty part, only
 		// then can we close the file
 		ctx := context.TODO()
-		err := sybx.ops.DxFileUploadPart(ctx, httpClient, fileId, 1, make([]byte, 0))
+		err := sybx.uploadPart(ctx, httpClient, fileId, 1, make([]byte, 0))
 		if err != nil {
-			sybx.log("error uploading empty chunk to file %s", fileId)
+			sybx.logAt(LOG_ERROR, "error uploading empty chunk to file %s", fileId)
 			return err
 		}
 	} else {
@@ -363,8 +583,8 @@ func (sybx *SyncDbDx) uploadFileDataAndWait(
 	client *retryablehttp.Client,
 	upReq FileUpdateReq,
 	fileId string) error {
-	if sybx.options.Verbose {
-		sybx.log("Upload file-size=%d part-size=%d", upReq.dfi.FileSize, upReq.partSize)
+	if sybx.logEnabled(LOG_DEBUG) {
+		sybx.logAt(LOG_DEBUG, "Upload file-size=%d part-size=%d", upReq.dfi.FileSize, upReq.partSize)
 	}
 
 	if upReq.dfi.FileSize == 0 {
@@ -379,23 +599,63 @@ func (sybx *SyncDbDx) uploadFileDataAndWait(
 		}
 	}
 
-	if sybx.options.Verbose {
-		sybx.log("Closing %s", fileId)
+	if sybx.logEnabled(LOG_DEBUG) {
+		sybx.logAt(LOG_DEBUG, "Closing %s", fileId)
 	}
 	return sybx.ops.DxFileCloseAndWait(context.TODO(), client, fileId)
 }
 
 
+// The file may have been renamed, or moved to another project, since it was
+// queued. Update its location from the database. Returns false if the file
+// was removed. Called with the global lock held.
+func (sybx *SyncDbDx) refreshLocation(dfi *DirtyFileInfo) (bool, error) {
+	crnt, ok, err := sybx.mdb.FileUploadInfo(dfi.Inode)
+	if err != nil || !ok {
+		return false, err
+	}
+	dfi.Name = crnt.Name
+	dfi.Directory = crnt.Directory
+	dfi.ProjFolder = crnt.ProjFolder
+	dfi.ProjId = crnt.ProjId
+	return true, nil
+}
+
 // Upload
 func (sybx *SyncDbDx) updateFileData(
 	client *retryablehttp.Client,
-	upReq FileUpdateReq) (string, error) {
+	upReq *FileUpdateReq) (string, error) {
 
 	// We need to lock the filesystem while we are doing this, because
 	// a race could happen if the directory is removed while the file
 	// is created.
 	sybx.mutex.Lock()
 
+	oldProjId := upReq.dfi.ProjId
+	ok, err := sybx.refreshLocation(&upReq.dfi)
+	if err != nil || !ok {
+		sybx.mutex.Unlock()
+		if err == nil {
+			err = errors.New("file was removed")
+		}
+		return "", err
+	}
+	if upReq.dfi.ProjId != oldProjId {
+		// the part size depends on the project
+		projDesc, ok := sybx.projId2Desc[upReq.dfi.ProjId]
+		if !ok {
+			sybx.mutex.Unlock()
+			return "", fmt.Errorf("project %s not found", upReq.dfi.ProjId)
+		}
+		partSize, err := sybx.calcPartSize(projDesc.UploadParams, upReq.dfi.FileSize)
+		if err != nil {
+			sybx.mutex.Unlock()
+			return "", err
+		}
+		upReq.partSize = partSize
+		upReq.uploadParams = projDesc.UploadParams
+	}
+
 	// create the file object on the platform.
 	fileId, err := sybx.ops.DxFileNew(
 		context.TODO(), client, sybx.nonce.String(),
@@ -406,7 +666,7 @@ func (sybx *SyncDbDx) updateFileData(
 		sybx.mutex.Unlock()
 		// an error could occur here if the directory has been removed
 		// while we were trying to upload the file.
-		sybx.log("Error in creating file (%s:%s/%s) on dnanexus: %s",
+		sybx.logAt(LOG_ERROR, "Error in creating file (%s:%s/%s) on dnanexus: %s",
 			upReq.dfi.ProjId, upReq.dfi.ProjFolder,	upReq.dfi.Name,
 			err.Error())
 		return "", err
@@ -418,11 +678,11 @@ func (sybx *SyncDbDx) updateFileData(
 
 	// Note: the file may have been deleted while it was being uploaded.
 	// This means that an error could happen here, and it would be legal.
-	err = sybx.uploadFileDataAndWait(client, upReq, fileId)
+	err = sybx.uploadFileDataAndWait(client, *upReq, fileId)
 	if err != nil {
 		// Upload failed.
 		// TODO: erase the local copy.
-		sybx.log("Error during upload of file %s: %s",
+		sybx.logAt(LOG_ERROR, "Error during upload of file %s: %s",
 			fileId, err.Error())
 		return "", err
 	}
@@ -446,16 +706,12 @@ func (sybx *SyncDbDx) updateFileData(
 	return fileId, nil
 }
 
-func (sybx *SyncDbDx) updateFileAttributes(client *retryablehttp.Client, dfi DirtyFileInfo) error {
-	// describe the object state on the platform. The properties/tags have
-	// changed.
-	fDesc, err := DxDescribe(context.TODO(), client, &sybx.dxEnv, dfi.Id)
-	if err != nil {
-		sybx.log(err.Error())
-		sybx.log("Failed ot describe file %v", dfi)
-		return err
-	}
-
+// Update the tags and properties of a file on the platform, given its
+// current description.
+func (sybx *SyncDbDx) syncTagsAndProperties(
+	client *retryablehttp.Client,
+	dfi DirtyFileInfo,
+	fDesc DxDescribeDataObject) error {
 	// Figure out the symmetric difference between the on-platform properties,
 	// and what the filesystem has.
 	dnaxProps := fDesc.Properties
@@ -485,8 +741,8 @@ func (sybx *SyncDbDx) updateFileAttributes(client *retryablehttp.Client, dfi Dir
 	}
 
 	if len(opProps) > 0 {
-		if sybx.options.Verbose {
-			sybx.log("%s symmetric difference between properties %v ^ %v = %v",
+		if sybx.logEnabled(LOG_DEBUG) {
+			sybx.logAt(LOG_DEBUG, "%s symmetric difference between properties %v ^ %v = %v",
 				dfi.Id, dnaxProps, fsProps, opProps)
 		}
 		err := sybx.ops.DxSetProperties(context.TODO(), client, dfi.ProjId, dfi.Id, opProps)
@@ -524,9 +780,9 @@ func (sybx *SyncDbDx) updateFileAttributes(client *retryablehttp.Client, dfi Dir
 			tagsAdded = append(tagsAdded, tag)
 		}
 	}
-	if sybx.options.Verbose {
+	if sybx.logEnabled(LOG_DEBUG) {
 		if len(tagsAdded) > 0 || len(tagsRemoved) > 0 {
-			sybx.log("%s symmetric difference between tags %v ^ %v = (added=%v, removed=%v)",
+			sybx.logAt(LOG_DEBUG, "%s symmetric difference between tags %v ^ %v = (added=%v, removed=%v)",
 				dfi.Id, dnaxTags, fsTags, tagsAdded, tagsRemoved)
 		}
 	}
@@ -546,47 +802,156 @@ func (sybx *SyncDbDx) updateFileAttributes(client *retryablehttp.Client, dfi Dir
 	return nil
 }
 
-func (sybx *SyncDbDx) updateFileWorker() {
+func (sybx *SyncDbDx) updateFileWorker(smallOnly bool) {
 	// A fixed http client. The idea is to be able to reuse http connections.
 	client := dxda.NewHttpClient(true)
 
 	for true {
-		upReq, ok := <-sybx.fileUpdateQueue
+		upReq, ok := sybx.sched.Next(smallOnly)
 		if !ok {
 			sybx.wg.Done()
 			return
 		}
-		if sybx.options.Verbose {
-			sybx.log("updateFile inode=%d part-size=%d", upReq.dfi.Inode, upReq.partSize)
+		if sybx.logEnabled(LOG_DEBUG) {
+			sybx.logAt(LOG_DEBUG, "updateFile inode=%d part-size=%d", upReq.dfi.Inode, upReq.partSize)
 		}
 
 		// note: the file-id may be empty ("") if the file
-		// has just been created on the local machine.
+		// has just been created on the local machine. It is also empty
+		// if an earlier upload failed; the file is then created from
+		// the local copy, even if only its metadata changed.
 		var err error
 		crntFileId := upReq.dfi.Id
-		if upReq.dfi.dirtyData {
-			crntFileId, err = sybx.updateFileData(client, upReq)
+		if upReq.dfi.dirtyData || crntFileId == "" {
+			crntFileId, err = sybx.updateFileData(client, &upReq)
+			sybx.uploadDone(upReq.dfi.Inode)
 			if err != nil {
-				sybx.log("Error in update-data: %s", err.Error())
+				sybx.logAt(LOG_ERROR, "Error in update-data: %s", err.Error())
 				continue
 			}
 		}
 		if upReq.dfi.dirtyMetadata {
-			if crntFileId == "" {
-				// create an empty file
-				check(upReq.dfi.FileSize == 0)
-				crntFileId, err = sybx.updateFileData(client, upReq)
-				if err != nil {
-					sybx.log("Error when creating a metadata-only file %s",
-						err.Error())
-					continue
-				}
-			}
-			// file exists, figure out what needs to be
-			// updated
+			// The file exists, hand it over to the metadata
+			// workers. They mark it as synced.
 			dfi := upReq.dfi
 			dfi.Id = crntFileId
-			sybx.updateFileAttributes(client, dfi)
+			dfi.dirtyData = false
+			sybx.metadataQueue <- dfi
+			continue
+		}
+		sybx.markSynced(upReq.dfi.Inode)
+	}
+}
+
+// Update the tags and properties of a batch of files that exist on the
+// platform. The files are described in bulk, instead of one at a time, so the
+// cost is one describe call per batch, and only the calls needed to apply each
+// file's changes. Return the files that could not be updated.
+func (sybx *SyncDbDx) updateMetadataBatch(client *retryablehttp.Client, batch []DirtyFileInfo) []DirtyFileInfo {
+	// the files may have moved to another project while they were queued
+	var current []DirtyFileInfo
+	sybx.mutex.Lock()
+	for _, dfi := range batch {
+		ok, err := sybx.refreshLocation(&dfi)
+		if err != nil {
+			sybx.logAt(LOG_ERROR, "database error looking up inode=%d: %s", dfi.Inode, err.Error())
+		} else if !ok {
+			// removed, there is nothing to update
+			sybx.markSynced(dfi.Inode)
+			continue
+		}
+		current = append(current, dfi)
+	}
+	sybx.mutex.Unlock()
+	batch = current
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var objIds []string
+	for _, dfi := range batch {
+		objIds = append(objIds, dfi.Id)
+	}
+	descs, err := DxDescribeBulkObjects(context.TODO(), client, &sybx.dxEnv, objIds)
+	if err != nil {
+		sybx.logAt(LOG_ERROR, "Failed to describe %d files for a metadata update: %s", len(batch), err.Error())
+		return batch
+	}
+	if sybx.logEnabled(LOG_DEBUG) {
+		sybx.logAt(LOG_DEBUG, "updating the metadata of %d files", len(batch))
+	}
+
+	var failed []DirtyFileInfo
+	for _, dfi := range batch {
+		fDesc, ok := descs[dfi.Id]
+		if !ok {
+			// The file was removed, or replaced by a newer
+			// version. There is nothing left to update.
+			sybx.logAt(LOG_WARN, "File %s (inode=%d) was not found on the platform, its metadata was not updated",
+				dfi.Id, dfi.Inode)
+			sybx.markSynced(dfi.Inode)
+			continue
+		}
+		if err := sybx.syncTagsAndProperties(client, dfi, fDesc); err != nil {
+			sybx.logAt(LOG_ERROR, "Error updating the metadata of %s: %s", dfi.Id, err.Error())
+			failed = append(failed, dfi)
+			continue
+		}
+		sybx.markSynced(dfi.Inode)
+		sybx.metadataSynced(dfi.ProjId, dfi.Id)
+	}
+	return failed
+}
+
+// A worker dedicated to tags and properties. It never uploads file data, so
+// a metadata change to a large remote file is applied quickly. The requests
+// that are waiting when the worker wakes up are handled as one batch.
+func (sybx *SyncDbDx) metadataWorker() {
+	client := dxda.NewHttpClient(true)
+
+	for true {
+		dfi, ok := <- sybx.metadataQueue
+		if !ok {
+			sybx.metadataWg.Done()
+			return
+		}
+		batch := []DirtyFileInfo{ dfi }
+	collect:
+		for len(batch) < maxNumObjectsInDescribe {
+			select {
+			case dfi, ok := <- sybx.metadataQueue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, dfi)
+			default:
+				break collect
+			}
+		}
+
+		for i := 0; len(batch) > 0 && i < NumRetries; i++ {
+			if i > 0 {
+				time.Sleep(metadataRetryDelay)
+			}
+			batch = sybx.updateMetadataBatch(client, batch)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		// Mark the files dirty again, so the next sweep retries them,
+		// and they are reported on shutdown if they never make it.
+		sybx.mutex.Lock()
+		for _, dfi := range batch {
+			sybx.logAt(LOG_ERROR, "Giving up on updating the metadata of %s (inode=%d), will retry on the next sync",
+				dfi.Id, dfi.Inode)
+			if err := sybx.mdb.MarkDirty(dfi.Inode, false, true); err != nil {
+				sybx.logAt(LOG_ERROR, "database error marking inode=%d as dirty: %s", dfi.Inode, err.Error())
+			}
+		}
+		sybx.mutex.Unlock()
+		for _, dfi := range batch {
+			sybx.markSynced(dfi.Inode)
 		}
 	}
 }
@@ -601,24 +966,33 @@ func (sybx *SyncDbDx) enqueueUpdateFileReq(dfi DirtyFileInfo) error {
 
 	partSize, err := sybx.calcPartSize(projDesc.UploadParams, dfi.FileSize)
 	if err != nil {
-		sybx.log(`
+		sybx.logAt(LOG_ERROR, `
 There is a problem with the file size, it cannot be uploaded
 to the platform due to part size constraints. Error=%s`,
 			err.Error())
 		return fuse.EINVAL
 	}
 
-	sybx.fileUpdateQueue <- FileUpdateReq{
+	// files that fit in a single part are uploaded first
+	class := UPLOAD_CLASS_LARGE
+	if dfi.FileSize <= partSize {
+		class = UPLOAD_CLASS_SMALL
+	}
+	ok = sybx.sched.Enqueue(FileUpdateReq{
 		dfi : dfi,
 		partSize : partSize,
 		uploadParams : projDesc.UploadParams,
+	}, class)
+	if !ok {
+		sybx.logAt(LOG_WARN, "upload scheduler is closed, dropping update for inode=%d", dfi.Inode)
+		return fuse.EIO
 	}
 	return nil
 }
 
 func (sybx *SyncDbDx) sweep(flag int) error {
-	if sybx.options.Verbose {
-		sybx.log("syncing database and platform [")
+	if sybx.logEnabled(LOG_DEBUG) {
+		sybx.logAt(LOG_DEBUG, "syncing database and platform [")
 	}
 
 	// find all the dirty files. We need to lock
@@ -629,19 +1003,59 @@ func (sybx *SyncDbDx) sweep(flag int) error {
 		sybx.mutex.Unlock()
 		return err
 	}
+
+	// Files that are being streamed are uploaded when they are released.
+	// Leave them dirty, in case the stream is abandoned.
+	var filesToUpdate []DirtyFileInfo
+	for _, file := range(dirtyFiles) {
+		if sybx.streamActive(file.Inode) {
+			if err := sybx.mdb.MarkDirty(file.Inode, file.dirtyData, file.dirtyMetadata); err != nil {
+				sybx.logAt(LOG_ERROR, "database error marking inode=%d as dirty: %s", file.Inode, err.Error())
+			}
+			continue
+		}
+		if !file.dirtyData && file.Id == "" && sybx.uploadPending(file.Inode) {
+			// Only the metadata changed, and the file is still being
+			// uploaded. Leave it dirty, the metadata is applied once the
+			// file has an ID.
+			if err := sybx.mdb.MarkDirty(file.Inode, false, true); err != nil {
+				sybx.logAt(LOG_ERROR, "database error marking inode=%d as dirty: %s", file.Inode, err.Error())
+			}
+			continue
+		}
+		filesToUpdate = append(filesToUpdate, file)
+	}
+	dirtyFiles = filesToUpdate
 	sybx.mutex.Unlock()
 
-	if sybx.options.Verbose {
-		sybx.log("%d dirty files", len(dirtyFiles))
+	if sybx.logEnabled(LOG_DEBUG) {
+		sybx.logAt(LOG_DEBUG, "%d dirty files", len(dirtyFiles))
 	}
 
 	// enqueue them on the "to-upload" list
+	sybx.unsyncedMutex.Lock()
+	for _, file := range(dirtyFiles) {
+		sybx.unsynced[file.Inode] = filepath.Join(file.Directory, file.Name)
+		if file.dirtyData || file.Id == "" {
+			sybx.uploading[file.Inode] = true
+		}
+	}
+	sybx.unsyncedMutex.Unlock()
+
+	// Files that have only new tags or properties, and exist on the
+	// platform, go to the metadata workers. The data is not touched.
 	for _, file := range(dirtyFiles) {
-		sybx.enqueueUpdateFileReq(file)
+		if !file.dirtyData && file.Id != "" {
+			sybx.metadataQueue <- file
+			continue
+		}
+		if err := sybx.enqueueUpdateFileReq(file); err != nil {
+			sybx.uploadDone(file.Inode)
+		}
 	}
 
-	if sybx.options.Verbose {
-		sybx.log("]")
+	if sybx.logEnabled(LOG_DEBUG) {
+		sybx.logAt(LOG_DEBUG, "]")
 	}
 	return nil
 }
@@ -670,17 +1084,28 @@ func (sybx *SyncDbDx) periodicSync() {
 		lastSweepTs = now
 
 		if err := sybx.sweep(DIRTY_FILES_INACTIVE); err != nil {
-			sybx.log("Error in sweep: %s", err.Error())
+			sybx.logAt(LOG_ERROR, "Error in sweep: %s", err.Error())
 		}
 	}
 }
 
 func (sybx *SyncDbDx) CmdSync() error {
+	sybx.cmdMutex.Lock()
+	defer sybx.cmdMutex.Unlock()
+	if sybx.draining {
+		// the filesystem is being unmounted
+		return errors.New("the filesystem is shutting down")
+	}
+
 	// we don't want to have two sweeps running concurrently
 	sybx.stopSweepWorker()
 
+	// Files that were closed are uploaded by their streams. Files
+	// that are still being written are left to the sweep.
+	sybx.finishStreams(time.Time{})
+
 	if err := sybx.sweep(DIRTY_FILES_ALL); err != nil {
-		sybx.log("Error in sweep: %s", err.Error())
+		sybx.logAt(LOG_ERROR, "Error in sweep: %s", err.Error())
 		return err
 	}
 
@@ -0,0 +1,62 @@
+package dxfuse
+
+import (
+	"testing"
+)
+
+// The parts must cover the file exactly, without gaps or overlaps. An earlier
+// version dropped the last byte of every part.
+func TestSplitIntoParts(t *testing.T) {
+	testCases := []struct {
+		fileSize int64
+		partSize int64
+		numParts int
+	}{
+		{ 1, 10, 1 },
+		{ 10, 10, 1 },
+		{ 11, 10, 2 },
+		{ 20, 10, 2 },
+		{ 25, 10, 3 },
+		{ 16 * MiB + 3, 5 * MiB, 4 },
+	}
+
+	for _, tc := range testCases {
+		parts := splitIntoParts(tc.fileSize, tc.partSize)
+		if len(parts) != tc.numParts {
+			t.Errorf("file-size=%d part-size=%d: expected %d parts, got %d",
+				tc.fileSize, tc.partSize, tc.numParts, len(parts))
+			continue
+		}
+		if int64(len(parts)) != divideRoundUp(tc.fileSize, tc.partSize) {
+			t.Errorf("file-size=%d part-size=%d: number of parts does not match divideRoundUp",
+				tc.fileSize, tc.partSize)
+		}
+
+		ofs := int64(0)
+		for i, part := range parts {
+			if part.ofs != ofs {
+				t.Errorf("file-size=%d part-size=%d: part %d starts at %d, expected %d",
+					tc.fileSize, tc.partSize, i, part.ofs, ofs)
+			}
+			if i < len(parts) - 1 && part.size != tc.partSize {
+				t.Errorf("file-size=%d part-size=%d: part %d has size %d",
+					tc.fileSize, tc.partSize, i, part.size)
+			}
+			if part.size <= 0 || part.size > tc.partSize {
+				t.Errorf("file-size=%d part-size=%d: part %d has invalid size %d",
+					tc.fileSize, tc.partSize, i, part.size)
+			}
+			ofs += part.size
+		}
+		if ofs != tc.fileSize {
+			t.Errorf("file-size=%d part-size=%d: the parts cover %d bytes",
+				tc.fileSize, tc.partSize, ofs)
+		}
+	}
+}
+
+func TestSplitIntoPartsEmpty(t *testing.T) {
+	if parts := splitIntoParts(0, 10); len(parts) != 0 {
+		t.Errorf("an empty file should have no parts, got %d", len(parts))
+	}
+}
@@ -9,6 +9,9 @@ mountpoint=${baseDir}/MNT
 
 # Directories created during the test
 writeable_dirs=()
+
+# A scratch project, the destination of moves between projects
+xprojName=""
 ######################################################################
 
 teardown_complete=0
@@ -29,6 +32,9 @@ function teardown {
     for d in ${writeable_dirs[@]}; do
         dx rm -r $projName:/$d >& /dev/null || true
     done
+    if [[ $xprojName != "" ]]; then
+        dx rmproject -y $xprojName >& /dev/null || true
+    fi
 }
 
 # trap any errors and cleanup
@@ -259,6 +265,47 @@ function move_file2 {
     rm -rf B
 }
 
+# rename replaces an existing target, the way editors and
+# atomic writers use it.
+function move_file_over_existing {
+    local write_dir=$1
+    cd $write_dir
+
+    rm -f XX.txt ZZ.txt
+    echo "old contents" > ZZ.txt
+    echo "new contents" > XX.txt
+    mv XX.txt ZZ.txt
+
+    if [[ -f XX.txt ]]; then
+        echo "Error, the source file still exists after rename"
+        exit 1
+    fi
+    result=$(cat ZZ.txt)
+    if [[ $result != "new contents" ]]; then
+        echo "Error, the target was not replaced, content=$result"
+        exit 1
+    fi
+    rm -f ZZ.txt
+}
+
+function move_dir_over_empty_dir {
+    local write_dir=$1
+    cd $write_dir
+
+    rm -rf A B
+    mkdir A
+    echo "Monroe doctrine" > A/X.txt
+    mkdir B
+    mv -T A B
+
+    tree B
+    if [[ ! -f B/X.txt ]]; then
+        echo "Error, directory B was not replaced"
+        exit 1
+    fi
+    rm -rf B
+}
+
 function rename_dir {
     local write_dir=$1
     cd $write_dir
@@ -368,6 +415,105 @@ function move_dir_to_file {
 }
 
 
+# Move a file, and a directory, to another project. They are removed
+# from the source project.
+function move_across_projects {
+    local src_dir=$1
+    local dest_dir=$2
+    local src_path=$3
+
+    rm -rf $src_dir/XP $dest_dir/XP $dest_dir/XP.txt $dest_dir/XP_renamed.txt
+    echo "Fortune favours the bold" > $src_dir/XP.txt
+    mkdir $src_dir/XP
+    echo "Veni, vidi, vici" > $src_dir/XP/A.txt
+    echo "Alea iacta est" > $src_dir/XP/B.txt
+    $dxfuse -sync
+
+    mv $src_dir/XP.txt $dest_dir/XP_renamed.txt
+    mv $src_dir/XP $dest_dir/
+    if [[ -e $src_dir/XP.txt || -e $src_dir/XP ]]; then
+        echo "Error, the source still exists after a move between projects"
+        exit 1
+    fi
+    if [[ $(cat $dest_dir/XP_renamed.txt) != "Fortune favours the bold" ]]; then
+        echo "Error, the moved file has the wrong content"
+        exit 1
+    fi
+    if [[ $(cat $dest_dir/XP/B.txt) != "Alea iacta est" ]]; then
+        echo "Error, the moved directory has the wrong content"
+        exit 1
+    fi
+
+    # the platform agrees
+    dx ls $xprojName:/XP_renamed.txt
+    dx ls $xprojName:/XP/A.txt
+    if dx ls $projName:/$src_path/XP.txt >& /dev/null; then
+        echo "Error, the file was not removed from the source project"
+        exit 1
+    fi
+
+    rm -rf $dest_dir/XP $dest_dir/XP_renamed.txt
+}
+
+# A file modified locally, and queued for upload, is moved to another
+# project. It is uploaded to its new project.
+function move_dirty_file_across_projects {
+    local src_dir=$1
+    local dest_dir=$2
+
+    rm -f $src_dir/XD.txt $dest_dir/XD.txt
+    echo "first version" > $src_dir/XD.txt
+    $dxfuse -sync
+    echo "second version" > $src_dir/XD.txt
+    mv $src_dir/XD.txt $dest_dir/XD.txt
+    $dxfuse -sync
+
+    local content=$(dx cat $xprojName:/XD.txt)
+    if [[ $content != "second version" ]]; then
+        echo "Error, the file was not uploaded to its new project, content=$content"
+        exit 1
+    fi
+    rm -f $dest_dir/XD.txt
+}
+
+# Without permission to remove from the source, a move between projects
+# is a copy. The source stays in place.
+function copy_from_read_only_project {
+    local src_dir=$1
+    local dest_dir=$2
+
+    local src_file=$(find $src_dir -maxdepth 1 -type f | head -n 1)
+    if [[ $src_file == "" ]]; then
+        echo "no file to copy in $src_dir"
+        exit 1
+    fi
+    local name=$(basename "$src_file")
+    local content=$(cat "$src_file")
+
+    mv "$src_file" $dest_dir/
+    if [[ ! -f "$src_file" ]]; then
+        echo "Error, the source of the copy is gone"
+        exit 1
+    fi
+    if [[ $(cat "$dest_dir/$name") != "$content" ]]; then
+        echo "Error, the copy has the wrong content"
+        exit 1
+    fi
+    rm -f "$dest_dir/$name"
+
+    local src_folder=$(find $src_dir -mindepth 1 -maxdepth 1 -type d | head -n 1)
+    if [[ $src_folder != "" ]]; then
+        local dname=$(basename "$src_folder")
+        mv "$src_folder" $dest_dir/
+        if [[ ! -d "$src_folder" ]]; then
+            echo "Error, the source folder of the copy is gone"
+            exit 1
+        fi
+        diff -r "$src_folder" "$dest_dir/$dname"
+        rm -rf "$dest_dir/$dname"
+    fi
+}
+
 function dir_and_file_with_the_same_name {
     local root_dir=$1
 
@@ -409,6 +555,8 @@ function fs_test_cases {
 
     dx mkdir $projName:/$base_dir
     dx mkdir $projName:/$expr_dir
+    xprojName="dxfuse_test_xproj_$base_dir"
+    dx new project $xprojName --brief
 
     # Start the dxfuse daemon in the background, and wait for it to initilize.
     echo "Mounting dxfuse"
@@ -416,7 +564,7 @@ function fs_test_cases {
     if [[ $verbose != "" ]]; then
         flags="-verbose 2"
     fi
-    sudo -E $dxfuse -uid $(id -u) -gid $(id -g) $flags $mountpoint dxfuse_test_data dxfuse_test_read_only ArchivedStuff
+    sudo -E $dxfuse -uid $(id -u) -gid $(id -g) $flags $mountpoint dxfuse_test_data dxfuse_test_read_only ArchivedStuff $xprojName
     sleep 1
 
     echo "can't write to read-only project"
@@ -447,6 +595,12 @@ function fs_test_cases {
     echo "move file II"
     move_file2 $mountpoint/$projName/$expr_dir
 
+    echo "move file over an existing file"
+    move_file_over_existing $mountpoint/$projName/$expr_dir
+
+    echo "move directory over an empty directory"
+    move_dir_over_empty_dir $mountpoint/$projName/$expr_dir
+
     echo "rename directory"
     rename_dir $mountpoint/$projName/$expr_dir
     rename_dir /tmp
@@ -470,6 +624,11 @@ function fs_test_cases {
     move_non_existent_dir "$mountpoint/$projName"
     move_dir_to_file "$mountpoint/$projName"
 
+    echo "moves between projects"
+    move_across_projects $mountpoint/$projName/$expr_dir $mountpoint/$xprojName $expr_dir
+    move_dirty_file_across_projects $mountpoint/$projName/$expr_dir $mountpoint/$xprojName
+    copy_from_read_only_project $mountpoint/dxfuse_test_read_only $mountpoint/$xprojName
+
     echo "directory and file with the same name"
     dir_and_file_with_the_same_name $mountpoint/$projName
 
@@ -9,6 +9,9 @@ xattr_test
 source $CRNT_DIR/manifest_test.sh
 manifest_test
 
+source $CRNT_DIR/read_only.sh
+read_only_test
+
 source $CRNT_DIR/dx_download_compare.sh
 dx_download_compare
 
@@ -1,5 +1,89 @@
 CRNT_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" >/dev/null 2>&1 && pwd )"
 
+# compare a file in the mount with its copy on the platform
+function manifest_check_content {
+    local local_path=$1
+    local dx_path=$2
+
+    local content=$(cat $local_path)
+    local content_dx=$(dx cat $dx_path)
+    if [[ "$content" == "$content_dx" ]]; then
+        echo "$dx_path +"
+    else
+        echo "file $local_path has incorrect content"
+        exit 1
+    fi
+}
+
+# Files picked by selectors are resolved at mount time. The same file
+# picked twice, for the same directory, is mounted once.
+function manifest_selectors {
+    local mountpoint=$1
+    local projName=$2
+    local dxfuse=$3
+    local projId=$(dx describe $projName --json | jq -r .id)
+    local manifest=/tmp/selectors_$$.json
+
+    cat > $manifest <<EOF
+{
+  "files" : [],
+  "directories" : [],
+  "selectors" : [
+    { "proj_id" : "$projId", "folder" : "/correctness/small", "name" : "*.txt", "parent" : "/sel" },
+    { "proj_id" : "$projId", "folder" : "/correctness/small", "name" : "A.txt", "parent" : "/sel" }
+  ]
+}
+EOF
+    sudo -E $dxfuse -uid $(id -u) -gid $(id -g) $mountpoint $manifest
+    sleep 1
+
+    tree $mountpoint
+    manifest_check_content $mountpoint/sel/A.txt $projName:/correctness/small/A.txt
+
+    local num_mounted=$(ls $mountpoint/sel | wc -l)
+    local num_expected=$(dx find data --class file --state closed --name "*.txt" --path $projName:/correctness/small --norecurse --brief | wc -l)
+    if [[ $num_mounted != $num_expected ]]; then
+        echo "selectors mounted the wrong number of files"
+        echo "   got:       $num_mounted"
+        echo "   expecting: $num_expected"
+        exit 1
+    fi
+    sudo umount $mountpoint
+    rm -f $manifest
+}
+
+# Folders and files of a project, given as PROJECT:/PATH. A local
+# manifest is recognized even if there is a colon in its path.
+function manifest_project_paths {
+    local mountpoint=$1
+    local projName=$2
+    local dxfuse=$3
+
+    sudo -E $dxfuse -uid $(id -u) -gid $(id -g) $mountpoint \
+         $projName:/correctness/small $projName:/correctness/small/A.txt
+    sleep 1
+
+    tree $mountpoint
+    manifest_check_content $mountpoint/$projName/correctness/small/A.txt $projName:/correctness/small/A.txt
+    local folders=$(ls $mountpoint/$projName/correctness | tr '\n' ' ')
+    if [[ $folders != "small " ]]; then
+        echo "only the requested folder should be mounted"
+        echo "   got:       $folders"
+        echo "   expecting: small "
+        exit 1
+    fi
+    sudo umount $mountpoint
+
+    local manifest="/tmp/dxfuse:two_files_$$.json"
+    cp $CRNT_DIR/two_files.json "$manifest"
+    sudo -E $dxfuse -uid $(id -u) -gid $(id -g) $mountpoint "$manifest"
+    sleep 1
+
+    manifest_check_content $mountpoint/A.txt $projName:/correctness/small/A.txt
+    sudo umount $mountpoint
+    rm -f "$manifest"
+}
+
 function manifest_test {
     local mountpoint=${HOME}/MNT
     local projName="dxfuse_test_data"
@@ -22,4 +106,7 @@ function manifest_test {
         exit 1
     fi
     sudo umount $mountpoint
+
+    manifest_selectors $mountpoint $projName $dxfuse
+    manifest_project_paths $mountpoint $projName $dxfuse
 }
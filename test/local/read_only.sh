@@ -0,0 +1,46 @@
+CRNT_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" >/dev/null 2>&1 && pwd )"
+
+# Mount read-only as a regular user, without sudo. The metadata database is kept
+# in memory, and the log is written to the temporary directory.
+function read_only_test {
+    local mountpoint=${HOME}/MNT_RO
+    local projName="dxfuse_test_data"
+    local dxfuse="$GOPATH/bin/dxfuse"
+
+    if [[ $(id -u) == 0 ]]; then
+        echo "read_only_test must run as a regular user, skipping"
+        return
+    fi
+
+    mkdir -p $mountpoint
+
+    $dxfuse -readOnly $mountpoint $CRNT_DIR/two_files.json
+    sleep 1
+
+    full_path=/correctness/small/A.txt
+    local content=$(cat $mountpoint/A.txt)
+    local content_dx=$(dx cat $projName:$full_path)
+
+    if [[ "$content" == "$content_dx" ]]; then
+        echo "$full_path +"
+    else
+        echo "file $full_path has incorrect content"
+        fusermount -u $mountpoint
+        exit 1
+    fi
+
+    # modifications are refused
+    if echo "hello" > $mountpoint/new_file.txt 2> /dev/null; then
+        echo "created a file on a read-only mount"
+        fusermount -u $mountpoint
+        exit 1
+    fi
+    if rm -f $mountpoint/A.txt 2> /dev/null && [[ ! -e $mountpoint/A.txt ]]; then
+        echo "removed a file on a read-only mount"
+        fusermount -u $mountpoint
+        exit 1
+    fi
+
+    fusermount -u $mountpoint
+    echo "read only mount as a regular user +"
+}
@@ -42,6 +42,21 @@ function close_file {
     done
 }
 
+# Every file lists the same base.* attributes. The ones that a file does
+# not have, such as the description of a file that was not uploaded yet,
+# are missing when read.
+base_attrs="base.archivalState base.created base.createdBy base.details base.folder base.hidden base.id base.md5 base.media base.modified base.project base.properties base.sponsored base.state base.tags"
+
+# All the attributes of a file, in sorted order
+function all_attrs {
+    xattr $1 | sort | tr '\n' ' '
+}
+
+# The base.* attributes, and the given tags and properties, in sorted order
+function expected_attrs {
+    echo $base_attrs "$@" | tr ' ' '\n' | sort | tr '\n' ' '
+}
+
 function setup {
     local base_dir=$1
 
@@ -69,8 +84,8 @@ function check_bat {
     local test_dir=$mountpoint/$projName/$base_dir
 
     # Get a list of all the attributes
-    local bat_all_attrs=$(xattr $test_dir/bat.txt | sort | tr '\n' ' ')
-    local bat_all_expected="base.archivalState base.id base.state prop.eat prop.family prop.fly "
+    local bat_all_attrs=$(all_attrs $test_dir/bat.txt)
+    local bat_all_expected=$(expected_attrs prop.eat prop.family prop.fly)
     if [[ $bat_all_attrs != $bat_all_expected ]]; then
         echo "bat attributes are incorrect"
         echo "   got:       $bat_all_attrs"
@@ -96,8 +111,8 @@ function check_whale {
     local base_dir=$1
     local test_dir=$mountpoint/$projName/$base_dir
 
-    local whale_all_attrs=$(xattr $test_dir/whale.txt | sort | tr '\n' ' ')
-    local whale_all_expected="base.archivalState base.id base.state "
+    local whale_all_attrs=$(all_attrs $test_dir/whale.txt)
+    local whale_all_expected=$(expected_attrs)
     if [[ $whale_all_attrs != $whale_all_expected ]]; then
        echo "whale attributes are incorrect"
        echo "   got:       $whale_all_attrs"
@@ -124,8 +139,8 @@ function check_new {
         exit 1
     fi
 
-    local all_attrs=$(xattr $f | sort | tr '\n' ' ')
-    local all_expected="base.archivalState base.id base.state prop.family tag.high "
+    local all_attrs=$(all_attrs $f)
+    local all_expected=$(expected_attrs prop.family tag.high)
     if [[ $all_attrs != $all_expected ]]; then
         echo "$f attributes are incorrect"
         echo "   got:       $all_attrs"
@@ -160,8 +175,8 @@ function check_new {
     xattr -d tag.high $f
     xattr  $f
 
-    local all_attrs2=$(xattr $f | sort | tr '\n' ' ')
-    local all_expected2="base.archivalState base.id base.state "
+    local all_attrs2=$(all_attrs $f)
+    local all_expected2=$(expected_attrs)
     if [[ $all_attrs2 != $all_expected2 ]]; then
         echo "$f attributes are incorrect"
         echo "   got:       $all_attrs2"
@@ -170,6 +185,210 @@ function check_new {
     fi
 }
 
+# All the tags, or all the properties, are replaced at once through
+# base.tags and base.properties.
+function check_json_attrs {
+    local base_dir=$1
+    local test_dir=$mountpoint/$projName/$base_dir
+    local f=$test_dir/Mountains.txt
+    local dnaxF=$projName:/$base_dir/Mountains.txt
+
+    xattr -w base.properties '{"peak":"K2","range":"Karakoram"}' $f
+    xattr -w base.tags '["high","cold"]' $f
+
+    local peak=$(xattr -p prop.peak $f)
+    if [[ $peak != "K2" ]]; then
+        echo "$f peak property is wrong"
+        echo "   got:       $peak"
+        echo "   expecting: K2"
+        exit 1
+    fi
+    local tags=$(xattr -p base.tags $f | jq -cM 'sort')
+    local tags_expected='["cold","high"]'
+    if [[ $tags != $tags_expected ]]; then
+        echo "$f tags are wrong"
+        echo "   got:       $tags"
+        echo "   expecting: $tags_expected"
+        exit 1
+    fi
+
+    # malformed JSON is rejected, and changes nothing
+    if xattr -w base.properties '["peak"]' $f 2> /dev/null; then
+        echo "setting base.properties to a list should fail"
+        exit 1
+    fi
+
+    echo "synchronizing filesystem"
+    $dxfuse -sync
+
+    local props=$(dx describe $dnaxF --json | jq -cMS .properties)
+    local props_expected='{"peak":"K2","range":"Karakoram"}'
+    if [[ $props != $props_expected ]]; then
+        echo "$f properties mismatch"
+        echo "   got:        $props"
+        echo "   expecting:  $props_expected"
+        exit 1
+    fi
+    tags=$(dx describe $dnaxF --json | jq -cM '.tags | sort')
+    if [[ $tags != $tags_expected ]]; then
+        echo "$f tags mismatch"
+        echo "   got:        $tags"
+        echo "   expecting:  $tags_expected"
+        exit 1
+    fi
+
+    xattr -w base.properties '{}' $f
+    xattr -w base.tags '[]' $f
+    local all_attrs=$(all_attrs $f)
+    local all_expected=$(expected_attrs)
+    if [[ $all_attrs != $all_expected ]]; then
+        echo "$f should have no tags or properties"
+        echo "   got:       $all_attrs"
+        echo "   expecting: $all_expected"
+        exit 1
+    fi
+}
+
+# Attributes that come from the full object description. They are
+# described again after the file moves.
+function check_described {
+    local base_dir=$1
+    local test_dir=$mountpoint/$projName/$base_dir
+    local f=$test_dir/whale.txt
+
+    for key in base.created base.modified base.createdBy base.folder base.project; do
+        if ! xattr -p $key $f > /dev/null; then
+            echo "$f has no $key attribute"
+            exit 1
+        fi
+    done
+
+    local proj_id=$(xattr -p base.project $f)
+    local proj_id_expected=$(dx describe $projName --json | jq -r .id)
+    if [[ $proj_id != $proj_id_expected ]]; then
+        echo "$f project is wrong"
+        echo "   got:       $proj_id"
+        echo "   expecting: $proj_id_expected"
+        exit 1
+    fi
+
+    local folder=$(xattr -p base.folder $f)
+    if [[ $folder != "/$base_dir" ]]; then
+        echo "$f folder is wrong"
+        echo "   got:       $folder"
+        echo "   expecting: /$base_dir"
+        exit 1
+    fi
+
+    mkdir $test_dir/sub
+    mv $f $test_dir/sub/whale.txt
+    folder=$(xattr -p base.folder $test_dir/sub/whale.txt)
+    if [[ $folder != "/$base_dir/sub" ]]; then
+        echo "folder of moved file is wrong"
+        echo "   got:       $folder"
+        echo "   expecting: /$base_dir/sub"
+        exit 1
+    fi
+    mv $test_dir/sub/whale.txt $f
+    rmdir $test_dir/sub
+
+    # describing the file does not change the list of attributes
+    local described_attrs=$(all_attrs $f)
+    local described_expected=$(expected_attrs)
+    if [[ $described_attrs != $described_expected ]]; then
+        echo "$f attributes changed after it was described"
+        echo "   got:       $described_attrs"
+        echo "   expecting: $described_expected"
+        exit 1
+    fi
+
+    # A file that is still written has not been uploaded, it lists the
+    # same attributes, but has no description.
+    local new_f=$test_dir/not_uploaded.txt
+    exec 3> $new_f
+    echo "not uploaded yet" >&3
+    local new_attrs=$(all_attrs $new_f)
+    if [[ $new_attrs != $described_expected ]]; then
+        echo "$new_f attributes are incorrect"
+        echo "   got:       $new_attrs"
+        echo "   expecting: $described_expected"
+        exit 1
+    fi
+    for key in base.created base.md5 base.project; do
+        if xattr -p $key $new_f >& /dev/null; then
+            echo "$new_f should have no $key attribute"
+            exit 1
+        fi
+    done
+    exec 3>&-
+    rm -f $new_f
+}
+
+# Directories that map to project folders, and the project itself
+function check_dirs {
+    local base_dir=$1
+    local test_dir=$mountpoint/$projName/$base_dir
+
+    local folder=$(xattr -p base.projFolder $test_dir)
+    if [[ $folder != "/$base_dir" ]]; then
+        echo "$test_dir project folder is wrong"
+        echo "   got:       $folder"
+        echo "   expecting: /$base_dir"
+        exit 1
+    fi
+
+    local proj_id=$(xattr -p base.id $mountpoint/$projName)
+    local proj_id_expected=$(dx describe $projName --json | jq -r .id)
+    if [[ $proj_id != $proj_id_expected ]]; then
+        echo "project id is wrong"
+        echo "   got:       $proj_id"
+        echo "   expecting: $proj_id_expected"
+        exit 1
+    fi
+
+    local proj_name=$(xattr -p base.name $mountpoint/$projName)
+    if [[ $proj_name != $projName ]]; then
+        echo "project name is wrong"
+        echo "   got:       $proj_name"
+        echo "   expecting: $projName"
+        exit 1
+    fi
+}
+
+# The test project is not archived, so only the requests that
+# leave a live file alone can be checked.
+function check_archival {
+    local base_dir=$1
+    local test_dir=$mountpoint/$projName/$base_dir
+    local f=$test_dir/whale.txt
+
+    local state=$(xattr -p base.archivalState $f)
+    if [[ $state != "live" ]]; then
+        echo "$f archival state is wrong"
+        echo "   got:       $state"
+        echo "   expecting: live"
+        exit 1
+    fi
+
+    # unarchiving a live file does nothing
+    xattr -w base.archivalState live $f
+    $dxfuse unarchive $f
+
+    # the state can only be set to live
+    if xattr -w base.archivalState archived $f 2> /dev/null; then
+        echo "setting the archival state of $f to archived should fail"
+        exit 1
+    fi
+
+    state=$(xattr -p base.archivalState $f)
+    if [[ $state != "live" ]]; then
+        echo "$f archival state changed to $state"
+        exit 1
+    fi
+
+    # a live file opens right away
+    cat $f > /dev/null
+}
 
 function xattr_test {
     # Get all the DX environment variables, so that dxfuse can use them
@@ -208,7 +427,11 @@ function xattr_test {
 
     check_bat $base_dir
     check_whale $base_dir
+    check_described $base_dir
     check_new $base_dir
+    check_json_attrs $base_dir
+    check_dirs $base_dir
+    check_archival $base_dir
 
     teardown
 }
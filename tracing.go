@@ -0,0 +1,515 @@
+package dxfuse
+
+// Optional request tracing.
+//
+// Spans are recorded around filesystem operations, database queries, API
+// calls, and prefetch IOs. A filesystem operation starts a trace; the work it
+// does synchronously (waiting for the global lock, queries, API calls, waiting
+// for prefetched data) is recorded in child spans. Prefetch IOs run in the
+// background, and are linked to the operations that use them through the
+// handle and inode attributes.
+//
+// Spans are exported in the OTLP/JSON format, either appended to a local file
+// (one export request per line), or posted to an OTLP/HTTP endpoint. When
+// tracing is disabled, starting a span returns nil, and all the span methods
+// are no-ops.
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dnanexus/dxda"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	traceQueueSize = 16 * 1024
+	traceBatchSize = 512
+	traceFlushInterval = 1 * time.Second
+	traceHttpTimeout = 10 * time.Second
+
+	// OTLP span kinds
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_CLIENT = 3
+
+	// OTLP status codes
+	spanStatusError = 2
+
+	// limit the size of SQL statements recorded as attributes
+	maxTraceStatementLen = 256
+)
+
+type TraceConfig struct {
+	FilePath string   // append spans to this file
+	Endpoint string   // OTLP/HTTP endpoint, such as http://localhost:4318/v1/traces
+}
+
+// OTLP/JSON encoding
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(key string, value interface{}) otlpKeyValue {
+	var v otlpAnyValue
+	switch x := value.(type) {
+	case string:
+		v.StringValue = &x
+	case bool:
+		v.BoolValue = &x
+	case int:
+		s := strconv.FormatInt(int64(x), 10)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(x, 10)
+		v.IntValue = &s
+	default:
+		s := fmt.Sprintf("%v", x)
+		v.StringValue = &s
+	}
+	return otlpKeyValue{ Key : key, Value : v }
+}
+
+type Tracer struct {
+	cfg        TraceConfig
+	queue      chan otlpSpan
+	done       chan struct{}
+	file      *os.File
+	httpClient *http.Client
+	numDropped int64
+
+	// set when the tracer is shut down, after that, the queue is closed.
+	// Protected by tracerMutex.
+	closed     bool
+}
+
+type Span struct {
+	tracer   *Tracer
+	traceId  [16]byte
+	spanId   [8]byte
+	parentId [8]byte
+	hasParent bool
+	name     string
+	kind     int
+	start    time.Time
+
+	mutex    sync.Mutex
+	attrs    []otlpKeyValue
+	errMsg   string
+	ended    bool
+}
+
+var tracerMutex sync.Mutex
+var globalTracer *Tracer = nil
+
+// write a log message, and add a header
+func (t *Tracer) log(a string, args ...interface{}) {
+	LogMsg("tracing", a, args...)
+}
+
+func (t *Tracer) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "tracing", a, args...)
+}
+
+// Start exporting spans. Tracing is enabled only if a file or an endpoint is given.
+func InitTracing(cfg TraceConfig) error {
+	if cfg.FilePath == "" && cfg.Endpoint == "" {
+		return nil
+	}
+	t := &Tracer{
+		cfg : cfg,
+		queue : make(chan otlpSpan, traceQueueSize),
+		done : make(chan struct{}),
+		httpClient : &http.Client{ Timeout : traceHttpTimeout },
+	}
+	if cfg.FilePath != "" {
+		f, err := os.OpenFile(cfg.FilePath, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		t.file = f
+	}
+	go t.exportWorker()
+
+	tracerMutex.Lock()
+	globalTracer = t
+	tracerMutex.Unlock()
+	t.log("tracing enabled, file=%s endpoint=%s", cfg.FilePath, cfg.Endpoint)
+	return nil
+}
+
+// Flush the spans that have not been exported yet, and stop tracing.
+func ShutdownTracing() {
+	tracerMutex.Lock()
+	t := globalTracer
+	globalTracer = nil
+	if t != nil {
+		t.closed = true
+	}
+	tracerMutex.Unlock()
+	if t == nil {
+		return
+	}
+
+	close(t.queue)
+	<- t.done
+	if t.file != nil {
+		t.file.Close()
+	}
+	if numDropped := atomic.LoadInt64(&t.numDropped); numDropped > 0 {
+		t.logAt(LOG_WARN, "%d spans were dropped, because the export queue was full", numDropped)
+	}
+}
+
+func getTracer() *Tracer {
+	tracerMutex.Lock()
+	defer tracerMutex.Unlock()
+	return globalTracer
+}
+
+type spanKey struct {}
+
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok {
+		return span
+	}
+	return nil
+}
+
+// Start a span. If the context holds a span, the new span is its child, otherwise,
+// it starts a new trace. Returns a context holding the new span.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startSpan(ctx, name, SPAN_KIND_INTERNAL)
+}
+
+// Start a span for a call to a remote service
+func StartClientSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startSpan(ctx, name, SPAN_KIND_CLIENT)
+}
+
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	t := getTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	span := &Span{
+		tracer : t,
+		name : name,
+		kind : kind,
+		start : time.Now(),
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.traceId = parent.traceId
+		span.parentId = parent.spanId
+		span.hasParent = true
+	} else {
+		rand.Read(span.traceId[:])
+	}
+	rand.Read(span.spanId[:])
+
+	if opId := OpIdFromContext(ctx); opId != 0 {
+		span.attrs = append(span.attrs, otlpAttr("dxfuse.op_id", opId))
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (span *Span) SetAttr(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.attrs = append(span.attrs, otlpAttr(key, value))
+}
+
+// Mark the span as failed. A nil error is ignored.
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.errMsg = err.Error()
+}
+
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	end := time.Now()
+
+	span.mutex.Lock()
+	if span.ended {
+		span.mutex.Unlock()
+		return
+	}
+	span.ended = true
+	s := otlpSpan{
+		TraceId : hex.EncodeToString(span.traceId[:]),
+		SpanId : hex.EncodeToString(span.spanId[:]),
+		Name : span.name,
+		Kind : span.kind,
+		StartTimeUnixNano : strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano : strconv.FormatInt(end.UnixNano(), 10),
+		Attributes : span.attrs,
+	}
+	if span.hasParent {
+		s.ParentSpanId = hex.EncodeToString(span.parentId[:])
+	}
+	if span.errMsg != "" {
+		s.Status = otlpStatus{ Code : spanStatusError, Message : span.errMsg }
+	}
+	span.mutex.Unlock()
+
+	span.tracer.enqueue(s)
+}
+
+// Does not block. If the queue is full, the span is dropped. A span that ends
+// after the tracer was shut down is dropped too.
+func (t *Tracer) enqueue(s otlpSpan) {
+	tracerMutex.Lock()
+	defer tracerMutex.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddInt64(&t.numDropped, 1)
+	}
+}
+
+func (t *Tracer) exportWorker() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []otlpSpan
+	for {
+		select {
+		case s, ok := <- t.queue:
+			if !ok {
+				t.export(batch)
+				close(t.done)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <- ticker.C:
+			t.export(batch)
+			batch = nil
+		}
+	}
+}
+
+func (t *Tracer) export(batch []otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	req := otlpExportRequest{
+		ResourceSpans : []otlpResourceSpans{
+			otlpResourceSpans{
+				Resource : otlpResource{
+					Attributes : []otlpKeyValue{
+						otlpAttr("service.name", "dxfuse"),
+						otlpAttr("service.version", Version),
+					},
+				},
+				ScopeSpans : []otlpScopeSpans{
+					otlpScopeSpans{
+						Scope : otlpScope{ Name : "dxfuse", Version : Version },
+						Spans : batch,
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.logAt(LOG_ERROR, "could not encode spans: %s", err.Error())
+		return
+	}
+
+	if t.file != nil {
+		if _, err := t.file.Write(append(data, '\n')); err != nil {
+			t.logAt(LOG_ERROR, "could not write spans to %s: %s", t.cfg.FilePath, err.Error())
+		}
+	}
+	if t.cfg.Endpoint != "" {
+		resp, err := t.httpClient.Post(t.cfg.Endpoint, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.logAt(LOG_ERROR, "could not export spans to %s: %s", t.cfg.Endpoint, err.Error())
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode / 100 != 2 {
+			t.logAt(LOG_ERROR, "exporting spans to %s failed with status %s", t.cfg.Endpoint, resp.Status)
+		}
+	}
+}
+
+// A database transaction that records a span for each statement. The
+// context is the one of the operation that opened the transaction.
+type TracedTx struct {
+	tx  *sql.Tx
+	ctx  context.Context
+}
+
+func NewTracedTx(ctx context.Context, tx *sql.Tx) *TracedTx {
+	return &TracedTx{
+		tx : tx,
+		ctx : ctx,
+	}
+}
+
+func traceStatement(sqlStmt string) string {
+	if len(sqlStmt) > maxTraceStatementLen {
+		return sqlStmt[:maxTraceStatementLen]
+	}
+	return sqlStmt
+}
+
+func (ttx *TracedTx) Exec(sqlStmt string, args ...interface{}) (sql.Result, error) {
+	_, span := StartSpan(ttx.ctx, "MetadataDb.exec")
+	if span != nil {
+		span.SetAttr("db.statement", traceStatement(sqlStmt))
+	}
+	res, err := ttx.tx.Exec(sqlStmt, args...)
+	span.SetError(err)
+	span.End()
+	return res, err
+}
+
+func (ttx *TracedTx) Query(sqlStmt string, args ...interface{}) (*sql.Rows, error) {
+	_, span := StartSpan(ttx.ctx, "MetadataDb.query")
+	if span != nil {
+		span.SetAttr("db.statement", traceStatement(sqlStmt))
+	}
+	rows, err := ttx.tx.Query(sqlStmt, args...)
+	span.SetError(err)
+	span.End()
+	return rows, err
+}
+
+func (ttx *TracedTx) Commit() error {
+	_, span := StartSpan(ttx.ctx, "MetadataDb.commit")
+	err := ttx.tx.Commit()
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+func (ttx *TracedTx) Rollback() error {
+	return ttx.tx.Rollback()
+}
+
+// Calls to the platform, recorded as client spans. Retries happen inside the
+// call, so the span covers all the attempts.
+func dxAPI(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	numRetries int,
+	dxEnv *dxda.DXEnvironment,
+	api string,
+	payload string) ([]byte, error) {
+	ctx, span := StartClientSpan(ctx, "DxAPI")
+	if span != nil {
+		span.SetAttr("dx.api", api)
+	}
+	repJs, err := dxda.DxAPI(ctx, httpClient, numRetries, dxEnv, api, payload)
+	span.SetError(err)
+	span.End()
+	return repJs, err
+}
+
+func dxHttpRequest(
+	ctx context.Context,
+	httpClient *retryablehttp.Client,
+	numRetries int,
+	method string,
+	url string,
+	headers map[string]string,
+	data []byte) ([]byte, error) {
+	ctx, span := StartClientSpan(ctx, "DxHttpRequest")
+	if span != nil {
+		// presigned URLs carry credentials in the query string, do not record it
+		span.SetAttr("http.method", method)
+		span.SetAttr("http.url", strings.SplitN(url, "?", 2)[0])
+		if rng, ok := headers["Range"]; ok {
+			span.SetAttr("http.range", rng)
+		}
+	}
+	body, err := dxda.DxHttpRequest(ctx, httpClient, numRetries, method, url, headers, data)
+	span.SetError(err)
+	span.End()
+	return body, err
+}
@@ -0,0 +1,38 @@
+package dxfuse
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Spans that end after the tracer is shut down are dropped, the
+// ones that ended before are flushed.
+func TestTracingShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	if err := InitTracing(TraceConfig{ FilePath : path }); err != nil {
+		t.Fatal(err)
+	}
+	_, before := StartSpan(context.Background(), "before")
+	_, after := StartSpan(context.Background(), "after")
+	before.End()
+
+	ShutdownTracing()
+	after.End()
+
+	// shutting down twice is fine
+	ShutdownTracing()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"before"`) {
+		t.Errorf("the span that ended before the shutdown was not exported")
+	}
+	if strings.Contains(string(data), `"after"`) {
+		t.Errorf("the span that ended after the shutdown was exported")
+	}
+}
@@ -0,0 +1,218 @@
+package dxfuse
+
+// Scheduling for the upload pipeline. File update requests are placed
+// in two classes, small files (a single part) and large files. Small files
+// are served first, because they complete quickly, and are often waited
+// upon by users. Large files are guaranteed a share, one in every few
+// requests, so that a steady stream of small files does not starve them.
+// Within each class, projects take turns, so that one project with many
+// files does not starve the others.
+//
+// The bandwidth used for uploading data is bounded by a token bucket.
+import (
+	"sync"
+	"time"
+)
+
+const (
+	UPLOAD_CLASS_SMALL = 0
+	UPLOAD_CLASS_LARGE = 1
+	numUploadClasses = 2
+
+	// the number of small files handed out in a row, while large
+	// files are waiting, before a large file gets its turn.
+	maxSmallInARow = 4
+)
+
+// pending requests for one class, organized by project
+type projectQueues struct {
+	// round-robin order of the projects that have pending requests
+	order  []string
+	queues map[string][]FileUpdateReq
+}
+
+func newProjectQueues() *projectQueues {
+	return &projectQueues{
+		order : make([]string, 0),
+		queues : make(map[string][]FileUpdateReq),
+	}
+}
+
+func (pq *projectQueues) push(req FileUpdateReq) {
+	projId := req.dfi.ProjId
+	q, ok := pq.queues[projId]
+	if !ok || len(q) == 0 {
+		pq.order = append(pq.order, projId)
+	}
+	pq.queues[projId] = append(q, req)
+}
+
+// take a request from the project at the head of the line, and
+// move the project to the back.
+func (pq *projectQueues) pop() (FileUpdateReq, bool) {
+	if len(pq.order) == 0 {
+		return FileUpdateReq{}, false
+	}
+	projId := pq.order[0]
+	pq.order = pq.order[1:]
+
+	q := pq.queues[projId]
+	req := q[0]
+	q = q[1:]
+	if len(q) == 0 {
+		delete(pq.queues, projId)
+	} else {
+		pq.queues[projId] = q
+		pq.order = append(pq.order, projId)
+	}
+	return req, true
+}
+
+func (pq *projectQueues) empty() bool {
+	return len(pq.order) == 0
+}
+
+type UploadScheduler struct {
+	mutex   sync.Mutex
+	cond   *sync.Cond
+	classes [numUploadClasses]*projectQueues
+	closed  bool
+
+	// small files handed out since the last large file, while
+	// large files were waiting
+	smallInARow int
+}
+
+func NewUploadScheduler() *UploadScheduler {
+	sched := &UploadScheduler{
+		closed : false,
+	}
+	sched.cond = sync.NewCond(&sched.mutex)
+	for i := 0; i < numUploadClasses; i++ {
+		sched.classes[i] = newProjectQueues()
+	}
+	return sched
+}
+
+// Add a request. Returns false if the scheduler has been closed.
+func (sched *UploadScheduler) Enqueue(req FileUpdateReq, class int) bool {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+	if sched.closed {
+		return false
+	}
+	sched.classes[class].push(req)
+	sched.cond.Signal()
+	return true
+}
+
+// Wait for the next request. Workers that pass [smallOnly] do not take large
+// files, ensuring that small files make progress even when all other workers
+// are busy uploading large files.
+//
+// Returns false when the scheduler has been closed, and there are no more
+// requests the worker can take.
+func (sched *UploadScheduler) Next(smallOnly bool) (FileUpdateReq, bool) {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	small := sched.classes[UPLOAD_CLASS_SMALL]
+	large := sched.classes[UPLOAD_CLASS_LARGE]
+	for {
+		if !smallOnly && sched.smallInARow >= maxSmallInARow {
+			// the large files have waited long enough
+			if req, ok := large.pop(); ok {
+				sched.smallInARow = 0
+				return req, true
+			}
+		}
+		if req, ok := small.pop(); ok {
+			if !large.empty() {
+				sched.smallInARow++
+			}
+			return req, true
+		}
+		if !smallOnly {
+			if req, ok := large.pop(); ok {
+				sched.smallInARow = 0
+				return req, true
+			}
+		}
+		if sched.closed {
+			return FileUpdateReq{}, false
+		}
+		sched.cond.Wait()
+	}
+}
+
+// Stop accepting requests. Workers drain the pending requests, and then exit.
+func (sched *UploadScheduler) Close() {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+	sched.closed = true
+	sched.cond.Broadcast()
+}
+
+func (sched *UploadScheduler) Empty() bool {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+	for i := 0; i < numUploadClasses; i++ {
+		if !sched.classes[i].empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// A token bucket limiting the upload bandwidth. A nil bucket
+// does not impose a limit.
+type TokenBucket struct {
+	mutex    sync.Mutex
+	rate     float64 // bytes per second
+	burst    float64
+	tokens   float64
+	lastTs   time.Time
+}
+
+func NewTokenBucket(bytesPerSec int64) *TokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	rate := float64(bytesPerSec)
+	return &TokenBucket{
+		rate : rate,
+		burst : rate,
+		tokens : rate,
+		lastTs : time.Now(),
+	}
+}
+
+// Take [n] tokens, waiting until they are available. A request larger than
+// the bucket puts it into debt, which later requests pay off.
+//
+// The limit is on the average rate. A request is paid for up front, and
+// then sent at full speed, so an upload part goes out in one burst. The
+// bucket holds at most one second worth of tokens, and a request that
+// finds the bucket in debt waits for the debt to be paid first; a burst is
+// therefore never larger than one part, plus one second of bandwidth
+// saved while idle.
+func (tb *TokenBucket) Wait(n int64) {
+	if tb == nil || n <= 0 {
+		return
+	}
+
+	tb.mutex.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.lastTs).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.lastTs = now
+	tb.tokens -= float64(n)
+	deficit := -tb.tokens
+	tb.mutex.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / tb.rate * float64(time.Second)))
+	}
+}
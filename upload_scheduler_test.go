@@ -0,0 +1,192 @@
+package dxfuse
+
+import (
+	"testing"
+	"time"
+)
+
+func makeUploadReq(inode int64, projId string) FileUpdateReq {
+	return FileUpdateReq{
+		dfi : DirtyFileInfo{
+			Inode : inode,
+			ProjId : projId,
+		},
+	}
+}
+
+func nextInode(t *testing.T, sched *UploadScheduler, smallOnly bool) int64 {
+	req, ok := sched.Next(smallOnly)
+	if !ok {
+		t.Fatalf("expected a pending request")
+	}
+	return req.dfi.Inode
+}
+
+// Small files are served before large files
+func TestUploadSchedulerSmallFirst(t *testing.T) {
+	sched := NewUploadScheduler()
+	sched.Enqueue(makeUploadReq(1, "project-A"), UPLOAD_CLASS_LARGE)
+	sched.Enqueue(makeUploadReq(2, "project-A"), UPLOAD_CLASS_SMALL)
+	sched.Enqueue(makeUploadReq(3, "project-A"), UPLOAD_CLASS_LARGE)
+	sched.Enqueue(makeUploadReq(4, "project-A"), UPLOAD_CLASS_SMALL)
+
+	for _, expected := range []int64{ 2, 4, 1, 3 } {
+		if inode := nextInode(t, sched, false); inode != expected {
+			t.Errorf("expected inode %d, got %d", expected, inode)
+		}
+	}
+	if !sched.Empty() {
+		t.Errorf("the scheduler should be empty")
+	}
+}
+
+// Large files get a turn after a few small files, so that they are not
+// starved by a steady stream of small files. Workers that take only small
+// files do not count.
+func TestUploadSchedulerLargeShare(t *testing.T) {
+	testCases := []struct {
+		numSmall  int
+		numLarge  int
+		smallOnly []bool   // a worker per request, the rest take any file
+		expected  []int64  // small files are 1-99, large files 100 and up
+	}{
+		{ 0, 2, nil, []int64{ 100, 101 } },
+		{ 3, 1, nil, []int64{ 1, 2, 3, 100 } },
+		{ 10, 2, nil, []int64{ 1, 2, 3, 4, 100, 5, 6, 7, 8, 101, 9, 10 } },
+		{ 6, 1, []bool{ true, true, true, true, true }, []int64{ 1, 2, 3, 4, 5, 100, 6 } },
+	}
+
+	for i, tc := range testCases {
+		sched := NewUploadScheduler()
+		for j := 0; j < tc.numLarge; j++ {
+			sched.Enqueue(makeUploadReq(int64(100 + j), "project-A"), UPLOAD_CLASS_LARGE)
+		}
+		for j := 1; j <= tc.numSmall; j++ {
+			sched.Enqueue(makeUploadReq(int64(j), "project-A"), UPLOAD_CLASS_SMALL)
+		}
+		for j, expected := range tc.expected {
+			smallOnly := j < len(tc.smallOnly) && tc.smallOnly[j]
+			if inode := nextInode(t, sched, smallOnly); inode != expected {
+				t.Errorf("case %d, request %d: expected inode %d, got %d", i, j, expected, inode)
+			}
+		}
+	}
+}
+
+// Projects take turns within a class
+func TestUploadSchedulerRoundRobin(t *testing.T) {
+	sched := NewUploadScheduler()
+	sched.Enqueue(makeUploadReq(1, "project-A"), UPLOAD_CLASS_SMALL)
+	sched.Enqueue(makeUploadReq(2, "project-A"), UPLOAD_CLASS_SMALL)
+	sched.Enqueue(makeUploadReq(3, "project-A"), UPLOAD_CLASS_SMALL)
+	sched.Enqueue(makeUploadReq(4, "project-B"), UPLOAD_CLASS_SMALL)
+	sched.Enqueue(makeUploadReq(5, "project-B"), UPLOAD_CLASS_SMALL)
+	sched.Enqueue(makeUploadReq(6, "project-C"), UPLOAD_CLASS_SMALL)
+
+	for _, expected := range []int64{ 1, 4, 6, 2, 5, 3 } {
+		if inode := nextInode(t, sched, false); inode != expected {
+			t.Errorf("expected inode %d, got %d", expected, inode)
+		}
+	}
+}
+
+// A worker that takes only small files does not take a large file, even
+// when it is the only one pending.
+func TestUploadSchedulerSmallOnly(t *testing.T) {
+	sched := NewUploadScheduler()
+	sched.Enqueue(makeUploadReq(1, "project-A"), UPLOAD_CLASS_LARGE)
+	sched.Close()
+
+	if _, ok := sched.Next(true); ok {
+		t.Errorf("a small-only worker took a large file")
+	}
+	if inode := nextInode(t, sched, false); inode != 1 {
+		t.Errorf("expected inode 1, got %d", inode)
+	}
+}
+
+// After close, new requests are refused, pending requests are still
+// handed out, and then the workers are released.
+func TestUploadSchedulerClose(t *testing.T) {
+	sched := NewUploadScheduler()
+	sched.Enqueue(makeUploadReq(1, "project-A"), UPLOAD_CLASS_SMALL)
+
+	done := make(chan bool)
+	go func() {
+		// wait for a request that never arrives
+		sched.Next(true)
+		_, ok := sched.Next(true)
+		done <- ok
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	sched.Close()
+	select {
+	case ok := <- done:
+		if ok {
+			t.Errorf("a request was returned after close")
+		}
+	case <- time.After(5 * time.Second):
+		t.Fatalf("the worker was not released on close")
+	}
+
+	if sched.Enqueue(makeUploadReq(2, "project-A"), UPLOAD_CLASS_SMALL) {
+		t.Errorf("a request was accepted after close")
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	tb := NewTokenBucket(0)
+	if tb != nil {
+		t.Fatalf("a zero rate should not create a bucket")
+	}
+
+	// a nil bucket does not impose a limit
+	start := time.Now()
+	tb.Wait(100 * MiB)
+	if time.Since(start) > time.Second {
+		t.Errorf("a nil bucket waited")
+	}
+}
+
+func TestTokenBucketRate(t *testing.T) {
+	tb := NewTokenBucket(1000)
+
+	// the bucket starts full
+	start := time.Now()
+	tb.Wait(1000)
+	if elapsed := time.Since(start); elapsed > 100 * time.Millisecond {
+		t.Errorf("the first request waited %v", elapsed)
+	}
+
+	// the bucket is now empty, half a second worth of tokens
+	// has to accumulate.
+	start = time.Now()
+	tb.Wait(500)
+	elapsed := time.Since(start)
+	if elapsed < 400 * time.Millisecond || elapsed > 2 * time.Second {
+		t.Errorf("expected to wait about 500ms, waited %v", elapsed)
+	}
+}
+
+// A request larger than the bucket is paid off before the next
+// request goes out, there is no burst after the debt.
+func TestTokenBucketDebt(t *testing.T) {
+	tb := NewTokenBucket(10000)
+
+	// a full bucket, and half a second of debt
+	start := time.Now()
+	tb.Wait(15000)
+	elapsed := time.Since(start)
+	if elapsed < 400 * time.Millisecond || elapsed > 2 * time.Second {
+		t.Errorf("expected to wait about 500ms, waited %v", elapsed)
+	}
+
+	// the debt was slept off, the bucket is empty
+	start = time.Now()
+	tb.Wait(5000)
+	elapsed = time.Since(start)
+	if elapsed < 400 * time.Millisecond || elapsed > 2 * time.Second {
+		t.Errorf("expected to wait about 500ms, waited %v", elapsed)
+	}
+}
@@ -0,0 +1,428 @@
+package dxfuse
+
+// Streaming upload for new files that are written sequentially (append only).
+//
+// Instead of waiting for the file to become inactive, and then reading it
+// again from the start, each part is uploaded as soon as it has been fully
+// written. The last part is uploaded, and the file is closed, when the file
+// handle is released. Parts are uploaded in order, by one thread per stream.
+//
+// If the writer does anything other than appending (seeks backwards, truncates,
+// writes through another handle), the stream is abandoned. The file remains dirty,
+// and is uploaded by the normal sweep. The partially uploaded platform object
+// is removed when the stream thread exits.
+//
+// The stream threads are tracked. A sync waits for the streams whose handles
+// were released, and abandons the ones that are still being written, so that
+// their files are uploaded by the sweep.
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dnanexus/dxda"
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const (
+	// The part size is chosen so that files up to this size can be streamed.
+	// Larger files are uploaded by the sweep.
+	streamingMaxFileSize = 512 * GiB
+)
+
+type streamPart struct {
+	index     int
+	ofs       int64
+	len       int64
+}
+
+type UploadStream struct {
+	inode      int64
+	hid        fuseops.HandleID   // the handle writing the file
+	localPath  string
+	partSize   int64
+	params     FileUploadParameters
+
+	// Protected by the stream lock
+	mutex      sync.Mutex
+	cond      *sync.Cond
+	written    int64       // bytes appended so far
+	queued     int64       // bytes handed to the upload thread
+	nextIndex  int         // index of the next part (one based)
+	pending    []streamPart
+	released   bool        // the file handle has been released
+	abandoned  bool
+
+	// closed when the stream thread exits
+	done       chan struct{}
+}
+
+// write a log message, and add a header
+func (s *UploadStream) log(a string, args ...interface{}) {
+	LogMsg("upload_stream", a, args...)
+}
+
+func (s *UploadStream) logAt(level int, a string, args ...interface{}) {
+	LogMsgLevel(level, "upload_stream", a, args...)
+}
+
+// Start streaming a new file. Called with the global lock held.
+func (sybx *SyncDbDx) StreamOpen(inode int64, hid fuseops.HandleID, projId string, localPath string) bool {
+	projDesc, ok := sybx.projId2Desc[projId]
+	if !ok {
+		return false
+	}
+	maxSize := MinInt64(projDesc.UploadParams.MaximumFileSize, streamingMaxFileSize)
+	partSize, err := sybx.calcPartSize(projDesc.UploadParams, maxSize)
+	if err != nil {
+		sybx.logAt(LOG_WARN, "Cannot stream inode=%d, %s", inode, err.Error())
+		return false
+	}
+
+	s := newUploadStream(inode, hid, localPath, partSize, projDesc.UploadParams)
+	sybx.streamsMutex.Lock()
+	sybx.streams[inode] = s
+	sybx.streamsMutex.Unlock()
+
+	if sybx.logEnabled(LOG_DEBUG) {
+		sybx.logAt(LOG_DEBUG, "streaming upload for inode=%d part-size=%d", inode, partSize)
+	}
+	sybx.streamsWg.Add(1)
+	go sybx.streamWorker(s)
+	return true
+}
+
+func newUploadStream(
+	inode int64,
+	hid fuseops.HandleID,
+	localPath string,
+	partSize int64,
+	params FileUploadParameters) *UploadStream {
+	s := &UploadStream{
+		inode : inode,
+		hid : hid,
+		localPath : localPath,
+		partSize : partSize,
+		params : params,
+		written : 0,
+		queued : 0,
+		nextIndex : 1,
+		released : false,
+		abandoned : false,
+		done : make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+func (sybx *SyncDbDx) lookupStream(inode int64) *UploadStream {
+	sybx.streamsMutex.Lock()
+	defer sybx.streamsMutex.Unlock()
+	return sybx.streams[inode]
+}
+
+// Is the file being uploaded by a stream that hasn't been abandoned?
+func (sybx *SyncDbDx) streamActive(inode int64) bool {
+	s := sybx.lookupStream(inode)
+	if s == nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.abandoned
+}
+
+// Called with the stream lock held
+func (s *UploadStream) abandon(reason string) {
+	if s.abandoned {
+		return
+	}
+	s.logAt(LOG_WARN, "abandoning streaming upload for inode=%d, %s", s.inode, reason)
+	s.abandoned = true
+	s.pending = nil
+	s.cond.Signal()
+}
+
+// Data was written to a file, at [ofs]. Queue the parts that are complete.
+func (sybx *SyncDbDx) StreamWrite(inode int64, hid fuseops.HandleID, ofs int64, length int) {
+	s := sybx.lookupStream(inode)
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.abandoned {
+		return
+	}
+	if hid != s.hid {
+		s.abandon("written through another file handle")
+		return
+	}
+	if ofs != s.written {
+		s.abandon("the write is not an append")
+		return
+	}
+	s.written += int64(length)
+
+	for s.written - s.queued >= s.partSize {
+		if int64(s.nextIndex) > s.params.MaximumNumParts {
+			s.abandon("too many parts")
+			return
+		}
+		s.pending = append(s.pending, streamPart{
+			index : s.nextIndex,
+			ofs : s.queued,
+			len : s.partSize,
+		})
+		s.queued += s.partSize
+		s.nextIndex++
+	}
+	s.cond.Signal()
+}
+
+// The size of the file was changed by the user (truncate)
+func (sybx *SyncDbDx) StreamSetSize(inode int64, size int64) {
+	s := sybx.lookupStream(inode)
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if size != s.written {
+		s.abandon("the file was truncated")
+	}
+}
+
+// The file handle was released. Upload the last part, and close the file.
+func (sybx *SyncDbDx) StreamRelease(inode int64, hid fuseops.HandleID) {
+	s := sybx.lookupStream(inode)
+	if s == nil || s.hid != hid {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.released = true
+	s.cond.Signal()
+}
+
+// Wait for the streams whose handles were released to upload their last part,
+// and close their files. The streams that are still being written are abandoned;
+// the sweep uploads their files. A zero deadline means no limit.
+func (sybx *SyncDbDx) finishStreams(deadline time.Time) {
+	sybx.streamsMutex.Lock()
+	var streams []*UploadStream
+	for _, s := range sybx.streams {
+		streams = append(streams, s)
+	}
+	sybx.streamsMutex.Unlock()
+
+	numAbandoned := 0
+	for _, s := range streams {
+		s.mutex.Lock()
+		if !s.released && !s.abandoned {
+			s.abandon("the file is still open for writing")
+			numAbandoned++
+		}
+		s.mutex.Unlock()
+	}
+	if numAbandoned > 0 {
+		sybx.log("%d files are still open for writing, they will be uploaded by the sweep", numAbandoned)
+	}
+
+	for _, s := range streams {
+		if deadline.IsZero() {
+			<- s.done
+			continue
+		}
+		select {
+		case <- s.done:
+		case <- time.After(time.Until(deadline)):
+			sybx.logAt(LOG_WARN, "timed out waiting for the streaming upload of inode=%d", s.inode)
+			return
+		}
+	}
+}
+
+func (sybx *SyncDbDx) streamsIdle() bool {
+	sybx.streamsMutex.Lock()
+	defer sybx.streamsMutex.Unlock()
+	return len(sybx.streams) == 0
+}
+
+// Abandon all the streams, and wait for their threads to exit
+func (sybx *SyncDbDx) stopStreams() {
+	sybx.streamsMutex.Lock()
+	for _, s := range sybx.streams {
+		s.mutex.Lock()
+		s.abandon("the filesystem is shutting down")
+		s.mutex.Unlock()
+	}
+	sybx.streamsMutex.Unlock()
+	sybx.streamsWg.Wait()
+}
+
+// The file has been written, or the stream was abandoned. Remove it from
+// the table. For a completed upload, clear the dirty flag; the sweep
+// does not need to upload the file again.
+//
+// If the upload failed after the platform object was created, the object
+// is removed, and the file goes back to having no ID. The sweep uploads it
+// as a new file.
+func (sybx *SyncDbDx) streamDone(
+	client *retryablehttp.Client,
+	s *UploadStream,
+	fileId string,
+	fileSize int64,
+	err error) {
+	sybx.mutex.Lock()
+
+	// The file may have been modified through another handle while
+	// we were closing it.
+	s.mutex.Lock()
+	abandoned := s.abandoned
+	s.mutex.Unlock()
+
+	if err == nil && !abandoned {
+		if err := sybx.mdb.ClearDirtyData(s.inode, fileId, fileSize); err != nil {
+			sybx.logAt(LOG_ERROR, "database error clearing the dirty flag for inode=%d: %s", s.inode, err.Error())
+		}
+	}
+
+	orphanProjId := ""
+	if err != nil && fileId != "" {
+		// The file may have been removed, or already uploaded by the
+		// sweep, which replaces the object.
+		dfi, ok, dbErr := sybx.mdb.FileUploadInfo(s.inode)
+		if dbErr == nil && ok && dfi.Id == fileId {
+			if dbErr := sybx.mdb.UpdateInodeFileId(s.inode, ""); dbErr != nil {
+				sybx.logAt(LOG_ERROR, "database error resetting the ID of inode=%d: %s", s.inode, dbErr.Error())
+			} else {
+				orphanProjId = dfi.ProjId
+			}
+		}
+	}
+
+	sybx.streamsMutex.Lock()
+	delete(sybx.streams, s.inode)
+	sybx.streamsMutex.Unlock()
+	sybx.mutex.Unlock()
+
+	if orphanProjId != "" {
+		objectIds := []string{ fileId }
+		if err := sybx.ops.DxRemoveObjects(context.TODO(), client, orphanProjId, objectIds); err != nil {
+			sybx.logAt(LOG_WARN, "could not remove the partial upload %s of inode=%d: %s",
+				fileId, s.inode, err.Error())
+		}
+	}
+	close(s.done)
+}
+
+// create the file on the platform, and record its ID
+func (sybx *SyncDbDx) streamCreateFile(client *retryablehttp.Client, s *UploadStream) (string, error) {
+	// We hold the global lock, because the file may be renamed, or
+	// its directory removed, while we create it.
+	sybx.mutex.Lock()
+	defer sybx.mutex.Unlock()
+
+	dfi, ok, err := sybx.mdb.FileUploadInfo(s.inode)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("file was removed")
+	}
+	fileId, err := sybx.ops.DxFileNew(
+		context.TODO(), client, sybx.nonce.String(),
+		dfi.ProjId, dfi.Name, dfi.ProjFolder)
+	if err != nil {
+		return "", err
+	}
+	if err := sybx.mdb.UpdateInodeFileId(s.inode, fileId); err != nil {
+		return "", err
+	}
+	return fileId, nil
+}
+
+func (sybx *SyncDbDx) streamUploadPart(
+	client *retryablehttp.Client,
+	s *UploadStream,
+	fileId string,
+	part streamPart) error {
+	data := make([]byte, 0)
+	if part.len > 0 {
+		var err error
+		data, err = readLocalFileExtent(s.localPath, part.ofs, int(part.len))
+		if err != nil {
+			return err
+		}
+	}
+	if sybx.logEnabled(LOG_TRACE) {
+		sybx.logAt(LOG_TRACE, "stream inode=%d uploading part %d len=%d", s.inode, part.index, len(data))
+	}
+	return sybx.uploadPart(context.TODO(), client, fileId, part.index, data)
+}
+
+// Upload the parts of one stream, in order.
+func (sybx *SyncDbDx) streamWorker(s *UploadStream) {
+	defer sybx.streamsWg.Done()
+	client := dxda.NewHttpClient(true)
+	fileId := ""
+
+	for {
+		s.mutex.Lock()
+		for len(s.pending) == 0 && !s.released && !s.abandoned {
+			s.cond.Wait()
+		}
+		if s.abandoned {
+			s.mutex.Unlock()
+			sybx.streamDone(client, s, fileId, 0, errors.New("abandoned"))
+			return
+		}
+
+		var part streamPart
+		last := false
+		if len(s.pending) > 0 {
+			part = s.pending[0]
+			s.pending = s.pending[1:]
+		} else {
+			// released, and all the full parts have been uploaded.
+			// What remains is the tail of the file.
+			last = true
+			part = streamPart{
+				index : s.nextIndex,
+				ofs : s.queued,
+				len : s.written - s.queued,
+			}
+		}
+		fileSize := s.written
+		s.mutex.Unlock()
+
+		var err error
+		if fileId == "" {
+			fileId, err = sybx.streamCreateFile(client, s)
+		}
+		if err == nil && (part.len > 0 || (part.index == 1 && s.params.EmptyLastPartAllowed)) {
+			err = sybx.streamUploadPart(client, s, fileId, part)
+		}
+		if err == nil && last {
+			if sybx.logEnabled(LOG_DEBUG) {
+				sybx.logAt(LOG_DEBUG, "stream inode=%d closing %s", s.inode, fileId)
+			}
+			err = sybx.ops.DxFileCloseAndWait(context.TODO(), client, fileId)
+		}
+
+		if err != nil {
+			s.mutex.Lock()
+			s.abandon(err.Error())
+			s.mutex.Unlock()
+			sybx.streamDone(client, s, fileId, 0, err)
+			return
+		}
+		if last {
+			sybx.streamDone(client, s, fileId, fileSize, nil)
+			return
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package dxfuse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A stream that is registered with the sync module, without a thread
+// uploading its parts.
+func newTestStream(sybx *SyncDbDx, inode int64, partSize int64, maxNumParts int64) *UploadStream {
+	params := FileUploadParameters{
+		MaximumNumParts : maxNumParts,
+	}
+	s := newUploadStream(inode, fuseops.HandleID(1), "/dev/null", partSize, params)
+	sybx.streams[inode] = s
+	return s
+}
+
+func newTestSyncDbDx() *SyncDbDx {
+	return &SyncDbDx{
+		streams : make(map[int64]*UploadStream),
+	}
+}
+
+type streamWriteOp struct {
+	ofs    int64
+	length int
+}
+
+// Complete parts are queued as soon as they are written
+func TestStreamWriteParts(t *testing.T) {
+	testCases := []struct {
+		writes   []streamWriteOp
+		parts    []streamPart
+	}{
+		// nothing written yet
+		{ nil, nil },
+
+		// less than a part
+		{ []streamWriteOp{ {0, 4}, {4, 5} }, nil },
+
+		// exactly one part
+		{ []streamWriteOp{ {0, 4}, {4, 6} }, []streamPart{ {1, 0, 10} } },
+
+		// a write that spans several parts
+		{ []streamWriteOp{ {0, 25} }, []streamPart{ {1, 0, 10}, {2, 10, 10} } },
+
+		// small writes, one part completes in the middle of a write
+		{
+			[]streamWriteOp{ {0, 7}, {7, 7}, {14, 7} },
+			[]streamPart{ {1, 0, 10}, {2, 10, 10} },
+		},
+	}
+
+	for i, tc := range testCases {
+		sybx := newTestSyncDbDx()
+		s := newTestStream(sybx, 1, 10, 100)
+
+		var written int64
+		for _, w := range tc.writes {
+			sybx.StreamWrite(1, s.hid, w.ofs, w.length)
+			written += int64(w.length)
+		}
+		if s.abandoned {
+			t.Errorf("case %d: the stream was abandoned", i)
+			continue
+		}
+		if s.written != written {
+			t.Errorf("case %d: expected %d bytes written, got %d", i, written, s.written)
+		}
+		if len(s.pending) != len(tc.parts) {
+			t.Errorf("case %d: expected %d parts, got %d", i, len(tc.parts), len(s.pending))
+			continue
+		}
+		for j, p := range tc.parts {
+			if s.pending[j] != p {
+				t.Errorf("case %d: expected part %v, got %v", i, p, s.pending[j])
+			}
+		}
+		if s.nextIndex != len(tc.parts) + 1 {
+			t.Errorf("case %d: the next part should be %d, it is %d", i, len(tc.parts) + 1, s.nextIndex)
+		}
+		if !sybx.streamActive(1) {
+			t.Errorf("case %d: the stream should be active", i)
+		}
+	}
+}
+
+// Anything other than an append abandons the stream. The file is then
+// uploaded by the sweep, which only skips files with an active stream.
+func TestStreamWriteNotAppend(t *testing.T) {
+	testCases := []struct {
+		name     string
+		writes   []streamWriteOp
+		hid      fuseops.HandleID
+		truncate int64
+	}{
+		{ "seek backwards", []streamWriteOp{ {0, 15}, {5, 5} }, 1, -1 },
+		{ "rewrite the start", []streamWriteOp{ {0, 5}, {0, 5} }, 1, -1 },
+		{ "a hole", []streamWriteOp{ {0, 5}, {8, 5} }, 1, -1 },
+		{ "another handle", []streamWriteOp{ {0, 5} }, 2, -1 },
+		{ "truncate", []streamWriteOp{ {0, 15} }, 1, 3 },
+	}
+
+	for _, tc := range testCases {
+		sybx := newTestSyncDbDx()
+		s := newTestStream(sybx, 1, 10, 100)
+		for _, w := range tc.writes {
+			sybx.StreamWrite(1, tc.hid, w.ofs, w.length)
+		}
+		if tc.truncate >= 0 {
+			sybx.StreamSetSize(1, tc.truncate)
+		}
+
+		if !s.abandoned {
+			t.Errorf("%s: the stream should be abandoned", tc.name)
+		}
+		if len(s.pending) != 0 {
+			t.Errorf("%s: no parts should be pending", tc.name)
+		}
+		if sybx.streamActive(1) {
+			t.Errorf("%s: the file should be left to the sweep", tc.name)
+		}
+
+		// later writes are ignored
+		sybx.StreamWrite(1, s.hid, s.written, 100)
+		if len(s.pending) != 0 {
+			t.Errorf("%s: an abandoned stream queued a part", tc.name)
+		}
+	}
+}
+
+// Setting the size to the current size is not a truncate
+func TestStreamSetSameSize(t *testing.T) {
+	sybx := newTestSyncDbDx()
+	s := newTestStream(sybx, 1, 10, 100)
+	sybx.StreamWrite(1, s.hid, 0, 5)
+	sybx.StreamSetSize(1, 5)
+	if s.abandoned {
+		t.Errorf("the stream should not be abandoned")
+	}
+}
+
+// A file that needs more parts than the platform allows is left to the sweep
+func TestStreamWriteTooManyParts(t *testing.T) {
+	sybx := newTestSyncDbDx()
+	s := newTestStream(sybx, 1, 10, 2)
+	sybx.StreamWrite(1, s.hid, 0, 20)
+	if s.abandoned {
+		t.Fatalf("two parts are allowed")
+	}
+	sybx.StreamWrite(1, s.hid, 20, 10)
+	if !s.abandoned {
+		t.Errorf("a third part should abandon the stream")
+	}
+}
+
+// Streams of files that are closed are waited for, and streams of files that
+// are still open are abandoned.
+func TestFinishStreams(t *testing.T) {
+	sybx := newTestSyncDbDx()
+	closed := newTestStream(sybx, 1, 10, 100)
+	open := newTestStream(sybx, 2, 10, 100)
+	sybx.StreamRelease(1, closed.hid)
+
+	// the stream threads have exited
+	close(closed.done)
+	close(open.done)
+
+	sybx.finishStreams(time.Now().Add(5 * time.Second))
+	if closed.abandoned {
+		t.Errorf("a released stream should complete its upload")
+	}
+	if !open.abandoned {
+		t.Errorf("a stream that is still written should be abandoned")
+	}
+}
+
+// A stream that does not complete in time is not waited for
+func TestFinishStreamsDeadline(t *testing.T) {
+	sybx := newTestSyncDbDx()
+	s := newTestStream(sybx, 1, 10, 100)
+	sybx.StreamRelease(1, s.hid)
+
+	start := time.Now()
+	sybx.finishStreams(start.Add(100 * time.Millisecond))
+	if elapsed := time.Since(start); elapsed > 2 * time.Second {
+		t.Errorf("waited %v, past the deadline", elapsed)
+	}
+	if s.abandoned {
+		t.Errorf("a released stream should keep uploading")
+	}
+	if sybx.streamsIdle() {
+		t.Errorf("the stream should still be registered")
+	}
+}
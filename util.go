@@ -1,7 +1,6 @@
 package dxfuse
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
 	"os"
@@ -17,18 +16,31 @@ const (
 	MiB                   = 1024 * KiB
 	GiB                   = 1024 * MiB
 )
+// The number of attempts for an API call. Set from the tuning knobs when
+// the command line is parsed, before any API call is made.
+var NumRetries = NumRetriesDefault
+
 const (
 	CreatedFilesDir     = "/var/dxfuse/created_files"
 	DatabaseFile        = "/var/dxfuse/metadata.db"
+	DatabaseInMemory    = ":memory:"
 	HttpClientPoolSize  = 4
 	FileWriteInactivityThresh = 5 * time.Minute
 	WritableFileSizeLimit = 16 * MiB
+	MaterializeCacheSize = 32 * GiB
 	LogFile             = "/var/log/dxfuse.log"
-	MaxDirSize          = 10 * 1000
+	MaxDirSize          = 0   // zero means no limit
 	MaxNumFileHandles   = 1000 * 1000
 	NumRetriesDefault   = 3
 	Version             = "v0.20"
 )
+const (
+	// how long a preauthenticated download URL is valid for
+	DownloadUrlDurationDefault = 365 * 24 * time.Hour
+
+	// how long an unmount waits for the pending uploads
+	ShutdownTimeoutDefault     = 10 * time.Minute
+)
 const (
 	InodeInvalid       = 0
 	InodeRoot          = fuseops.RootInodeID  // This is an OS constant
@@ -60,6 +72,7 @@ const (
 type DxDownloadURL struct {
 	URL     string            `json:"url"`
 	Headers map[string]string `json:"headers"`
+	Expires int64             `json:"expires"`  // milliseconds since the epoch
 }
 
 type Options struct {
@@ -68,6 +81,14 @@ type Options struct {
 	VerboseLevel        int
 	Uid                 uint32
 	Gid                 uint32
+	DownloadUrlDuration time.Duration
+	UploadThreads       int    // zero means a default based on the number of CPUs
+	UploadBandwidth     int64  // bytes per second, zero means no limit
+	StreamingUpload     bool   // upload new files while they are being written
+	ShutdownTimeout     time.Duration  // how long to wait for pending uploads when unmounting
+	UnarchiveWait       time.Duration  // how long an open waits for a file being unarchived, zero means it fails right away
+	WaitForClose        time.Duration  // how long an open waits for a file that is not closed yet, zero means it fails right away
+	Tuning              Tuning  // knobs set in the configuration file, zero values mean the default
 }
 
 
@@ -127,6 +148,22 @@ const (
 	FK_Other = 16
 )
 
+// A database is shown as a directory, holding a file with its description
+const (
+	databaseDescribeFile = "describe.json"
+)
+
+// Data objects that are not files are shown as read-only files, holding
+// their description in JSON.
+func isDescribedKind(kind int) bool {
+	switch kind {
+	case FK_Applet, FK_Workflow, FK_Record, FK_Database:
+		return true
+	default:
+		return false
+	}
+}
+
 // A Unix file can stand for any DNAx data object. For example, it could be a workflow or an applet.
 // We distinguish between them based on the Id (file-xxxx, applet-xxxx, workflow-xxxx, ...).
 //
@@ -222,7 +259,7 @@ type DirtyFileInfo struct {
 // operation. We normally need a transaction and an http client.
 type OpHandle struct {
 	httpClient *retryablehttp.Client
-	txn        *sql.Tx
+	txn        *TracedTx
 	err         error
 }
 
@@ -261,6 +298,13 @@ func MinInt(x, y int) int {
     return x
 }
 
+func MinDuration(x, y time.Duration) time.Duration {
+    if x > y {
+        return y
+    }
+    return x
+}
+
 // convert time in seconds since 1-Jan 1970, to the equivalent
 // golang structure
 func SecondsToTime(t int64) time.Time {
@@ -271,12 +315,6 @@ func Time2string(t time.Time) string {
 	return fmt.Sprintf("%02d:%02d:%02d.%03d", t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1000000)
 }
 
-// add a timestamp and module name, to a log message
-func LogMsg(moduleName string, a string, args ...interface{}) {
-	msg := fmt.Sprintf(a, args...)
-	now := time.Now()
-	log.Printf("%s %s: %s", Time2string(now), moduleName, msg)
-}
 
 
 //